@@ -0,0 +1,52 @@
+// Command migrate-images moves the image files that older databases keep in
+// blob columns into the image store. It upgrades the schema first, as the
+// server does on startup. Run it once from the backend directory, with the
+// server stopped and the same IMAGE_STORE and IMAGE_DIR as the server:
+//
+//	go run ./cmd/migrate-images
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+)
+
+func main() {
+	defaultKind, defaultDir := imagestore.EnvConfig()
+	kind := flag.String("store", defaultKind, "image store to move the files to")
+	dir := flag.String("dir", defaultDir, "directory of the fs image store")
+	flag.Parse()
+
+	if err := run(context.Background(), *kind, *dir); err != nil {
+		fmt.Fprintf(os.Stderr, "migrate-images: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, kind, dir string) error {
+	if kind == "memory" {
+		return fmt.Errorf("the memory store would lose the images on exit")
+	}
+	store, err := imagestore.New(kind, dir)
+	if err != nil {
+		return err
+	}
+
+	sqlDB, err := db.PrepareDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	moved, err := db.MigrateImageBlobs(ctx, sqlDB, store)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("moved %d images to %s\n", moved, dir)
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+)
+
+func TestRunOnBaselineDB(t *testing.T) {
+	// run uses the database and schema under the working directory, as the
+	// server does.
+	root := t.TempDir()
+	sqlDir, err := filepath.Abs(filepath.Join("..", "..", "sql"))
+	if err != nil {
+		t.Fatalf("failed to find sql: %s", err)
+	}
+	if err := os.Symlink(sqlDir, filepath.Join(root, "sql")); err != nil {
+		t.Fatalf("failed to link sql: %s", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "db"), 0o755); err != nil {
+		t.Fatalf("failed to create db: %s", err)
+	}
+	schema, err := os.ReadFile(filepath.Join("..", "..", "db", "testdata", "baseline_schema.sql"))
+	if err != nil {
+		t.Fatalf("failed to read schema: %s", err)
+	}
+
+	dbPath := filepath.Join(root, "db", "mercari.sqlite3")
+	sqlDB, err := sql.Open("sqlite3", "file:"+dbPath)
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	defer sqlDB.Close()
+	if _, err := sqlDB.Exec(string(schema)); err != nil {
+		t.Fatalf("failed to apply schema: %s", err)
+	}
+	cover := []byte("\x89PNG\r\n\x1a\n legacy png")
+	res, err := sqlDB.Exec("INSERT INTO items (name, price, description, category_id, seller_id, image, status) VALUES ('item', 100, '', 1, 1, ?, 1)", cover)
+	if err != nil {
+		t.Fatalf("failed to add item: %s", err)
+	}
+	itemID, err := res.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get item id: %s", err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get working directory: %s", err)
+	}
+	if err := os.Chdir(root); err != nil {
+		t.Fatalf("failed to change directory: %s", err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	dir := filepath.Join(root, "images")
+	if err := run(context.Background(), "fs", dir); err != nil {
+		t.Fatalf("failed to migrate: %s", err)
+	}
+
+	var key string
+	if err := sqlDB.QueryRow("SELECT image_key FROM item_images WHERE item_id = ? AND position = 0", itemID).Scan(&key); err != nil {
+		t.Fatalf("failed to get the cover: %s", err)
+	}
+	store, err := imagestore.NewFSStore(dir)
+	if err != nil {
+		t.Fatalf("failed to open the store: %s", err)
+	}
+	if data, err := store.Get(context.Background(), key); err != nil || !bytes.Equal(data, cover) {
+		t.Errorf("expected the cover in the store, got %q, %v", data, err)
+	}
+	var blobs int
+	if err := sqlDB.QueryRow("SELECT count(*) FROM pragma_table_info('items') WHERE name = 'image'").Scan(&blobs); err != nil {
+		t.Fatalf("failed to read columns: %s", err)
+	}
+	if blobs != 0 {
+		t.Errorf("expected items.image to be dropped")
+	}
+}
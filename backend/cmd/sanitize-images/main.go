@@ -0,0 +1,53 @@
+// Command sanitize-images removes the metadata, such as GPS positions, from
+// the item images stored before uploads were cleaned, and turns rotated
+// JPEGs upright. Run it from the backend directory with the same
+// IMAGE_STORE and IMAGE_DIR as the server:
+//
+//	go run ./cmd/sanitize-images
+//
+// It can run while the server is up, and again at any time; images that
+// are already clean are left alone.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imaging"
+)
+
+func main() {
+	defaultKind, defaultDir := imagestore.EnvConfig()
+	kind := flag.String("store", defaultKind, "image store holding the images")
+	dir := flag.String("dir", defaultDir, "directory of the fs image store")
+	flag.Parse()
+
+	if err := run(context.Background(), *kind, *dir); err != nil {
+		fmt.Fprintf(os.Stderr, "sanitize-images: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, kind, dir string) error {
+	if kind == "memory" {
+		return fmt.Errorf("the memory store only lives inside the server")
+	}
+	store, err := imagestore.New(kind, dir)
+	if err != nil {
+		return err
+	}
+
+	sqlDB, err := db.PrepareDB(ctx)
+	if err != nil {
+		return err
+	}
+	defer sqlDB.Close()
+
+	sanitized, skipped, err := db.SanitizeStoredImages(ctx, sqlDB, store, imaging.Sanitize)
+	fmt.Printf("sanitized %d images, skipped %d that could not be read\n", sanitized, skipped)
+	return err
+}
@@ -0,0 +1,271 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrBidNotFound  = errors.New("bid not found")
+	ErrNotAuction   = errors.New("item is not sold by auction")
+	ErrAuctionItem  = errors.New("item is sold by auction")
+	ErrAuctionEnded = errors.New("auction has ended")
+	ErrBidTooLow    = errors.New("bid is below the minimum")
+)
+
+const bidColumns = "id, item_id, bidder_id, amount, status, created_at"
+
+type AuctionRepository interface {
+	PlaceBid(ctx context.Context, itemID int32, bidderID int64, amount int64) (domain.Bid, error)
+	GetBids(ctx context.Context, itemID int32) ([]domain.Bid, error)
+	GetHighestBid(ctx context.Context, itemID int32) (domain.Bid, error)
+	CloseEndedAuctions(ctx context.Context) (int, error)
+}
+
+type AuctionDBRepository struct {
+	*sql.DB
+}
+
+func NewAuctionRepository(db *sql.DB) AuctionRepository {
+	return &AuctionDBRepository{DB: db}
+}
+
+// PlaceBid bids amount on a running auction. The first bid must be at least
+// the starting price, later ones at least the highest bid plus the item's
+// minimum increment. The amount is held from the bidder's balance; when a
+// bidder raises their own bid only the difference is held additionally.
+func (r *AuctionDBRepository) PlaceBid(ctx context.Context, itemID int32, bidderID int64, amount int64) (domain.Bid, error) {
+	var bid domain.Bid
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var (
+			item  domain.Item
+			ended bool
+		)
+		row := tx.QueryRowContext(ctx, "SELECT seller_id, price, status, listing_type, min_increment, COALESCE(ends_at <= DATETIME('now', 'localtime'), 1) FROM items WHERE id = ?", itemID)
+		if err := row.Scan(&item.UserID, &item.Price, &item.Status, &item.ListingType, &item.MinIncrement, &ended); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrItemNotFound
+			}
+			return err
+		}
+		if item.ListingType != domain.ListingTypeAuction {
+			return ErrNotAuction
+		}
+		if item.UserID == bidderID {
+			return ErrOwnItem
+		}
+		if item.Status != domain.ItemStatusOnSale {
+			return ErrItemNotOnSale
+		}
+		if ended {
+			return ErrAuctionEnded
+		}
+
+		minAmount := item.Price
+		highest, err := getHighestBid(ctx, tx, itemID)
+		switch {
+		case err == nil:
+			minAmount = highest.Amount + item.MinIncrement
+		case err != ErrBidNotFound:
+			return err
+		}
+		if amount < minAmount {
+			return ErrBidTooLow
+		}
+		if err := checkPurchase(ctx, tx, bidderID, amount, 0); err != nil {
+			return err
+		}
+
+		// The bidder's previous bid keeps its hold, so only the raise is
+		// taken from the balance.
+		var (
+			prevID     int64
+			prevAmount int64
+		)
+		row = tx.QueryRowContext(ctx, "SELECT id, amount FROM bids WHERE item_id = ? AND bidder_id = ? AND status = ?", itemID, bidderID, domain.BidStatusActive)
+		if err := row.Scan(&prevID, &prevAmount); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if prevID != 0 {
+			if _, err := tx.ExecContext(ctx, "UPDATE bids SET status = ? WHERE id = ?", domain.BidStatusReplaced, prevID); err != nil {
+				return err
+			}
+		}
+
+		hold := amount - prevAmount
+		if err := postJournal(ctx, tx, itemID,
+			posting{AccountID: bidderID, Kind: domain.LedgerEntryBidHold, Amount: -hold},
+			posting{AccountID: domain.AccountBidHolds, Kind: domain.LedgerEntryBidHold, Amount: hold},
+		); err != nil {
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, "INSERT INTO bids (item_id, bidder_id, amount, status) VALUES (?, ?, ?, ?)", itemID, bidderID, amount, domain.BidStatusActive)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		bid, err = scanBid(tx.QueryRowContext(ctx, "SELECT "+bidColumns+" FROM bids WHERE id = ?", id))
+		return err
+	})
+	if err != nil {
+		return bid, recordViolation(ctx, r.DB, bidderID, err)
+	}
+	return bid, nil
+}
+
+func (r *AuctionDBRepository) GetBids(ctx context.Context, itemID int32) ([]domain.Bid, error) {
+	rows, err := r.QueryContext(ctx, "SELECT "+bidColumns+" FROM bids WHERE item_id = ? ORDER BY amount desc, id", itemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bids []domain.Bid
+	for rows.Next() {
+		bid, err := scanBid(rows)
+		if err != nil {
+			return nil, err
+		}
+		bids = append(bids, bid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return bids, nil
+}
+
+// GetHighestBid returns the leading bid of an auction, or ErrBidNotFound
+// when nobody has bid yet.
+func (r *AuctionDBRepository) GetHighestBid(ctx context.Context, itemID int32) (domain.Bid, error) {
+	return getHighestBid(ctx, r.DB, itemID)
+}
+
+// CloseEndedAuctions closes the auctions whose end time has passed. The
+// highest bidder wins: their hold moves into escrow and a paid order is
+// created, exactly as if they had purchased the item. The holds of all other
+// bidders are released. Auctions without bids go back to draft.
+func (r *AuctionDBRepository) CloseEndedAuctions(ctx context.Context) (int, error) {
+	rows, err := r.QueryContext(ctx, "SELECT id FROM items WHERE listing_type = ? AND status = ? AND ends_at <= DATETIME('now', 'localtime')", domain.ListingTypeAuction, domain.ItemStatusOnSale)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int32
+	for rows.Next() {
+		var id int32
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var closed int
+	for _, id := range ids {
+		err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+			return closeAuction(ctx, tx, id)
+		})
+		if err != nil {
+			return closed, errors.Wrapf(err, "failed to close auction %d", id)
+		}
+		closed++
+	}
+	return closed, nil
+}
+
+func closeAuction(ctx context.Context, tx *sql.Tx, itemID int32) error {
+	var sellerID int64
+	if err := tx.QueryRowContext(ctx, "SELECT seller_id FROM items WHERE id = ?", itemID).Scan(&sellerID); err != nil {
+		return err
+	}
+
+	winner, err := getHighestBid(ctx, tx, itemID)
+	if err == ErrBidNotFound {
+		_, err := transitionItem(ctx, tx, itemID, 0, domain.ItemEventEndUnsold)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	revisionID, err := latestItemRevisionID(ctx, tx, itemID)
+	if err != nil {
+		return err
+	}
+	// The single unit goes to the winner, as in a purchase, so that a
+	// cancelled order puts it back rather than adding one.
+	if _, err := tx.ExecContext(ctx, "UPDATE items SET stock = 0 WHERE id = ?", itemID); err != nil {
+		return err
+	}
+	if _, err := transitionItem(ctx, tx, itemID, 0, domain.ItemEventSellOut); err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT "+bidColumns+" FROM bids WHERE item_id = ? AND status = ? AND id != ?", itemID, domain.BidStatusActive, winner.ID)
+	if err != nil {
+		return err
+	}
+	var losers []domain.Bid
+	for rows.Next() {
+		bid, err := scanBid(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		losers = append(losers, bid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, bid := range losers {
+		if err := postJournal(ctx, tx, itemID,
+			posting{AccountID: domain.AccountBidHolds, Kind: domain.LedgerEntryBidRelease, Amount: -bid.Amount},
+			posting{AccountID: bid.BidderID, Kind: domain.LedgerEntryBidRelease, Amount: bid.Amount},
+		); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE bids SET status = ? WHERE id = ?", domain.BidStatusLost, bid.ID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE bids SET status = ? WHERE id = ?", domain.BidStatusWon, winner.ID); err != nil {
+		return err
+	}
+	if err := postJournal(ctx, tx, itemID,
+		posting{AccountID: domain.AccountBidHolds, Kind: domain.LedgerEntryPurchase, Amount: -winner.Amount},
+		posting{AccountID: domain.AccountEscrow, Kind: domain.LedgerEntryPurchase, Amount: winner.Amount},
+	); err != nil {
+		return err
+	}
+
+	_, err = insertOrder(ctx, tx, domain.Order{ItemID: itemID, BuyerID: winner.BidderID, SellerID: sellerID, Price: winner.Amount, ItemRevisionID: revisionID})
+	return err
+}
+
+// getHighestBid returns the leading active bid. Of two equal bids the
+// earlier one leads.
+func getHighestBid(ctx context.Context, q dbtx, itemID int32) (domain.Bid, error) {
+	bid, err := scanBid(q.QueryRowContext(ctx, "SELECT "+bidColumns+" FROM bids WHERE item_id = ? AND status = ? ORDER BY amount desc, id LIMIT 1", itemID, domain.BidStatusActive))
+	if err == sql.ErrNoRows {
+		return bid, ErrBidNotFound
+	}
+	return bid, err
+}
+
+func scanBid(row rowScanner) (domain.Bid, error) {
+	var bid domain.Bid
+	return bid, row.Scan(&bid.ID, &bid.ItemID, &bid.BidderID, &bid.Amount, &bid.Status, &bid.CreatedAt)
+}
@@ -0,0 +1,247 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+	"github.com/pkg/errors"
+)
+
+// addTestAuction lists an auction starting at price that ends after
+// endsIn, which may be negative for auctions that have already ended.
+func addTestAuction(t *testing.T, sqlDB *sql.DB, sellerID int64, price, minIncrement int64, endsIn time.Duration) int32 {
+	t.Helper()
+
+	itemID := addTestItem(t, sqlDB, sellerID, price)
+	if _, err := sqlDB.Exec("UPDATE items SET listing_type = ?, min_increment = ?, ends_at = DATETIME('now', 'localtime', ?) WHERE id = ?", domain.ListingTypeAuction, minIncrement, secondsModifier(endsIn), itemID); err != nil {
+		t.Fatalf("failed to make an auction: %s", err)
+	}
+	return itemID
+}
+
+func TestPlaceBid(t *testing.T) {
+	type bid struct {
+		bidder  string
+		amount  int64
+		wantErr error
+	}
+	tests := []struct {
+		name   string
+		endsIn time.Duration
+		bids   []bid
+		// wantHeld is what each bidder has held after the bids.
+		wantHeld map[string]int64
+	}{
+		{
+			name:     "starting price",
+			endsIn:   time.Hour,
+			bids:     []bid{{"alice", 99, ErrBidTooLow}, {"alice", 100, nil}},
+			wantHeld: map[string]int64{"alice": 100},
+		},
+		{
+			name:     "minimum increment",
+			endsIn:   time.Hour,
+			bids:     []bid{{"alice", 100, nil}, {"bob", 109, ErrBidTooLow}, {"bob", 110, nil}},
+			wantHeld: map[string]int64{"alice": 100, "bob": 110},
+		},
+		{
+			name:     "raise holds only the difference",
+			endsIn:   time.Hour,
+			bids:     []bid{{"alice", 100, nil}, {"bob", 110, nil}, {"alice", 300, nil}},
+			wantHeld: map[string]int64{"alice": 300, "bob": 110},
+		},
+		{
+			name:     "insufficient balance",
+			endsIn:   time.Hour,
+			bids:     []bid{{"alice", 1001, ErrInsufficientBalance}},
+			wantHeld: map[string]int64{},
+		},
+		{
+			name:     "seller",
+			endsIn:   time.Hour,
+			bids:     []bid{{"seller", 100, ErrOwnItem}},
+			wantHeld: map[string]int64{},
+		},
+		{
+			name:     "ended",
+			endsIn:   -time.Minute,
+			bids:     []bid{{"alice", 100, ErrAuctionEnded}},
+			wantHeld: map[string]int64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			repo := NewAuctionRepository(sqlDB)
+			ctx := context.Background()
+			users := map[string]int64{"seller": addTestUser(t, sqlDB, 0)}
+			for _, name := range []string{"alice", "bob"} {
+				users[name] = addTestUser(t, sqlDB, 0)
+				if err := NewLedgerRepository(sqlDB).TopUp(ctx, users[name], 1000); err != nil {
+					t.Fatalf("failed to top up: %s", err)
+				}
+			}
+			itemID := addTestAuction(t, sqlDB, users["seller"], 100, 10, tt.endsIn)
+
+			for _, b := range tt.bids {
+				if _, err := repo.PlaceBid(ctx, itemID, users[b.bidder], b.amount); !errors.Is(err, b.wantErr) {
+					t.Fatalf("%s bidding %d: expected %v, got %v", b.bidder, b.amount, b.wantErr, err)
+				}
+			}
+			var held int64
+			for _, name := range []string{"alice", "bob"} {
+				if balance := getTestBalance(t, sqlDB, users[name]); balance != 1000-tt.wantHeld[name] {
+					t.Errorf("expected %s to have %d held, got balance %d", name, tt.wantHeld[name], balance)
+				}
+				held += tt.wantHeld[name]
+			}
+			if holds := getTestAccount(t, sqlDB, domain.AccountBidHolds); holds != held {
+				t.Errorf("expected %d in bid holds, got %d", held, holds)
+			}
+		})
+	}
+}
+
+func TestPlaceBidOnFixedPriceItem(t *testing.T) {
+	sqlDB := newTestDB(t)
+	sellerID := addTestUser(t, sqlDB, 0)
+	bidderID := addTestUser(t, sqlDB, 1000)
+	itemID := addTestItem(t, sqlDB, sellerID, 100)
+
+	if _, err := NewAuctionRepository(sqlDB).PlaceBid(context.Background(), itemID, bidderID, 100); !errors.Is(err, ErrNotAuction) {
+		t.Errorf("expected ErrNotAuction, got %v", err)
+	}
+	if _, err := NewPurchaseRepository(sqlDB).Purchase(context.Background(), bidderID, addTestAuction(t, sqlDB, sellerID, 100, 10, time.Hour), 1, "", 0); !errors.Is(err, ErrAuctionItem) {
+		t.Errorf("expected ErrAuctionItem, got %v", err)
+	}
+}
+
+func TestCloseEndedAuctions(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewAuctionRepository(sqlDB)
+	ctx := context.Background()
+
+	sellerID := addTestUser(t, sqlDB, 0)
+	alice := addTestUser(t, sqlDB, 0)
+	bob := addTestUser(t, sqlDB, 0)
+	for _, id := range []int64{alice, bob} {
+		if err := NewLedgerRepository(sqlDB).TopUp(ctx, id, 1000); err != nil {
+			t.Fatalf("failed to top up: %s", err)
+		}
+	}
+
+	sold := addTestAuction(t, sqlDB, sellerID, 100, 10, time.Hour)
+	unsold := addTestAuction(t, sqlDB, sellerID, 100, 10, -time.Minute)
+	running := addTestAuction(t, sqlDB, sellerID, 100, 10, time.Hour)
+	for _, b := range []struct {
+		bidder int64
+		amount int64
+	}{{alice, 100}, {bob, 200}, {alice, 300}} {
+		if _, err := repo.PlaceBid(ctx, sold, b.bidder, b.amount); err != nil {
+			t.Fatalf("failed to bid: %s", err)
+		}
+	}
+	if _, err := repo.PlaceBid(ctx, running, bob, 100); err != nil {
+		t.Fatalf("failed to bid: %s", err)
+	}
+	if _, err := sqlDB.Exec("UPDATE items SET ends_at = DATETIME('now', 'localtime', '-1 minute') WHERE id = ?", sold); err != nil {
+		t.Fatalf("failed to end the auction: %s", err)
+	}
+
+	closed, err := repo.CloseEndedAuctions(ctx)
+	if err != nil {
+		t.Fatalf("failed to close auctions: %s", err)
+	}
+	if closed != 2 {
+		t.Errorf("expected 2 auctions to close, got %d", closed)
+	}
+
+	tests := []struct {
+		itemID     int32
+		wantStatus domain.ItemStatus
+		wantStock  int64
+	}{
+		{sold, domain.ItemStatusSoldOut, 0},
+		{unsold, domain.ItemStatusInitial, 1},
+		{running, domain.ItemStatusOnSale, 1},
+	}
+	for _, tt := range tests {
+		var (
+			status domain.ItemStatus
+			stock  int64
+		)
+		if err := sqlDB.QueryRow("SELECT status, stock FROM items WHERE id = ?", tt.itemID).Scan(&status, &stock); err != nil {
+			t.Fatalf("failed to get item: %s", err)
+		}
+		if status != tt.wantStatus || stock != tt.wantStock {
+			t.Errorf("item %d: expected status %d and stock %d, got %d and %d", tt.itemID, tt.wantStatus, tt.wantStock, status, stock)
+		}
+	}
+
+	// Alice wins at 300; Bob gets his 200 back but keeps the hold on the
+	// running auction.
+	if balance := getTestBalance(t, sqlDB, alice); balance != 700 {
+		t.Errorf("expected the winner to have paid 300, got balance %d", balance)
+	}
+	if balance := getTestBalance(t, sqlDB, bob); balance != 900 {
+		t.Errorf("expected the loser's hold to be released, got balance %d", balance)
+	}
+	if holds := getTestAccount(t, sqlDB, domain.AccountBidHolds); holds != 100 {
+		t.Errorf("expected only the running auction's hold, got %d", holds)
+	}
+	if escrow := getTestAccount(t, sqlDB, domain.AccountEscrow); escrow != 300 {
+		t.Errorf("expected the winning bid in escrow, got %d", escrow)
+	}
+
+	orders, err := NewOrderRepository(sqlDB).GetOrdersByUserID(ctx, alice)
+	if err != nil {
+		t.Fatalf("failed to get orders: %s", err)
+	}
+	if len(orders) != 1 || orders[0].ItemID != sold || orders[0].Price != 300 {
+		t.Fatalf("expected one order at 300, got %+v", orders)
+	}
+
+	// Cancelling the order puts the single unit back.
+	if _, err := NewOrderRepository(sqlDB).Cancel(ctx, orders[0].ID, alice, "", false); err != nil {
+		t.Fatalf("failed to cancel: %s", err)
+	}
+	var stock int64
+	if err := sqlDB.QueryRow("SELECT stock FROM items WHERE id = ?", sold).Scan(&stock); err != nil {
+		t.Fatalf("failed to get item: %s", err)
+	}
+	if stock != 1 {
+		t.Errorf("expected stock 1 after the cancellation, got %d", stock)
+	}
+	if balance := getTestBalance(t, sqlDB, alice); balance != 1000 {
+		t.Errorf("expected the winner to be refunded, got balance %d", balance)
+	}
+
+	// The auction comes back to the drafts without its end time, and can
+	// only go on sale again with a new one.
+	var (
+		status domain.ItemStatus
+		endsAt sql.NullString
+	)
+	if err := sqlDB.QueryRow("SELECT status, ends_at FROM items WHERE id = ?", sold).Scan(&status, &endsAt); err != nil {
+		t.Fatalf("failed to get item: %s", err)
+	}
+	if status != domain.ItemStatusInitial || endsAt.Valid {
+		t.Errorf("expected a draft without an end time, got status %d ending at %v", status, endsAt)
+	}
+	items := NewItemRepository(sqlDB, imagestore.NewMemoryStore())
+	if _, err := items.ChangeItemStatus(ctx, sold, sellerID, domain.ItemEventSell, ""); !errors.Is(err, ErrAuctionEnded) {
+		t.Errorf("expected %v without a new end time, got %v", ErrAuctionEnded, err)
+	}
+	newEnd := time.Now().Add(time.Hour).Format("2006-01-02 15:04:05")
+	item, err := items.ChangeItemStatus(ctx, sold, sellerID, domain.ItemEventSell, newEnd)
+	if err != nil {
+		t.Fatalf("failed to sell again: %s", err)
+	}
+	if item.Status != domain.ItemStatusOnSale || item.EndsAt != newEnd {
+		t.Errorf("expected the auction on sale until %s, got status %d until %s", newEnd, item.Status, item.EndsAt)
+	}
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrChargeNotFound = errors.New("charge not found")
+	ErrChargeSettled  = errors.New("charge is already settled")
+)
+
+const chargeColumns = "id, user_id, amount, status, reference, failure_reason, created_at, updated_at"
+
+type ChargeRepository interface {
+	AddCharge(ctx context.Context, userID int64, amount int64) (domain.Charge, error)
+	GetCharge(ctx context.Context, id int64) (domain.Charge, error)
+	GetChargesByUserID(ctx context.Context, userID int64) ([]domain.Charge, error)
+	SetChargeReference(ctx context.Context, id int64, reference string) error
+	ConfirmCharge(ctx context.Context, id int64, reference string) (domain.Charge, error)
+	FailCharge(ctx context.Context, id int64, reason string) (domain.Charge, error)
+}
+
+type ChargeDBRepository struct {
+	*sql.DB
+}
+
+func NewChargeRepository(db *sql.DB) ChargeRepository {
+	return &ChargeDBRepository{DB: db}
+}
+
+// AddCharge records a pending top-up. Nothing is credited until the charge is
+// confirmed. Top-ups that would break the user's limits return a
+// LimitError and are recorded as violations.
+func (r *ChargeDBRepository) AddCharge(ctx context.Context, userID int64, amount int64) (domain.Charge, error) {
+	var charge domain.Charge
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrUserNotFound
+		}
+		if err := checkTopUp(ctx, tx, userID, amount); err != nil {
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, "INSERT INTO charges (user_id, amount, status) VALUES (?, ?, ?)", userID, amount, domain.ChargeStatusPending)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		charge, err = getCharge(ctx, tx, id)
+		return err
+	})
+	if err != nil {
+		return charge, recordViolation(ctx, r.DB, userID, err)
+	}
+	return charge, nil
+}
+
+func (r *ChargeDBRepository) GetCharge(ctx context.Context, id int64) (domain.Charge, error) {
+	return getCharge(ctx, r.DB, id)
+}
+
+func (r *ChargeDBRepository) GetChargesByUserID(ctx context.Context, userID int64) ([]domain.Charge, error) {
+	rows, err := r.QueryContext(ctx, "SELECT "+chargeColumns+" FROM charges WHERE user_id = ? ORDER BY id desc", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var charges []domain.Charge
+	for rows.Next() {
+		charge, err := scanCharge(rows)
+		if err != nil {
+			return nil, err
+		}
+		charges = append(charges, charge)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return charges, nil
+}
+
+// SetChargeReference stores the provider's ID for a charge, unless the
+// callback already did.
+func (r *ChargeDBRepository) SetChargeReference(ctx context.Context, id int64, reference string) error {
+	_, err := r.ExecContext(ctx, "UPDATE charges SET reference = ?, updated_at = DATETIME('now', 'localtime') WHERE id = ? AND reference = ''", reference, id)
+	return err
+}
+
+// ConfirmCharge marks a pending charge succeeded and credits its amount to
+// the user's balance. Charges that are no longer pending return
+// ErrChargeSettled, so a repeated callback never credits twice.
+func (r *ChargeDBRepository) ConfirmCharge(ctx context.Context, id int64, reference string) (domain.Charge, error) {
+	var charge domain.Charge
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var err error
+		charge, err = settleCharge(ctx, tx, id, domain.ChargeStatusSucceeded, reference, "")
+		if err != nil {
+			return err
+		}
+		return postJournal(ctx, tx, 0,
+			posting{AccountID: domain.AccountExternal, Kind: domain.LedgerEntryTopUp, Amount: -charge.Amount},
+			posting{AccountID: charge.UserID, Kind: domain.LedgerEntryTopUp, Amount: charge.Amount},
+		)
+	})
+	return charge, err
+}
+
+// FailCharge marks a pending charge failed. The balance is left untouched.
+func (r *ChargeDBRepository) FailCharge(ctx context.Context, id int64, reason string) (domain.Charge, error) {
+	var charge domain.Charge
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var err error
+		charge, err = settleCharge(ctx, tx, id, domain.ChargeStatusFailed, "", reason)
+		return err
+	})
+	return charge, err
+}
+
+func settleCharge(ctx context.Context, tx *sql.Tx, id int64, status domain.ChargeStatus, reference string, reason string) (domain.Charge, error) {
+	if _, err := getCharge(ctx, tx, id); err != nil {
+		return domain.Charge{}, err
+	}
+
+	res, err := tx.ExecContext(ctx, "UPDATE charges SET status = ?, reference = CASE WHEN ? = '' THEN reference ELSE ? END, failure_reason = ?, updated_at = DATETIME('now', 'localtime') WHERE id = ? AND status = ?", status, reference, reference, reason, id, domain.ChargeStatusPending)
+	if err != nil {
+		return domain.Charge{}, err
+	}
+	if err := expectOneRow(res, ErrChargeSettled); err != nil {
+		return domain.Charge{}, err
+	}
+	return getCharge(ctx, tx, id)
+}
+
+func getCharge(ctx context.Context, q dbtx, id int64) (domain.Charge, error) {
+	charge, err := scanCharge(q.QueryRowContext(ctx, "SELECT "+chargeColumns+" FROM charges WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return charge, ErrChargeNotFound
+	}
+	return charge, err
+}
+
+func scanCharge(row rowScanner) (domain.Charge, error) {
+	var charge domain.Charge
+	return charge, row.Scan(&charge.ID, &charge.UserID, &charge.Amount, &charge.Status, &charge.Reference, &charge.FailureReason, &charge.CreatedAt, &charge.UpdatedAt)
+}
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+func TestSettleCharge(t *testing.T) {
+	tests := []struct {
+		name string
+		// settle are applied in order; "confirm" or "fail".
+		settle      []string
+		wantErr     error
+		wantStatus  domain.ChargeStatus
+		wantBalance int64
+	}{
+		{name: "pending", wantStatus: domain.ChargeStatusPending, wantBalance: 0},
+		{name: "confirm", settle: []string{"confirm"}, wantStatus: domain.ChargeStatusSucceeded, wantBalance: 500},
+		{name: "fail", settle: []string{"fail"}, wantStatus: domain.ChargeStatusFailed, wantBalance: 0},
+		{name: "confirm twice", settle: []string{"confirm", "confirm"}, wantErr: ErrChargeSettled, wantStatus: domain.ChargeStatusSucceeded, wantBalance: 500},
+		{name: "fail after confirm", settle: []string{"confirm", "fail"}, wantErr: ErrChargeSettled, wantStatus: domain.ChargeStatusSucceeded, wantBalance: 500},
+		{name: "confirm after fail", settle: []string{"fail", "confirm"}, wantErr: ErrChargeSettled, wantStatus: domain.ChargeStatusFailed, wantBalance: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			repo := NewChargeRepository(sqlDB)
+			ctx := context.Background()
+			userID := addTestUser(t, sqlDB, 0)
+
+			charge, err := repo.AddCharge(ctx, userID, 500)
+			if err != nil {
+				t.Fatalf("failed to add charge: %s", err)
+			}
+			for _, settle := range tt.settle {
+				if settle == "confirm" {
+					_, err = repo.ConfirmCharge(ctx, charge.ID, "ch_1")
+				} else {
+					_, err = repo.FailCharge(ctx, charge.ID, "declined")
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+
+			got, err := repo.GetCharge(ctx, charge.ID)
+			if err != nil {
+				t.Fatalf("failed to get charge: %s", err)
+			}
+			if got.Status != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, got.Status)
+			}
+			if balance := getTestBalance(t, sqlDB, userID); balance != tt.wantBalance {
+				t.Errorf("expected balance %d, got %d", tt.wantBalance, balance)
+			}
+		})
+	}
+}
+
+func TestChargeNotFound(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewChargeRepository(sqlDB)
+
+	if _, err := repo.ConfirmCharge(context.Background(), 1, ""); !errors.Is(err, ErrChargeNotFound) {
+		t.Errorf("expected ErrChargeNotFound, got %v", err)
+	}
+	if _, err := repo.AddCharge(context.Background(), 1, 100); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestSetChargeReference(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewChargeRepository(sqlDB)
+	ctx := context.Background()
+	userID := addTestUser(t, sqlDB, 0)
+
+	charge, err := repo.AddCharge(ctx, userID, 100)
+	if err != nil {
+		t.Fatalf("failed to add charge: %s", err)
+	}
+	// The callback may arrive before the provider's response.
+	if _, err := repo.ConfirmCharge(ctx, charge.ID, "from_callback"); err != nil {
+		t.Fatalf("failed to confirm: %s", err)
+	}
+	if err := repo.SetChargeReference(ctx, charge.ID, "from_response"); err != nil {
+		t.Fatalf("failed to set reference: %s", err)
+	}
+	got, err := repo.GetCharge(ctx, charge.ID)
+	if err != nil {
+		t.Fatalf("failed to get charge: %s", err)
+	}
+	if got.Reference != "from_callback" {
+		t.Errorf("expected the callback's reference to be kept, got %q", got.Reference)
+	}
+}
@@ -0,0 +1,296 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrCouponNotFound      = errors.New("coupon not found")
+	ErrCouponCodeTaken     = errors.New("coupon code is already used")
+	ErrCouponNotApplicable = errors.New("coupon cannot be used for this purchase")
+	ErrCouponUsedUp        = errors.New("coupon has been used up")
+)
+
+const couponColumns = "id, code, discount_type, value, min_spend, max_uses, max_uses_per_user, uses, COALESCE(starts_at, ''), COALESCE(ends_at, ''), active, created_at, updated_at"
+
+type CouponRepository interface {
+	AddCoupon(ctx context.Context, coupon domain.Coupon) (domain.Coupon, error)
+	GetCoupon(ctx context.Context, id int64) (domain.Coupon, error)
+	GetCoupons(ctx context.Context) ([]domain.Coupon, error)
+	UpdateCoupon(ctx context.Context, coupon domain.Coupon) (domain.Coupon, error)
+	GetRedemptions(ctx context.Context, couponID int64) ([]domain.CouponRedemption, error)
+}
+
+type CouponDBRepository struct {
+	*sql.DB
+}
+
+func NewCouponRepository(db *sql.DB) CouponRepository {
+	return &CouponDBRepository{DB: db}
+}
+
+// AddCoupon creates a coupon. Codes are case-insensitive and stored in upper
+// case.
+func (r *CouponDBRepository) AddCoupon(ctx context.Context, coupon domain.Coupon) (domain.Coupon, error) {
+	var added domain.Coupon
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM coupons WHERE code = ?)", normalizeCouponCode(coupon.Code)).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return ErrCouponCodeTaken
+		}
+
+		res, err := tx.ExecContext(ctx, "INSERT INTO coupons (code, discount_type, value, min_spend, max_uses, max_uses_per_user, starts_at, ends_at, active) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			normalizeCouponCode(coupon.Code), coupon.DiscountType, coupon.Value, coupon.MinSpend, coupon.MaxUses, coupon.MaxUsesPerUser, nullString(coupon.StartsAt), nullString(coupon.EndsAt), coupon.Active)
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if err := setCouponCategories(ctx, tx, id, coupon.CategoryIDs); err != nil {
+			return err
+		}
+		added, err = getCoupon(ctx, tx, id)
+		return err
+	})
+	return added, err
+}
+
+func (r *CouponDBRepository) GetCoupon(ctx context.Context, id int64) (domain.Coupon, error) {
+	return getCoupon(ctx, r.DB, id)
+}
+
+func (r *CouponDBRepository) GetCoupons(ctx context.Context) ([]domain.Coupon, error) {
+	rows, err := r.QueryContext(ctx, "SELECT "+couponColumns+" FROM coupons ORDER BY id desc")
+	if err != nil {
+		return nil, err
+	}
+	var coupons []domain.Coupon
+	for rows.Next() {
+		coupon, err := scanCoupon(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		coupons = append(coupons, coupon)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range coupons {
+		if coupons[i].CategoryIDs, err = getCouponCategories(ctx, r.DB, coupons[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	return coupons, nil
+}
+
+// UpdateCoupon changes the terms of a coupon. The code and the number of
+// uses so far cannot be changed.
+func (r *CouponDBRepository) UpdateCoupon(ctx context.Context, coupon domain.Coupon) (domain.Coupon, error) {
+	var updated domain.Coupon
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "UPDATE coupons SET discount_type = ?, value = ?, min_spend = ?, max_uses = ?, max_uses_per_user = ?, starts_at = ?, ends_at = ?, active = ?, updated_at = DATETIME('now', 'localtime') WHERE id = ?",
+			coupon.DiscountType, coupon.Value, coupon.MinSpend, coupon.MaxUses, coupon.MaxUsesPerUser, nullString(coupon.StartsAt), nullString(coupon.EndsAt), coupon.Active, coupon.ID)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(res, ErrCouponNotFound); err != nil {
+			return err
+		}
+		if err := setCouponCategories(ctx, tx, coupon.ID, coupon.CategoryIDs); err != nil {
+			return err
+		}
+		updated, err = getCoupon(ctx, tx, coupon.ID)
+		return err
+	})
+	return updated, err
+}
+
+func (r *CouponDBRepository) GetRedemptions(ctx context.Context, couponID int64) ([]domain.CouponRedemption, error) {
+	rows, err := r.QueryContext(ctx, "SELECT id, coupon_id, user_id, order_id, discount, created_at FROM coupon_redemptions WHERE coupon_id = ? ORDER BY id desc", couponID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var redemptions []domain.CouponRedemption
+	for rows.Next() {
+		var redemption domain.CouponRedemption
+		if err := rows.Scan(&redemption.ID, &redemption.CouponID, &redemption.UserID, &redemption.OrderID, &redemption.Discount, &redemption.CreatedAt); err != nil {
+			return nil, err
+		}
+		redemptions = append(redemptions, redemption)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return redemptions, nil
+}
+
+// claimCoupon checks that the coupon with code can be used by userID for a
+// purchase of amount in the category, and counts the use against its caps.
+// It returns the coupon and the discount. The caller records the redemption
+// with redeemCoupon once the orders exist.
+func claimCoupon(ctx context.Context, tx *sql.Tx, code string, userID int64, categoryID int64, amount int64) (domain.Coupon, int64, error) {
+	coupon, err := scanCoupon(tx.QueryRowContext(ctx, "SELECT "+couponColumns+" FROM coupons WHERE code = ?", normalizeCouponCode(code)))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return coupon, 0, ErrCouponNotFound
+		}
+		return coupon, 0, err
+	}
+	if coupon.CategoryIDs, err = getCouponCategories(ctx, tx, coupon.ID); err != nil {
+		return coupon, 0, err
+	}
+
+	var valid bool
+	row := tx.QueryRowContext(ctx, "SELECT COALESCE(starts_at <= DATETIME('now', 'localtime'), 1) AND COALESCE(ends_at > DATETIME('now', 'localtime'), 1) FROM coupons WHERE id = ?", coupon.ID)
+	if err := row.Scan(&valid); err != nil {
+		return coupon, 0, err
+	}
+	if !coupon.Active || !valid || !coupon.AppliesTo(categoryID) || amount < coupon.MinSpend {
+		return coupon, 0, ErrCouponNotApplicable
+	}
+
+	if coupon.MaxUsesPerUser > 0 {
+		var used int64
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM coupon_redemptions WHERE coupon_id = ? AND user_id = ?", coupon.ID, userID).Scan(&used); err != nil {
+			return coupon, 0, err
+		}
+		if used >= coupon.MaxUsesPerUser {
+			return coupon, 0, ErrCouponUsedUp
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, "UPDATE coupons SET uses = uses + 1 WHERE id = ? AND (max_uses = 0 OR uses < max_uses)", coupon.ID)
+	if err != nil {
+		return coupon, 0, err
+	}
+	if err := expectOneRow(res, ErrCouponUsedUp); err != nil {
+		return coupon, 0, err
+	}
+	return coupon, coupon.Discount(amount), nil
+}
+
+// redeemCoupon records the use of a coupon claimed with claimCoupon and the
+// orders it discounted.
+func redeemCoupon(ctx context.Context, tx *sql.Tx, redemption domain.CouponRedemption, orderIDs []int64) error {
+	res, err := tx.ExecContext(ctx, "INSERT INTO coupon_redemptions (coupon_id, user_id, order_id, discount) VALUES (?, ?, ?, ?)", redemption.CouponID, redemption.UserID, redemption.OrderID, redemption.Discount)
+	if err != nil {
+		return err
+	}
+	redemptionID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for _, orderID := range orderIDs {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO coupon_redemption_orders (redemption_id, order_id) VALUES (?, ?)", redemptionID, orderID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseCoupon gives back the coupon use that discounted the cancelled
+// order once every order it discounted is cancelled, so that the buyer can
+// use the coupon again and it counts towards max_uses no more.
+func releaseCoupon(ctx context.Context, tx *sql.Tx, orderID int64) error {
+	var redemptionID, couponID int64
+	row := tx.QueryRowContext(ctx, "SELECT coupon_redemptions.id, coupon_redemptions.coupon_id FROM coupon_redemptions JOIN coupon_redemption_orders ON coupon_redemption_orders.redemption_id = coupon_redemptions.id WHERE coupon_redemption_orders.order_id = ?", orderID)
+	if err := row.Scan(&redemptionID, &couponID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	var left int64
+	row = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM coupon_redemption_orders JOIN orders ON orders.id = coupon_redemption_orders.order_id WHERE coupon_redemption_orders.redemption_id = ? AND orders.status != ?", redemptionID, domain.OrderStatusCancelled)
+	if err := row.Scan(&left); err != nil {
+		return err
+	}
+	if left > 0 {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM coupon_redemption_orders WHERE redemption_id = ?", redemptionID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM coupon_redemptions WHERE id = ?", redemptionID); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "UPDATE coupons SET uses = uses - 1, updated_at = DATETIME('now', 'localtime') WHERE id = ? AND uses > 0", couponID)
+	return err
+}
+
+func getCoupon(ctx context.Context, q dbtx, id int64) (domain.Coupon, error) {
+	coupon, err := scanCoupon(q.QueryRowContext(ctx, "SELECT "+couponColumns+" FROM coupons WHERE id = ?", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return coupon, ErrCouponNotFound
+		}
+		return coupon, err
+	}
+	coupon.CategoryIDs, err = getCouponCategories(ctx, q, id)
+	return coupon, err
+}
+
+func getCouponCategories(ctx context.Context, q dbtx, couponID int64) ([]int64, error) {
+	rows, err := q.QueryContext(ctx, "SELECT category_id FROM coupon_categories WHERE coupon_id = ? ORDER BY category_id", couponID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func setCouponCategories(ctx context.Context, tx *sql.Tx, couponID int64, categoryIDs []int64) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM coupon_categories WHERE coupon_id = ?", couponID); err != nil {
+		return err
+	}
+	for _, categoryID := range categoryIDs {
+		if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO coupon_categories (coupon_id, category_id) VALUES (?, ?)", couponID, categoryID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanCoupon(row rowScanner) (domain.Coupon, error) {
+	var coupon domain.Coupon
+	return coupon, row.Scan(&coupon.ID, &coupon.Code, &coupon.DiscountType, &coupon.Value, &coupon.MinSpend, &coupon.MaxUses, &coupon.MaxUsesPerUser, &coupon.Uses, &coupon.StartsAt, &coupon.EndsAt, &coupon.Active, &coupon.CreatedAt, &coupon.UpdatedAt)
+}
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// nullString stores empty strings as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullInt64(n int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: n, Valid: n != 0}
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+func TestPurchaseWithCoupon(t *testing.T) {
+	const layout = "2006-01-02 15:04:05"
+	yesterday := time.Now().Add(-24 * time.Hour).Format(layout)
+	tomorrow := time.Now().Add(24 * time.Hour).Format(layout)
+
+	tests := []struct {
+		name   string
+		coupon domain.Coupon
+		code   string
+		// Coupons are active unless inactive is set.
+		inactive bool
+		// earlier is how many times the buyer used the coupon before.
+		earlier      int
+		wantErr      error
+		wantDiscount int64
+	}{
+		{name: "percent", coupon: domain.Coupon{DiscountType: domain.DiscountTypePercent, Value: 10}, wantDiscount: 100},
+		{name: "fixed", coupon: domain.Coupon{DiscountType: domain.DiscountTypeFixed, Value: 300}, wantDiscount: 300},
+		{name: "fixed above the price", coupon: domain.Coupon{DiscountType: domain.DiscountTypeFixed, Value: 5000}, wantDiscount: 1000},
+		{name: "code is case-insensitive", coupon: domain.Coupon{DiscountType: domain.DiscountTypeFixed, Value: 300}, code: "welcome", wantDiscount: 300},
+		{name: "unknown code", coupon: domain.Coupon{Value: 10}, code: "OTHER", wantErr: ErrCouponNotFound},
+		{name: "inactive", coupon: domain.Coupon{Value: 10}, inactive: true, wantErr: ErrCouponNotApplicable},
+		{name: "not started", coupon: domain.Coupon{Value: 10, StartsAt: tomorrow}, wantErr: ErrCouponNotApplicable},
+		{name: "ended", coupon: domain.Coupon{Value: 10, EndsAt: yesterday}, wantErr: ErrCouponNotApplicable},
+		{name: "within window", coupon: domain.Coupon{Value: 10, StartsAt: yesterday, EndsAt: tomorrow}, wantDiscount: 100},
+		{name: "below min spend", coupon: domain.Coupon{Value: 10, MinSpend: 1001}, wantErr: ErrCouponNotApplicable},
+		{name: "other category", coupon: domain.Coupon{Value: 10, CategoryIDs: []int64{2}}, wantErr: ErrCouponNotApplicable},
+		{name: "matching category", coupon: domain.Coupon{Value: 10, CategoryIDs: []int64{1, 2}}, wantDiscount: 100},
+		{name: "used up", coupon: domain.Coupon{Value: 10, MaxUses: 1}, earlier: 1, wantErr: ErrCouponUsedUp},
+		{name: "used up by the buyer", coupon: domain.Coupon{Value: 10, MaxUsesPerUser: 2}, earlier: 2, wantErr: ErrCouponUsedUp},
+		{name: "uses left", coupon: domain.Coupon{Value: 10, MaxUses: 3, MaxUsesPerUser: 3}, earlier: 2, wantDiscount: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			ctx := context.Background()
+			repo := NewPurchaseRepository(sqlDB)
+			sellerID := addTestUser(t, sqlDB, 0)
+			buyerID := addTestUser(t, sqlDB, 100000)
+
+			tt.coupon.Code = "WELCOME"
+			tt.coupon.Active = !tt.inactive
+			coupon, err := NewCouponRepository(sqlDB).AddCoupon(ctx, tt.coupon)
+			if err != nil {
+				t.Fatalf("failed to add coupon: %s", err)
+			}
+			for i := 0; i < tt.earlier; i++ {
+				if _, err := repo.Purchase(ctx, buyerID, addTestItem(t, sqlDB, sellerID, 1000), 1, "WELCOME", 0); err != nil {
+					t.Fatalf("failed to use the coupon before: %s", err)
+				}
+			}
+
+			code := tt.code
+			if code == "" {
+				code = "WELCOME"
+			}
+			before := getTestBalance(t, sqlDB, buyerID)
+			orders, err := repo.Purchase(ctx, buyerID, addTestItem(t, sqlDB, sellerID, 1000), 1, code, 0)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr != nil {
+				if balance := getTestBalance(t, sqlDB, buyerID); balance != before {
+					t.Errorf("expected the balance to stay %d, got %d", before, balance)
+				}
+				got, err := NewCouponRepository(sqlDB).GetCoupon(ctx, coupon.ID)
+				if err != nil {
+					t.Fatalf("failed to get coupon: %s", err)
+				}
+				if got.Uses != int64(tt.earlier) {
+					t.Errorf("expected %d uses, got %d", tt.earlier, got.Uses)
+				}
+				return
+			}
+
+			if orders[0].Discount != tt.wantDiscount {
+				t.Errorf("expected discount %d, got %d", tt.wantDiscount, orders[0].Discount)
+			}
+			if balance := getTestBalance(t, sqlDB, buyerID); balance != before-1000+tt.wantDiscount {
+				t.Errorf("expected the buyer to pay %d, got balance %d", 1000-tt.wantDiscount, balance)
+			}
+			// The seller is paid on the full price.
+			if orders[0].Price != 1000 {
+				t.Errorf("expected the order price to stay 1000, got %d", orders[0].Price)
+			}
+			redemptions, err := NewCouponRepository(sqlDB).GetRedemptions(ctx, coupon.ID)
+			if err != nil {
+				t.Fatalf("failed to get redemptions: %s", err)
+			}
+			if len(redemptions) != tt.earlier+1 || redemptions[0].OrderID != orders[0].ID || redemptions[0].Discount != tt.wantDiscount {
+				t.Errorf("unexpected redemptions %+v", redemptions)
+			}
+		})
+	}
+}
+
+func TestAddCouponCodeTaken(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewCouponRepository(sqlDB)
+
+	if _, err := repo.AddCoupon(context.Background(), domain.Coupon{Code: "spring", Value: 10}); err != nil {
+		t.Fatalf("failed to add coupon: %s", err)
+	}
+	if _, err := repo.AddCoupon(context.Background(), domain.Coupon{Code: "SPRING", Value: 20}); !errors.Is(err, ErrCouponCodeTaken) {
+		t.Errorf("expected ErrCouponCodeTaken, got %v", err)
+	}
+}
@@ -16,7 +16,7 @@ func PrepareDB(ctx context.Context) (*sql.DB, error) {
 		return nil, errors.Wrap(err, "failed to get current path: %w")
 	}
 
-	db, err := sql.Open("sqlite3", filepath.Join(path, "db", "mercari.sqlite3"))
+	db, err := openDB(filepath.Join(path, "db", "mercari.sqlite3"))
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create DB: %w")
 	}
@@ -25,14 +25,16 @@ func PrepareDB(ctx context.Context) (*sql.DB, error) {
 		return nil, errors.Wrap(err, "failed to ping DB: %w")
 	}
 
-	f, err := os.ReadFile(filepath.Join(path, "sql", "01_schema.sql"))
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to open schema.sql %w")
-	}
-
-	if _, err = db.ExecContext(ctx, string(f)); err != nil {
-		return nil, errors.Wrap(err, "failed to exec query: %w")
+	if err = prepareSchema(ctx, db, filepath.Join(path, "sql")); err != nil {
+		return nil, err
 	}
 
 	return db, nil
 }
+
+// openDB opens the SQLite file at path. Transactions take the write lock up
+// front (BEGIN IMMEDIATE) and wait for it instead of failing with SQLITE_BUSY,
+// so concurrent purchases are serialized rather than rejected.
+func openDB(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000&_txlock=immediate")
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"math/bits"
+	"strings"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+)
+
+// DuplicateImageDistance is how many bits apart the hashes of two images may
+// be for them to count as copies. It is configured on startup and can be at
+// most MaxDuplicateImageDistance.
+var DuplicateImageDistance = 5
+
+// MaxDuplicateImageDistance is the largest distance the hash bands can find:
+// two hashes that differ in at most 7 bits share at least one of 8 bytes.
+const MaxDuplicateImageDistance = 7
+
+const hashBands = 8
+
+// GetDuplicateImageFlags lists flagged image pairs, the latest first.
+func (r *ItemDBRepository) GetDuplicateImageFlags(ctx context.Context, limit, offset int) ([]domain.DuplicateImageFlag, error) {
+	rows, err := r.QueryContext(ctx, `SELECT f.id, f.item_id, f.image_id, items.seller_id, f.other_item_id, f.other_image_id, others.seller_id, f.distance, f.created_at
+		FROM duplicate_image_flags f
+		JOIN items ON items.id = f.item_id
+		JOIN items others ON others.id = f.other_item_id
+		ORDER BY f.id desc LIMIT ? OFFSET ?`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var flags []domain.DuplicateImageFlag
+	for rows.Next() {
+		var f domain.DuplicateImageFlag
+		if err := rows.Scan(&f.ID, &f.ItemID, &f.ImageID, &f.SellerID, &f.OtherItemID, &f.OtherImageID, &f.OtherSellerID, &f.Distance, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		flags = append(flags, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return flags, nil
+}
+
+func (r *ItemDBRepository) CountDuplicateImageFlags(ctx context.Context) (int64, error) {
+	var count int64
+	return count, r.QueryRowContext(ctx, "SELECT COUNT(*) FROM duplicate_image_flags").Scan(&count)
+}
+
+// indexImageHash records the hash of a new image and flags the images of
+// other sellers' active listings it is a near-duplicate of.
+func indexImageHash(ctx context.Context, tx *sql.Tx, itemID int32, imageID int64, hash uint64) error {
+	bands := make([]any, 0, hashBands*2)
+	for band := 0; band < hashBands; band++ {
+		value := int64(hash >> (8 * band) & 0xff)
+		if _, err := tx.ExecContext(ctx, "INSERT INTO item_image_hash_bands (image_id, band, value) VALUES (?, ?, ?)", imageID, band, value); err != nil {
+			return err
+		}
+		bands = append(bands, band, value)
+	}
+
+	match := strings.TrimSuffix(strings.Repeat("(b.band = ? AND b.value = ?) OR ", hashBands), " OR ")
+	args := append(bands, itemID, domain.ItemStatusOnSale, domain.ItemStatusReserved)
+	rows, err := tx.QueryContext(ctx, `SELECT DISTINCT item_images.id, item_images.item_id, item_images.dhash
+		FROM item_image_hash_bands b
+		JOIN item_images ON item_images.id = b.image_id
+		JOIN items ON items.id = item_images.item_id
+		WHERE (`+match+`)
+		AND items.seller_id != (SELECT seller_id FROM items WHERE id = ?)
+		AND items.status IN (?, ?)`, args...)
+	if err != nil {
+		return err
+	}
+
+	type candidate struct {
+		imageID  int64
+		itemID   int32
+		distance int
+	}
+	var copies []candidate
+	for rows.Next() {
+		var c candidate
+		var other int64
+		if err := rows.Scan(&c.imageID, &c.itemID, &other); err != nil {
+			rows.Close()
+			return err
+		}
+		c.distance = bits.OnesCount64(hash ^ uint64(other))
+		if c.distance <= DuplicateImageDistance {
+			copies = append(copies, c)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range copies {
+		if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO duplicate_image_flags (item_id, image_id, other_item_id, other_image_id, distance) VALUES (?, ?, ?, ?, ?)", itemID, imageID, c.itemID, c.imageID, c.distance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
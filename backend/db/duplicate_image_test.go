@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+)
+
+func TestDuplicateImageFlags(t *testing.T) {
+	const original uint64 = 0x0123456789abcdef
+
+	tests := []struct {
+		name string
+		// sameSeller uploads the copy as the original's seller.
+		sameSeller   bool
+		otherStatus  domain.ItemStatus
+		hash         uint64
+		wantDistance int
+		wantFlag     bool
+	}{
+		{name: "identical", otherStatus: domain.ItemStatusOnSale, hash: original, wantFlag: true},
+		{name: "near", otherStatus: domain.ItemStatusOnSale, hash: original ^ 0b10101, wantDistance: 3, wantFlag: true},
+		{name: "at the distance", otherStatus: domain.ItemStatusOnSale, hash: original ^ 0b11111, wantDistance: 5, wantFlag: true},
+		{name: "too far", otherStatus: domain.ItemStatusOnSale, hash: original ^ 0b111111, wantFlag: false},
+		{name: "spread over every band", otherStatus: domain.ItemStatusOnSale, hash: original ^ 0x0100010001000100, wantDistance: 4, wantFlag: true},
+		{name: "same seller", sameSeller: true, otherStatus: domain.ItemStatusOnSale, hash: original, wantFlag: false},
+		{name: "original sold out", otherStatus: domain.ItemStatusSoldOut, hash: original, wantFlag: false},
+		{name: "original reserved", otherStatus: domain.ItemStatusReserved, hash: original, wantFlag: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			repo := NewItemRepository(sqlDB, imagestore.NewMemoryStore())
+			ctx := context.Background()
+			sellerID := addTestUser(t, sqlDB, 0)
+			copierID := addTestUser(t, sqlDB, 0)
+			if tt.sameSeller {
+				copierID = sellerID
+			}
+
+			add := func(userID int64, data string, hash uint64) domain.Item {
+				item, err := repo.AddItem(ctx, domain.Item{Name: "item", Price: 100, CategoryID: 1, UserID: userID, Status: domain.ItemStatusOnSale, Stock: 1}, []domain.Image{{ContentType: "image/png", Data: []byte(data), DHash: &hash}})
+				if err != nil {
+					t.Fatalf("failed to add item: %s", err)
+				}
+				return item
+			}
+			other := add(sellerID, "original", original)
+			if _, err := sqlDB.Exec("UPDATE items SET status = ? WHERE id = ?", tt.otherStatus, other.ID); err != nil {
+				t.Fatalf("failed to set status: %s", err)
+			}
+			copied := add(copierID, "copy", tt.hash)
+
+			flags, err := repo.GetDuplicateImageFlags(ctx, 10, 0)
+			if err != nil {
+				t.Fatalf("failed to get flags: %s", err)
+			}
+			if !tt.wantFlag {
+				if len(flags) != 0 {
+					t.Errorf("expected no flags, got %+v", flags)
+				}
+				return
+			}
+			if len(flags) != 1 {
+				t.Fatalf("expected one flag, got %+v", flags)
+			}
+			f := flags[0]
+			if f.ItemID != copied.ID || f.OtherItemID != other.ID || f.SellerID != copierID || f.OtherSellerID != sellerID || f.Distance != tt.wantDistance {
+				t.Errorf("unexpected flag %+v", f)
+			}
+		})
+	}
+}
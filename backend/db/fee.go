@@ -0,0 +1,39 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+)
+
+// DefaultFeeRule is the sale commission for categories that do not override
+// it. It is configured on startup.
+var DefaultFeeRule = domain.FeeRule{BasisPoints: 1000}
+
+// getCategoryFeeRule returns the fee rule of a category. Each part of the
+// rule falls back to DefaultFeeRule when the category leaves it NULL or does
+// not exist.
+func getCategoryFeeRule(ctx context.Context, q dbtx, categoryID int64) (domain.FeeRule, error) {
+	return scanFeeRule(q.QueryRowContext(ctx, "SELECT fee_bps, fee_flat FROM category WHERE id = ?", categoryID))
+}
+
+func getItemFeeRule(ctx context.Context, q dbtx, itemID int32) (domain.FeeRule, error) {
+	return scanFeeRule(q.QueryRowContext(ctx, "SELECT category.fee_bps, category.fee_flat FROM items LEFT JOIN category ON category.id = items.category_id WHERE items.id = ?", itemID))
+}
+
+func scanFeeRule(row rowScanner) (domain.FeeRule, error) {
+	var bps, flat sql.NullInt64
+	if err := row.Scan(&bps, &flat); err != nil && err != sql.ErrNoRows {
+		return domain.FeeRule{}, err
+	}
+
+	rule := DefaultFeeRule
+	if bps.Valid {
+		rule.BasisPoints = bps.Int64
+	}
+	if flat.Valid {
+		rule.Flat = flat.Int64
+	}
+	return rule, nil
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+)
+
+type IdempotencyRepository interface {
+	Reserve(ctx context.Context, userID int64, key string, requestHash string, ttl time.Duration) (domain.IdempotencyRecord, bool, error)
+	Complete(ctx context.Context, userID int64, key string, statusCode int, contentType string, body []byte) error
+	Release(ctx context.Context, userID int64, key string) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type IdempotencyDBRepository struct {
+	*sql.DB
+}
+
+func NewIdempotencyRepository(db *sql.DB) IdempotencyRepository {
+	return &IdempotencyDBRepository{DB: db}
+}
+
+// Reserve claims key for userID. It returns true when the key was free (or
+// had expired) and the caller should process the request, and false together
+// with the stored record when the key has been seen before.
+func (r *IdempotencyDBRepository) Reserve(ctx context.Context, userID int64, key string, requestHash string, ttl time.Duration) (domain.IdempotencyRecord, bool, error) {
+	var (
+		rec      domain.IdempotencyRecord
+		reserved bool
+	)
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE user_id = ? AND key = ? AND expires_at <= DATETIME('now', 'localtime')", userID, key); err != nil {
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, "INSERT INTO idempotency_keys (user_id, key, request_hash, expires_at) VALUES (?, ?, ?, DATETIME('now', 'localtime', ?)) ON CONFLICT DO NOTHING", userID, key, requestHash, secondsModifier(ttl))
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		reserved = n == 1
+
+		var (
+			statusCode  sql.NullInt64
+			contentType sql.NullString
+		)
+		row := tx.QueryRowContext(ctx, "SELECT user_id, key, request_hash, status_code, content_type, body, created_at, expires_at FROM idempotency_keys WHERE user_id = ? AND key = ?", userID, key)
+		if err := row.Scan(&rec.UserID, &rec.Key, &rec.RequestHash, &statusCode, &contentType, &rec.Body, &rec.CreatedAt, &rec.ExpiresAt); err != nil {
+			return err
+		}
+		rec.StatusCode = int(statusCode.Int64)
+		rec.ContentType = contentType.String
+		return nil
+	})
+	return rec, reserved, err
+}
+
+func (r *IdempotencyDBRepository) Complete(ctx context.Context, userID int64, key string, statusCode int, contentType string, body []byte) error {
+	if _, err := r.ExecContext(ctx, "UPDATE idempotency_keys SET status_code = ?, content_type = ?, body = ? WHERE user_id = ? AND key = ?", statusCode, contentType, body, userID, key); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Release forgets key so that the request can be retried, e.g. after a
+// server error.
+func (r *IdempotencyDBRepository) Release(ctx context.Context, userID int64, key string) error {
+	if _, err := r.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE user_id = ? AND key = ?", userID, key); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *IdempotencyDBRepository) DeleteExpired(ctx context.Context) (int64, error) {
+	res, err := r.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= DATETIME('now', 'localtime')")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
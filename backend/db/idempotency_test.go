@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyReserve(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewIdempotencyRepository(sqlDB)
+	ctx := context.Background()
+	userID := addTestUser(t, sqlDB, 0)
+	otherID := addTestUser(t, sqlDB, 0)
+
+	steps := []struct {
+		name         string
+		do           func() error
+		userID       int64
+		key          string
+		hash         string
+		ttl          time.Duration
+		wantReserved bool
+		wantHash     string
+		wantStatus   int
+	}{
+		{name: "first use", userID: userID, key: "a", hash: "h1", ttl: time.Hour, wantReserved: true, wantHash: "h1"},
+		{name: "in flight", userID: userID, key: "a", hash: "h1", ttl: time.Hour, wantHash: "h1"},
+		{name: "different body", userID: userID, key: "a", hash: "h2", ttl: time.Hour, wantHash: "h1"},
+		{name: "other user", userID: otherID, key: "a", hash: "h2", ttl: time.Hour, wantReserved: true, wantHash: "h2"},
+		{
+			name:       "replay",
+			do:         func() error { return repo.Complete(ctx, userID, "a", 200, "application/json", []byte(`{"id":1}`)) },
+			userID:     userID,
+			key:        "a",
+			hash:       "h1",
+			ttl:        time.Hour,
+			wantHash:   "h1",
+			wantStatus: 200,
+		},
+		{
+			name:   "released",
+			do:     func() error { return repo.Release(ctx, userID, "a") },
+			userID: userID,
+			key:    "a",
+			hash:   "h3",
+			// Expires at once so that the next step sees it expired.
+			ttl:          -time.Hour,
+			wantReserved: true,
+			wantHash:     "h3",
+		},
+		{name: "expired", userID: userID, key: "a", hash: "h4", ttl: time.Hour, wantReserved: true, wantHash: "h4"},
+	}
+	for _, step := range steps {
+		if step.do != nil {
+			if err := step.do(); err != nil {
+				t.Fatalf("%s: unexpected error: %s", step.name, err)
+			}
+		}
+		rec, reserved, err := repo.Reserve(ctx, step.userID, step.key, step.hash, step.ttl)
+		if err != nil {
+			t.Fatalf("%s: failed to reserve: %s", step.name, err)
+		}
+		if reserved != step.wantReserved {
+			t.Errorf("%s: expected reserved %t, got %t", step.name, step.wantReserved, reserved)
+		}
+		if rec.RequestHash != step.wantHash || rec.StatusCode != step.wantStatus {
+			t.Errorf("%s: expected hash %s and status %d, got %s and %d", step.name, step.wantHash, step.wantStatus, rec.RequestHash, rec.StatusCode)
+		}
+		if step.wantStatus != 0 && string(rec.Body) != `{"id":1}` {
+			t.Errorf("%s: expected the stored body, got %q", step.name, rec.Body)
+		}
+	}
+}
+
+func TestIdempotencyDeleteExpired(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewIdempotencyRepository(sqlDB)
+	ctx := context.Background()
+	userID := addTestUser(t, sqlDB, 0)
+
+	for key, ttl := range map[string]time.Duration{"old": -time.Minute, "older": -time.Hour, "new": time.Hour} {
+		if _, _, err := repo.Reserve(ctx, userID, key, "h", ttl); err != nil {
+			t.Fatalf("failed to reserve: %s", err)
+		}
+	}
+	deleted, err := repo.DeleteExpired(ctx)
+	if err != nil {
+		t.Fatalf("failed to delete expired keys: %s", err)
+	}
+	if deleted != 2 {
+		t.Errorf("expected 2 keys to be deleted, got %d", deleted)
+	}
+	if _, reserved, err := repo.Reserve(ctx, userID, "new", "h", time.Hour); err != nil || reserved {
+		t.Errorf("expected the live key to be kept, got reserved %t, %v", reserved, err)
+	}
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+)
+
+// imageBlobTables are the tables that kept image files in an "image" blob
+// column before the image store existed.
+var imageBlobTables = []struct {
+	name string
+	// byteSize tells whether the table records the file length.
+	byteSize bool
+}{
+	{"item_images", true},
+	{"item_image_variants", false},
+}
+
+// MigrateImageBlobs moves the image files that older databases keep in blob
+// columns into store, leaving their keys behind, and then drops the blob
+// columns. Covers still in items.image become the items' images at position
+// 0, as in MigrateItemCovers. It returns how many files it moved. Tables
+// already migrated are left alone, so it can be run again after a failure.
+func MigrateImageBlobs(ctx context.Context, sqlDB *sql.DB, store imagestore.Store) (int, error) {
+	moved, err := MigrateItemCovers(ctx, sqlDB, store)
+	if err != nil {
+		return moved, fmt.Errorf("failed to migrate items: %w", err)
+	}
+	for _, table := range imageBlobTables {
+		var n int
+		err := withTx(ctx, sqlDB, func(tx *sql.Tx) error {
+			var err error
+			n, err = migrateImageBlobTable(ctx, tx, store, table.name, table.byteSize)
+			return err
+		})
+		if err != nil {
+			return moved, fmt.Errorf("failed to migrate %s: %w", table.name, err)
+		}
+		moved += n
+	}
+	if moved > 0 {
+		// Give the space of the dropped blobs back to the file system.
+		if _, err := sqlDB.ExecContext(ctx, "VACUUM"); err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
+}
+
+func migrateImageBlobTable(ctx context.Context, tx *sql.Tx, store imagestore.Store, table string, byteSize bool) (int, error) {
+	columns, err := getColumns(ctx, tx, table)
+	if err != nil {
+		return 0, err
+	}
+	if !columns["image"] {
+		return 0, nil
+	}
+	if !columns["image_key"] {
+		if _, err := tx.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN image_key text NOT NULL DEFAULT ''"); err != nil {
+			return 0, err
+		}
+	}
+	if byteSize && !columns["byte_size"] {
+		if _, err := tx.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN byte_size integer NOT NULL DEFAULT 0"); err != nil {
+			return 0, err
+		}
+	}
+
+	// The row IDs are read up front so that no query is open while the
+	// rows are updated.
+	var rowIDs []int64
+	rows, err := tx.QueryContext(ctx, "SELECT rowid FROM "+table+" WHERE image_key = ''")
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var rowID int64
+		if err := rows.Scan(&rowID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		rowIDs = append(rowIDs, rowID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, rowID := range rowIDs {
+		var data []byte
+		if err := tx.QueryRowContext(ctx, "SELECT image FROM "+table+" WHERE rowid = ?", rowID).Scan(&data); err != nil {
+			return 0, err
+		}
+		key, err := store.Put(ctx, data)
+		if err != nil {
+			return 0, err
+		}
+		if byteSize {
+			_, err = tx.ExecContext(ctx, "UPDATE "+table+" SET image_key = ?, byte_size = ? WHERE rowid = ?", key, len(data), rowID)
+		} else {
+			_, err = tx.ExecContext(ctx, "UPDATE "+table+" SET image_key = ? WHERE rowid = ?", key, rowID)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE "+table+" DROP COLUMN image"); err != nil {
+		return 0, err
+	}
+	return len(rowIDs), nil
+}
+
+// getColumns returns the names of the table's columns.
+func getColumns(ctx context.Context, tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+)
+
+// SanitizeFunc returns the image with its metadata removed.
+type SanitizeFunc func(contentType string, data []byte) ([]byte, error)
+
+// SanitizeStoredImages runs sanitize over every stored item image and
+// replaces the images it changes. Their variants are dropped, to be made
+// again from the cleaned image when next requested, and the old files are
+// deleted once nothing refers to them. Images that sanitize rejects are
+// left as they are and counted as skipped.
+func SanitizeStoredImages(ctx context.Context, sqlDB *sql.DB, store imagestore.Store, sanitize SanitizeFunc) (sanitized int, skipped int, err error) {
+	type storedImage struct {
+		id          int64
+		contentType string
+		key         string
+	}
+	var images []storedImage
+	rows, err := sqlDB.QueryContext(ctx, "SELECT id, content_type, image_key FROM item_images ORDER BY id")
+	if err != nil {
+		return 0, 0, err
+	}
+	for rows.Next() {
+		var image storedImage
+		if err := rows.Scan(&image.id, &image.contentType, &image.key); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		images = append(images, image)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	for _, image := range images {
+		data, err := store.Get(ctx, image.key)
+		if err != nil {
+			return sanitized, skipped, err
+		}
+		clean, err := sanitize(image.contentType, data)
+		if err != nil {
+			skipped++
+			continue
+		}
+		if bytes.Equal(clean, data) {
+			continue
+		}
+
+		var replaced []string
+		err = withTx(ctx, sqlDB, func(tx *sql.Tx) error {
+			key, err := store.Put(ctx, clean)
+			if err != nil {
+				return err
+			}
+			// The image may have been replaced since it was read.
+			res, err := tx.ExecContext(ctx, "UPDATE item_images SET image_key = ?, byte_size = ? WHERE id = ? AND image_key = ?", key, len(clean), image.id, image.key)
+			if err != nil {
+				return err
+			}
+			if n, err := res.RowsAffected(); err != nil || n == 0 {
+				return err
+			}
+			replaced = append(replaced, image.key)
+
+			rows, err := tx.QueryContext(ctx, "SELECT image_key FROM item_image_variants WHERE image_id = ?", image.id)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var variantKey string
+				if err := rows.Scan(&variantKey); err != nil {
+					rows.Close()
+					return err
+				}
+				replaced = append(replaced, variantKey)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, "DELETE FROM item_image_variants WHERE image_id = ?", image.id)
+			return err
+		})
+		if err != nil {
+			return sanitized, skipped, err
+		}
+		if len(replaced) == 0 {
+			continue
+		}
+		sanitized++
+
+		for _, old := range replaced {
+			err := withTx(ctx, sqlDB, func(tx *sql.Tx) error {
+				return deleteUnusedImage(ctx, tx, store, old)
+			})
+			if err != nil {
+				return sanitized, skipped, err
+			}
+		}
+	}
+	return sanitized, skipped, nil
+}
+
+// deleteUnusedImage deletes the file stored under key unless an image or
+// variant still refers to it. tx holds the database's write lock, which
+// whoever stores a file keeps until the reference to it is committed, so a
+// file being uploaded again meanwhile is not deleted.
+func deleteUnusedImage(ctx context.Context, tx *sql.Tx, store imagestore.Store, key string) error {
+	var used bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM item_images WHERE image_key = ?) OR EXISTS (SELECT 1 FROM item_image_variants WHERE image_key = ?)", key, key).Scan(&used); err != nil {
+		return err
+	}
+	if used {
+		return nil
+	}
+	return store.Delete(ctx, key)
+}
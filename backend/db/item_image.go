@@ -0,0 +1,339 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrItemImageNotFound = errors.New("item image not found")
+	ErrInvalidImageOrder = errors.New("image order must list every image position once")
+	// ErrImageVariantNotFound means the rendition has not been generated yet.
+	ErrImageVariantNotFound = errors.New("image variant not found")
+)
+
+// GetItemImages describes the item's images in display order.
+func (r *ItemDBRepository) GetItemImages(ctx context.Context, itemID int32) ([]domain.ItemImage, error) {
+	rows, err := r.QueryContext(ctx, "SELECT item_images.id, item_images.item_id, item_images.position, item_images.content_type, item_images.byte_size, item_images.created_at FROM item_images JOIN items ON items.id = item_images.item_id WHERE item_images.item_id = ? AND items.status != ? ORDER BY item_images.position", itemID, domain.ItemStatusDeleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []domain.ItemImage
+	for rows.Next() {
+		var image domain.ItemImage
+		if err := rows.Scan(&image.ID, &image.ItemID, &image.Position, &image.ContentType, &image.Size, &image.CreatedAt); err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// GetItemImageAt returns the item's image at position, 0 being the cover,
+// without its data; see LoadImage.
+func (r *ItemDBRepository) GetItemImageAt(ctx context.Context, itemID int32, position int) (domain.Image, error) {
+	var image domain.Image
+	row := r.QueryRowContext(ctx, "SELECT item_images.id, item_images.content_type, item_images.image_key FROM item_images JOIN items ON items.id = item_images.item_id WHERE item_images.item_id = ? AND item_images.position = ? AND items.status != ?", itemID, position, domain.ItemStatusDeleted)
+	if err := row.Scan(&image.ID, &image.ContentType, &image.Key); err != nil {
+		if err == sql.ErrNoRows {
+			return image, ErrItemImageNotFound
+		}
+		return image, err
+	}
+	return image, nil
+}
+
+// GetItemImageVariant returns a stored rendition of the item's image at
+// position, without its data. It returns ErrImageVariantNotFound when the rendition is
+// missing, which includes when there is no such image.
+func (r *ItemDBRepository) GetItemImageVariant(ctx context.Context, itemID int32, position int, size domain.ImageSize) (domain.Image, error) {
+	var image domain.Image
+	row := r.QueryRowContext(ctx, "SELECT item_images.id, item_image_variants.content_type, item_image_variants.image_key FROM item_images JOIN items ON items.id = item_images.item_id JOIN item_image_variants ON item_image_variants.image_id = item_images.id WHERE item_images.item_id = ? AND item_images.position = ? AND item_image_variants.size = ? AND items.status != ?", itemID, position, size, domain.ItemStatusDeleted)
+	if err := row.Scan(&image.ID, &image.ContentType, &image.Key); err != nil {
+		if err == sql.ErrNoRows {
+			return image, ErrImageVariantNotFound
+		}
+		return image, err
+	}
+	return image, nil
+}
+
+// LoadImage reads the data of image from the image store.
+func (r *ItemDBRepository) LoadImage(ctx context.Context, image domain.Image) (domain.Image, error) {
+	data, err := r.Images.Get(ctx, image.Key)
+	if err != nil {
+		return image, errors.Wrapf(err, "failed to read image %s", image.Key)
+	}
+	image.Data = data
+	return image, nil
+}
+
+// AddItemImageVariant stores a rendition generated after the upload and
+// returns it with its key. A rendition stored meanwhile by another request
+// is kept. The file is stored inside the transaction, like in
+// insertItemImages, so that it cannot be deleted as unused before the row
+// refers to it.
+func (r *ItemDBRepository) AddItemImageVariant(ctx context.Context, imageID int64, size domain.ImageSize, variant domain.Image) (domain.Image, error) {
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		key, err := r.Images.Put(ctx, variant.Data)
+		if err != nil {
+			return err
+		}
+		variant.ID = imageID
+		variant.Key = key
+		_, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO item_image_variants (image_id, size, content_type, image_key) VALUES (?, ?, ?, ?)", imageID, size, variant.ContentType, key)
+		return err
+	})
+	return variant, err
+}
+
+// ReorderItemImages rearranges the seller's item images: order[i] is the
+// current position of the image to show at position i, so order[0] picks
+// the cover. version guards the change as in UpdateItem.
+func (r *ItemDBRepository) ReorderItemImages(ctx context.Context, itemID int32, sellerID int64, version int64, order []int) (domain.Item, error) {
+	var item domain.Item
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var err error
+		item, err = getEditableItem(ctx, tx, itemID, sellerID, version)
+		if err != nil {
+			return err
+		}
+
+		ids, err := getItemImageIDs(ctx, tx, itemID)
+		if err != nil {
+			return err
+		}
+		if len(order) != len(ids) {
+			return ErrInvalidImageOrder
+		}
+		seen := make([]bool, len(ids))
+		for _, position := range order {
+			if position < 0 || position >= len(ids) || seen[position] {
+				return ErrInvalidImageOrder
+			}
+			seen[position] = true
+		}
+
+		for i, position := range order {
+			if _, err := tx.ExecContext(ctx, "UPDATE item_images SET position = ? WHERE id = ?", i, ids[position]); err != nil {
+				return err
+			}
+		}
+		res, err := tx.ExecContext(ctx, "UPDATE items SET updated_at = DATETIME('now', 'localtime') WHERE id = ? AND version = ?", itemID, item.Version)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(res, ErrItemModified); err != nil {
+			return err
+		}
+		if err := addItemRevision(ctx, tx, itemID, sellerID, itemChangeEdit); err != nil {
+			return err
+		}
+		item, err = scanItem(tx.QueryRowContext(ctx, "SELECT "+itemColumns+" FROM items WHERE id = ?", itemID))
+		return err
+	})
+	return item, err
+}
+
+// getEditableItem returns the item if sellerID may edit it. A non-zero
+// version must match the item's; otherwise the current item is returned
+// together with ErrItemModified.
+func getEditableItem(ctx context.Context, tx *sql.Tx, id int32, sellerID int64, version int64) (domain.Item, error) {
+	item, err := scanItem(tx.QueryRowContext(ctx, "SELECT "+itemColumns+" FROM items WHERE id = ? AND status != ?", id, domain.ItemStatusDeleted))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return item, ErrItemNotFound
+		}
+		return item, err
+	}
+	if item.UserID != sellerID {
+		return item, ErrNotItemOwner
+	}
+	if version != 0 && version != item.Version {
+		return item, ErrItemModified
+	}
+	return item, nil
+}
+
+func getItemImageIDs(ctx context.Context, tx *sql.Tx, itemID int32) ([]int64, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM item_images WHERE item_id = ? ORDER BY position", itemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// insertItemImages stores images at positions 0 onwards, with their
+// variants, and flags those copied from other sellers. Files are put in the
+// image store right away; if the transaction fails they stay there
+// unreferenced, which is harmless. Holding the transaction's write lock
+// while they are stored keeps SanitizeStoredImages from deleting them.
+func insertItemImages(ctx context.Context, tx *sql.Tx, store imagestore.Store, itemID int32, images []domain.Image) error {
+	for i, image := range images {
+		key, err := store.Put(ctx, image.Data)
+		if err != nil {
+			return err
+		}
+		var dhash sql.NullInt64
+		if image.DHash != nil {
+			dhash = sql.NullInt64{Int64: int64(*image.DHash), Valid: true}
+		}
+		res, err := tx.ExecContext(ctx, "INSERT INTO item_images (item_id, position, content_type, image_key, byte_size, dhash) VALUES (?, ?, ?, ?, ?, ?)", itemID, i, image.ContentType, key, len(image.Data), dhash)
+		if err != nil {
+			return err
+		}
+		imageID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		if image.DHash != nil {
+			if err := indexImageHash(ctx, tx, itemID, imageID, *image.DHash); err != nil {
+				return err
+			}
+		}
+		for size, variant := range image.Variants {
+			key, err := store.Put(ctx, variant.Data)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, "INSERT INTO item_image_variants (image_id, size, content_type, image_key) VALUES (?, ?, ?, ?)", imageID, size, variant.ContentType, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteItemImages removes the item's images and their variants, and
+// returns the keys of their files.
+func deleteItemImages(ctx context.Context, tx *sql.Tx, itemID int32) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT image_key FROM item_images WHERE item_id = ? UNION SELECT item_image_variants.image_key FROM item_image_variants JOIN item_images ON item_images.id = item_image_variants.image_id WHERE item_images.item_id = ?", itemID, itemID)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM item_image_variants WHERE image_id IN (SELECT id FROM item_images WHERE item_id = ?)", itemID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM item_image_hash_bands WHERE image_id IN (SELECT id FROM item_images WHERE item_id = ?)", itemID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM item_images WHERE item_id = ?", itemID); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// evictImages drops replaced images from the image cache, if there is one.
+// The files stay in the store, as other items may share them.
+func (r *ItemDBRepository) evictImages(keys []string) {
+	if cache, ok := r.Images.(imagestore.Evicter); ok {
+		for _, key := range keys {
+			cache.Evict(key)
+		}
+	}
+}
+
+// legacyImageType is what GET /items/:itemID/image served every image as
+// before item_images existed.
+const legacyImageType = "image/jpeg"
+
+// MigrateItemCovers moves the covers that databases from before item_images
+// keep in items.image into store, as the items' images at position 0, and
+// drops the column. It returns how many covers it moved, and does nothing
+// once the column is gone.
+func MigrateItemCovers(ctx context.Context, sqlDB *sql.DB, store imagestore.Store) (int, error) {
+	var moved int
+	err := withTx(ctx, sqlDB, func(tx *sql.Tx) error {
+		var err error
+		moved, err = migrateItemCovers(ctx, tx, store)
+		return err
+	})
+	return moved, err
+}
+
+func migrateItemCovers(ctx context.Context, tx *sql.Tx, store imagestore.Store) (int, error) {
+	columns, err := getColumns(ctx, tx, "items")
+	if err != nil {
+		return 0, err
+	}
+	if !columns["image"] {
+		return 0, nil
+	}
+
+	// Items added since the upgrade have their images in item_images already.
+	var itemIDs []int32
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM items WHERE LENGTH(image) > 0 AND NOT EXISTS (SELECT 1 FROM item_images WHERE item_images.item_id = items.id)")
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var itemID int32
+		if err := rows.Scan(&itemID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		itemIDs = append(itemIDs, itemID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, itemID := range itemIDs {
+		var data []byte
+		if err := tx.QueryRowContext(ctx, "SELECT image FROM items WHERE id = ?", itemID).Scan(&data); err != nil {
+			return 0, err
+		}
+		contentType := http.DetectContentType(data)
+		if !strings.HasPrefix(contentType, "image/") {
+			contentType = legacyImageType
+		}
+		key, err := store.Put(ctx, data)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO item_images (item_id, position, content_type, image_key, byte_size) VALUES (?, 0, ?, ?, ?)", itemID, contentType, key, len(data)); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE items DROP COLUMN image"); err != nil {
+		return 0, err
+	}
+	return len(itemIDs), nil
+}
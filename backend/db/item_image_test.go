@@ -0,0 +1,388 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+	"github.com/pkg/errors"
+)
+
+// addTestItemWithImages lists an on-sale item with images whose data are
+// the given strings.
+func addTestItemWithImages(t *testing.T, repo ItemRepository, sellerID int64, images ...string) domain.Item {
+	t.Helper()
+
+	var uploads []domain.Image
+	for _, data := range images {
+		uploads = append(uploads, domain.Image{ContentType: "image/png", Data: []byte(data)})
+	}
+	item, err := repo.AddItem(context.Background(), domain.Item{Name: "item", Price: 100, CategoryID: 1, UserID: sellerID, Status: domain.ItemStatusOnSale, Stock: 1}, uploads)
+	if err != nil {
+		t.Fatalf("failed to add item: %s", err)
+	}
+	return item
+}
+
+// getTestImages returns the data of the item's images in order.
+func getTestImages(t *testing.T, repo ItemRepository, itemID int32) []string {
+	t.Helper()
+
+	ctx := context.Background()
+	images, err := repo.GetItemImages(ctx, itemID)
+	if err != nil {
+		t.Fatalf("failed to get images: %s", err)
+	}
+	var data []string
+	for _, image := range images {
+		stored, err := repo.GetItemImageAt(ctx, itemID, image.Position)
+		if err != nil {
+			t.Fatalf("failed to get image: %s", err)
+		}
+		stored, err = repo.LoadImage(ctx, stored)
+		if err != nil {
+			t.Fatalf("failed to load image: %s", err)
+		}
+		data = append(data, string(stored.Data))
+	}
+	return data
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReorderItemImages(t *testing.T) {
+	tests := []struct {
+		name    string
+		order   []int
+		wantErr error
+		want    []string
+	}{
+		{name: "new cover", order: []int{2, 0, 1}, want: []string{"c", "a", "b"}},
+		{name: "same order", order: []int{0, 1, 2}, want: []string{"a", "b", "c"}},
+		{name: "missing position", order: []int{1, 0}, wantErr: ErrInvalidImageOrder, want: []string{"a", "b", "c"}},
+		{name: "repeated position", order: []int{0, 0, 1}, wantErr: ErrInvalidImageOrder, want: []string{"a", "b", "c"}},
+		{name: "out of range", order: []int{0, 1, 3}, wantErr: ErrInvalidImageOrder, want: []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			repo := NewItemRepository(sqlDB, imagestore.NewMemoryStore())
+			sellerID := addTestUser(t, sqlDB, 0)
+			item := addTestItemWithImages(t, repo, sellerID, "a", "b", "c")
+
+			_, err := repo.ReorderItemImages(context.Background(), item.ID, sellerID, item.Version, tt.order)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if got := getTestImages(t, repo, item.ID); !equalStrings(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestReorderItemImagesStaleVersion(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewItemRepository(sqlDB, imagestore.NewMemoryStore())
+	sellerID := addTestUser(t, sqlDB, 0)
+	item := addTestItemWithImages(t, repo, sellerID, "a", "b")
+
+	if _, err := repo.ReorderItemImages(context.Background(), item.ID, sellerID, item.Version, []int{1, 0}); err != nil {
+		t.Fatalf("failed to reorder: %s", err)
+	}
+	if _, err := repo.ReorderItemImages(context.Background(), item.ID, sellerID, item.Version, []int{1, 0}); !errors.Is(err, ErrItemModified) {
+		t.Errorf("expected ErrItemModified, got %v", err)
+	}
+}
+
+func TestUpdateItemImages(t *testing.T) {
+	sqlDB := newTestDB(t)
+	store := imagestore.NewMemoryStore()
+	cache := imagestore.NewCachedStore(store, 1<<20)
+	repo := NewItemRepository(sqlDB, cache)
+	ctx := context.Background()
+	sellerID := addTestUser(t, sqlDB, 0)
+	item := addTestItemWithImages(t, repo, sellerID, "a", "b")
+	// Read the old cover so that it is cached.
+	if got := getTestImages(t, repo, item.ID); !equalStrings(got, []string{"a", "b"}) {
+		t.Fatalf("unexpected images %v", got)
+	}
+
+	if _, err := repo.UpdateItem(ctx, item.ID, sellerID, item.Version, domain.ItemPatch{Images: []domain.Image{{ContentType: "image/png", Data: []byte("c")}}}); err != nil {
+		t.Fatalf("failed to update item: %s", err)
+	}
+	if got := getTestImages(t, repo, item.ID); !equalStrings(got, []string{"c"}) {
+		t.Errorf("expected the images to be replaced, got %v", got)
+	}
+	if _, err := repo.GetItemImageAt(ctx, item.ID, 1); !errors.Is(err, ErrItemImageNotFound) {
+		t.Errorf("expected ErrItemImageNotFound, got %v", err)
+	}
+	// Other items may share the file, so it stays in the store.
+	if _, err := store.Get(ctx, imagestore.Key([]byte("a"))); err != nil {
+		t.Errorf("expected the old file to stay in the store: %v", err)
+	}
+}
+
+func TestItemImageVariants(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewItemRepository(sqlDB, imagestore.NewMemoryStore())
+	ctx := context.Background()
+	sellerID := addTestUser(t, sqlDB, 0)
+
+	item, err := repo.AddItem(ctx, domain.Item{Name: "item", Price: 100, CategoryID: 1, UserID: sellerID, Stock: 1}, []domain.Image{{
+		ContentType: "image/png",
+		Data:        []byte("original"),
+		Variants:    map[domain.ImageSize]domain.Image{domain.ImageSizeThumb: {ContentType: "image/png", Data: []byte("thumb")}},
+	}})
+	if err != nil {
+		t.Fatalf("failed to add item: %s", err)
+	}
+
+	tests := []struct {
+		size    domain.ImageSize
+		wantErr error
+		want    string
+	}{
+		{size: domain.ImageSizeThumb, want: "thumb"},
+		{size: domain.ImageSizeMedium, wantErr: ErrImageVariantNotFound},
+	}
+	for _, tt := range tests {
+		variant, err := repo.GetItemImageVariant(ctx, item.ID, 0, tt.size)
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%s: expected %v, got %v", tt.size, tt.wantErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		if variant, err = repo.LoadImage(ctx, variant); err != nil {
+			t.Fatalf("%s: failed to load: %s", tt.size, err)
+		}
+		if string(variant.Data) != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.size, tt.want, variant.Data)
+		}
+	}
+
+	// A rendition generated later is stored once; the first one wins.
+	cover, err := repo.GetItemImageAt(ctx, item.ID, 0)
+	if err != nil {
+		t.Fatalf("failed to get cover: %s", err)
+	}
+	for _, data := range []string{"medium", "medium again"} {
+		if _, err := repo.AddItemImageVariant(ctx, cover.ID, domain.ImageSizeMedium, domain.Image{ContentType: "image/png", Data: []byte(data)}); err != nil {
+			t.Fatalf("failed to add variant: %s", err)
+		}
+	}
+	medium, err := repo.GetItemImageVariant(ctx, item.ID, 0, domain.ImageSizeMedium)
+	if err != nil {
+		t.Fatalf("failed to get variant: %s", err)
+	}
+	if medium.Key != imagestore.Key([]byte("medium")) {
+		t.Errorf("expected the first rendition to be kept")
+	}
+}
+
+func TestMigrateItemCovers(t *testing.T) {
+	sqlDB := newTestDB(t)
+	store := imagestore.NewMemoryStore()
+	repo := NewItemRepository(sqlDB, store)
+	ctx := context.Background()
+	sellerID := addTestUser(t, sqlDB, 0)
+
+	if _, err := sqlDB.Exec("ALTER TABLE items ADD COLUMN image blob"); err != nil {
+		t.Fatalf("failed to add the legacy column: %s", err)
+	}
+	png := []byte("\x89PNG\r\n\x1a\n legacy png")
+	legacy := addTestItem(t, sqlDB, sellerID, 100)
+	unknown := addTestItem(t, sqlDB, sellerID, 100)
+	empty := addTestItem(t, sqlDB, sellerID, 100)
+	for itemID, data := range map[int32][]byte{legacy: png, unknown: []byte("not sniffable"), empty: {}} {
+		if _, err := sqlDB.Exec("UPDATE items SET image = ? WHERE id = ?", data, itemID); err != nil {
+			t.Fatalf("failed to set the legacy image: %s", err)
+		}
+	}
+	// Items added since the upgrade already have their images.
+	upgraded := addTestItemWithImages(t, repo, sellerID, "new cover")
+	if _, err := sqlDB.Exec("UPDATE items SET image = ? WHERE id = ?", png, upgraded.ID); err != nil {
+		t.Fatalf("failed to set the legacy image: %s", err)
+	}
+
+	moved, err := MigrateItemCovers(ctx, sqlDB, store)
+	if err != nil {
+		t.Fatalf("failed to migrate: %s", err)
+	}
+	if moved != 2 {
+		t.Errorf("expected 2 covers to move, got %d", moved)
+	}
+
+	tests := []struct {
+		itemID   int32
+		wantType string
+		want     []string
+	}{
+		{legacy, "image/png", []string{string(png)}},
+		{unknown, legacyImageType, []string{"not sniffable"}},
+		{empty, "", nil},
+		{upgraded.ID, "image/png", []string{"new cover"}},
+	}
+	for _, tt := range tests {
+		if got := getTestImages(t, repo, tt.itemID); !equalStrings(got, tt.want) {
+			t.Errorf("item %d: expected %q, got %q", tt.itemID, tt.want, got)
+		}
+		if tt.wantType == "" {
+			continue
+		}
+		cover, err := repo.GetItemImage(ctx, tt.itemID)
+		if err != nil {
+			t.Fatalf("item %d: failed to get cover: %s", tt.itemID, err)
+		}
+		if cover.ContentType != tt.wantType {
+			t.Errorf("item %d: expected %s, got %s", tt.itemID, tt.wantType, cover.ContentType)
+		}
+	}
+
+	// The column is gone, so running again does nothing.
+	if moved, err := MigrateItemCovers(ctx, sqlDB, store); err != nil || moved != 0 {
+		t.Errorf("expected nothing to move again, got %d, %v", moved, err)
+	}
+	err = withTx(ctx, sqlDB, func(tx *sql.Tx) error {
+		columns, err := getColumns(ctx, tx, "items")
+		if err == nil && columns["image"] {
+			t.Errorf("expected items.image to be dropped")
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to read columns: %s", err)
+	}
+}
+
+func TestMigrateItemCoversOnBaselineDB(t *testing.T) {
+	sqlDB := newBaselineTestDB(t)
+	store := imagestore.NewMemoryStore()
+	repo := NewItemRepository(sqlDB, store)
+	ctx := context.Background()
+	png := []byte("\x89PNG\r\n\x1a\n legacy png")
+	itemID := addTestItem(t, sqlDB, addTestUser(t, sqlDB, 0), 100)
+	if _, err := sqlDB.Exec("UPDATE items SET image = ? WHERE id = ?", png, itemID); err != nil {
+		t.Fatalf("failed to set the legacy image: %s", err)
+	}
+
+	// The server upgrades the schema before it moves the covers.
+	if err := prepareSchema(ctx, sqlDB, filepath.Join("..", "sql")); err != nil {
+		t.Fatalf("failed to upgrade: %s", err)
+	}
+	if moved, err := MigrateItemCovers(ctx, sqlDB, store); err != nil || moved != 1 {
+		t.Fatalf("expected 1 cover to move, got %d, %v", moved, err)
+	}
+
+	if got := getTestImages(t, repo, itemID); !equalStrings(got, []string{string(png)}) {
+		t.Errorf("expected the legacy cover, got %q", got)
+	}
+	cover, err := repo.GetItemImage(ctx, itemID)
+	if err != nil {
+		t.Fatalf("failed to get cover: %s", err)
+	}
+	if cover.ContentType != "image/png" {
+		t.Errorf("expected image/png, got %s", cover.ContentType)
+	}
+}
+
+func TestSanitizeStoredImages(t *testing.T) {
+	sqlDB := newTestDB(t)
+	store := imagestore.NewMemoryStore()
+	repo := NewItemRepository(sqlDB, store)
+	ctx := context.Background()
+	sellerID := addTestUser(t, sqlDB, 0)
+
+	dirty := addTestItemWithImages(t, repo, sellerID, "photo+gps", "clean")
+	// Another item shares the dirty file, which must survive until both
+	// are cleaned.
+	shared := addTestItemWithImages(t, repo, sellerID, "photo+gps")
+	broken := addTestItemWithImages(t, repo, sellerID, "broken")
+	cover, err := repo.GetItemImage(ctx, dirty.ID)
+	if err != nil {
+		t.Fatalf("failed to get cover: %s", err)
+	}
+	if _, err := repo.AddItemImageVariant(ctx, cover.ID, domain.ImageSizeThumb, domain.Image{ContentType: "image/png", Data: []byte("thumb+gps")}); err != nil {
+		t.Fatalf("failed to add variant: %s", err)
+	}
+
+	sanitize := func(contentType string, data []byte) ([]byte, error) {
+		if string(data) == "broken" {
+			return nil, errors.New("invalid image")
+		}
+		return bytes.TrimSuffix(data, []byte("+gps")), nil
+	}
+	sanitized, skipped, err := SanitizeStoredImages(ctx, sqlDB, store, sanitize)
+	if err != nil {
+		t.Fatalf("failed to sanitize: %s", err)
+	}
+	if sanitized != 2 || skipped != 1 {
+		t.Errorf("expected 2 sanitized and 1 skipped, got %d and %d", sanitized, skipped)
+	}
+
+	for itemID, want := range map[int32][]string{dirty.ID: {"photo", "clean"}, shared.ID: {"photo"}, broken.ID: {"broken"}} {
+		if got := getTestImages(t, repo, itemID); !equalStrings(got, want) {
+			t.Errorf("item %d: expected %v, got %v", itemID, want, got)
+		}
+	}
+	if _, err := repo.GetItemImageVariant(ctx, dirty.ID, 0, domain.ImageSizeThumb); !errors.Is(err, ErrImageVariantNotFound) {
+		t.Errorf("expected the variant to be dropped, got %v", err)
+	}
+	for _, data := range []string{"photo+gps", "thumb+gps"} {
+		if _, err := store.Get(ctx, imagestore.Key([]byte(data))); !errors.Is(err, imagestore.ErrNotFound) {
+			t.Errorf("expected %q to be deleted, got %v", data, err)
+		}
+	}
+
+	// Nothing is left to clean.
+	if sanitized, _, err := SanitizeStoredImages(ctx, sqlDB, store, sanitize); err != nil || sanitized != 0 {
+		t.Errorf("expected nothing to sanitize again, got %d, %v", sanitized, err)
+	}
+}
+
+func TestDeleteUnusedImage(t *testing.T) {
+	sqlDB := newTestDB(t)
+	store := imagestore.NewMemoryStore()
+	repo := NewItemRepository(sqlDB, store)
+	ctx := context.Background()
+	addTestItemWithImages(t, repo, addTestUser(t, sqlDB, 0), "used")
+	unused, err := store.Put(ctx, []byte("unused"))
+	if err != nil {
+		t.Fatalf("failed to store: %s", err)
+	}
+
+	tests := []struct {
+		key         string
+		wantDeleted bool
+	}{
+		{imagestore.Key([]byte("used")), false},
+		{unused, true},
+	}
+	for _, tt := range tests {
+		err := withTx(ctx, sqlDB, func(tx *sql.Tx) error {
+			return deleteUnusedImage(ctx, tx, store, tt.key)
+		})
+		if err != nil {
+			t.Fatalf("failed to delete: %s", err)
+		}
+		_, err = store.Get(ctx, tt.key)
+		if deleted := errors.Is(err, imagestore.ErrNotFound); deleted != tt.wantDeleted {
+			t.Errorf("%s: expected deleted %t, got %t", tt.key, tt.wantDeleted, deleted)
+		}
+	}
+}
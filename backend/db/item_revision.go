@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+)
+
+// Changes recorded in item revisions besides status events.
+const (
+	itemChangeCreate = "create"
+	itemChangeEdit   = "edit"
+)
+
+const itemRevisionColumns = "id, item_id, version, actor_id, change, name, price, description, category_id, image_hash, status, created_at"
+
+// GetItemRevisions lists the item's revisions, the latest first.
+func (r *ItemDBRepository) GetItemRevisions(ctx context.Context, itemID int32, limit, offset int) ([]domain.ItemRevision, error) {
+	rows, err := r.QueryContext(ctx, "SELECT "+itemRevisionColumns+" FROM item_revisions WHERE item_id = ? ORDER BY id desc LIMIT ? OFFSET ?", itemID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revisions []domain.ItemRevision
+	for rows.Next() {
+		var rev domain.ItemRevision
+		if err := rows.Scan(&rev.ID, &rev.ItemID, &rev.Version, &rev.ActorID, &rev.Change, &rev.Name, &rev.Price, &rev.Description, &rev.CategoryID, &rev.ImageHash, &rev.Status, &rev.CreatedAt); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+func (r *ItemDBRepository) CountItemRevisions(ctx context.Context, itemID int32) (int64, error) {
+	var count int64
+	return count, r.QueryRowContext(ctx, "SELECT COUNT(*) FROM item_revisions WHERE item_id = ?", itemID).Scan(&count)
+}
+
+// addItemRevision snapshots the item as it is now. It must run after the
+// change in the same transaction.
+func addItemRevision(ctx context.Context, tx *sql.Tx, itemID int32, actorID int64, change string) error {
+	var rev domain.ItemRevision
+	row := tx.QueryRowContext(ctx, "SELECT version, name, price, description, category_id, status FROM items WHERE id = ?", itemID)
+	if err := row.Scan(&rev.Version, &rev.Name, &rev.Price, &rev.Description, &rev.CategoryID, &rev.Status); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrItemNotFound
+		}
+		return err
+	}
+	imageHash, err := hashItemImages(ctx, tx, itemID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO item_revisions (item_id, version, actor_id, change, name, price, description, category_id, image_hash, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		itemID, rev.Version, actorID, change, rev.Name, rev.Price, rev.Description, rev.CategoryID, imageHash, rev.Status)
+	return err
+}
+
+// hashItemImages returns the hex SHA-256 over the SHA-256 of each of the
+// item's images in order, so that reordering changes it too. The image
+// keys are those SHA-256s.
+func hashItemImages(ctx context.Context, tx *sql.Tx, itemID int32) (string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT image_key FROM item_images WHERE item_id = ? ORDER BY position", itemID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	h := sha256.New()
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return "", err
+		}
+		sum, err := hex.DecodeString(key)
+		if err != nil {
+			return "", err
+		}
+		h.Write(sum)
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// latestItemRevisionID returns the ID of the item's current revision, or 0
+// for items listed before revisions were kept.
+func latestItemRevisionID(ctx context.Context, q dbtx, itemID int32) (int64, error) {
+	var id int64
+	return id, q.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM item_revisions WHERE item_id = ?", itemID).Scan(&id)
+}
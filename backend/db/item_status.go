@@ -0,0 +1,103 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotItemOwner   = errors.New("item does not belong to the user")
+	ErrAuctionHasBids = errors.New("auction already has bids")
+)
+
+// ChangeItemStatus applies a seller's event (sell, unlist, relist or delete)
+// to their item and returns the updated item. Auctions cannot be unlisted or
+// deleted once they have bids, and cannot go on sale after they ended or
+// without an end time, unless endsAt gives them a new one. An empty endsAt
+// keeps the current end time; fixed-price items ignore it. Deleted items are
+// reported as not found.
+func (r *ItemDBRepository) ChangeItemStatus(ctx context.Context, id int32, sellerID int64, event domain.ItemEvent, endsAt string) (domain.Item, error) {
+	var item domain.Item
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var (
+			ended bool
+			err   error
+		)
+		row := tx.QueryRowContext(ctx, "SELECT seller_id, status, listing_type, COALESCE(ends_at <= DATETIME('now', 'localtime'), 1) FROM items WHERE id = ?", id)
+		if err := row.Scan(&item.UserID, &item.Status, &item.ListingType, &ended); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrItemNotFound
+			}
+			return err
+		}
+		if item.Status == domain.ItemStatusDeleted {
+			return ErrItemNotFound
+		}
+		if item.UserID != sellerID {
+			return ErrNotItemOwner
+		}
+
+		if item.ListingType == domain.ListingTypeAuction {
+			switch event {
+			case domain.ItemEventSell, domain.ItemEventRelist:
+				if endsAt != "" {
+					if _, err := tx.ExecContext(ctx, "UPDATE items SET ends_at = ? WHERE id = ?", endsAt, id); err != nil {
+						return err
+					}
+					ended = false
+				}
+				if ended {
+					return ErrAuctionEnded
+				}
+			case domain.ItemEventUnlist, domain.ItemEventDelete:
+				if item.Status == domain.ItemStatusOnSale {
+					if _, err := getHighestBid(ctx, tx, id); err == nil {
+						return ErrAuctionHasBids
+					} else if err != ErrBidNotFound {
+						return err
+					}
+				}
+			}
+		}
+
+		if _, err := transitionItem(ctx, tx, id, sellerID, event); err != nil {
+			return err
+		}
+		item, err = scanItem(tx.QueryRowContext(ctx, "SELECT "+itemColumns+" FROM items WHERE id = ?", id))
+		return err
+	})
+	return item, err
+}
+
+// transitionItem moves the item to its next status on event, as declared by
+// the domain state machine, records the revision and returns the new status.
+// Events the current status does not allow return an error wrapping
+// domain.ErrInvalidItemTransition.
+func transitionItem(ctx context.Context, tx *sql.Tx, itemID int32, actorID int64, event domain.ItemEvent) (domain.ItemStatus, error) {
+	var status domain.ItemStatus
+	if err := tx.QueryRowContext(ctx, "SELECT status FROM items WHERE id = ?", itemID).Scan(&status); err != nil {
+		if err == sql.ErrNoRows {
+			return status, ErrItemNotFound
+		}
+		return status, err
+	}
+
+	next, err := status.Next(event)
+	if err != nil {
+		return status, err
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE items SET status = ? WHERE id = ? AND status = ?", next, itemID, status)
+	if err != nil {
+		return status, err
+	}
+	if err := expectOneRow(res, ErrItemNotFound); err != nil {
+		return status, err
+	}
+	if err := addItemRevision(ctx, tx, itemID, actorID, event.String()); err != nil {
+		return status, err
+	}
+	return next, nil
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+	"github.com/pkg/errors"
+)
+
+func TestChangeItemStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  domain.ItemStatus
+		auction bool
+		// ended auctions have passed their end time, and bid ones have a bid.
+		ended bool
+		bid   bool
+		// newEnd gives the auction a new end time.
+		newEnd     bool
+		seller     string
+		event      domain.ItemEvent
+		wantErr    error
+		wantStatus domain.ItemStatus
+	}{
+		{name: "sell", status: domain.ItemStatusInitial, seller: "seller", event: domain.ItemEventSell, wantStatus: domain.ItemStatusOnSale},
+		{name: "sell twice", status: domain.ItemStatusOnSale, seller: "seller", event: domain.ItemEventSell, wantErr: domain.ErrInvalidItemTransition, wantStatus: domain.ItemStatusOnSale},
+		{name: "unlist", status: domain.ItemStatusOnSale, seller: "seller", event: domain.ItemEventUnlist, wantStatus: domain.ItemStatusPaused},
+		{name: "relist", status: domain.ItemStatusPaused, seller: "seller", event: domain.ItemEventRelist, wantStatus: domain.ItemStatusOnSale},
+		{name: "delete", status: domain.ItemStatusSoldOut, seller: "seller", event: domain.ItemEventDelete, wantStatus: domain.ItemStatusDeleted},
+		{name: "deleted", status: domain.ItemStatusDeleted, seller: "seller", event: domain.ItemEventRelist, wantErr: ErrItemNotFound, wantStatus: domain.ItemStatusDeleted},
+		{name: "unlist reserved", status: domain.ItemStatusReserved, seller: "seller", event: domain.ItemEventUnlist, wantErr: domain.ErrInvalidItemTransition, wantStatus: domain.ItemStatusReserved},
+		{name: "other user", status: domain.ItemStatusInitial, seller: "other", event: domain.ItemEventSell, wantErr: ErrNotItemOwner, wantStatus: domain.ItemStatusInitial},
+		{name: "sell ended auction", status: domain.ItemStatusInitial, auction: true, ended: true, seller: "seller", event: domain.ItemEventSell, wantErr: ErrAuctionEnded, wantStatus: domain.ItemStatusInitial},
+		{name: "sell ended auction with a new end", status: domain.ItemStatusInitial, auction: true, ended: true, newEnd: true, seller: "seller", event: domain.ItemEventSell, wantStatus: domain.ItemStatusOnSale},
+		{name: "relist ended auction with a new end", status: domain.ItemStatusPaused, auction: true, ended: true, newEnd: true, seller: "seller", event: domain.ItemEventRelist, wantStatus: domain.ItemStatusOnSale},
+		{name: "unlist auction without bids", status: domain.ItemStatusOnSale, auction: true, seller: "seller", event: domain.ItemEventUnlist, wantStatus: domain.ItemStatusPaused},
+		{name: "unlist auction with bids", status: domain.ItemStatusOnSale, auction: true, bid: true, seller: "seller", event: domain.ItemEventUnlist, wantErr: ErrAuctionHasBids, wantStatus: domain.ItemStatusOnSale},
+		{name: "delete auction with bids", status: domain.ItemStatusOnSale, auction: true, bid: true, seller: "seller", event: domain.ItemEventDelete, wantErr: ErrAuctionHasBids, wantStatus: domain.ItemStatusOnSale},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			repo := NewItemRepository(sqlDB, imagestore.NewMemoryStore())
+			ctx := context.Background()
+			users := map[string]int64{"seller": addTestUser(t, sqlDB, 0), "other": addTestUser(t, sqlDB, 0)}
+
+			itemID := addTestItem(t, sqlDB, users["seller"], 100)
+			if tt.auction {
+				endsIn := time.Hour
+				if tt.ended {
+					endsIn = -time.Minute
+				}
+				itemID = addTestAuction(t, sqlDB, users["seller"], 100, 10, endsIn)
+			}
+			if tt.bid {
+				bidderID := addTestUser(t, sqlDB, 0)
+				if err := NewLedgerRepository(sqlDB).TopUp(ctx, bidderID, 100); err != nil {
+					t.Fatalf("failed to top up: %s", err)
+				}
+				if _, err := NewAuctionRepository(sqlDB).PlaceBid(ctx, itemID, bidderID, 100); err != nil {
+					t.Fatalf("failed to bid: %s", err)
+				}
+			}
+			if _, err := sqlDB.Exec("UPDATE items SET status = ? WHERE id = ?", tt.status, itemID); err != nil {
+				t.Fatalf("failed to set status: %s", err)
+			}
+
+			var endsAt string
+			if tt.newEnd {
+				endsAt = time.Now().Add(time.Hour).Format("2006-01-02 15:04:05")
+			}
+			item, err := repo.ChangeItemStatus(ctx, itemID, users[tt.seller], tt.event, endsAt)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && item.Status != tt.wantStatus {
+				t.Errorf("expected the returned item in status %d, got %d", tt.wantStatus, item.Status)
+			}
+			if err == nil && tt.newEnd && item.EndsAt != endsAt {
+				t.Errorf("expected the auction to end at %s, got %s", endsAt, item.EndsAt)
+			}
+			var status domain.ItemStatus
+			if err := sqlDB.QueryRow("SELECT status FROM items WHERE id = ?", itemID).Scan(&status); err != nil {
+				t.Fatalf("failed to get item: %s", err)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, status)
+			}
+		})
+	}
+}
+
+func TestUpdateItemVersion(t *testing.T) {
+	name := "renamed"
+	tests := []struct {
+		name    string
+		seller  string
+		version func(current int64) int64
+		wantErr error
+	}{
+		{name: "current version", seller: "seller", version: func(current int64) int64 { return current }},
+		{name: "no version", seller: "seller", version: func(int64) int64 { return 0 }},
+		{name: "stale version", seller: "seller", version: func(current int64) int64 { return current - 1 }, wantErr: ErrItemModified},
+		{name: "other user", seller: "other", version: func(current int64) int64 { return current }, wantErr: ErrNotItemOwner},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			repo := NewItemRepository(sqlDB, imagestore.NewMemoryStore())
+			ctx := context.Background()
+			users := map[string]int64{"seller": addTestUser(t, sqlDB, 0), "other": addTestUser(t, sqlDB, 0)}
+			itemID := addTestItem(t, sqlDB, users["seller"], 100)
+			// Bump the version past 1 so that a stale one is still valid.
+			if _, err := sqlDB.Exec("UPDATE items SET price = 200 WHERE id = ?", itemID); err != nil {
+				t.Fatalf("failed to update item: %s", err)
+			}
+			before, err := repo.GetItem(ctx, itemID)
+			if err != nil {
+				t.Fatalf("failed to get item: %s", err)
+			}
+
+			item, err := repo.UpdateItem(ctx, itemID, users[tt.seller], tt.version(before.Version), domain.ItemPatch{Name: &name})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if tt.wantErr != nil {
+				// The current item comes back so that the client can merge.
+				if item.Version != before.Version || item.Name != before.Name {
+					t.Errorf("expected the unchanged item, got %+v", item)
+				}
+				return
+			}
+			if item.Name != name || item.Price != 200 {
+				t.Errorf("expected only the name to change, got %+v", item)
+			}
+			if item.Version != before.Version+1 {
+				t.Errorf("expected version %d, got %d", before.Version+1, item.Version)
+			}
+		})
+	}
+}
+
+func TestItemRevisions(t *testing.T) {
+	sqlDB := newTestDB(t)
+	store := imagestore.NewMemoryStore()
+	repo := NewItemRepository(sqlDB, store)
+	ctx := context.Background()
+	sellerID := addTestUser(t, sqlDB, 0)
+	buyerID := addTestUser(t, sqlDB, 1000)
+
+	item, err := repo.AddItem(ctx, domain.Item{Name: "item", Price: 100, CategoryID: 1, UserID: sellerID, Stock: 1}, []domain.Image{
+		{ContentType: "image/png", Data: []byte("cover")},
+		{ContentType: "image/png", Data: []byte("side")},
+	})
+	if err != nil {
+		t.Fatalf("failed to add item: %s", err)
+	}
+	price := int64(150)
+	if _, err := repo.UpdateItem(ctx, item.ID, sellerID, 0, domain.ItemPatch{Price: &price}); err != nil {
+		t.Fatalf("failed to update item: %s", err)
+	}
+	if _, err := repo.ReorderItemImages(ctx, item.ID, sellerID, 0, []int{1, 0}); err != nil {
+		t.Fatalf("failed to reorder images: %s", err)
+	}
+	if _, err := repo.ChangeItemStatus(ctx, item.ID, sellerID, domain.ItemEventSell, ""); err != nil {
+		t.Fatalf("failed to sell: %s", err)
+	}
+	order := buyTestItem(t, sqlDB, buyerID, item.ID)
+
+	revisions, err := repo.GetItemRevisions(ctx, item.ID, 10, 0)
+	if err != nil {
+		t.Fatalf("failed to get revisions: %s", err)
+	}
+	want := []struct {
+		change  string
+		actorID int64
+		price   int64
+		status  domain.ItemStatus
+	}{
+		{domain.ItemEventSellOut.String(), buyerID, 150, domain.ItemStatusSoldOut},
+		{domain.ItemEventSell.String(), sellerID, 150, domain.ItemStatusOnSale},
+		{itemChangeEdit, sellerID, 150, domain.ItemStatusInitial},
+		{itemChangeEdit, sellerID, 150, domain.ItemStatusInitial},
+		{itemChangeCreate, sellerID, 100, domain.ItemStatusInitial},
+	}
+	if len(revisions) != len(want) {
+		t.Fatalf("expected %d revisions, got %d", len(want), len(revisions))
+	}
+	for i, w := range want {
+		rev := revisions[i]
+		if rev.Change != w.change || rev.ActorID != w.actorID || rev.Price != w.price || rev.Status != w.status {
+			t.Errorf("revision %d: expected %+v, got %+v", i, w, rev)
+		}
+		if i > 0 && rev.Version >= revisions[i-1].Version {
+			t.Errorf("revision %d: expected versions to increase, got %d after %d", i, revisions[i-1].Version, rev.Version)
+		}
+	}
+	// Reordering the images changes the hash; editing the price does not.
+	if revisions[3].ImageHash != revisions[4].ImageHash {
+		t.Errorf("expected the price edit to keep the image hash")
+	}
+	if revisions[2].ImageHash == revisions[3].ImageHash {
+		t.Errorf("expected reordering to change the image hash")
+	}
+	if order.ItemRevisionID != revisions[1].ID {
+		t.Errorf("expected the order to refer to the revision the buyer saw, %d, got %d", revisions[1].ID, order.ItemRevisionID)
+	}
+
+	count, err := repo.CountItemRevisions(ctx, item.ID)
+	if err != nil {
+		t.Fatalf("failed to count revisions: %s", err)
+	}
+	if count != int64(len(want)) {
+		t.Errorf("expected %d revisions, got %d", len(want), count)
+	}
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"math"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrLedgerMismatch  = errors.New("cached balance does not match the ledger")
+	ErrBalanceOverflow = errors.New("balance would overflow")
+)
+
+type LedgerRepository interface {
+	TopUp(ctx context.Context, userID int64, amount int64) error
+	GetEntries(ctx context.Context, accountID int64, limit, offset int) ([]domain.LedgerEntry, error)
+	CountEntries(ctx context.Context, accountID int64) (int64, error)
+}
+
+type LedgerDBRepository struct {
+	*sql.DB
+}
+
+func NewLedgerRepository(db *sql.DB) LedgerRepository {
+	return &LedgerDBRepository{DB: db}
+}
+
+// posting is one side of a journal: amount is added to the balance of
+// accountID (negative amounts are debits).
+type posting struct {
+	AccountID int64
+	Kind      domain.LedgerEntryKind
+	Amount    int64
+}
+
+func (r *LedgerDBRepository) TopUp(ctx context.Context, userID int64, amount int64) error {
+	return withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		return postJournal(ctx, tx, 0,
+			posting{AccountID: domain.AccountExternal, Kind: domain.LedgerEntryTopUp, Amount: -amount},
+			posting{AccountID: userID, Kind: domain.LedgerEntryTopUp, Amount: amount},
+		)
+	})
+}
+
+func (r *LedgerDBRepository) GetEntries(ctx context.Context, accountID int64, limit, offset int) ([]domain.LedgerEntry, error) {
+	rows, err := r.QueryContext(ctx, "SELECT id, journal_id, account_id, kind, amount, balance_after, COALESCE(item_id, 0), created_at FROM ledger_entries WHERE account_id = ? ORDER BY id desc LIMIT ? OFFSET ?", accountID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []domain.LedgerEntry
+	for rows.Next() {
+		var entry domain.LedgerEntry
+		if err := rows.Scan(&entry.ID, &entry.JournalID, &entry.AccountID, &entry.Kind, &entry.Amount, &entry.BalanceAfter, &entry.ItemID, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (r *LedgerDBRepository) CountEntries(ctx context.Context, accountID int64) (int64, error) {
+	row := r.QueryRowContext(ctx, "SELECT COUNT(*) FROM ledger_entries WHERE account_id = ?", accountID)
+
+	var count int64
+	return count, row.Scan(&count)
+}
+
+// postJournal records postings as one journal inside tx. The postings must
+// sum to zero. User balances are updated together with their entries and may
+// not go below zero; system accounts may.
+func postJournal(ctx context.Context, tx *sql.Tx, itemID int32, postings ...posting) error {
+	var sum int64
+	for _, p := range postings {
+		sum += p.Amount
+	}
+	if sum != 0 {
+		return errors.Errorf("unbalanced journal: postings sum to %d", sum)
+	}
+
+	res, err := tx.ExecContext(ctx, "INSERT INTO ledger_journals DEFAULT VALUES")
+	if err != nil {
+		return err
+	}
+	journalID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	var item sql.NullInt32
+	if itemID != 0 {
+		item = sql.NullInt32{Int32: itemID, Valid: true}
+	}
+
+	for _, p := range postings {
+		balance, err := applyPosting(ctx, tx, p)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO ledger_entries (journal_id, account_id, kind, amount, balance_after, item_id) VALUES (?, ?, ?, ?, ?, ?)", journalID, p.AccountID, p.Kind, p.Amount, balance, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyPosting adds the posting to the account balance and returns the new
+// balance.
+func applyPosting(ctx context.Context, tx *sql.Tx, p posting) (int64, error) {
+	var last sql.NullInt64
+	row := tx.QueryRowContext(ctx, "SELECT balance_after FROM ledger_entries WHERE account_id = ? ORDER BY id desc LIMIT 1", p.AccountID)
+	if err := row.Scan(&last); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	if p.AccountID < 0 {
+		return last.Int64 + p.Amount, nil
+	}
+
+	var balance int64
+	row = tx.QueryRowContext(ctx, "SELECT balance FROM users WHERE id = ?", p.AccountID)
+	if err := row.Scan(&balance); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, ErrUserNotFound
+		}
+		return 0, err
+	}
+	// Balances seeded before the ledger existed have no entries to check.
+	if last.Valid && last.Int64 != balance {
+		return 0, errors.Wrapf(ErrLedgerMismatch, "user %d", p.AccountID)
+	}
+	if p.Amount > 0 && balance > math.MaxInt64-p.Amount {
+		return 0, ErrBalanceOverflow
+	}
+	if balance+p.Amount < 0 {
+		return 0, ErrInsufficientBalance
+	}
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET balance = balance + ? WHERE id = ? AND balance + ? >= 0", p.Amount, p.AccountID, p.Amount)
+	if err != nil {
+		return 0, err
+	}
+	if err := expectOneRow(res, ErrInsufficientBalance); err != nil {
+		return 0, err
+	}
+	return balance + p.Amount, nil
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+func TestPostJournal(t *testing.T) {
+	tests := []struct {
+		name        string
+		balance     int64
+		amount      int64
+		setup       func(t *testing.T, sqlDB *sql.DB, userID int64)
+		wantErr     error
+		wantBalance int64
+	}{
+		{name: "credit", balance: 100, amount: 50, wantBalance: 150},
+		{name: "debit", balance: 100, amount: -100, wantBalance: 0},
+		{name: "insufficient balance", balance: 100, amount: -101, wantErr: ErrInsufficientBalance, wantBalance: 100},
+		{name: "overflow", balance: math.MaxInt64 - 10, amount: 11, wantErr: ErrBalanceOverflow, wantBalance: math.MaxInt64 - 10},
+		{
+			name:    "balance changed outside the ledger",
+			balance: 100,
+			amount:  10,
+			setup: func(t *testing.T, sqlDB *sql.DB, userID int64) {
+				if err := NewLedgerRepository(sqlDB).TopUp(context.Background(), userID, 1); err != nil {
+					t.Fatalf("failed to top up: %s", err)
+				}
+				if _, err := sqlDB.Exec("UPDATE users SET balance = 1000 WHERE id = ?", userID); err != nil {
+					t.Fatalf("failed to set balance: %s", err)
+				}
+			},
+			wantErr:     ErrLedgerMismatch,
+			wantBalance: 1000,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			userID := addTestUser(t, sqlDB, tt.balance)
+			if tt.setup != nil {
+				tt.setup(t, sqlDB, userID)
+			}
+
+			err := withTx(context.Background(), sqlDB, func(tx *sql.Tx) error {
+				return postJournal(context.Background(), tx, 0,
+					posting{AccountID: domain.AccountExternal, Kind: domain.LedgerEntryTopUp, Amount: -tt.amount},
+					posting{AccountID: userID, Kind: domain.LedgerEntryTopUp, Amount: tt.amount},
+				)
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if balance := getTestBalance(t, sqlDB, userID); balance != tt.wantBalance {
+				t.Errorf("expected balance %d, got %d", tt.wantBalance, balance)
+			}
+		})
+	}
+}
+
+func TestPostJournalUnbalanced(t *testing.T) {
+	sqlDB := newTestDB(t)
+	userID := addTestUser(t, sqlDB, 0)
+
+	err := withTx(context.Background(), sqlDB, func(tx *sql.Tx) error {
+		return postJournal(context.Background(), tx, 0,
+			posting{AccountID: domain.AccountExternal, Kind: domain.LedgerEntryTopUp, Amount: -100},
+			posting{AccountID: userID, Kind: domain.LedgerEntryTopUp, Amount: 90},
+		)
+	})
+	if err == nil {
+		t.Fatalf("expected an unbalanced journal to be refused")
+	}
+	var entries int
+	if err := sqlDB.QueryRow("SELECT COUNT(*) FROM ledger_entries").Scan(&entries); err != nil {
+		t.Fatalf("failed to count entries: %s", err)
+	}
+	if entries != 0 {
+		t.Errorf("expected no entries, got %d", entries)
+	}
+}
+
+func TestTopUpEntries(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewLedgerRepository(sqlDB)
+	userID := addTestUser(t, sqlDB, 0)
+
+	for _, amount := range []int64{100, 250} {
+		if err := repo.TopUp(context.Background(), userID, amount); err != nil {
+			t.Fatalf("failed to top up: %s", err)
+		}
+	}
+
+	count, err := repo.CountEntries(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("failed to count entries: %s", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 entries, got %d", count)
+	}
+	entries, err := repo.GetEntries(context.Background(), userID, 10, 0)
+	if err != nil {
+		t.Fatalf("failed to get entries: %s", err)
+	}
+	if len(entries) != 2 || entries[0].Amount != 250 || entries[0].BalanceAfter != 350 || entries[1].BalanceAfter != 100 {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+	external, err := repo.GetEntries(context.Background(), domain.AccountExternal, 1, 0)
+	if err != nil {
+		t.Fatalf("failed to get entries: %s", err)
+	}
+	if len(external) != 1 || external[0].BalanceAfter != -350 {
+		t.Errorf("expected the external account at -350, got %+v", external)
+	}
+}
@@ -0,0 +1,232 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+// DefaultLimits apply to users without overrides. They are configured on
+// startup.
+var DefaultLimits = domain.Limits{
+	MaxBalance:     10000000,
+	DailyTopUp:     1000000,
+	MonthlyTopUp:   5000000,
+	MaxPurchase:    1000000,
+	PurchaseBurst:  20,
+	PurchaseWindow: 10 * time.Minute,
+	TopUpBurst:     5,
+	TopUpWindow:    10 * time.Minute,
+}
+
+// LimitError is returned when a request would break one of the user's
+// limits. Attempted is the amount or count of the refused request.
+type LimitError struct {
+	Rule      domain.LimitRule
+	Limit     int64
+	Attempted int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %d against a limit of %d", e.Rule, e.Attempted, e.Limit)
+}
+
+type LimitRepository interface {
+	GetLimits(ctx context.Context, userID int64) (domain.Limits, error)
+	GetOverrides(ctx context.Context, userID int64) (domain.LimitOverrides, error)
+	SetOverrides(ctx context.Context, userID int64, overrides domain.LimitOverrides) error
+	GetViolations(ctx context.Context, userID int64, limit, offset int) ([]domain.LimitViolation, error)
+	CountViolations(ctx context.Context, userID int64) (int64, error)
+}
+
+type LimitDBRepository struct {
+	*sql.DB
+}
+
+func NewLimitRepository(db *sql.DB) LimitRepository {
+	return &LimitDBRepository{DB: db}
+}
+
+func (r *LimitDBRepository) GetLimits(ctx context.Context, userID int64) (domain.Limits, error) {
+	return getLimits(ctx, r.DB, userID)
+}
+
+func (r *LimitDBRepository) GetOverrides(ctx context.Context, userID int64) (domain.LimitOverrides, error) {
+	return getLimitOverrides(ctx, r.DB, userID)
+}
+
+// SetOverrides replaces all of the user's overrides.
+func (r *LimitDBRepository) SetOverrides(ctx context.Context, userID int64, o domain.LimitOverrides) error {
+	return withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrUserNotFound
+		}
+
+		_, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO user_limits (user_id, max_balance, daily_top_up, monthly_top_up, max_purchase, purchase_burst, top_up_burst) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			userID, o.MaxBalance, o.DailyTopUp, o.MonthlyTopUp, o.MaxPurchase, o.PurchaseBurst, o.TopUpBurst)
+		return err
+	})
+}
+
+// GetViolations lists refused requests, the latest first. A userID of 0
+// lists every user's.
+func (r *LimitDBRepository) GetViolations(ctx context.Context, userID int64, limit, offset int) ([]domain.LimitViolation, error) {
+	rows, err := r.QueryContext(ctx, "SELECT id, user_id, rule, limit_value, attempted, created_at FROM limit_violations WHERE ? = 0 OR user_id = ? ORDER BY id desc LIMIT ? OFFSET ?", userID, userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var violations []domain.LimitViolation
+	for rows.Next() {
+		var v domain.LimitViolation
+		if err := rows.Scan(&v.ID, &v.UserID, &v.Rule, &v.Limit, &v.Attempted, &v.CreatedAt); err != nil {
+			return nil, err
+		}
+		violations = append(violations, v)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return violations, nil
+}
+
+func (r *LimitDBRepository) CountViolations(ctx context.Context, userID int64) (int64, error) {
+	var count int64
+	return count, r.QueryRowContext(ctx, "SELECT COUNT(*) FROM limit_violations WHERE ? = 0 OR user_id = ?", userID, userID).Scan(&count)
+}
+
+func getLimits(ctx context.Context, q dbtx, userID int64) (domain.Limits, error) {
+	overrides, err := getLimitOverrides(ctx, q, userID)
+	if err != nil {
+		return domain.Limits{}, err
+	}
+	return overrides.Apply(DefaultLimits), nil
+}
+
+func getLimitOverrides(ctx context.Context, q dbtx, userID int64) (domain.LimitOverrides, error) {
+	var maxBalance, dailyTopUp, monthlyTopUp, maxPurchase, purchaseBurst, topUpBurst sql.NullInt64
+	row := q.QueryRowContext(ctx, "SELECT max_balance, daily_top_up, monthly_top_up, max_purchase, purchase_burst, top_up_burst FROM user_limits WHERE user_id = ?", userID)
+	if err := row.Scan(&maxBalance, &dailyTopUp, &monthlyTopUp, &maxPurchase, &purchaseBurst, &topUpBurst); err != nil && err != sql.ErrNoRows {
+		return domain.LimitOverrides{}, err
+	}
+	return domain.LimitOverrides{
+		MaxBalance:    nullInt64Ptr(maxBalance),
+		DailyTopUp:    nullInt64Ptr(dailyTopUp),
+		MonthlyTopUp:  nullInt64Ptr(monthlyTopUp),
+		MaxPurchase:   nullInt64Ptr(maxPurchase),
+		PurchaseBurst: nullInt64Ptr(purchaseBurst),
+		TopUpBurst:    nullInt64Ptr(topUpBurst),
+	}, nil
+}
+
+// checkTopUp returns a LimitError when the user may not top up amount now.
+// Pending charges count towards the limits, failed ones only towards the
+// velocity rule.
+func checkTopUp(ctx context.Context, tx *sql.Tx, userID int64, amount int64) error {
+	limits, err := getLimits(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	if limits.TopUpBurst > 0 {
+		var count int64
+		row := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM charges WHERE user_id = ? AND created_at > DATETIME('now', 'localtime', ?)", userID, secondsModifier(-limits.TopUpWindow))
+		if err := row.Scan(&count); err != nil {
+			return err
+		}
+		if count >= limits.TopUpBurst {
+			return &LimitError{Rule: domain.LimitRuleTopUpBurst, Limit: limits.TopUpBurst, Attempted: count + 1}
+		}
+	}
+
+	for _, period := range []struct {
+		rule  domain.LimitRule
+		limit int64
+		since string
+	}{
+		{domain.LimitRuleDailyTopUp, limits.DailyTopUp, "start of day"},
+		{domain.LimitRuleMonthlyTopUp, limits.MonthlyTopUp, "start of month"},
+	} {
+		if period.limit <= 0 {
+			continue
+		}
+		var total int64
+		row := tx.QueryRowContext(ctx, "SELECT COALESCE(SUM(amount), 0) FROM charges WHERE user_id = ? AND status != ? AND created_at >= DATETIME('now', 'localtime', ?)", userID, domain.ChargeStatusFailed, period.since)
+		if err := row.Scan(&total); err != nil {
+			return err
+		}
+		if amount > period.limit-total {
+			return &LimitError{Rule: period.rule, Limit: period.limit, Attempted: amount}
+		}
+	}
+
+	if limits.MaxBalance > 0 {
+		var balance int64
+		row := tx.QueryRowContext(ctx, "SELECT balance + (SELECT COALESCE(SUM(amount), 0) FROM charges WHERE user_id = ? AND status = ?) FROM users WHERE id = ?", userID, domain.ChargeStatusPending, userID)
+		if err := row.Scan(&balance); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrUserNotFound
+			}
+			return err
+		}
+		if amount > limits.MaxBalance-balance {
+			return &LimitError{Rule: domain.LimitRuleMaxBalance, Limit: limits.MaxBalance, Attempted: amount}
+		}
+	}
+	return nil
+}
+
+// checkPurchase returns a LimitError when the user may not buy units for a
+// total of amount now. Bids pass no units, so only their amount is checked.
+func checkPurchase(ctx context.Context, tx *sql.Tx, userID int64, amount int64, units int64) error {
+	limits, err := getLimits(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+
+	if limits.PurchaseBurst > 0 && units > 0 {
+		var count int64
+		row := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM orders WHERE buyer_id = ? AND created_at > DATETIME('now', 'localtime', ?)", userID, secondsModifier(-limits.PurchaseWindow))
+		if err := row.Scan(&count); err != nil {
+			return err
+		}
+		if count+units > limits.PurchaseBurst {
+			return &LimitError{Rule: domain.LimitRulePurchaseBurst, Limit: limits.PurchaseBurst, Attempted: count + units}
+		}
+	}
+
+	if limits.MaxPurchase > 0 && amount > limits.MaxPurchase {
+		return &LimitError{Rule: domain.LimitRuleMaxPurchase, Limit: limits.MaxPurchase, Attempted: amount}
+	}
+	return nil
+}
+
+// recordViolation stores err for review when it is a LimitError, and
+// returns it. It runs outside the refused request's transaction, which has
+// been rolled back.
+func recordViolation(ctx context.Context, q dbtx, userID int64, err error) error {
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		return err
+	}
+	if _, recordErr := q.ExecContext(ctx, "INSERT INTO limit_violations (user_id, rule, limit_value, attempted) VALUES (?, ?, ?, ?)", userID, limitErr.Rule, limitErr.Limit, limitErr.Attempted); recordErr != nil {
+		return errors.Wrapf(recordErr, "failed to record %s", limitErr.Rule)
+	}
+	return err
+}
+
+func nullInt64Ptr(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+func int64Ptr(n int64) *int64 {
+	return &n
+}
+
+func TestAddChargeLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides domain.LimitOverrides
+		balance   int64
+		// earlier are the amounts of earlier charges, confirmed unless
+		// negative, in which case they failed.
+		earlier  []int64
+		amount   int64
+		wantRule domain.LimitRule
+	}{
+		{name: "within limits", amount: 1000},
+		{name: "max balance", overrides: domain.LimitOverrides{MaxBalance: int64Ptr(1000)}, balance: 600, amount: 401, wantRule: domain.LimitRuleMaxBalance},
+		{name: "max balance reached exactly", overrides: domain.LimitOverrides{MaxBalance: int64Ptr(1000)}, balance: 600, amount: 400},
+		{name: "daily top-up", overrides: domain.LimitOverrides{DailyTopUp: int64Ptr(1000)}, earlier: []int64{700}, amount: 301, wantRule: domain.LimitRuleDailyTopUp},
+		{name: "failed top-ups do not count", overrides: domain.LimitOverrides{DailyTopUp: int64Ptr(1000)}, earlier: []int64{-700}, amount: 1000},
+		{name: "monthly top-up", overrides: domain.LimitOverrides{DailyTopUp: int64Ptr(0), MonthlyTopUp: int64Ptr(1000)}, earlier: []int64{1000}, amount: 1, wantRule: domain.LimitRuleMonthlyTopUp},
+		{name: "velocity counts failed top-ups", overrides: domain.LimitOverrides{TopUpBurst: int64Ptr(2)}, earlier: []int64{-1, -1}, amount: 1, wantRule: domain.LimitRuleTopUpBurst},
+		{name: "zero means no limit", overrides: domain.LimitOverrides{MaxBalance: int64Ptr(0), DailyTopUp: int64Ptr(0), MonthlyTopUp: int64Ptr(0)}, amount: 100000000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			ctx := context.Background()
+			repo := NewChargeRepository(sqlDB)
+			limits := NewLimitRepository(sqlDB)
+			userID := addTestUser(t, sqlDB, tt.balance)
+			if err := limits.SetOverrides(ctx, userID, tt.overrides); err != nil {
+				t.Fatalf("failed to set overrides: %s", err)
+			}
+			for _, amount := range tt.earlier {
+				failed := amount < 0
+				if failed {
+					amount = -amount
+				}
+				charge, err := repo.AddCharge(ctx, userID, amount)
+				if err != nil {
+					t.Fatalf("failed to add earlier charge: %s", err)
+				}
+				if failed {
+					_, err = repo.FailCharge(ctx, charge.ID, "declined")
+				} else {
+					_, err = repo.ConfirmCharge(ctx, charge.ID, "")
+				}
+				if err != nil {
+					t.Fatalf("failed to settle earlier charge: %s", err)
+				}
+			}
+
+			_, err := repo.AddCharge(ctx, userID, tt.amount)
+			violations, countErr := limits.CountViolations(ctx, userID)
+			if countErr != nil {
+				t.Fatalf("failed to count violations: %s", countErr)
+			}
+			if tt.wantRule == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if violations != 0 {
+					t.Errorf("expected no violations, got %d", violations)
+				}
+				return
+			}
+
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("expected a LimitError, got %v", err)
+			}
+			if limitErr.Rule != tt.wantRule {
+				t.Errorf("expected %s, got %s", tt.wantRule, limitErr.Rule)
+			}
+			if violations != 1 {
+				t.Errorf("expected the violation to be recorded, got %d", violations)
+			}
+		})
+	}
+}
+
+func TestPurchaseLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		overrides domain.LimitOverrides
+		earlier   int
+		quantity  int64
+		wantRule  domain.LimitRule
+	}{
+		{name: "within limits", quantity: 2},
+		{name: "max purchase", overrides: domain.LimitOverrides{MaxPurchase: int64Ptr(150)}, quantity: 2, wantRule: domain.LimitRuleMaxPurchase},
+		{name: "velocity", overrides: domain.LimitOverrides{PurchaseBurst: int64Ptr(3)}, earlier: 2, quantity: 2, wantRule: domain.LimitRulePurchaseBurst},
+		{name: "velocity reached exactly", overrides: domain.LimitOverrides{PurchaseBurst: int64Ptr(3)}, earlier: 1, quantity: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			ctx := context.Background()
+			repo := NewPurchaseRepository(sqlDB)
+			sellerID := addTestUser(t, sqlDB, 0)
+			buyerID := addTestUser(t, sqlDB, 10000)
+			if err := NewLimitRepository(sqlDB).SetOverrides(ctx, buyerID, tt.overrides); err != nil {
+				t.Fatalf("failed to set overrides: %s", err)
+			}
+			for i := 0; i < tt.earlier; i++ {
+				buyTestItem(t, sqlDB, buyerID, addTestItem(t, sqlDB, sellerID, 100))
+			}
+			itemID := addTestItem(t, sqlDB, sellerID, 100)
+			if _, err := sqlDB.Exec("UPDATE items SET stock = 10 WHERE id = ?", itemID); err != nil {
+				t.Fatalf("failed to set stock: %s", err)
+			}
+
+			_, err := repo.Purchase(ctx, buyerID, itemID, tt.quantity, "", 0)
+			if tt.wantRule == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) || limitErr.Rule != tt.wantRule {
+				t.Fatalf("expected %s, got %v", tt.wantRule, err)
+			}
+			violations, err := NewLimitRepository(sqlDB).GetViolations(ctx, buyerID, 10, 0)
+			if err != nil {
+				t.Fatalf("failed to get violations: %s", err)
+			}
+			if len(violations) != 1 || violations[0].Rule != tt.wantRule {
+				t.Errorf("expected the violation to be recorded, got %+v", violations)
+			}
+		})
+	}
+}
+
+func TestSetOverridesUnknownUser(t *testing.T) {
+	sqlDB := newTestDB(t)
+	if err := NewLimitRepository(sqlDB).SetOverrides(context.Background(), 1, domain.LimitOverrides{}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound, got %v", err)
+	}
+}
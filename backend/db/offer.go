@@ -0,0 +1,320 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrOfferNotFound     = errors.New("offer not found")
+	ErrOfferPending      = errors.New("an offer on this item is already waiting for an answer")
+	ErrNotOfferParty     = errors.New("user is not allowed to answer this offer")
+	ErrOfferNotOpen      = errors.New("offer is no longer open")
+	ErrItemReserved      = errors.New("item is reserved for another buyer")
+	ErrInvalidOfferPrice = errors.New("offer price must be positive and below the listed price")
+)
+
+const offerColumns = "id, item_id, buyer_id, seller_id, price, proposed_by, COALESCE(parent_id, 0), status, expires_at, COALESCE(reserved_until, ''), created_at, updated_at"
+
+type OfferRepository interface {
+	MakeOffer(ctx context.Context, itemID int32, buyerID int64, price int64, ttl time.Duration) (domain.Offer, error)
+	GetOffer(ctx context.Context, id int64) (domain.Offer, error)
+	GetOffersByItemID(ctx context.Context, itemID int32) ([]domain.Offer, error)
+	Accept(ctx context.Context, id int64, userID int64, reservation time.Duration) (domain.Offer, error)
+	Reject(ctx context.Context, id int64, userID int64) (domain.Offer, error)
+	Counter(ctx context.Context, id int64, userID int64, price int64, ttl time.Duration) (domain.Offer, error)
+	ExpireOffers(ctx context.Context) (int64, error)
+}
+
+type OfferDBRepository struct {
+	*sql.DB
+}
+
+func NewOfferRepository(db *sql.DB) OfferRepository {
+	return &OfferDBRepository{DB: db}
+}
+
+// MakeOffer records a buyer's offer on an on-sale item. The offer expires
+// after ttl unless the seller answers it.
+func (r *OfferDBRepository) MakeOffer(ctx context.Context, itemID int32, buyerID int64, price int64, ttl time.Duration) (domain.Offer, error) {
+	var offer domain.Offer
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var (
+			sellerID    int64
+			listPrice   int64
+			status      domain.ItemStatus
+			listingType domain.ListingType
+		)
+		row := tx.QueryRowContext(ctx, "SELECT seller_id, price, status, listing_type FROM items WHERE id = ?", itemID)
+		if err := row.Scan(&sellerID, &listPrice, &status, &listingType); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrItemNotFound
+			}
+			return err
+		}
+		if sellerID == buyerID {
+			return ErrOwnItem
+		}
+		if status == domain.ItemStatusReserved {
+			return ErrItemReserved
+		}
+		if status != domain.ItemStatusOnSale {
+			return ErrItemNotOnSale
+		}
+		if listingType == domain.ListingTypeAuction {
+			return ErrAuctionItem
+		}
+		if price <= 0 || price >= listPrice {
+			return ErrInvalidOfferPrice
+		}
+
+		var pending int
+		row = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM offers WHERE item_id = ? AND buyer_id = ? AND status = ? AND expires_at > DATETIME('now', 'localtime')", itemID, buyerID, domain.OfferStatusPending)
+		if err := row.Scan(&pending); err != nil {
+			return err
+		}
+		if pending > 0 {
+			return ErrOfferPending
+		}
+
+		var err error
+		offer, err = insertOffer(ctx, tx, domain.Offer{ItemID: itemID, BuyerID: buyerID, SellerID: sellerID, Price: price, ProposedBy: buyerID}, ttl)
+		return err
+	})
+	return offer, err
+}
+
+func (r *OfferDBRepository) GetOffer(ctx context.Context, id int64) (domain.Offer, error) {
+	return getOffer(ctx, r.DB, id)
+}
+
+func (r *OfferDBRepository) GetOffersByItemID(ctx context.Context, itemID int32) ([]domain.Offer, error) {
+	rows, err := r.QueryContext(ctx, "SELECT "+offerColumns+" FROM offers WHERE item_id = ? ORDER BY id desc", itemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var offers []domain.Offer
+	for rows.Next() {
+		offer, err := scanOffer(rows)
+		if err != nil {
+			return nil, err
+		}
+		offers = append(offers, offer)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return offers, nil
+}
+
+// Accept accepts an open offer and reserves the item for the buyer at the
+// offered price for the reservation period. Nobody else can buy the item or
+// make offers on it meanwhile.
+func (r *OfferDBRepository) Accept(ctx context.Context, id int64, userID int64, reservation time.Duration) (domain.Offer, error) {
+	var offer domain.Offer
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var err error
+		offer, err = getOpenOffer(ctx, tx, id, userID)
+		if err != nil {
+			return err
+		}
+
+		var status domain.ItemStatus
+		if err := tx.QueryRowContext(ctx, "SELECT status FROM items WHERE id = ?", offer.ItemID).Scan(&status); err != nil {
+			return err
+		}
+		if status == domain.ItemStatusReserved {
+			return ErrItemReserved
+		}
+		if _, err := transitionItem(ctx, tx, offer.ItemID, userID, domain.ItemEventReserve); err != nil {
+			if errors.Is(err, domain.ErrInvalidItemTransition) {
+				return ErrItemNotOnSale
+			}
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, "UPDATE offers SET status = ?, reserved_until = DATETIME('now', 'localtime', ?), updated_at = DATETIME('now', 'localtime') WHERE id = ? AND status = ?", domain.OfferStatusAccepted, secondsModifier(reservation), id, domain.OfferStatusPending)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(res, ErrOfferNotOpen); err != nil {
+			return err
+		}
+		offer, err = getOffer(ctx, tx, id)
+		return err
+	})
+	return offer, err
+}
+
+func (r *OfferDBRepository) Reject(ctx context.Context, id int64, userID int64) (domain.Offer, error) {
+	var offer domain.Offer
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		if _, err := getOpenOffer(ctx, tx, id, userID); err != nil {
+			return err
+		}
+		if err := closeOffer(ctx, tx, id, domain.OfferStatusRejected); err != nil {
+			return err
+		}
+		var err error
+		offer, err = getOffer(ctx, tx, id)
+		return err
+	})
+	return offer, err
+}
+
+// Counter closes an open offer and proposes price to the other party
+// instead. The counter offer expires after ttl.
+func (r *OfferDBRepository) Counter(ctx context.Context, id int64, userID int64, price int64, ttl time.Duration) (domain.Offer, error) {
+	var counter domain.Offer
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		offer, err := getOpenOffer(ctx, tx, id, userID)
+		if err != nil {
+			return err
+		}
+
+		var listPrice int64
+		if err := tx.QueryRowContext(ctx, "SELECT price FROM items WHERE id = ?", offer.ItemID).Scan(&listPrice); err != nil {
+			return err
+		}
+		if price <= 0 || price >= listPrice {
+			return ErrInvalidOfferPrice
+		}
+
+		if err := closeOffer(ctx, tx, id, domain.OfferStatusCountered); err != nil {
+			return err
+		}
+		counter, err = insertOffer(ctx, tx, domain.Offer{ItemID: offer.ItemID, BuyerID: offer.BuyerID, SellerID: offer.SellerID, Price: price, ProposedBy: userID, ParentID: id}, ttl)
+		return err
+	})
+	return counter, err
+}
+
+// ExpireOffers closes pending offers that were not answered in time and
+// accepted offers whose reservation ran out without a purchase. Items whose
+// reservation ran out go back on sale.
+func (r *OfferDBRepository) ExpireOffers(ctx context.Context) (int64, error) {
+	var expired int64
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, "SELECT DISTINCT offers.item_id FROM offers JOIN items ON items.id = offers.item_id WHERE offers.status = ? AND offers.reserved_until <= DATETIME('now', 'localtime') AND items.status = ?", domain.OfferStatusAccepted, domain.ItemStatusReserved)
+		if err != nil {
+			return err
+		}
+		var itemIDs []int32
+		for rows.Next() {
+			var id int32
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			itemIDs = append(itemIDs, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, "UPDATE offers SET status = ?, updated_at = DATETIME('now', 'localtime') WHERE (status = ? AND expires_at <= DATETIME('now', 'localtime')) OR (status = ? AND reserved_until <= DATETIME('now', 'localtime'))", domain.OfferStatusExpired, domain.OfferStatusPending, domain.OfferStatusAccepted)
+		if err != nil {
+			return err
+		}
+		if expired, err = res.RowsAffected(); err != nil {
+			return err
+		}
+
+		for _, id := range itemIDs {
+			if _, err := transitionItem(ctx, tx, id, 0, domain.ItemEventRelease); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return expired, err
+}
+
+func getOffer(ctx context.Context, q dbtx, id int64) (domain.Offer, error) {
+	offer, err := scanOffer(q.QueryRowContext(ctx, "SELECT "+offerColumns+" FROM offers WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return offer, ErrOfferNotFound
+	}
+	return offer, err
+}
+
+// getOpenOffer returns the offer if it is still waiting for an answer from
+// userID.
+func getOpenOffer(ctx context.Context, q dbtx, id int64, userID int64) (domain.Offer, error) {
+	offer, err := getOffer(ctx, q, id)
+	if err != nil {
+		return offer, err
+	}
+	if userID != offer.BuyerID && userID != offer.SellerID {
+		return offer, ErrOfferNotFound
+	}
+	if userID == offer.ProposedBy {
+		return offer, ErrNotOfferParty
+	}
+
+	var open bool
+	row := q.QueryRowContext(ctx, "SELECT status = ? AND expires_at > DATETIME('now', 'localtime') FROM offers WHERE id = ?", domain.OfferStatusPending, id)
+	if err := row.Scan(&open); err != nil {
+		return offer, err
+	}
+	if !open {
+		return offer, ErrOfferNotOpen
+	}
+	return offer, nil
+}
+
+// getReservation returns the accepted offer currently reserving the item, or
+// ErrOfferNotFound.
+func getReservation(ctx context.Context, q dbtx, itemID int32) (domain.Offer, error) {
+	offer, err := scanOffer(q.QueryRowContext(ctx, "SELECT "+offerColumns+" FROM offers WHERE item_id = ? AND status = ? AND reserved_until > DATETIME('now', 'localtime') ORDER BY id desc LIMIT 1", itemID, domain.OfferStatusAccepted))
+	if err == sql.ErrNoRows {
+		return offer, ErrOfferNotFound
+	}
+	return offer, err
+}
+
+func closeOffer(ctx context.Context, tx *sql.Tx, id int64, status domain.OfferStatus) error {
+	res, err := tx.ExecContext(ctx, "UPDATE offers SET status = ?, updated_at = DATETIME('now', 'localtime') WHERE id = ?", status, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(res, ErrOfferNotFound)
+}
+
+// expireOpenOffers closes the offers still waiting for an answer on an item
+// that has just been sold.
+func expireOpenOffers(ctx context.Context, tx *sql.Tx, itemID int32) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE offers SET status = ?, updated_at = DATETIME('now', 'localtime') WHERE item_id = ? AND status = ?", domain.OfferStatusExpired, itemID, domain.OfferStatusPending); err != nil {
+		return err
+	}
+	return nil
+}
+
+func insertOffer(ctx context.Context, tx *sql.Tx, offer domain.Offer, ttl time.Duration) (domain.Offer, error) {
+	var parentID sql.NullInt64
+	if offer.ParentID != 0 {
+		parentID = sql.NullInt64{Int64: offer.ParentID, Valid: true}
+	}
+
+	res, err := tx.ExecContext(ctx, "INSERT INTO offers (item_id, buyer_id, seller_id, price, proposed_by, parent_id, status, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, DATETIME('now', 'localtime', ?))", offer.ItemID, offer.BuyerID, offer.SellerID, offer.Price, offer.ProposedBy, parentID, domain.OfferStatusPending, secondsModifier(ttl))
+	if err != nil {
+		return domain.Offer{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return domain.Offer{}, err
+	}
+	return getOffer(ctx, tx, id)
+}
+
+func scanOffer(row rowScanner) (domain.Offer, error) {
+	var offer domain.Offer
+	return offer, row.Scan(&offer.ID, &offer.ItemID, &offer.BuyerID, &offer.SellerID, &offer.Price, &offer.ProposedBy, &offer.ParentID, &offer.Status, &offer.ExpiresAt, &offer.ReservedUntil, &offer.CreatedAt, &offer.UpdatedAt)
+}
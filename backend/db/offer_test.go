@@ -0,0 +1,228 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+func TestMakeOffer(t *testing.T) {
+	tests := []struct {
+		name       string
+		itemStatus domain.ItemStatus
+		buyer      string
+		price      int64
+		// pending makes the buyer's earlier offer still open.
+		pending bool
+		wantErr error
+	}{
+		{name: "offer", itemStatus: domain.ItemStatusOnSale, buyer: "buyer", price: 800},
+		{name: "own item", itemStatus: domain.ItemStatusOnSale, buyer: "seller", price: 800, wantErr: ErrOwnItem},
+		{name: "not on sale", itemStatus: domain.ItemStatusInitial, buyer: "buyer", price: 800, wantErr: ErrItemNotOnSale},
+		{name: "reserved", itemStatus: domain.ItemStatusReserved, buyer: "buyer", price: 800, wantErr: ErrItemReserved},
+		{name: "zero", itemStatus: domain.ItemStatusOnSale, buyer: "buyer", price: 0, wantErr: ErrInvalidOfferPrice},
+		{name: "listed price", itemStatus: domain.ItemStatusOnSale, buyer: "buyer", price: 1000, wantErr: ErrInvalidOfferPrice},
+		{name: "already pending", itemStatus: domain.ItemStatusOnSale, buyer: "buyer", price: 800, pending: true, wantErr: ErrOfferPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			repo := NewOfferRepository(sqlDB)
+			ctx := context.Background()
+			users := map[string]int64{"seller": addTestUser(t, sqlDB, 0), "buyer": addTestUser(t, sqlDB, 0)}
+			itemID := addTestItem(t, sqlDB, users["seller"], 1000)
+			if tt.pending {
+				if _, err := repo.MakeOffer(ctx, itemID, users["buyer"], 700, time.Hour); err != nil {
+					t.Fatalf("failed to make the earlier offer: %s", err)
+				}
+			}
+			if _, err := sqlDB.Exec("UPDATE items SET status = ? WHERE id = ?", tt.itemStatus, itemID); err != nil {
+				t.Fatalf("failed to set item status: %s", err)
+			}
+
+			offer, err := repo.MakeOffer(ctx, itemID, users[tt.buyer], tt.price, time.Hour)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && (offer.Status != domain.OfferStatusPending || offer.Price != tt.price || offer.ProposedBy != users["buyer"]) {
+				t.Errorf("unexpected offer %+v", offer)
+			}
+		})
+	}
+}
+
+func TestOfferAnswers(t *testing.T) {
+	tests := []struct {
+		name string
+		// answerer answers with "accept", "reject" or "counter".
+		answerer   string
+		answer     string
+		ttl        time.Duration
+		wantErr    error
+		wantStatus domain.OfferStatus
+		wantItem   domain.ItemStatus
+	}{
+		{name: "accept", answerer: "seller", answer: "accept", wantStatus: domain.OfferStatusAccepted, wantItem: domain.ItemStatusReserved},
+		{name: "reject", answerer: "seller", answer: "reject", wantStatus: domain.OfferStatusRejected, wantItem: domain.ItemStatusOnSale},
+		{name: "counter", answerer: "seller", answer: "counter", wantStatus: domain.OfferStatusCountered, wantItem: domain.ItemStatusOnSale},
+		{name: "buyer cannot accept own offer", answerer: "buyer", answer: "accept", wantErr: ErrNotOfferParty, wantStatus: domain.OfferStatusPending, wantItem: domain.ItemStatusOnSale},
+		{name: "stranger", answerer: "stranger", answer: "reject", wantErr: ErrOfferNotFound, wantStatus: domain.OfferStatusPending, wantItem: domain.ItemStatusOnSale},
+		{name: "expired", answerer: "seller", answer: "accept", ttl: -time.Minute, wantErr: ErrOfferNotOpen, wantStatus: domain.OfferStatusPending, wantItem: domain.ItemStatusOnSale},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			repo := NewOfferRepository(sqlDB)
+			ctx := context.Background()
+			users := map[string]int64{"seller": addTestUser(t, sqlDB, 0), "buyer": addTestUser(t, sqlDB, 0), "stranger": addTestUser(t, sqlDB, 0)}
+			itemID := addTestItem(t, sqlDB, users["seller"], 1000)
+			ttl := tt.ttl
+			if ttl == 0 {
+				ttl = time.Hour
+			}
+			offer, err := repo.MakeOffer(ctx, itemID, users["buyer"], 800, ttl)
+			if err != nil {
+				t.Fatalf("failed to make offer: %s", err)
+			}
+
+			switch tt.answer {
+			case "accept":
+				_, err = repo.Accept(ctx, offer.ID, users[tt.answerer], time.Hour)
+			case "reject":
+				_, err = repo.Reject(ctx, offer.ID, users[tt.answerer])
+			case "counter":
+				var counter domain.Offer
+				counter, err = repo.Counter(ctx, offer.ID, users[tt.answerer], 900, time.Hour)
+				if err == nil && (counter.ParentID != offer.ID || counter.ProposedBy != users["seller"] || counter.Status != domain.OfferStatusPending) {
+					t.Errorf("unexpected counter offer %+v", counter)
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+
+			got, err := repo.GetOffer(ctx, offer.ID)
+			if err != nil {
+				t.Fatalf("failed to get offer: %s", err)
+			}
+			if got.Status != tt.wantStatus {
+				t.Errorf("expected offer status %d, got %d", tt.wantStatus, got.Status)
+			}
+			var status domain.ItemStatus
+			if err := sqlDB.QueryRow("SELECT status FROM items WHERE id = ?", itemID).Scan(&status); err != nil {
+				t.Fatalf("failed to get item: %s", err)
+			}
+			if status != tt.wantItem {
+				t.Errorf("expected item status %d, got %d", tt.wantItem, status)
+			}
+		})
+	}
+}
+
+func TestAcceptedOfferReservation(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewOfferRepository(sqlDB)
+	purchases := NewPurchaseRepository(sqlDB)
+	ctx := context.Background()
+
+	sellerID := addTestUser(t, sqlDB, 0)
+	buyerID := addTestUser(t, sqlDB, 1000)
+	otherID := addTestUser(t, sqlDB, 1000)
+	itemID := addTestItem(t, sqlDB, sellerID, 1000)
+	offer, err := repo.MakeOffer(ctx, itemID, buyerID, 800, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to make offer: %s", err)
+	}
+	if _, err := repo.Accept(ctx, offer.ID, sellerID, time.Hour); err != nil {
+		t.Fatalf("failed to accept: %s", err)
+	}
+
+	if _, err := purchases.Purchase(ctx, otherID, itemID, 1, "", 0); !errors.Is(err, ErrItemReserved) {
+		t.Errorf("expected ErrItemReserved for another buyer, got %v", err)
+	}
+	if _, err := repo.MakeOffer(ctx, itemID, otherID, 900, time.Hour); !errors.Is(err, ErrItemReserved) {
+		t.Errorf("expected ErrItemReserved for another offer, got %v", err)
+	}
+
+	orders, err := purchases.Purchase(ctx, buyerID, itemID, 1, "", 0)
+	if err != nil {
+		t.Fatalf("failed to purchase: %s", err)
+	}
+	if orders[0].Price != 800 {
+		t.Errorf("expected the offered price, got %d", orders[0].Price)
+	}
+	if balance := getTestBalance(t, sqlDB, buyerID); balance != 200 {
+		t.Errorf("expected the buyer to pay 800, got balance %d", balance)
+	}
+	got, err := repo.GetOffer(ctx, offer.ID)
+	if err != nil {
+		t.Fatalf("failed to get offer: %s", err)
+	}
+	if got.Status != domain.OfferStatusPurchased {
+		t.Errorf("expected the offer to be purchased, got status %d", got.Status)
+	}
+}
+
+func TestExpireOffers(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewOfferRepository(sqlDB)
+	ctx := context.Background()
+
+	sellerID := addTestUser(t, sqlDB, 0)
+	buyerID := addTestUser(t, sqlDB, 0)
+	unanswered := addTestItem(t, sqlDB, sellerID, 1000)
+	reserved := addTestItem(t, sqlDB, sellerID, 1000)
+	open := addTestItem(t, sqlDB, sellerID, 1000)
+
+	late, err := repo.MakeOffer(ctx, unanswered, buyerID, 800, -time.Minute)
+	if err != nil {
+		t.Fatalf("failed to make offer: %s", err)
+	}
+	lapsed, err := repo.MakeOffer(ctx, reserved, buyerID, 800, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to make offer: %s", err)
+	}
+	if _, err := repo.Accept(ctx, lapsed.ID, sellerID, -time.Minute); err != nil {
+		t.Fatalf("failed to accept: %s", err)
+	}
+	waiting, err := repo.MakeOffer(ctx, open, buyerID, 800, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to make offer: %s", err)
+	}
+
+	expired, err := repo.ExpireOffers(ctx)
+	if err != nil {
+		t.Fatalf("failed to expire offers: %s", err)
+	}
+	if expired != 2 {
+		t.Errorf("expected 2 offers to expire, got %d", expired)
+	}
+
+	tests := []struct {
+		offerID int64
+		want    domain.OfferStatus
+	}{
+		{late.ID, domain.OfferStatusExpired},
+		{lapsed.ID, domain.OfferStatusExpired},
+		{waiting.ID, domain.OfferStatusPending},
+	}
+	for _, tt := range tests {
+		offer, err := repo.GetOffer(ctx, tt.offerID)
+		if err != nil {
+			t.Fatalf("failed to get offer: %s", err)
+		}
+		if offer.Status != tt.want {
+			t.Errorf("offer %d: expected status %d, got %d", tt.offerID, tt.want, offer.Status)
+		}
+	}
+	var status domain.ItemStatus
+	if err := sqlDB.QueryRow("SELECT status FROM items WHERE id = ?", reserved).Scan(&status); err != nil {
+		t.Fatalf("failed to get item: %s", err)
+	}
+	if status != domain.ItemStatusOnSale {
+		t.Errorf("expected the reserved item back on sale, got status %d", status)
+	}
+}
@@ -0,0 +1,368 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrOrderNotFound      = errors.New("order not found")
+	ErrNotOrderParty      = errors.New("user is not allowed to change this order")
+	ErrInvalidOrderStatus = errors.New("order status does not allow this operation")
+	ErrCancelRequested    = errors.New("cancellation is waiting for the other party")
+)
+
+const orderColumns = "id, item_id, buyer_id, seller_id, price, fee, discount, points_used, COALESCE(item_revision_id, 0), status, COALESCE(shipped_at, ''), COALESCE(delivered_at, ''), COALESCE(completed_at, ''), COALESCE(cancelled_at, ''), COALESCE(cancel_requested_by, 0), created_at, updated_at"
+
+type OrderRepository interface {
+	GetOrder(ctx context.Context, id int64) (domain.Order, error)
+	GetOrdersByUserID(ctx context.Context, userID int64) ([]domain.Order, error)
+	Ship(ctx context.Context, id int64, sellerID int64) error
+	Confirm(ctx context.Context, id int64, buyerID int64) error
+	AutoComplete(ctx context.Context, shippedFor time.Duration) (int, error)
+	Cancel(ctx context.Context, id int64, userID int64, reason string, relist bool) (domain.Order, error)
+	GetOrderEvents(ctx context.Context, orderID int64) ([]domain.OrderEvent, error)
+}
+
+type OrderDBRepository struct {
+	*sql.DB
+}
+
+func NewOrderRepository(db *sql.DB) OrderRepository {
+	return &OrderDBRepository{DB: db}
+}
+
+func (r *OrderDBRepository) GetOrder(ctx context.Context, id int64) (domain.Order, error) {
+	return getOrder(ctx, r.DB, id)
+}
+
+// GetOrdersByUserID returns the orders the user bought or sold, newest first.
+func (r *OrderDBRepository) GetOrdersByUserID(ctx context.Context, userID int64) ([]domain.Order, error) {
+	rows, err := r.QueryContext(ctx, "SELECT "+orderColumns+" FROM orders WHERE buyer_id = ? OR seller_id = ? ORDER BY id desc", userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []domain.Order
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (r *OrderDBRepository) Ship(ctx context.Context, id int64, sellerID int64) error {
+	return withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		order, err := getOrder(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if order.SellerID != sellerID {
+			return ErrNotOrderParty
+		}
+		if order.Status != domain.OrderStatusPaid {
+			return ErrInvalidOrderStatus
+		}
+
+		res, err := tx.ExecContext(ctx, "UPDATE orders SET status = ?, shipped_at = DATETIME('now', 'localtime'), updated_at = DATETIME('now', 'localtime') WHERE id = ? AND status = ?", domain.OrderStatusShipped, id, domain.OrderStatusPaid)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(res, ErrInvalidOrderStatus); err != nil {
+			return err
+		}
+		return addOrderEvent(ctx, tx, domain.OrderEvent{OrderID: id, ActorID: sellerID, Kind: domain.OrderEventShipped, FromStatus: domain.OrderStatusPaid, ToStatus: domain.OrderStatusShipped})
+	})
+}
+
+// Confirm records that the buyer received the item and completes the order,
+// releasing the escrowed price to the seller.
+func (r *OrderDBRepository) Confirm(ctx context.Context, id int64, buyerID int64) error {
+	return withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		order, err := getOrder(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if order.BuyerID != buyerID {
+			return ErrNotOrderParty
+		}
+		if order.Status != domain.OrderStatusShipped {
+			return ErrInvalidOrderStatus
+		}
+
+		res, err := tx.ExecContext(ctx, "UPDATE orders SET status = ?, delivered_at = DATETIME('now', 'localtime'), updated_at = DATETIME('now', 'localtime') WHERE id = ? AND status = ?", domain.OrderStatusDelivered, id, domain.OrderStatusShipped)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(res, ErrInvalidOrderStatus); err != nil {
+			return err
+		}
+		if err := addOrderEvent(ctx, tx, domain.OrderEvent{OrderID: id, ActorID: buyerID, Kind: domain.OrderEventDelivered, FromStatus: domain.OrderStatusShipped, ToStatus: domain.OrderStatusDelivered}); err != nil {
+			return err
+		}
+		order.Status = domain.OrderStatusDelivered
+		return completeOrder(ctx, tx, order, buyerID, "")
+	})
+}
+
+// AutoComplete completes orders that have been shipped for longer than
+// shippedFor without the buyer confirming receipt, and returns how many
+// orders were completed.
+func (r *OrderDBRepository) AutoComplete(ctx context.Context, shippedFor time.Duration) (int, error) {
+	rows, err := r.QueryContext(ctx, "SELECT id FROM orders WHERE status = ? AND shipped_at <= DATETIME('now', 'localtime', ?)", domain.OrderStatusShipped, secondsModifier(-shippedFor))
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var completed int
+	for _, id := range ids {
+		var done bool
+		err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+			order, err := getOrder(ctx, tx, id)
+			if err != nil {
+				return err
+			}
+			// The buyer may have confirmed in the meantime.
+			if order.Status != domain.OrderStatusShipped {
+				return nil
+			}
+			done = true
+			return completeOrder(ctx, tx, order, 0, "completed automatically")
+		})
+		if err != nil {
+			return completed, errors.Wrapf(err, "failed to complete order %d", id)
+		}
+		if done {
+			completed++
+		}
+	}
+	return completed, nil
+}
+
+// Cancel cancels the order on behalf of userID. Unshipped orders can be
+// cancelled by either party. Once shipped, both parties have to agree: the
+// first call only records the request and the order stays shipped until the
+// other party cancels as well. A cancelled order refunds the buyer, puts the
+// points they spent back into their lots, gives back the coupon use once the
+// whole purchase it discounted is cancelled, and returns the unit to stock.
+// A sold out item goes back to draft, or on sale when the seller asks to
+// relist it. Auctions always go back to draft, without their end time.
+func (r *OrderDBRepository) Cancel(ctx context.Context, id int64, userID int64, reason string, relist bool) (domain.Order, error) {
+	var order domain.Order
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var err error
+		order, err = getOrder(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+		if userID != order.BuyerID && userID != order.SellerID {
+			return ErrNotOrderParty
+		}
+
+		switch order.Status {
+		case domain.OrderStatusPaid:
+		case domain.OrderStatusShipped:
+			if order.CancelRequestedBy == userID {
+				return ErrCancelRequested
+			}
+			if order.CancelRequestedBy == 0 {
+				res, err := tx.ExecContext(ctx, "UPDATE orders SET cancel_requested_by = ?, updated_at = DATETIME('now', 'localtime') WHERE id = ? AND status = ? AND cancel_requested_by IS NULL", userID, id, domain.OrderStatusShipped)
+				if err != nil {
+					return err
+				}
+				if err := expectOneRow(res, ErrInvalidOrderStatus); err != nil {
+					return err
+				}
+				if err := addOrderEvent(ctx, tx, domain.OrderEvent{OrderID: id, ActorID: userID, Kind: domain.OrderEventCancelRequested, FromStatus: order.Status, ToStatus: order.Status, Note: reason}); err != nil {
+					return err
+				}
+				order, err = getOrder(ctx, tx, id)
+				return err
+			}
+		default:
+			return ErrInvalidOrderStatus
+		}
+
+		res, err := tx.ExecContext(ctx, "UPDATE orders SET status = ?, cancelled_at = DATETIME('now', 'localtime'), cancel_requested_by = NULL, updated_at = DATETIME('now', 'localtime') WHERE id = ? AND status = ?", domain.OrderStatusCancelled, id, order.Status)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(res, ErrInvalidOrderStatus); err != nil {
+			return err
+		}
+		if err := addOrderEvent(ctx, tx, domain.OrderEvent{OrderID: id, ActorID: userID, Kind: domain.OrderEventCancelled, FromStatus: order.Status, ToStatus: domain.OrderStatusCancelled, Note: reason}); err != nil {
+			return err
+		}
+
+		// The buyer gets back what they paid and the points they spent; the
+		// part covered by a coupon or points goes back to the platform.
+		refund := []posting{
+			{AccountID: domain.AccountEscrow, Kind: domain.LedgerEntryRefund, Amount: -order.Price},
+			{AccountID: order.BuyerID, Kind: domain.LedgerEntryRefund, Amount: order.Price - order.Discount - order.PointsUsed},
+		}
+		if order.Discount > 0 {
+			refund = append(refund, posting{AccountID: domain.AccountPlatform, Kind: domain.LedgerEntryCouponDiscount, Amount: order.Discount})
+		}
+		if order.PointsUsed > 0 {
+			refund = append(refund, posting{AccountID: domain.AccountPlatform, Kind: domain.LedgerEntryPointsRedemption, Amount: order.PointsUsed})
+		}
+		if err := postJournal(ctx, tx, order.ItemID, refund...); err != nil {
+			return err
+		}
+		if err := refundPoints(ctx, tx, order.BuyerID, order.PointsUsed, order.ID); err != nil {
+			return err
+		}
+		if err := releaseCoupon(ctx, tx, order.ID); err != nil {
+			return err
+		}
+
+		// The unit goes back into stock. A sold out item comes back to
+		// the seller's drafts, or straight back on sale if they ask for it.
+		// An auction has ended by now, so it comes back without an end time
+		// and the seller gives it a new one when selling it again.
+		if _, err := tx.ExecContext(ctx, "UPDATE items SET stock = stock + 1 WHERE id = ?", order.ItemID); err != nil {
+			return err
+		}
+		var (
+			itemStatus  domain.ItemStatus
+			listingType domain.ListingType
+		)
+		if err := tx.QueryRowContext(ctx, "SELECT status, listing_type FROM items WHERE id = ?", order.ItemID).Scan(&itemStatus, &listingType); err != nil {
+			return err
+		}
+		if itemStatus == domain.ItemStatusSoldOut {
+			event := domain.ItemEventReturn
+			if listingType == domain.ListingTypeAuction {
+				if _, err := tx.ExecContext(ctx, "UPDATE items SET ends_at = NULL WHERE id = ?", order.ItemID); err != nil {
+					return err
+				}
+			} else if relist && userID == order.SellerID {
+				event = domain.ItemEventRestock
+			}
+			if _, err := transitionItem(ctx, tx, order.ItemID, userID, event); err != nil {
+				return err
+			}
+		}
+
+		order, err = getOrder(ctx, tx, id)
+		return err
+	})
+	return order, err
+}
+
+func (r *OrderDBRepository) GetOrderEvents(ctx context.Context, orderID int64) ([]domain.OrderEvent, error) {
+	rows, err := r.QueryContext(ctx, "SELECT id, order_id, actor_id, kind, from_status, to_status, note, created_at FROM order_events WHERE order_id = ? ORDER BY id", orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []domain.OrderEvent
+	for rows.Next() {
+		var event domain.OrderEvent
+		if err := rows.Scan(&event.ID, &event.OrderID, &event.ActorID, &event.Kind, &event.FromStatus, &event.ToStatus, &event.Note, &event.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func getOrder(ctx context.Context, q dbtx, id int64) (domain.Order, error) {
+	order, err := scanOrder(q.QueryRowContext(ctx, "SELECT "+orderColumns+" FROM orders WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return order, ErrOrderNotFound
+	}
+	return order, err
+}
+
+func scanOrder(row rowScanner) (domain.Order, error) {
+	var order domain.Order
+	return order, row.Scan(&order.ID, &order.ItemID, &order.BuyerID, &order.SellerID, &order.Price, &order.Fee, &order.Discount, &order.PointsUsed, &order.ItemRevisionID, &order.Status, &order.ShippedAt, &order.DeliveredAt, &order.CompletedAt, &order.CancelledAt, &order.CancelRequestedBy, &order.CreatedAt, &order.UpdatedAt)
+}
+
+func addOrderEvent(ctx context.Context, tx *sql.Tx, event domain.OrderEvent) error {
+	if _, err := tx.ExecContext(ctx, "INSERT INTO order_events (order_id, actor_id, kind, from_status, to_status, note) VALUES (?, ?, ?, ?, ?, ?)", event.OrderID, event.ActorID, event.Kind, event.FromStatus, event.ToStatus, event.Note); err != nil {
+		return err
+	}
+	return nil
+}
+
+// insertOrder creates a paid order. Its fee is calculated from the item's
+// current fee rule, so later changes to the rule do not affect it.
+func insertOrder(ctx context.Context, tx *sql.Tx, order domain.Order) (domain.Order, error) {
+	rule, err := getItemFeeRule(ctx, tx, order.ItemID)
+	if err != nil {
+		return domain.Order{}, err
+	}
+
+	res, err := tx.ExecContext(ctx, "INSERT INTO orders (item_id, buyer_id, seller_id, price, fee, discount, points_used, item_revision_id, status) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", order.ItemID, order.BuyerID, order.SellerID, order.Price, rule.Fee(order.Price), order.Discount, order.PointsUsed, nullInt64(order.ItemRevisionID), domain.OrderStatusPaid)
+	if err != nil {
+		return domain.Order{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return domain.Order{}, err
+	}
+	if err := addOrderEvent(ctx, tx, domain.OrderEvent{OrderID: id, ActorID: order.BuyerID, Kind: domain.OrderEventCreated, FromStatus: domain.OrderStatusPaid, ToStatus: domain.OrderStatusPaid}); err != nil {
+		return domain.Order{}, err
+	}
+	return getOrder(ctx, tx, id)
+}
+
+// completeOrder pays the escrowed price out to the seller, less the fee which
+// goes to the platform, and marks the order completed. The buyer earns
+// loyalty points for what they paid from their balance.
+func completeOrder(ctx context.Context, tx *sql.Tx, order domain.Order, actorID int64, note string) error {
+	res, err := tx.ExecContext(ctx, "UPDATE orders SET status = ?, completed_at = DATETIME('now', 'localtime'), cancel_requested_by = NULL, updated_at = DATETIME('now', 'localtime') WHERE id = ? AND status = ?", domain.OrderStatusCompleted, order.ID, order.Status)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(res, ErrInvalidOrderStatus); err != nil {
+		return err
+	}
+	if err := addOrderEvent(ctx, tx, domain.OrderEvent{OrderID: order.ID, ActorID: actorID, Kind: domain.OrderEventCompleted, FromStatus: order.Status, ToStatus: domain.OrderStatusCompleted, Note: note}); err != nil {
+		return err
+	}
+
+	postings := []posting{
+		{AccountID: domain.AccountEscrow, Kind: domain.LedgerEntrySale, Amount: -order.Price},
+		{AccountID: order.SellerID, Kind: domain.LedgerEntrySale, Amount: order.Price - order.Fee},
+	}
+	if order.Fee > 0 {
+		postings = append(postings, posting{AccountID: domain.AccountPlatform, Kind: domain.LedgerEntrySaleFee, Amount: order.Fee})
+	}
+	if err := postJournal(ctx, tx, order.ItemID, postings...); err != nil {
+		return err
+	}
+
+	earned := DefaultPointsPolicy.Earned(order.Price - order.Discount - order.PointsUsed)
+	return addPoints(ctx, tx, order.BuyerID, domain.PointEntryEarned, earned, order.ID)
+}
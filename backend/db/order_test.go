@@ -0,0 +1,388 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+// getTestAccount returns the balance of a system account from the ledger.
+func getTestAccount(t *testing.T, sqlDB *sql.DB, accountID int64) int64 {
+	t.Helper()
+
+	var balance int64
+	if err := sqlDB.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM ledger_entries WHERE account_id = ?", accountID).Scan(&balance); err != nil {
+		t.Fatalf("failed to read account %d: %s", accountID, err)
+	}
+	return balance
+}
+
+// addTestPointLot gives the user a lot of points that expires after ttl,
+// which may be negative for lots that have already expired.
+func addTestPointLot(t *testing.T, sqlDB *sql.DB, userID int64, amount int64, ttl time.Duration) int64 {
+	t.Helper()
+
+	res, err := sqlDB.Exec("INSERT INTO point_lots (user_id, amount, remaining, expires_at) VALUES (?, ?, ?, DATETIME('now', 'localtime', ?))", userID, amount, amount, secondsModifier(ttl))
+	if err != nil {
+		t.Fatalf("failed to add point lot: %s", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get point lot id: %s", err)
+	}
+	return id
+}
+
+func getTestLotRemaining(t *testing.T, sqlDB *sql.DB, lotID int64) int64 {
+	t.Helper()
+
+	var remaining int64
+	if err := sqlDB.QueryRow("SELECT remaining FROM point_lots WHERE id = ?", lotID).Scan(&remaining); err != nil {
+		t.Fatalf("failed to get point lot: %s", err)
+	}
+	return remaining
+}
+
+func buyTestItem(t *testing.T, sqlDB *sql.DB, buyerID int64, itemID int32) domain.Order {
+	t.Helper()
+
+	orders, err := NewPurchaseRepository(sqlDB).Purchase(context.Background(), buyerID, itemID, 1, "", 0)
+	if err != nil {
+		t.Fatalf("failed to purchase: %s", err)
+	}
+	return orders[0]
+}
+
+func TestOrderComplete(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewOrderRepository(sqlDB)
+	ctx := context.Background()
+
+	sellerID := addTestUser(t, sqlDB, 0)
+	buyerID := addTestUser(t, sqlDB, 2000)
+	order := buyTestItem(t, sqlDB, buyerID, addTestItem(t, sqlDB, sellerID, 1000))
+	if order.Fee != 100 {
+		t.Fatalf("expected the default 10%% fee, got %d", order.Fee)
+	}
+
+	tests := []struct {
+		name    string
+		do      func() error
+		wantErr error
+	}{
+		{"buyer cannot ship", func() error { return repo.Ship(ctx, order.ID, buyerID) }, ErrNotOrderParty},
+		{"confirm before shipping", func() error { return repo.Confirm(ctx, order.ID, buyerID) }, ErrInvalidOrderStatus},
+		{"ship", func() error { return repo.Ship(ctx, order.ID, sellerID) }, nil},
+		{"ship twice", func() error { return repo.Ship(ctx, order.ID, sellerID) }, ErrInvalidOrderStatus},
+		{"seller cannot confirm", func() error { return repo.Confirm(ctx, order.ID, sellerID) }, ErrNotOrderParty},
+		{"confirm", func() error { return repo.Confirm(ctx, order.ID, buyerID) }, nil},
+		{"confirm twice", func() error { return repo.Confirm(ctx, order.ID, buyerID) }, ErrInvalidOrderStatus},
+		{"cancel once completed", func() error { _, err := repo.Cancel(ctx, order.ID, buyerID, "", false); return err }, ErrInvalidOrderStatus},
+	}
+	for _, tt := range tests {
+		if err := tt.do(); !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%s: expected %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+
+	got, err := repo.GetOrder(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("failed to get order: %s", err)
+	}
+	if got.Status != domain.OrderStatusCompleted {
+		t.Errorf("expected the order to be completed, got status %d", got.Status)
+	}
+	if balance := getTestBalance(t, sqlDB, sellerID); balance != 900 {
+		t.Errorf("expected the seller to receive 900, got %d", balance)
+	}
+	if balance := getTestBalance(t, sqlDB, buyerID); balance != 1000 {
+		t.Errorf("expected the buyer to keep 1000, got %d", balance)
+	}
+	if escrow := getTestAccount(t, sqlDB, domain.AccountEscrow); escrow != 0 {
+		t.Errorf("expected escrow to be empty, got %d", escrow)
+	}
+	if platform := getTestAccount(t, sqlDB, domain.AccountPlatform); platform != 100 {
+		t.Errorf("expected the platform to earn the 100 fee, got %d", platform)
+	}
+	points, err := NewPointsRepository(sqlDB).GetBalance(ctx, buyerID)
+	if err != nil {
+		t.Fatalf("failed to get points: %s", err)
+	}
+	if want := DefaultPointsPolicy.Earned(1000); points != want {
+		t.Errorf("expected the buyer to earn %d points, got %d", want, points)
+	}
+
+	events, err := repo.GetOrderEvents(ctx, order.ID)
+	if err != nil {
+		t.Fatalf("failed to get events: %s", err)
+	}
+	var kinds []domain.OrderEventKind
+	for _, event := range events {
+		kinds = append(kinds, event.Kind)
+	}
+	want := []domain.OrderEventKind{domain.OrderEventCreated, domain.OrderEventShipped, domain.OrderEventDelivered, domain.OrderEventCompleted}
+	if len(kinds) != len(want) {
+		t.Fatalf("expected events %v, got %v", want, kinds)
+	}
+	for i := range want {
+		if kinds[i] != want[i] {
+			t.Errorf("expected events %v, got %v", want, kinds)
+			break
+		}
+	}
+}
+
+func TestOrderAutoComplete(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewOrderRepository(sqlDB)
+	ctx := context.Background()
+
+	sellerID := addTestUser(t, sqlDB, 0)
+	buyerID := addTestUser(t, sqlDB, 3000)
+	old := buyTestItem(t, sqlDB, buyerID, addTestItem(t, sqlDB, sellerID, 1000))
+	recent := buyTestItem(t, sqlDB, buyerID, addTestItem(t, sqlDB, sellerID, 1000))
+	unshipped := buyTestItem(t, sqlDB, buyerID, addTestItem(t, sqlDB, sellerID, 1000))
+	for _, id := range []int64{old.ID, recent.ID} {
+		if err := repo.Ship(ctx, id, sellerID); err != nil {
+			t.Fatalf("failed to ship: %s", err)
+		}
+	}
+	if _, err := sqlDB.Exec("UPDATE orders SET shipped_at = DATETIME('now', 'localtime', '-15 days') WHERE id = ?", old.ID); err != nil {
+		t.Fatalf("failed to backdate shipping: %s", err)
+	}
+
+	completed, err := repo.AutoComplete(ctx, 14*24*time.Hour)
+	if err != nil {
+		t.Fatalf("failed to auto-complete: %s", err)
+	}
+	if completed != 1 {
+		t.Errorf("expected one order to be completed, got %d", completed)
+	}
+
+	tests := []struct {
+		id   int64
+		want domain.OrderStatus
+	}{
+		{old.ID, domain.OrderStatusCompleted},
+		{recent.ID, domain.OrderStatusShipped},
+		{unshipped.ID, domain.OrderStatusPaid},
+	}
+	for _, tt := range tests {
+		order, err := repo.GetOrder(ctx, tt.id)
+		if err != nil {
+			t.Fatalf("failed to get order: %s", err)
+		}
+		if order.Status != tt.want {
+			t.Errorf("order %d: expected status %d, got %d", tt.id, tt.want, order.Status)
+		}
+	}
+	if balance := getTestBalance(t, sqlDB, sellerID); balance != 900 {
+		t.Errorf("expected the seller to be paid for one order, got %d", balance)
+	}
+}
+
+func TestOrderCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		// shipped orders need both parties to cancel.
+		shipped    bool
+		cancellers []string
+		relist     bool
+		wantErr    error
+		wantStatus domain.OrderStatus
+		wantItem   domain.ItemStatus
+	}{
+		{name: "buyer before shipping", cancellers: []string{"buyer"}, wantStatus: domain.OrderStatusCancelled, wantItem: domain.ItemStatusInitial},
+		{name: "seller relists", cancellers: []string{"seller"}, relist: true, wantStatus: domain.OrderStatusCancelled, wantItem: domain.ItemStatusOnSale},
+		{name: "buyer cannot relist", cancellers: []string{"buyer"}, relist: true, wantStatus: domain.OrderStatusCancelled, wantItem: domain.ItemStatusInitial},
+		{name: "stranger", cancellers: []string{"stranger"}, wantErr: ErrNotOrderParty, wantStatus: domain.OrderStatusPaid, wantItem: domain.ItemStatusSoldOut},
+		{name: "shipped, one party", shipped: true, cancellers: []string{"buyer"}, wantStatus: domain.OrderStatusShipped, wantItem: domain.ItemStatusSoldOut},
+		{name: "shipped, same party twice", shipped: true, cancellers: []string{"buyer", "buyer"}, wantErr: ErrCancelRequested, wantStatus: domain.OrderStatusShipped, wantItem: domain.ItemStatusSoldOut},
+		{name: "shipped, both parties", shipped: true, cancellers: []string{"seller", "buyer"}, wantStatus: domain.OrderStatusCancelled, wantItem: domain.ItemStatusInitial},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			repo := NewOrderRepository(sqlDB)
+			ctx := context.Background()
+
+			users := map[string]int64{
+				"seller":   addTestUser(t, sqlDB, 0),
+				"buyer":    addTestUser(t, sqlDB, 1000),
+				"stranger": addTestUser(t, sqlDB, 0),
+			}
+			itemID := addTestItem(t, sqlDB, users["seller"], 1000)
+			order := buyTestItem(t, sqlDB, users["buyer"], itemID)
+			if tt.shipped {
+				if err := repo.Ship(ctx, order.ID, users["seller"]); err != nil {
+					t.Fatalf("failed to ship: %s", err)
+				}
+			}
+
+			var err error
+			for _, canceller := range tt.cancellers {
+				if _, err = repo.Cancel(ctx, order.ID, users[canceller], "reason", tt.relist); err != nil {
+					break
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+
+			got, err := repo.GetOrder(ctx, order.ID)
+			if err != nil {
+				t.Fatalf("failed to get order: %s", err)
+			}
+			if got.Status != tt.wantStatus {
+				t.Errorf("expected order status %d, got %d", tt.wantStatus, got.Status)
+			}
+			var (
+				itemStatus domain.ItemStatus
+				stock      int64
+			)
+			if err := sqlDB.QueryRow("SELECT status, stock FROM items WHERE id = ?", itemID).Scan(&itemStatus, &stock); err != nil {
+				t.Fatalf("failed to get item: %s", err)
+			}
+			if itemStatus != tt.wantItem {
+				t.Errorf("expected item status %d, got %d", tt.wantItem, itemStatus)
+			}
+
+			cancelled := tt.wantStatus == domain.OrderStatusCancelled
+			wantBalance, wantEscrow, wantStock := int64(0), int64(1000), int64(0)
+			if cancelled {
+				wantBalance, wantEscrow, wantStock = 1000, 0, 1
+			}
+			if balance := getTestBalance(t, sqlDB, users["buyer"]); balance != wantBalance {
+				t.Errorf("expected buyer balance %d, got %d", wantBalance, balance)
+			}
+			if escrow := getTestAccount(t, sqlDB, domain.AccountEscrow); escrow != wantEscrow {
+				t.Errorf("expected escrow %d, got %d", wantEscrow, escrow)
+			}
+			if stock != wantStock {
+				t.Errorf("expected stock %d, got %d", wantStock, stock)
+			}
+		})
+	}
+}
+
+func TestOrderCancelReturnsCouponAndPoints(t *testing.T) {
+	sqlDB := newTestDB(t)
+	ctx := context.Background()
+
+	sellerID := addTestUser(t, sqlDB, 0)
+	buyerID := addTestUser(t, sqlDB, 1000)
+	itemID := addTestItem(t, sqlDB, sellerID, 500)
+	if _, err := sqlDB.Exec("UPDATE items SET stock = 2 WHERE id = ?", itemID); err != nil {
+		t.Fatalf("failed to set stock: %s", err)
+	}
+	coupon, err := NewCouponRepository(sqlDB).AddCoupon(ctx, domain.Coupon{Code: "SAVE", DiscountType: domain.DiscountTypeFixed, Value: 600, MaxUses: 1, Active: true})
+	if err != nil {
+		t.Fatalf("failed to add coupon: %s", err)
+	}
+	// Both lots are spent: the one expiring first entirely, the other in
+	// part.
+	soon := addTestPointLot(t, sqlDB, buyerID, 100, 24*time.Hour)
+	later := addTestPointLot(t, sqlDB, buyerID, 200, 48*time.Hour)
+
+	// The coupon covers the first unit and 100 of the second, and the
+	// points 150 of what is left.
+	orders, err := NewPurchaseRepository(sqlDB).Purchase(ctx, buyerID, itemID, 2, "save", 150)
+	if err != nil {
+		t.Fatalf("failed to purchase: %s", err)
+	}
+	if orders[0].Discount != 500 || orders[1].Discount != 100 || orders[1].PointsUsed != 150 {
+		t.Fatalf("unexpected split of the discount and points: %+v", orders)
+	}
+	if balance := getTestBalance(t, sqlDB, buyerID); balance != 750 {
+		t.Fatalf("expected the buyer to pay 250, got balance %d", balance)
+	}
+	if got := getTestLotRemaining(t, sqlDB, soon); got != 0 {
+		t.Errorf("expected the first lot to be spent, got %d left", got)
+	}
+	if got := getTestLotRemaining(t, sqlDB, later); got != 150 {
+		t.Errorf("expected 150 left in the second lot, got %d", got)
+	}
+
+	orderRepo := NewOrderRepository(sqlDB)
+	getUses := func() int64 {
+		t.Helper()
+		coupon, err := NewCouponRepository(sqlDB).GetCoupon(ctx, coupon.ID)
+		if err != nil {
+			t.Fatalf("failed to get coupon: %s", err)
+		}
+		return coupon.Uses
+	}
+
+	// The coupon stays used while one of the orders it discounted stands.
+	if _, err := orderRepo.Cancel(ctx, orders[1].ID, sellerID, "", true); err != nil {
+		t.Fatalf("failed to cancel: %s", err)
+	}
+	if uses := getUses(); uses != 1 {
+		t.Errorf("expected the coupon to stay used, got %d uses", uses)
+	}
+	if got := getTestLotRemaining(t, sqlDB, soon); got != 100 {
+		t.Errorf("expected the first lot to be restored, got %d", got)
+	}
+	if got := getTestLotRemaining(t, sqlDB, later); got != 200 {
+		t.Errorf("expected the second lot to be restored, got %d", got)
+	}
+	var lots int
+	if err := sqlDB.QueryRow("SELECT COUNT(*) FROM point_lots WHERE user_id = ?", buyerID).Scan(&lots); err != nil {
+		t.Fatalf("failed to count lots: %s", err)
+	}
+	if lots != 2 {
+		t.Errorf("expected no new lot, got %d lots", lots)
+	}
+
+	if _, err := orderRepo.Cancel(ctx, orders[0].ID, sellerID, "", true); err != nil {
+		t.Fatalf("failed to cancel: %s", err)
+	}
+	if uses := getUses(); uses != 0 {
+		t.Errorf("expected the coupon use to be given back, got %d uses", uses)
+	}
+	redemptions, err := NewCouponRepository(sqlDB).GetRedemptions(ctx, coupon.ID)
+	if err != nil {
+		t.Fatalf("failed to get redemptions: %s", err)
+	}
+	if len(redemptions) != 0 {
+		t.Errorf("expected the redemption to be removed, got %d", len(redemptions))
+	}
+	if balance := getTestBalance(t, sqlDB, buyerID); balance != 1000 {
+		t.Errorf("expected the buyer to be refunded in full, got balance %d", balance)
+	}
+	for _, account := range []int64{domain.AccountEscrow, domain.AccountPlatform} {
+		if balance := getTestAccount(t, sqlDB, account); balance != 0 {
+			t.Errorf("expected account %d to be back at 0, got %d", account, balance)
+		}
+	}
+
+	// The coupon can be used again on the relisted item.
+	if _, err := NewPurchaseRepository(sqlDB).Purchase(ctx, buyerID, itemID, 1, "SAVE", 0); err != nil {
+		t.Errorf("failed to use the coupon again: %s", err)
+	}
+}
+
+func TestRefundPointsWithoutLots(t *testing.T) {
+	// Orders paid before the spent lots were recorded get a new lot.
+	sqlDB := newTestDB(t)
+	ctx := context.Background()
+	userID := addTestUser(t, sqlDB, 0)
+
+	err := withTx(ctx, sqlDB, func(tx *sql.Tx) error {
+		return refundPoints(ctx, tx, userID, 70, 0)
+	})
+	if err != nil {
+		t.Fatalf("failed to refund points: %s", err)
+	}
+	points, err := NewPointsRepository(sqlDB).GetBalance(ctx, userID)
+	if err != nil {
+		t.Fatalf("failed to get points: %s", err)
+	}
+	if points != 70 {
+		t.Errorf("expected 70 points, got %d", points)
+	}
+}
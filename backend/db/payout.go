@@ -0,0 +1,233 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrBankAccountNotFound = errors.New("bank account not found")
+	ErrPayoutNotFound      = errors.New("payout not found")
+)
+
+const payoutColumns = "id, user_id, bank_account_id, amount, fee, status, reference, failure_reason, created_at, updated_at"
+
+type PayoutRepository interface {
+	AddBankAccount(ctx context.Context, account domain.BankAccount) (domain.BankAccount, error)
+	GetBankAccount(ctx context.Context, id int64) (domain.BankAccount, error)
+	GetBankAccountsByUserID(ctx context.Context, userID int64) ([]domain.BankAccount, error)
+	RequestPayout(ctx context.Context, payout domain.Payout) (domain.Payout, error)
+	GetPayoutsByUserID(ctx context.Context, userID int64) ([]domain.Payout, error)
+	ClaimPendingPayouts(ctx context.Context, limit int) ([]domain.Payout, error)
+	MarkPayoutPaid(ctx context.Context, id int64, reference string) error
+	MarkPayoutFailed(ctx context.Context, id int64, reason string) error
+}
+
+type PayoutDBRepository struct {
+	*sql.DB
+}
+
+func NewPayoutRepository(db *sql.DB) PayoutRepository {
+	return &PayoutDBRepository{DB: db}
+}
+
+func (r *PayoutDBRepository) AddBankAccount(ctx context.Context, account domain.BankAccount) (domain.BankAccount, error) {
+	res, err := r.ExecContext(ctx, "INSERT INTO bank_accounts (user_id, bank_name, branch_name, account_number, holder_name) VALUES (?, ?, ?, ?, ?)", account.UserID, account.BankName, account.BranchName, account.AccountNumber, account.HolderName)
+	if err != nil {
+		return domain.BankAccount{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return domain.BankAccount{}, err
+	}
+	return r.GetBankAccount(ctx, id)
+}
+
+func (r *PayoutDBRepository) GetBankAccount(ctx context.Context, id int64) (domain.BankAccount, error) {
+	row := r.QueryRowContext(ctx, "SELECT id, user_id, bank_name, branch_name, account_number, holder_name, created_at FROM bank_accounts WHERE id = ?", id)
+
+	var account domain.BankAccount
+	err := row.Scan(&account.ID, &account.UserID, &account.BankName, &account.BranchName, &account.AccountNumber, &account.HolderName, &account.CreatedAt)
+	if err == sql.ErrNoRows {
+		return account, ErrBankAccountNotFound
+	}
+	return account, err
+}
+
+func (r *PayoutDBRepository) GetBankAccountsByUserID(ctx context.Context, userID int64) ([]domain.BankAccount, error) {
+	rows, err := r.QueryContext(ctx, "SELECT id, user_id, bank_name, branch_name, account_number, holder_name, created_at FROM bank_accounts WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var accounts []domain.BankAccount
+	for rows.Next() {
+		var account domain.BankAccount
+		if err := rows.Scan(&account.ID, &account.UserID, &account.BankName, &account.BranchName, &account.AccountNumber, &account.HolderName, &account.CreatedAt); err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// RequestPayout moves payout.Amount from the user's balance into the payout
+// clearing account and records a pending payout, to be picked up by
+// ClaimPendingPayouts.
+func (r *PayoutDBRepository) RequestPayout(ctx context.Context, payout domain.Payout) (domain.Payout, error) {
+	var res domain.Payout
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var ownerID int64
+		row := tx.QueryRowContext(ctx, "SELECT user_id FROM bank_accounts WHERE id = ?", payout.BankAccountID)
+		if err := row.Scan(&ownerID); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrBankAccountNotFound
+			}
+			return err
+		}
+		if ownerID != payout.UserID {
+			return ErrBankAccountNotFound
+		}
+
+		if err := postJournal(ctx, tx, 0,
+			posting{AccountID: payout.UserID, Kind: domain.LedgerEntryWithdrawal, Amount: -payout.Amount},
+			posting{AccountID: domain.AccountPayoutClearing, Kind: domain.LedgerEntryWithdrawal, Amount: payout.Amount},
+		); err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(ctx, "INSERT INTO payouts (user_id, bank_account_id, amount, fee, status) VALUES (?, ?, ?, ?, ?)", payout.UserID, payout.BankAccountID, payout.Amount, payout.Fee, domain.PayoutStatusPending)
+		if err != nil {
+			return err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		res, err = getPayout(ctx, tx, id)
+		return err
+	})
+	return res, err
+}
+
+func (r *PayoutDBRepository) GetPayoutsByUserID(ctx context.Context, userID int64) ([]domain.Payout, error) {
+	rows, err := r.QueryContext(ctx, "SELECT "+payoutColumns+" FROM payouts WHERE user_id = ? ORDER BY id desc", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payouts []domain.Payout
+	for rows.Next() {
+		payout, err := scanPayout(rows)
+		if err != nil {
+			return nil, err
+		}
+		payouts = append(payouts, payout)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return payouts, nil
+}
+
+// ClaimPendingPayouts marks up to limit pending payouts as processing and
+// returns them. A payout is only ever claimed once.
+func (r *PayoutDBRepository) ClaimPendingPayouts(ctx context.Context, limit int) ([]domain.Payout, error) {
+	var payouts []domain.Payout
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, "SELECT "+payoutColumns+" FROM payouts WHERE status = ? ORDER BY id LIMIT ?", domain.PayoutStatusPending, limit)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			payout, err := scanPayout(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			payouts = append(payouts, payout)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for i := range payouts {
+			if _, err := tx.ExecContext(ctx, "UPDATE payouts SET status = ?, updated_at = DATETIME('now', 'localtime') WHERE id = ?", domain.PayoutStatusProcessing, payouts[i].ID); err != nil {
+				return err
+			}
+			payouts[i].Status = domain.PayoutStatusProcessing
+		}
+		return nil
+	})
+	return payouts, err
+}
+
+// MarkPayoutPaid settles a processing payout: the bank transfer leaves the
+// platform and the fee goes to the platform account.
+func (r *PayoutDBRepository) MarkPayoutPaid(ctx context.Context, id int64, reference string) error {
+	return withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		payout, err := getPayout(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, "UPDATE payouts SET status = ?, reference = ?, updated_at = DATETIME('now', 'localtime') WHERE id = ? AND status = ?", domain.PayoutStatusPaid, reference, id, domain.PayoutStatusProcessing)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(res, ErrPayoutNotFound); err != nil {
+			return err
+		}
+
+		return postJournal(ctx, tx, 0,
+			posting{AccountID: domain.AccountPayoutClearing, Kind: domain.LedgerEntryWithdrawal, Amount: -payout.Amount},
+			posting{AccountID: domain.AccountExternal, Kind: domain.LedgerEntryWithdrawal, Amount: payout.Amount - payout.Fee},
+			posting{AccountID: domain.AccountPlatform, Kind: domain.LedgerEntryWithdrawalFee, Amount: payout.Fee},
+		)
+	})
+}
+
+// MarkPayoutFailed gives a processing payout's amount back to the user.
+func (r *PayoutDBRepository) MarkPayoutFailed(ctx context.Context, id int64, reason string) error {
+	return withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		payout, err := getPayout(ctx, tx, id)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.ExecContext(ctx, "UPDATE payouts SET status = ?, failure_reason = ?, updated_at = DATETIME('now', 'localtime') WHERE id = ? AND status = ?", domain.PayoutStatusFailed, reason, id, domain.PayoutStatusProcessing)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(res, ErrPayoutNotFound); err != nil {
+			return err
+		}
+
+		return postJournal(ctx, tx, 0,
+			posting{AccountID: domain.AccountPayoutClearing, Kind: domain.LedgerEntryWithdrawalReversal, Amount: -payout.Amount},
+			posting{AccountID: payout.UserID, Kind: domain.LedgerEntryWithdrawalReversal, Amount: payout.Amount},
+		)
+	})
+}
+
+func getPayout(ctx context.Context, q dbtx, id int64) (domain.Payout, error) {
+	payout, err := scanPayout(q.QueryRowContext(ctx, "SELECT "+payoutColumns+" FROM payouts WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return payout, ErrPayoutNotFound
+	}
+	return payout, err
+}
+
+func scanPayout(row rowScanner) (domain.Payout, error) {
+	var payout domain.Payout
+	return payout, row.Scan(&payout.ID, &payout.UserID, &payout.BankAccountID, &payout.Amount, &payout.Fee, &payout.Status, &payout.Reference, &payout.FailureReason, &payout.CreatedAt, &payout.UpdatedAt)
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+func TestPayout(t *testing.T) {
+	tests := []struct {
+		name        string
+		amount      int64
+		paid        bool
+		wantErr     error
+		wantStatus  domain.PayoutStatus
+		wantBalance int64
+		wantClear   int64
+		wantFee     int64
+	}{
+		{name: "paid", amount: 1000, paid: true, wantStatus: domain.PayoutStatusPaid, wantBalance: 500, wantFee: 200},
+		{name: "failed", amount: 1000, wantStatus: domain.PayoutStatusFailed, wantBalance: 1500},
+		{name: "insufficient balance", amount: 1501, wantErr: ErrInsufficientBalance, wantBalance: 1500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			repo := NewPayoutRepository(sqlDB)
+			ctx := context.Background()
+			userID := addTestUser(t, sqlDB, 0)
+			if err := NewLedgerRepository(sqlDB).TopUp(ctx, userID, 1500); err != nil {
+				t.Fatalf("failed to top up: %s", err)
+			}
+			account, err := repo.AddBankAccount(ctx, domain.BankAccount{UserID: userID, BankName: "bank", BranchName: "branch", AccountNumber: "1234567", HolderName: "holder"})
+			if err != nil {
+				t.Fatalf("failed to add bank account: %s", err)
+			}
+
+			payout, err := repo.RequestPayout(ctx, domain.Payout{UserID: userID, BankAccountID: account.ID, Amount: tt.amount, Fee: 200})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if err == nil {
+				if balance := getTestBalance(t, sqlDB, userID); balance != 1500-tt.amount {
+					t.Errorf("expected the amount to leave the balance at once, got %d", balance)
+				}
+				claimed, err := repo.ClaimPendingPayouts(ctx, 10)
+				if err != nil {
+					t.Fatalf("failed to claim payouts: %s", err)
+				}
+				if len(claimed) != 1 || claimed[0].ID != payout.ID {
+					t.Fatalf("expected the payout to be claimed, got %+v", claimed)
+				}
+				if again, err := repo.ClaimPendingPayouts(ctx, 10); err != nil || len(again) != 0 {
+					t.Fatalf("expected the payout to be claimed only once, got %+v, %v", again, err)
+				}
+				if tt.paid {
+					err = repo.MarkPayoutPaid(ctx, payout.ID, "tr_1")
+				} else {
+					err = repo.MarkPayoutFailed(ctx, payout.ID, "closed account")
+				}
+				if err != nil {
+					t.Fatalf("failed to settle payout: %s", err)
+				}
+				// A payout is settled only once.
+				if err := repo.MarkPayoutPaid(ctx, payout.ID, "tr_2"); !errors.Is(err, ErrPayoutNotFound) {
+					t.Errorf("expected ErrPayoutNotFound, got %v", err)
+				}
+				if err := repo.MarkPayoutFailed(ctx, payout.ID, "again"); !errors.Is(err, ErrPayoutNotFound) {
+					t.Errorf("expected ErrPayoutNotFound, got %v", err)
+				}
+
+				payouts, err := repo.GetPayoutsByUserID(ctx, userID)
+				if err != nil {
+					t.Fatalf("failed to get payouts: %s", err)
+				}
+				if len(payouts) != 1 || payouts[0].Status != tt.wantStatus {
+					t.Errorf("expected one payout with status %d, got %+v", tt.wantStatus, payouts)
+				}
+			}
+
+			if balance := getTestBalance(t, sqlDB, userID); balance != tt.wantBalance {
+				t.Errorf("expected balance %d, got %d", tt.wantBalance, balance)
+			}
+			if clearing := getTestAccount(t, sqlDB, domain.AccountPayoutClearing); clearing != tt.wantClear {
+				t.Errorf("expected clearing %d, got %d", tt.wantClear, clearing)
+			}
+			if platform := getTestAccount(t, sqlDB, domain.AccountPlatform); platform != tt.wantFee {
+				t.Errorf("expected the platform to earn %d, got %d", tt.wantFee, platform)
+			}
+		})
+	}
+}
+
+func TestRequestPayoutOtherUsersAccount(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewPayoutRepository(sqlDB)
+	ctx := context.Background()
+	ownerID := addTestUser(t, sqlDB, 0)
+	otherID := addTestUser(t, sqlDB, 0)
+	if err := NewLedgerRepository(sqlDB).TopUp(ctx, otherID, 1000); err != nil {
+		t.Fatalf("failed to top up: %s", err)
+	}
+	account, err := repo.AddBankAccount(ctx, domain.BankAccount{UserID: ownerID, BankName: "bank", BranchName: "branch", AccountNumber: "1234567", HolderName: "holder"})
+	if err != nil {
+		t.Fatalf("failed to add bank account: %s", err)
+	}
+
+	if _, err := repo.RequestPayout(ctx, domain.Payout{UserID: otherID, BankAccountID: account.ID, Amount: 100}); !errors.Is(err, ErrBankAccountNotFound) {
+		t.Errorf("expected ErrBankAccountNotFound, got %v", err)
+	}
+	if balance := getTestBalance(t, sqlDB, otherID); balance != 1000 {
+		t.Errorf("expected the balance to stay 1000, got %d", balance)
+	}
+}
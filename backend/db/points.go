@@ -0,0 +1,225 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+var ErrInsufficientPoints = errors.New("insufficient points")
+
+// DefaultPointsPolicy decides how many points buyers earn and how long they
+// last. It is configured on startup.
+var DefaultPointsPolicy = domain.PointsPolicy{EarnBasisPoints: 100, TTL: 365 * 24 * time.Hour}
+
+type PointsRepository interface {
+	GetBalance(ctx context.Context, userID int64) (int64, error)
+	GetEntries(ctx context.Context, userID int64, limit, offset int) ([]domain.PointEntry, error)
+	CountEntries(ctx context.Context, userID int64) (int64, error)
+	GetUpcomingExpirations(ctx context.Context, userID int64) ([]domain.PointLot, error)
+	ExpirePoints(ctx context.Context) (int64, error)
+}
+
+type PointsDBRepository struct {
+	*sql.DB
+}
+
+func NewPointsRepository(db *sql.DB) PointsRepository {
+	return &PointsDBRepository{DB: db}
+}
+
+func (r *PointsDBRepository) GetBalance(ctx context.Context, userID int64) (int64, error) {
+	return getPointsBalance(ctx, r.DB, userID)
+}
+
+func (r *PointsDBRepository) GetEntries(ctx context.Context, userID int64, limit, offset int) ([]domain.PointEntry, error) {
+	rows, err := r.QueryContext(ctx, "SELECT id, user_id, kind, amount, COALESCE(order_id, 0), created_at FROM point_entries WHERE user_id = ? ORDER BY id desc LIMIT ? OFFSET ?", userID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []domain.PointEntry
+	for rows.Next() {
+		var entry domain.PointEntry
+		if err := rows.Scan(&entry.ID, &entry.UserID, &entry.Kind, &entry.Amount, &entry.OrderID, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (r *PointsDBRepository) CountEntries(ctx context.Context, userID int64) (int64, error) {
+	var count int64
+	return count, r.QueryRowContext(ctx, "SELECT COUNT(*) FROM point_entries WHERE user_id = ?", userID).Scan(&count)
+}
+
+// GetUpcomingExpirations returns the user's lots that still hold points,
+// the one expiring first first.
+func (r *PointsDBRepository) GetUpcomingExpirations(ctx context.Context, userID int64) ([]domain.PointLot, error) {
+	rows, err := r.QueryContext(ctx, "SELECT id, user_id, amount, remaining, expires_at, created_at FROM point_lots WHERE user_id = ? AND remaining > 0 AND expires_at > DATETIME('now', 'localtime') ORDER BY expires_at, id", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lots []domain.PointLot
+	for rows.Next() {
+		var lot domain.PointLot
+		if err := rows.Scan(&lot.ID, &lot.UserID, &lot.Amount, &lot.Remaining, &lot.ExpiresAt, &lot.CreatedAt); err != nil {
+			return nil, err
+		}
+		lots = append(lots, lot)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return lots, nil
+}
+
+// ExpirePoints empties the lots whose expiry has passed and records what
+// each user lost in their history. Expired points cannot be spent even
+// before this runs; it only makes the history complete.
+func (r *PointsDBRepository) ExpirePoints(ctx context.Context) (int64, error) {
+	var expired int64
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		rows, err := tx.QueryContext(ctx, "SELECT user_id, SUM(remaining) FROM point_lots WHERE remaining > 0 AND expires_at <= DATETIME('now', 'localtime') GROUP BY user_id")
+		if err != nil {
+			return err
+		}
+		type userPoints struct {
+			userID int64
+			amount int64
+		}
+		var users []userPoints
+		for rows.Next() {
+			var u userPoints
+			if err := rows.Scan(&u.userID, &u.amount); err != nil {
+				rows.Close()
+				return err
+			}
+			users = append(users, u)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, u := range users {
+			if err := addPointEntry(ctx, tx, u.userID, domain.PointEntryExpired, -u.amount, 0); err != nil {
+				return err
+			}
+			expired += u.amount
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE point_lots SET remaining = 0 WHERE remaining > 0 AND expires_at <= DATETIME('now', 'localtime')")
+		return err
+	})
+	return expired, err
+}
+
+func getPointsBalance(ctx context.Context, q dbtx, userID int64) (int64, error) {
+	var balance int64
+	return balance, q.QueryRowContext(ctx, "SELECT COALESCE(SUM(remaining), 0) FROM point_lots WHERE user_id = ? AND expires_at > DATETIME('now', 'localtime')", userID).Scan(&balance)
+}
+
+// addPoints gives the user a new lot of points valid for the policy's TTL.
+func addPoints(ctx context.Context, tx *sql.Tx, userID int64, kind domain.PointEntryKind, amount int64, orderID int64) error {
+	if amount <= 0 {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO point_lots (user_id, amount, remaining, expires_at) VALUES (?, ?, ?, DATETIME('now', 'localtime', ?))", userID, amount, amount, secondsModifier(DefaultPointsPolicy.TTL)); err != nil {
+		return err
+	}
+	return addPointEntry(ctx, tx, userID, kind, amount, orderID)
+}
+
+// spendPoints takes amount points from the user's valid lots, the one
+// expiring first first, and records which lots paid for the order.
+func spendPoints(ctx context.Context, tx *sql.Tx, userID int64, amount int64, orderID int64) error {
+	if amount <= 0 {
+		return nil
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, remaining FROM point_lots WHERE user_id = ? AND remaining > 0 AND expires_at > DATETIME('now', 'localtime') ORDER BY expires_at, id", userID)
+	if err != nil {
+		return err
+	}
+	var lots []domain.PointLot
+	for rows.Next() {
+		var lot domain.PointLot
+		if err := rows.Scan(&lot.ID, &lot.Remaining); err != nil {
+			rows.Close()
+			return err
+		}
+		lots = append(lots, lot)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	left := amount
+	for _, lot := range lots {
+		if left == 0 {
+			break
+		}
+		take := lot.Remaining
+		if take > left {
+			take = left
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE point_lots SET remaining = remaining - ? WHERE id = ?", take, lot.ID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO point_lot_spends (order_id, lot_id, amount) VALUES (?, ?, ?)", orderID, lot.ID, take); err != nil {
+			return err
+		}
+		left -= take
+	}
+	if left > 0 {
+		return ErrInsufficientPoints
+	}
+	return addPointEntry(ctx, tx, userID, domain.PointEntrySpent, -amount, orderID)
+}
+
+// refundPoints puts the points spent on a cancelled order back into the lots
+// they were taken from, which keep their expiry; points whose lot expired
+// meanwhile expire again. Orders from before the lots were recorded get a
+// new lot instead.
+func refundPoints(ctx context.Context, tx *sql.Tx, userID int64, amount int64, orderID int64) error {
+	if amount <= 0 {
+		return nil
+	}
+	res, err := tx.ExecContext(ctx, "UPDATE point_lots SET remaining = remaining + (SELECT amount FROM point_lot_spends WHERE order_id = ? AND lot_id = point_lots.id) WHERE id IN (SELECT lot_id FROM point_lot_spends WHERE order_id = ?)", orderID, orderID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return addPoints(ctx, tx, userID, domain.PointEntryRefunded, amount, orderID)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM point_lot_spends WHERE order_id = ?", orderID); err != nil {
+		return err
+	}
+	return addPointEntry(ctx, tx, userID, domain.PointEntryRefunded, amount, orderID)
+}
+
+func addPointEntry(ctx context.Context, tx *sql.Tx, userID int64, kind domain.PointEntryKind, amount int64, orderID int64) error {
+	var order sql.NullInt64
+	if orderID != 0 {
+		order = sql.NullInt64{Int64: orderID, Valid: true}
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO point_entries (user_id, kind, amount, order_id) VALUES (?, ?, ?, ?)", userID, kind, amount, order); err != nil {
+		return err
+	}
+	return nil
+}
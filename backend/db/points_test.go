@@ -0,0 +1,136 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+func TestSpendPoints(t *testing.T) {
+	const day = 24 * time.Hour
+
+	tests := []struct {
+		name string
+		// lots are the TTLs and amounts of the user's lots.
+		lots          []time.Duration
+		amounts       []int64
+		spend         int64
+		wantErr       error
+		wantRemaining []int64
+	}{
+		{name: "earliest expiry first", lots: []time.Duration{3 * day, day, 2 * day}, amounts: []int64{100, 100, 100}, spend: 150, wantRemaining: []int64{100, 0, 50}},
+		{name: "all", lots: []time.Duration{day, 2 * day}, amounts: []int64{100, 100}, spend: 200, wantRemaining: []int64{0, 0}},
+		{name: "expired lots are skipped", lots: []time.Duration{-day, day}, amounts: []int64{100, 100}, spend: 50, wantRemaining: []int64{100, 50}},
+		{name: "expired lots do not count", lots: []time.Duration{-day, day}, amounts: []int64{100, 100}, spend: 150, wantErr: ErrInsufficientPoints, wantRemaining: []int64{100, 100}},
+		{name: "nothing", lots: []time.Duration{day}, amounts: []int64{100}, spend: 0, wantRemaining: []int64{100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			ctx := context.Background()
+			userID := addTestUser(t, sqlDB, 0)
+			lotIDs := make([]int64, len(tt.lots))
+			for i, ttl := range tt.lots {
+				lotIDs[i] = addTestPointLot(t, sqlDB, userID, tt.amounts[i], ttl)
+			}
+
+			err := withTx(ctx, sqlDB, func(tx *sql.Tx) error {
+				return spendPoints(ctx, tx, userID, tt.spend, 0)
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			for i, lotID := range lotIDs {
+				if got := getTestLotRemaining(t, sqlDB, lotID); got != tt.wantRemaining[i] {
+					t.Errorf("lot %d: expected %d left, got %d", i, tt.wantRemaining[i], got)
+				}
+			}
+		})
+	}
+}
+
+func TestPurchaseWithPoints(t *testing.T) {
+	tests := []struct {
+		name        string
+		points      int64
+		have        int64
+		wantErr     error
+		wantUsed    int64
+		wantBalance int64
+	}{
+		{name: "part", points: 300, have: 500, wantUsed: 300, wantBalance: 300},
+		{name: "capped at the price", points: 5000, have: 5000, wantUsed: 1000, wantBalance: 1000},
+		{name: "not enough", points: 600, have: 500, wantErr: ErrInsufficientPoints, wantBalance: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			ctx := context.Background()
+			sellerID := addTestUser(t, sqlDB, 0)
+			buyerID := addTestUser(t, sqlDB, 1000)
+			addTestPointLot(t, sqlDB, buyerID, tt.have, 24*time.Hour)
+
+			orders, err := NewPurchaseRepository(sqlDB).Purchase(ctx, buyerID, addTestItem(t, sqlDB, sellerID, 1000), 1, "", tt.points)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && orders[0].PointsUsed != tt.wantUsed {
+				t.Errorf("expected %d points used, got %d", tt.wantUsed, orders[0].PointsUsed)
+			}
+			if balance := getTestBalance(t, sqlDB, buyerID); balance != tt.wantBalance {
+				t.Errorf("expected balance %d, got %d", tt.wantBalance, balance)
+			}
+			points, err := NewPointsRepository(sqlDB).GetBalance(ctx, buyerID)
+			if err != nil {
+				t.Fatalf("failed to get points: %s", err)
+			}
+			if points != tt.have-tt.wantUsed {
+				t.Errorf("expected %d points left, got %d", tt.have-tt.wantUsed, points)
+			}
+		})
+	}
+}
+
+func TestExpirePoints(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewPointsRepository(sqlDB)
+	ctx := context.Background()
+
+	first := addTestUser(t, sqlDB, 0)
+	second := addTestUser(t, sqlDB, 0)
+	addTestPointLot(t, sqlDB, first, 100, -time.Hour)
+	addTestPointLot(t, sqlDB, first, 50, -2*time.Hour)
+	valid := addTestPointLot(t, sqlDB, first, 70, time.Hour)
+	addTestPointLot(t, sqlDB, second, 30, -time.Hour)
+
+	expired, err := repo.ExpirePoints(ctx)
+	if err != nil {
+		t.Fatalf("failed to expire points: %s", err)
+	}
+	if expired != 180 {
+		t.Errorf("expected 180 points to expire, got %d", expired)
+	}
+	if again, err := repo.ExpirePoints(ctx); err != nil || again != 0 {
+		t.Errorf("expected nothing left to expire, got %d, %v", again, err)
+	}
+
+	entries, err := repo.GetEntries(ctx, first, 10, 0)
+	if err != nil {
+		t.Fatalf("failed to get entries: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Kind != domain.PointEntryExpired || entries[0].Amount != -150 {
+		t.Errorf("expected one entry for the 150 expired points, got %+v", entries)
+	}
+
+	lots, err := repo.GetUpcomingExpirations(ctx, first)
+	if err != nil {
+		t.Fatalf("failed to get lots: %s", err)
+	}
+	if len(lots) != 1 || lots[0].ID != valid || lots[0].Remaining != 70 {
+		t.Errorf("expected only the valid lot, got %+v", lots)
+	}
+}
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"math"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrItemNotFound        = errors.New("item not found")
+	ErrItemNotOnSale       = errors.New("item is not on sale")
+	ErrOwnItem             = errors.New("item is listed by the buyer")
+	ErrUserNotFound        = errors.New("user not found")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrOutOfStock          = errors.New("not enough units in stock")
+	ErrInvalidStock        = errors.New("stock must be between 1 and MaxStock")
+	ErrInvalidQuantity     = errors.New("quantity must be between 1 and MaxStock")
+	ErrAmountTooLarge      = errors.New("amount is too large")
+)
+
+// MaxStock is the most units an item can be listed with, and so the most a
+// single purchase can buy.
+const MaxStock = 1000
+
+type PurchaseRepository interface {
+	Purchase(ctx context.Context, buyerID int64, itemID int32, quantity int64, couponCode string, points int64) ([]domain.Order, error)
+}
+
+type PurchaseDBRepository struct {
+	*sql.DB
+}
+
+func NewPurchaseRepository(db *sql.DB) PurchaseRepository {
+	return &PurchaseDBRepository{DB: db}
+}
+
+// Purchase buys quantity units of the item in a single transaction: it takes
+// them from the stock, creates one paid order per unit and moves each unit's
+// price from the buyer into escrow. The stock update only matches while the
+// item is on sale with enough units left, so concurrent buyers can never
+// oversell; the losers get ErrItemNotOnSale or ErrOutOfStock. The item is
+// sold out once its stock reaches zero. A buyer holding an accepted offer pays
+// the offered price for one unit, and a reserved item goes back on sale
+// once the reservation is used up or has lapsed. A coupon code, if given, discounts the
+// purchase; the platform pays the discount into escrow so the seller still
+// receives the full price. Loyalty points work the same way: up to points of
+// them pay for what is left after the discount, and the balance pays the
+// rest. Purchases that would break the buyer's limits return a LimitError
+// and are recorded as violations.
+func (r *PurchaseDBRepository) Purchase(ctx context.Context, buyerID int64, itemID int32, quantity int64, couponCode string, points int64) ([]domain.Order, error) {
+	if quantity < 1 || quantity > MaxStock {
+		return nil, ErrInvalidQuantity
+	}
+	var orders []domain.Order
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var (
+			sellerID    int64
+			price       int64
+			status      domain.ItemStatus
+			listingType domain.ListingType
+			stock       int64
+			categoryID  int64
+		)
+		row := tx.QueryRowContext(ctx, "SELECT seller_id, price, status, listing_type, stock, category_id FROM items WHERE id = ?", itemID)
+		if err := row.Scan(&sellerID, &price, &status, &listingType, &stock, &categoryID); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrItemNotFound
+			}
+			return err
+		}
+
+		if sellerID == buyerID {
+			return ErrOwnItem
+		}
+		if status != domain.ItemStatusOnSale && status != domain.ItemStatusReserved {
+			return ErrItemNotOnSale
+		}
+		if listingType == domain.ListingTypeAuction {
+			return ErrAuctionItem
+		}
+		if quantity > stock {
+			return ErrOutOfStock
+		}
+
+		prices := make([]int64, quantity)
+		for i := range prices {
+			prices[i] = price
+		}
+
+		// An accepted offer reserves the item for its buyer at the agreed
+		// price.
+		reservation, err := getReservation(ctx, tx, itemID)
+		switch {
+		case err == nil:
+			if reservation.BuyerID != buyerID {
+				return ErrItemReserved
+			}
+			prices[0] = reservation.Price
+			if err := closeOffer(ctx, tx, reservation.ID, domain.OfferStatusPurchased); err != nil {
+				return err
+			}
+		case err != ErrOfferNotFound:
+			return err
+		}
+
+		var total int64
+		for _, price := range prices {
+			if price > math.MaxInt64-total {
+				return ErrAmountTooLarge
+			}
+			total += price
+		}
+		if err := checkPurchase(ctx, tx, buyerID, total, quantity); err != nil {
+			return err
+		}
+
+		var (
+			coupon   domain.Coupon
+			discount int64
+		)
+		if couponCode != "" {
+			coupon, discount, err = claimCoupon(ctx, tx, couponCode, buyerID, categoryID, total)
+			if err != nil {
+				return err
+			}
+		}
+
+		// Points beyond what is left to pay are not spent.
+		if points > total-discount {
+			points = total - discount
+		}
+		if points > 0 {
+			pointsBalance, err := getPointsBalance(ctx, tx, buyerID)
+			if err != nil {
+				return err
+			}
+			if pointsBalance < points {
+				return ErrInsufficientPoints
+			}
+		}
+
+		// The orders refer to the revision the buyer saw, not to the one
+		// this purchase records.
+		revisionID, err := latestItemRevisionID(ctx, tx, itemID)
+		if err != nil {
+			return err
+		}
+
+		var event domain.ItemEvent
+		changesStatus := true
+		switch {
+		case quantity == stock:
+			event = domain.ItemEventSellOut
+		case status == domain.ItemStatusReserved:
+			event = domain.ItemEventRelease
+		default:
+			changesStatus = false
+		}
+		next := status
+		if changesStatus {
+			if next, err = status.Next(event); err != nil {
+				return err
+			}
+		}
+		res, err := tx.ExecContext(ctx, "UPDATE items SET stock = stock - ?, status = ? WHERE id = ? AND status = ? AND stock >= ?", quantity, next, itemID, status, quantity)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(res, ErrItemNotOnSale); err != nil {
+			return err
+		}
+		if changesStatus {
+			if err := addItemRevision(ctx, tx, itemID, buyerID, event.String()); err != nil {
+				return err
+			}
+		}
+		if quantity == stock {
+			if err := expireOpenOffers(ctx, tx, itemID); err != nil {
+				return err
+			}
+		}
+
+		// The discount and then the points are spread over the units in
+		// order, so that every order knows how much of its price the platform
+		// paid.
+		remainingDiscount, remainingPoints := discount, points
+		for _, price := range prices {
+			unitDiscount := remainingDiscount
+			if unitDiscount > price {
+				unitDiscount = price
+			}
+			remainingDiscount -= unitDiscount
+			unitPoints := remainingPoints
+			if unitPoints > price-unitDiscount {
+				unitPoints = price - unitDiscount
+			}
+			remainingPoints -= unitPoints
+
+			postings := []posting{
+				{AccountID: buyerID, Kind: domain.LedgerEntryPurchase, Amount: -(price - unitDiscount - unitPoints)},
+				{AccountID: domain.AccountEscrow, Kind: domain.LedgerEntryPurchase, Amount: price},
+			}
+			if unitDiscount > 0 {
+				postings = append(postings, posting{AccountID: domain.AccountPlatform, Kind: domain.LedgerEntryCouponDiscount, Amount: -unitDiscount})
+			}
+			if unitPoints > 0 {
+				postings = append(postings, posting{AccountID: domain.AccountPlatform, Kind: domain.LedgerEntryPointsRedemption, Amount: -unitPoints})
+			}
+			if err := postJournal(ctx, tx, itemID, postings...); err != nil {
+				return err
+			}
+
+			order, err := insertOrder(ctx, tx, domain.Order{ItemID: itemID, BuyerID: buyerID, SellerID: sellerID, Price: price, Discount: unitDiscount, PointsUsed: unitPoints, ItemRevisionID: revisionID})
+			if err != nil {
+				return err
+			}
+			if err := spendPoints(ctx, tx, buyerID, unitPoints, order.ID); err != nil {
+				return err
+			}
+			orders = append(orders, order)
+		}
+
+		if couponCode != "" {
+			var discounted []int64
+			for _, order := range orders {
+				if order.Discount > 0 {
+					discounted = append(discounted, order.ID)
+				}
+			}
+			return redeemCoupon(ctx, tx, domain.CouponRedemption{CouponID: coupon.ID, UserID: buyerID, OrderID: orders[0].ID, Discount: discount}, discounted)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, recordViolation(ctx, r.DB, buyerID, err)
+	}
+	return orders, nil
+}
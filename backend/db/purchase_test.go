@@ -0,0 +1,263 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	sqlDB, err := openDB(filepath.Join(t.TempDir(), "test.sqlite3"))
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	schema, err := os.ReadFile(filepath.Join("..", "sql", "01_schema.sql"))
+	if err != nil {
+		t.Fatalf("failed to read schema: %s", err)
+	}
+	if _, err := sqlDB.Exec(string(schema)); err != nil {
+		t.Fatalf("failed to apply schema: %s", err)
+	}
+	return sqlDB
+}
+
+func addTestUser(t *testing.T, sqlDB *sql.DB, balance int64) int64 {
+	t.Helper()
+
+	res, err := sqlDB.Exec("INSERT INTO users (name, password, balance) VALUES (?, ?, ?)", "user", "password", balance)
+	if err != nil {
+		t.Fatalf("failed to add user: %s", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get user id: %s", err)
+	}
+	return id
+}
+
+func addTestItem(t *testing.T, sqlDB *sql.DB, sellerID int64, price int64) int32 {
+	t.Helper()
+
+	res, err := sqlDB.Exec("INSERT INTO items (name, price, description, category_id, seller_id, status) VALUES (?, ?, ?, ?, ?, ?)", "item", price, "description", 1, sellerID, domain.ItemStatusOnSale)
+	if err != nil {
+		t.Fatalf("failed to add item: %s", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get item id: %s", err)
+	}
+	return int32(id)
+}
+
+func getTestBalance(t *testing.T, sqlDB *sql.DB, userID int64) int64 {
+	t.Helper()
+
+	var balance int64
+	if err := sqlDB.QueryRow("SELECT balance FROM users WHERE id = ?", userID).Scan(&balance); err != nil {
+		t.Fatalf("failed to get balance: %s", err)
+	}
+	return balance
+}
+
+func TestPurchaseConcurrent(t *testing.T) {
+	const (
+		buyers       = 50
+		price        = 300
+		startBalance = 1000
+	)
+
+	sqlDB := newTestDB(t)
+	repo := NewPurchaseRepository(sqlDB)
+
+	sellerID := addTestUser(t, sqlDB, 0)
+	itemID := addTestItem(t, sqlDB, sellerID, price)
+	buyerIDs := make([]int64, buyers)
+	for i := range buyerIDs {
+		buyerIDs[i] = addTestUser(t, sqlDB, startBalance)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, buyers)
+	start := make(chan struct{})
+	for i, buyerID := range buyerIDs {
+		wg.Add(1)
+		go func(i int, buyerID int64) {
+			defer wg.Done()
+			<-start
+			_, errs[i] = repo.Purchase(context.Background(), buyerID, itemID, 1, "", 0)
+		}(i, buyerID)
+	}
+	close(start)
+	wg.Wait()
+
+	var succeeded int
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.Is(err, ErrItemNotOnSale):
+		default:
+			t.Errorf("buyer %d: unexpected error: %s", buyerIDs[i], err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("expected exactly one successful purchase, got %d", succeeded)
+	}
+
+	var total int64
+	for _, buyerID := range buyerIDs {
+		balance := getTestBalance(t, sqlDB, buyerID)
+		if balance != startBalance && balance != startBalance-price {
+			t.Errorf("buyer %d: unexpected balance %d", buyerID, balance)
+		}
+		total += balance
+	}
+	if sellerBalance := getTestBalance(t, sqlDB, sellerID); sellerBalance != 0 {
+		t.Errorf("expected the seller to be paid only on completion, got balance %d", sellerBalance)
+	}
+	var escrow int64
+	if err := sqlDB.QueryRow("SELECT COALESCE(SUM(amount), 0) FROM ledger_entries WHERE account_id = ?", domain.AccountEscrow).Scan(&escrow); err != nil {
+		t.Fatalf("failed to read escrow: %s", err)
+	}
+	if total+escrow != buyers*startBalance {
+		t.Errorf("balances do not add up: buyers %d, escrow %d", total, escrow)
+	}
+
+	var orders int
+	if err := sqlDB.QueryRow("SELECT COUNT(*) FROM orders WHERE item_id = ?", itemID).Scan(&orders); err != nil {
+		t.Fatalf("failed to count orders: %s", err)
+	}
+	if orders != 1 {
+		t.Errorf("expected one order, got %d", orders)
+	}
+
+	var entries, sum int64
+	if err := sqlDB.QueryRow("SELECT COUNT(*), COALESCE(SUM(amount), 0) FROM ledger_entries").Scan(&entries, &sum); err != nil {
+		t.Fatalf("failed to read ledger: %s", err)
+	}
+	if entries != 2 || sum != 0 {
+		t.Errorf("expected one balanced purchase journal, got %d entries summing to %d", entries, sum)
+	}
+
+	var status domain.ItemStatus
+	if err := sqlDB.QueryRow("SELECT status FROM items WHERE id = ?", itemID).Scan(&status); err != nil {
+		t.Fatalf("failed to get item status: %s", err)
+	}
+	if status != domain.ItemStatusSoldOut {
+		t.Errorf("expected item to be sold out, got status %d", status)
+	}
+}
+
+func TestPurchaseRollsBackOnInsufficientBalance(t *testing.T) {
+	sqlDB := newTestDB(t)
+	repo := NewPurchaseRepository(sqlDB)
+
+	sellerID := addTestUser(t, sqlDB, 0)
+	buyerID := addTestUser(t, sqlDB, 100)
+	itemID := addTestItem(t, sqlDB, sellerID, 300)
+
+	if _, err := repo.Purchase(context.Background(), buyerID, itemID, 1, "", 0); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("expected ErrInsufficientBalance, got %v", err)
+	}
+
+	var status domain.ItemStatus
+	if err := sqlDB.QueryRow("SELECT status FROM items WHERE id = ?", itemID).Scan(&status); err != nil {
+		t.Fatalf("failed to get item status: %s", err)
+	}
+	if status != domain.ItemStatusOnSale {
+		t.Errorf("expected item to stay on sale, got status %d", status)
+	}
+	if balance := getTestBalance(t, sqlDB, buyerID); balance != 100 {
+		t.Errorf("expected buyer balance to stay 100, got %d", balance)
+	}
+	if balance := getTestBalance(t, sqlDB, sellerID); balance != 0 {
+		t.Errorf("expected seller balance to stay 0, got %d", balance)
+	}
+}
+
+func TestPurchaseStockConcurrent(t *testing.T) {
+	const (
+		buyers = 30
+		stock  = 5
+		price  = 100
+	)
+
+	sqlDB := newTestDB(t)
+	repo := NewPurchaseRepository(sqlDB)
+
+	sellerID := addTestUser(t, sqlDB, 0)
+	itemID := addTestItem(t, sqlDB, sellerID, price)
+	if _, err := sqlDB.Exec("UPDATE items SET stock = ? WHERE id = ?", stock, itemID); err != nil {
+		t.Fatalf("failed to set stock: %s", err)
+	}
+	buyerIDs := make([]int64, buyers)
+	for i := range buyerIDs {
+		buyerIDs[i] = addTestUser(t, sqlDB, 1000)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, buyers)
+	start := make(chan struct{})
+	for i, buyerID := range buyerIDs {
+		wg.Add(1)
+		go func(i int, buyerID int64) {
+			defer wg.Done()
+			<-start
+			// Every buyer wants two units, so only two purchases fit and the
+			// last unit can only be bought on its own.
+			_, errs[i] = repo.Purchase(context.Background(), buyerID, itemID, 2, "", 0)
+		}(i, buyerID)
+	}
+	close(start)
+	wg.Wait()
+
+	var succeeded int
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.Is(err, ErrOutOfStock):
+		default:
+			t.Errorf("buyer %d: unexpected error: %s", buyerIDs[i], err)
+		}
+	}
+	if succeeded != 2 {
+		t.Fatalf("expected two successful purchases, got %d", succeeded)
+	}
+
+	orders, err := repo.Purchase(context.Background(), buyerIDs[0], itemID, 1, "", 0)
+	if err != nil {
+		t.Fatalf("failed to buy the last unit: %s", err)
+	}
+	if len(orders) != 1 {
+		t.Errorf("expected one order, got %d", len(orders))
+	}
+
+	var (
+		left   int64
+		status domain.ItemStatus
+		count  int
+	)
+	if err := sqlDB.QueryRow("SELECT stock, status FROM items WHERE id = ?", itemID).Scan(&left, &status); err != nil {
+		t.Fatalf("failed to get item: %s", err)
+	}
+	if left != 0 || status != domain.ItemStatusSoldOut {
+		t.Errorf("expected the item to be sold out with no stock, got stock %d and status %d", left, status)
+	}
+	if err := sqlDB.QueryRow("SELECT COUNT(*) FROM orders WHERE item_id = ?", itemID).Scan(&count); err != nil {
+		t.Fatalf("failed to count orders: %s", err)
+	}
+	if count != stock {
+		t.Errorf("expected one order per unit, got %d orders", count)
+	}
+}
@@ -5,12 +5,17 @@ import (
 	"database/sql"
 
 	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+	"github.com/pkg/errors"
 )
 
+// ErrItemModified is returned when an item changed since the version the
+// client edited.
+var ErrItemModified = errors.New("item was modified by someone else")
+
 type UserRepository interface {
 	AddUser(ctx context.Context, user domain.User) (int64, error)
 	GetUser(ctx context.Context, id int64) (domain.User, error)
-	UpdateBalance(ctx context.Context, id int64, balance int64) error
 }
 
 type UserDBRepository struct {
@@ -40,24 +45,28 @@ func (r *UserDBRepository) GetUser(ctx context.Context, id int64) (domain.User,
 	return user, row.Scan(&user.ID, &user.Name, &user.Password, &user.Balance)
 }
 
-func (r *UserDBRepository) UpdateBalance(ctx context.Context, id int64, balance int64) error {
-	if _, err := r.ExecContext(ctx, "UPDATE users SET balance = ? WHERE id = ?", balance, id); err != nil {
-		return err
-	}
-	return nil
-}
-
 type ItemRepository interface {
-	AddItem(ctx context.Context, item domain.Item) (domain.Item, error)
+	AddItem(ctx context.Context, item domain.Item, images []domain.Image) (domain.Item, error)
 	GetItem(ctx context.Context, id int32) (domain.Item, error)
-	GetItemImage(ctx context.Context, id int32) ([]byte, error)
+	GetItemImage(ctx context.Context, id int32) (domain.Image, error)
+	GetItemImages(ctx context.Context, itemID int32) ([]domain.ItemImage, error)
+	GetItemImageAt(ctx context.Context, itemID int32, position int) (domain.Image, error)
+	GetItemImageVariant(ctx context.Context, itemID int32, position int, size domain.ImageSize) (domain.Image, error)
+	LoadImage(ctx context.Context, image domain.Image) (domain.Image, error)
+	GetDuplicateImageFlags(ctx context.Context, limit, offset int) ([]domain.DuplicateImageFlag, error)
+	CountDuplicateImageFlags(ctx context.Context) (int64, error)
+	AddItemImageVariant(ctx context.Context, imageID int64, size domain.ImageSize, variant domain.Image) (domain.Image, error)
+	ReorderItemImages(ctx context.Context, itemID int32, sellerID int64, version int64, order []int) (domain.Item, error)
 	GetOnSaleItems(ctx context.Context) ([]domain.Item, error)
 	GetItemsByUserID(ctx context.Context, userID int64) ([]domain.Item, error)
 	GetItemsByName(ctx context.Context, searchWord string) ([]domain.Item, error)
 	GetCategory(ctx context.Context, id int64) (domain.Category, error)
 	GetCategories(ctx context.Context) ([]domain.Category, error)
-	UpdateItem(ctx context.Context, item domain.Item) (domain.Item, error)
-	UpdateItemStatus(ctx context.Context, id int32, status domain.ItemStatus) error
+	GetFeeRule(ctx context.Context, categoryID int64) (domain.FeeRule, error)
+	UpdateItem(ctx context.Context, id int32, sellerID int64, version int64, patch domain.ItemPatch) (domain.Item, error)
+	ChangeItemStatus(ctx context.Context, id int32, sellerID int64, event domain.ItemEvent, endsAt string) (domain.Item, error)
+	GetItemRevisions(ctx context.Context, itemID int32, limit, offset int) ([]domain.ItemRevision, error)
+	CountItemRevisions(ctx context.Context, itemID int32) (int64, error)
 	GetFolders(ctx context.Context, id int64) ([]domain.FavoriteFolder, error)
 	AddItemToFavoriteFolder(ctx context.Context, itemID int32, folderID int32) error
 	GetFavoriteItems(ctx context.Context, folderID int64) ([]domain.FavoriteItem, error)
@@ -65,47 +74,107 @@ type ItemRepository interface {
 	AddFavoriteFolder(ctx context.Context, userID int64, folderName string) error
 }
 
+const itemColumns = "id, name, price, description, category_id, seller_id, status, created_at, updated_at, listing_type, min_increment, COALESCE(ends_at, ''), stock, version"
+
 type ItemDBRepository struct {
 	*sql.DB
+	// Images holds the image files; the tables only keep their keys.
+	Images imagestore.Store
 }
 
-func NewItemRepository(db *sql.DB) ItemRepository {
-	return &ItemDBRepository{DB: db}
+func NewItemRepository(db *sql.DB, images imagestore.Store) ItemRepository {
+	return &ItemDBRepository{DB: db, Images: images}
 }
 
-func (r *ItemDBRepository) AddItem(ctx context.Context, item domain.Item) (domain.Item, error) {
-	if _, err := r.ExecContext(ctx, "INSERT INTO items (name, price, description, category_id, seller_id, image, status) VALUES (?, ?, ?, ?, ?, ?, ?)", item.Name, item.Price, item.Description, item.CategoryID, item.UserID, item.Image, item.Status); err != nil {
-		return domain.Item{}, err
+// AddItem lists a new item with its images, the first being the cover.
+// Its stock must be between 1 and MaxStock.
+func (r *ItemDBRepository) AddItem(ctx context.Context, item domain.Item, images []domain.Image) (domain.Item, error) {
+	var added domain.Item
+	if item.Stock < 1 || item.Stock > MaxStock {
+		return added, ErrInvalidStock
 	}
-	// TODO: if other insert query is executed at the same time, it might return wrong id
-	// http.StatusConflict(409) 既に同じIDがあった場合
-	row := r.QueryRowContext(ctx, "SELECT * FROM items WHERE rowid = LAST_INSERT_ROWID()")
-
-	var res domain.Item
-	return res, row.Scan(&res.ID, &res.Name, &res.Price, &res.Description, &res.CategoryID, &res.UserID, &res.Image, &res.Status, &res.CreatedAt, &res.UpdatedAt)
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO items (name, price, description, category_id, seller_id, status, listing_type, min_increment, ends_at, stock) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", item.Name, item.Price, item.Description, item.CategoryID, item.UserID, item.Status, item.ListingType, item.MinIncrement, nullString(item.EndsAt), item.Stock); err != nil {
+			return err
+		}
+		var err error
+		added, err = scanItem(tx.QueryRowContext(ctx, "SELECT "+itemColumns+" FROM items WHERE rowid = LAST_INSERT_ROWID()"))
+		if err != nil {
+			return err
+		}
+		if err := insertItemImages(ctx, tx, r.Images, added.ID, images); err != nil {
+			return err
+		}
+		return addItemRevision(ctx, tx, added.ID, item.UserID, itemChangeCreate)
+	})
+	return added, err
 }
 
-func (r *ItemDBRepository) UpdateItem(ctx context.Context, item domain.Item) (domain.Item, error) {
-	if _, err := r.ExecContext(ctx, "UPDATE items SET name = ?, price = ?, description = ?, category_id = ?, image = ? WHERE id = ?", item.Name, item.Price, item.Description, item.CategoryID, item.Image, item.ID); err != nil {
-		return domain.Item{}, err
+// UpdateItem applies the seller's patch to their item and returns the
+// updated item. A non-zero version must match the item's current version;
+// otherwise the current item is returned together with ErrItemModified.
+func (r *ItemDBRepository) UpdateItem(ctx context.Context, id int32, sellerID int64, version int64, patch domain.ItemPatch) (domain.Item, error) {
+	var item domain.Item
+	var replaced []string
+	err := withTx(ctx, r.DB, func(tx *sql.Tx) error {
+		var err error
+		item, err = getEditableItem(ctx, tx, id, sellerID, version)
+		if err != nil {
+			return err
+		}
+
+		if patch.Name != nil {
+			item.Name = *patch.Name
+		}
+		if patch.Price != nil {
+			item.Price = *patch.Price
+		}
+		if patch.Description != nil {
+			item.Description = *patch.Description
+		}
+		if patch.CategoryID != nil {
+			item.CategoryID = *patch.CategoryID
+		}
+		res, err := tx.ExecContext(ctx, "UPDATE items SET name = ?, price = ?, description = ?, category_id = ?, updated_at = DATETIME('now', 'localtime') WHERE id = ? AND version = ?", item.Name, item.Price, item.Description, item.CategoryID, id, item.Version)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(res, ErrItemModified); err != nil {
+			return err
+		}
+		if patch.Images != nil {
+			replaced, err = deleteItemImages(ctx, tx, id)
+			if err != nil {
+				return err
+			}
+			if err := insertItemImages(ctx, tx, r.Images, id, patch.Images); err != nil {
+				return err
+			}
+		}
+		if err := addItemRevision(ctx, tx, id, sellerID, itemChangeEdit); err != nil {
+			return err
+		}
+		item, err = scanItem(tx.QueryRowContext(ctx, "SELECT "+itemColumns+" FROM items WHERE id = ?", id))
+		return err
+	})
+	if err == nil {
+		r.evictImages(replaced)
 	}
-	return domain.Item{ID: item.ID}, nil
+	return item, err
 }
 
+// GetItem returns sql.ErrNoRows for deleted items.
 func (r *ItemDBRepository) GetItem(ctx context.Context, id int32) (domain.Item, error) {
-	row := r.QueryRowContext(ctx, "SELECT * FROM items WHERE id = ?", id)
-	var item domain.Item
-	return item, row.Scan(&item.ID, &item.Name, &item.Price, &item.Description, &item.CategoryID, &item.UserID, &item.Image, &item.Status, &item.CreatedAt, &item.UpdatedAt)
+	return scanItem(r.QueryRowContext(ctx, "SELECT "+itemColumns+" FROM items WHERE id = ? AND status != ?", id, domain.ItemStatusDeleted))
 }
 
-func (r *ItemDBRepository) GetItemImage(ctx context.Context, id int32) ([]byte, error) {
-	row := r.QueryRowContext(ctx, "SELECT image FROM items WHERE id = ?", id)
-	var image []byte
-	return image, row.Scan(&image)
+// GetItemImage returns the item's cover image, without its data.
+func (r *ItemDBRepository) GetItemImage(ctx context.Context, id int32) (domain.Image, error) {
+	return r.GetItemImageAt(ctx, id, 0)
 }
 
 func (r *ItemDBRepository) GetOnSaleItems(ctx context.Context) ([]domain.Item, error) {
-	rows, err := r.QueryContext(ctx, "SELECT * FROM items WHERE status = ? ORDER BY updated_at desc", domain.ItemStatusOnSale)
+	rows, err := r.QueryContext(ctx, "SELECT "+itemColumns+" FROM items WHERE status = ? ORDER BY updated_at desc", domain.ItemStatusOnSale)
 	if err != nil {
 		return nil, err
 	}
@@ -113,8 +182,8 @@ func (r *ItemDBRepository) GetOnSaleItems(ctx context.Context) ([]domain.Item, e
 
 	var items []domain.Item
 	for rows.Next() {
-		var item domain.Item
-		if err := rows.Scan(&item.ID, &item.Name, &item.Price, &item.Description, &item.CategoryID, &item.UserID, &item.Image, &item.Status, &item.CreatedAt, &item.UpdatedAt); err != nil {
+		item, err := scanItem(rows)
+		if err != nil {
 			return nil, err
 		}
 		items = append(items, item)
@@ -126,7 +195,7 @@ func (r *ItemDBRepository) GetOnSaleItems(ctx context.Context) ([]domain.Item, e
 }
 
 func (r *ItemDBRepository) GetItemsByUserID(ctx context.Context, userID int64) ([]domain.Item, error) {
-	rows, err := r.QueryContext(ctx, "SELECT * FROM items WHERE seller_id = ?", userID)
+	rows, err := r.QueryContext(ctx, "SELECT "+itemColumns+" FROM items WHERE seller_id = ? AND status != ?", userID, domain.ItemStatusDeleted)
 	if err != nil {
 		return nil, err
 	}
@@ -134,8 +203,8 @@ func (r *ItemDBRepository) GetItemsByUserID(ctx context.Context, userID int64) (
 
 	var items []domain.Item
 	for rows.Next() {
-		var item domain.Item
-		if err := rows.Scan(&item.ID, &item.Name, &item.Price, &item.Description, &item.CategoryID, &item.UserID, &item.Image, &item.Status, &item.CreatedAt, &item.UpdatedAt); err != nil {
+		item, err := scanItem(rows)
+		if err != nil {
 			return nil, err
 		}
 		items = append(items, item)
@@ -146,9 +215,10 @@ func (r *ItemDBRepository) GetItemsByUserID(ctx context.Context, userID int64) (
 	return items, nil
 }
 
+// GetItemsByName searches the items on sale by name and description. The
+// query syntax is that of parseSearchQuery.
 func (r *ItemDBRepository) GetItemsByName(ctx context.Context, searchWord string) ([]domain.Item, error) {
-	rows, err := r.QueryContext(ctx, "SELECT * FROM items WHERE name LIKE ? AND status = ? ORDER BY updated_at desc", "%"+searchWord+"%", domain.ItemStatusOnSale)
-
+	rows, err := searchItems(ctx, r.DB, parseSearchQuery(searchWord))
 	if err != nil {
 		return nil, err
 	}
@@ -156,8 +226,8 @@ func (r *ItemDBRepository) GetItemsByName(ctx context.Context, searchWord string
 
 	var items []domain.Item
 	for rows.Next() {
-		var item domain.Item
-		if err := rows.Scan(&item.ID, &item.Name, &item.Price, &item.Description, &item.CategoryID, &item.UserID, &item.Image, &item.Status, &item.CreatedAt, &item.UpdatedAt); err != nil {
+		item, err := scanItem(rows)
+		if err != nil {
 			return nil, err
 		}
 		items = append(items, item)
@@ -168,22 +238,20 @@ func (r *ItemDBRepository) GetItemsByName(ctx context.Context, searchWord string
 	return items, nil
 }
 
-func (r *ItemDBRepository) UpdateItemStatus(ctx context.Context, id int32, status domain.ItemStatus) error {
-	if _, err := r.ExecContext(ctx, "UPDATE items SET status = ? WHERE id = ?", status, id); err != nil {
-		return err
-	}
-	return nil
+func scanItem(row rowScanner) (domain.Item, error) {
+	var item domain.Item
+	return item, row.Scan(&item.ID, &item.Name, &item.Price, &item.Description, &item.CategoryID, &item.UserID, &item.Status, &item.CreatedAt, &item.UpdatedAt, &item.ListingType, &item.MinIncrement, &item.EndsAt, &item.Stock, &item.Version)
 }
 
 func (r *ItemDBRepository) GetCategory(ctx context.Context, id int64) (domain.Category, error) {
-	row := r.QueryRowContext(ctx, "SELECT * FROM category WHERE id = ?", id)
+	row := r.QueryRowContext(ctx, "SELECT id, name FROM category WHERE id = ?", id)
 
 	var cat domain.Category
 	return cat, row.Scan(&cat.ID, &cat.Name)
 }
 
 func (r *ItemDBRepository) GetCategories(ctx context.Context) ([]domain.Category, error) {
-	rows, err := r.QueryContext(ctx, "SELECT * FROM category")
+	rows, err := r.QueryContext(ctx, "SELECT id, name FROM category")
 	if err != nil {
 		return nil, err
 	}
@@ -203,6 +271,11 @@ func (r *ItemDBRepository) GetCategories(ctx context.Context) ([]domain.Category
 	return cats, nil
 }
 
+// GetFeeRule returns the sale commission for items in the category.
+func (r *ItemDBRepository) GetFeeRule(ctx context.Context, categoryID int64) (domain.FeeRule, error) {
+	return getCategoryFeeRule(ctx, r.DB, categoryID)
+}
+
 func (r *ItemDBRepository) GetFolders(ctx context.Context, id int64) ([]domain.FavoriteFolder, error) {
 	rows, err := r.QueryContext(ctx, "SELECT * FROM favoriteFolders WHERE user_id = ?", id)
 	if err != nil {
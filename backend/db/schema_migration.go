@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// addedColumns are the columns tables gained after they were first created.
+// 01_schema.sql creates new tables with them, but CREATE TABLE IF NOT EXISTS
+// leaves the tables of older databases as they are.
+var addedColumns = []struct {
+	table      string
+	name       string
+	definition string
+}{
+	{"items", "listing_type", "integer NOT NULL DEFAULT 0"},
+	{"items", "min_increment", "integer NOT NULL DEFAULT 0"},
+	{"items", "ends_at", "text"},
+	{"items", "stock", "integer NOT NULL DEFAULT 1"},
+	{"items", "version", "integer NOT NULL DEFAULT 1"},
+	{"category", "fee_bps", "integer"},
+	{"category", "fee_flat", "integer"},
+}
+
+// migrateSchema adds the missing columns of addedColumns to existing tables.
+// It runs before 01_schema.sql, whose indexes and triggers use them. Tables
+// that do not exist yet are left to 01_schema.sql.
+func migrateSchema(ctx context.Context, sqlDB *sql.DB) error {
+	return withTx(ctx, sqlDB, func(tx *sql.Tx) error {
+		tables := make(map[string]map[string]bool)
+		for _, column := range addedColumns {
+			columns, ok := tables[column.table]
+			if !ok {
+				var err error
+				columns, err = getColumns(ctx, tx, column.table)
+				if err != nil {
+					return err
+				}
+				tables[column.table] = columns
+			}
+			if len(columns) == 0 || columns[column.name] {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, "ALTER TABLE "+column.table+" ADD COLUMN "+column.name+" "+column.definition); err != nil {
+				return fmt.Errorf("failed to add %s.%s: %w", column.table, column.name, err)
+			}
+			columns[column.name] = true
+		}
+		return nil
+	})
+}
+
+// prepareSchema brings the database up to the schema in sqlDir.
+func prepareSchema(ctx context.Context, sqlDB *sql.DB, sqlDir string) error {
+	if err := migrateSchema(ctx, sqlDB); err != nil {
+		return fmt.Errorf("failed to migrate schema: %w", err)
+	}
+
+	f, err := os.ReadFile(filepath.Join(sqlDir, "01_schema.sql"))
+	if err != nil {
+		return fmt.Errorf("failed to open schema.sql: %w", err)
+	}
+	if _, err = sqlDB.ExecContext(ctx, string(f)); err != nil {
+		return fmt.Errorf("failed to exec query: %w", err)
+	}
+
+	if err = prepareSearchIndex(ctx, sqlDB, sqlDir); err != nil {
+		return fmt.Errorf("failed to prepare search index: %w", err)
+	}
+	return nil
+}
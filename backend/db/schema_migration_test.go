@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+)
+
+// newBaselineTestDB returns a database with the schema the backend started
+// from, as older deployments still have it.
+func newBaselineTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	sqlDB, err := openDB(filepath.Join(t.TempDir(), "test.sqlite3"))
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	schema, err := os.ReadFile(filepath.Join("testdata", "baseline_schema.sql"))
+	if err != nil {
+		t.Fatalf("failed to read schema: %s", err)
+	}
+	if _, err := sqlDB.Exec(string(schema)); err != nil {
+		t.Fatalf("failed to apply schema: %s", err)
+	}
+	return sqlDB
+}
+
+func TestPrepareSchemaUpgradesBaseline(t *testing.T) {
+	sqlDB := newBaselineTestDB(t)
+	ctx := context.Background()
+	itemID := addTestItem(t, sqlDB, addTestUser(t, sqlDB, 0), 100)
+	if _, err := sqlDB.Exec("INSERT INTO category (id, name) VALUES (1, 'category')"); err != nil {
+		t.Fatalf("failed to add category: %s", err)
+	}
+
+	if err := prepareSchema(ctx, sqlDB, filepath.Join("..", "sql")); err != nil {
+		t.Fatalf("failed to upgrade: %s", err)
+	}
+	// Upgraded databases are left as they are.
+	if err := prepareSchema(ctx, sqlDB, filepath.Join("..", "sql")); err != nil {
+		t.Fatalf("failed to prepare the upgraded schema: %s", err)
+	}
+
+	err := withTx(ctx, sqlDB, func(tx *sql.Tx) error {
+		for _, column := range addedColumns {
+			columns, err := getColumns(ctx, tx, column.table)
+			if err != nil {
+				return err
+			}
+			if !columns[column.name] {
+				t.Errorf("expected %s.%s to be added", column.table, column.name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read columns: %s", err)
+	}
+
+	repo := NewItemRepository(sqlDB, imagestore.NewMemoryStore())
+	item, err := repo.GetItem(ctx, itemID)
+	if err != nil {
+		t.Fatalf("failed to get item: %s", err)
+	}
+	if item.ListingType != domain.ListingTypeFixedPrice || item.EndsAt != "" || item.Stock != 1 || item.Version != 1 {
+		t.Errorf("expected a fixed price item with 1 in stock at version 1, got %+v", item)
+	}
+	if _, err := sqlDB.Exec("UPDATE items SET price = 200 WHERE id = ?", itemID); err != nil {
+		t.Fatalf("failed to update item: %s", err)
+	}
+	if item, err = repo.GetItem(ctx, itemID); err != nil || item.Version != 2 {
+		t.Errorf("expected version 2 after an update, got %d, %v", item.Version, err)
+	}
+	if rule, err := getItemFeeRule(ctx, sqlDB, itemID); err != nil || rule != DefaultFeeRule {
+		t.Errorf("expected the default fee rule, got %+v, %v", rule, err)
+	}
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"unicode"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+)
+
+// searchTerm is a word or quoted phrase of a search query.
+type searchTerm struct {
+	text string
+	// prefix terms only match at the start of a word.
+	prefix bool
+}
+
+// parseSearchQuery splits a search query into terms, all of which must be
+// found in the name or description of an item:
+//
+//   - words match anywhere, inside other words too
+//   - "quoted phrases" match with their spaces
+//   - word* matches words starting with word
+func parseSearchQuery(query string) []searchTerm {
+	var terms []searchTerm
+	rest := []rune(query)
+	for len(rest) > 0 {
+		if unicode.IsSpace(rest[0]) {
+			rest = rest[1:]
+			continue
+		}
+
+		var term searchTerm
+		if rest[0] == '"' {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				end++
+			}
+			term.text = strings.TrimSpace(string(rest[1:end]))
+			if end < len(rest) {
+				end++
+			}
+			rest = rest[end:]
+		} else {
+			end := 0
+			for end < len(rest) && !unicode.IsSpace(rest[end]) {
+				end++
+			}
+			term.text = string(rest[:end])
+			rest = rest[end:]
+			if len(term.text) > 1 && strings.HasSuffix(term.text, "*") {
+				term.text = strings.TrimSuffix(term.text, "*")
+				term.prefix = true
+			}
+		}
+		if term.text != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// likeCondition returns an SQL condition that matches term with LIKE, and
+// its arguments.
+func likeCondition(term searchTerm) (string, []any) {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term.text)
+	if term.prefix {
+		return `(' ' || items.name || ' ' || items.description) LIKE ? ESCAPE '\'`, []any{"% " + escaped + "%"}
+	}
+	return `(items.name LIKE ? ESCAPE '\' OR items.description LIKE ? ESCAPE '\')`, []any{"%" + escaped + "%", "%" + escaped + "%"}
+}
+
+// searchItemsByLike finds the items on sale matching every term by scanning
+// them, the latest updated first.
+func searchItemsByLike(ctx context.Context, q dbtx, terms []searchTerm) (*sql.Rows, error) {
+	query := "SELECT " + itemColumns + " FROM items WHERE status = ?"
+	args := []any{domain.ItemStatusOnSale}
+	for _, term := range terms {
+		condition, conditionArgs := likeCondition(term)
+		query += " AND " + condition
+		args = append(args, conditionArgs...)
+	}
+	return q.QueryContext(ctx, query+" ORDER BY updated_at desc", args...)
+}
@@ -0,0 +1,81 @@
+//go:build sqlite_fts5
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+)
+
+// minTrigramTerm is the length of the shortest term the trigram index can
+// find. Shorter terms are matched with LIKE.
+const minTrigramTerm = 3
+
+// searchItems finds the items on sale matching every term, the best
+// matches first. Matches in the name count ten times those in the
+// description.
+func searchItems(ctx context.Context, q dbtx, terms []searchTerm) (*sql.Rows, error) {
+	var phrases []string
+	var conditions string
+	var args []any
+	for _, term := range terms {
+		if utf8.RuneCountInString(term.text) >= minTrigramTerm {
+			phrases = append(phrases, `"`+strings.ReplaceAll(term.text, `"`, `""`)+`"`)
+			if !term.prefix {
+				continue
+			}
+			// The index finds the text anywhere; LIKE then checks that it
+			// starts a word.
+		}
+		condition, conditionArgs := likeCondition(term)
+		conditions += " AND " + condition
+		args = append(args, conditionArgs...)
+	}
+	if len(phrases) == 0 {
+		return searchItemsByLike(ctx, q, terms)
+	}
+
+	args = append([]any{strings.Join(phrases, " "), domain.ItemStatusOnSale}, args...)
+	return q.QueryContext(ctx, "SELECT "+itemColumns+" FROM items JOIN (SELECT rowid AS fts_id, bm25(items_fts, 10.0, 1.0) AS fts_rank FROM items_fts WHERE items_fts MATCH ?) AS hits ON hits.fts_id = items.id WHERE status = ?"+conditions+" ORDER BY hits.fts_rank, updated_at desc", args...)
+}
+
+// prepareSearchIndex creates the search index if needed, indexing the
+// items stored before it existed.
+func prepareSearchIndex(ctx context.Context, db *sql.DB, sqlDir string) error {
+	var exists bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE name = 'items_fts')").Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		// Adds the triggers if they are missing.
+		return execSearchSchema(ctx, db, sqlDir)
+	}
+	return rebuildSearchIndex(ctx, db, sqlDir)
+}
+
+// rebuildSearchIndex creates the search index again from the items.
+func rebuildSearchIndex(ctx context.Context, db *sql.DB, sqlDir string) error {
+	if _, err := db.ExecContext(ctx, "DROP TABLE IF EXISTS items_fts"); err != nil {
+		return err
+	}
+	if err := execSearchSchema(ctx, db, sqlDir); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "INSERT INTO items_fts (items_fts) VALUES ('rebuild')")
+	return err
+}
+
+func execSearchSchema(ctx context.Context, db *sql.DB, sqlDir string) error {
+	f, err := os.ReadFile(filepath.Join(sqlDir, "fts5", "items_fts.sql"))
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, string(f))
+	return err
+}
@@ -0,0 +1,22 @@
+//go:build !sqlite_fts5
+
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// searchItems finds the items on sale matching every term. Without FTS5,
+// which needs -tags sqlite_fts5, the items are scanned and not ranked.
+func searchItems(ctx context.Context, q dbtx, terms []searchTerm) (*sql.Rows, error) {
+	return searchItemsByLike(ctx, q, terms)
+}
+
+func prepareSearchIndex(ctx context.Context, db *sql.DB, sqlDir string) error {
+	return nil
+}
+
+func rebuildSearchIndex(ctx context.Context, db *sql.DB, sqlDir string) error {
+	return nil
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []searchTerm
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"shoes", []searchTerm{{text: "shoes"}}},
+		{"  red   shoes ", []searchTerm{{text: "red"}, {text: "shoes"}}},
+		{`"red shoes" size`, []searchTerm{{text: "red shoes"}, {text: "size"}}},
+		{`"  padded  "`, []searchTerm{{text: "padded"}}},
+		{`"unterminated phrase`, []searchTerm{{text: "unterminated phrase"}}},
+		{`"" empty`, []searchTerm{{text: "empty"}}},
+		{"sneak*", []searchTerm{{text: "sneak", prefix: true}}},
+		{"*", []searchTerm{{text: "*"}}},
+		{`"phrase*"`, []searchTerm{{text: "phrase*"}}},
+		{"100%_off", []searchTerm{{text: "100%_off"}}},
+		{"赤い　靴", []searchTerm{{text: "赤い"}, {text: "靴"}}},
+	}
+	for _, tt := range tests {
+		got := parseSearchQuery(tt.query)
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: expected %v, got %v", tt.query, tt.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%q: expected %v, got %v", tt.query, tt.want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestLikeCondition(t *testing.T) {
+	tests := []struct {
+		term     searchTerm
+		wantArgs []any
+	}{
+		{searchTerm{text: "shoe"}, []any{"%shoe%", "%shoe%"}},
+		{searchTerm{text: `100%_\`}, []any{`%100\%\_\\%`, `%100\%\_\\%`}},
+		{searchTerm{text: "sneak", prefix: true}, []any{"% sneak%"}},
+	}
+	for _, tt := range tests {
+		_, args := likeCondition(tt.term)
+		if len(args) != len(tt.wantArgs) {
+			t.Errorf("%v: expected %v, got %v", tt.term, tt.wantArgs, args)
+			continue
+		}
+		for i := range args {
+			if args[i] != tt.wantArgs[i] {
+				t.Errorf("%v: expected %v, got %v", tt.term, tt.wantArgs, args)
+				break
+			}
+		}
+	}
+}
+
+func TestGetItemsByName(t *testing.T) {
+	sqlDB := newTestDB(t)
+	ctx := context.Background()
+	if err := prepareSearchIndex(ctx, sqlDB, "../sql"); err != nil {
+		t.Fatalf("failed to prepare the search index: %s", err)
+	}
+	repo := NewItemRepository(sqlDB, imagestore.NewMemoryStore())
+	sellerID := addTestUser(t, sqlDB, 0)
+
+	items := map[string]domain.Item{}
+	for _, it := range []struct {
+		name        string
+		description string
+		status      domain.ItemStatus
+	}{
+		{"red sneakers", "barely worn", domain.ItemStatusOnSale},
+		{"blue jacket", "comes with red sneakers laces", domain.ItemStatusOnSale},
+		{"unsneakable boots", "100% leather", domain.ItemStatusOnSale},
+		{"red hat", "draft", domain.ItemStatusInitial},
+	} {
+		item, err := repo.AddItem(ctx, domain.Item{Name: it.name, Description: it.description, Price: 100, CategoryID: 1, UserID: sellerID, Status: it.status, Stock: 1}, nil)
+		if err != nil {
+			t.Fatalf("failed to add item: %s", err)
+		}
+		items[it.name] = item
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"sneakers", []string{"red sneakers", "blue jacket"}},
+		{`"red sneakers"`, []string{"red sneakers", "blue jacket"}},
+		{"red jacket", []string{"blue jacket"}},
+		{"sneak*", []string{"red sneakers", "blue jacket"}},
+		{"neak", []string{"red sneakers", "blue jacket", "unsneakable boots"}},
+		{"100%", []string{"unsneakable boots"}},
+		{"hat", nil},
+		{"missing", nil},
+	}
+	for _, tt := range tests {
+		got, err := repo.GetItemsByName(ctx, tt.query)
+		if err != nil {
+			t.Fatalf("%q: failed to search: %s", tt.query, err)
+		}
+		found := map[int32]bool{}
+		for _, item := range got {
+			found[item.ID] = true
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: expected %v, got %d items", tt.query, tt.want, len(got))
+			continue
+		}
+		for _, name := range tt.want {
+			if !found[items[name].ID] {
+				t.Errorf("%q: expected %q to be found", tt.query, name)
+			}
+		}
+	}
+}
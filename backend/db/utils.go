@@ -12,10 +12,14 @@ import (
 	"path/filepath"
 	"sort"
 
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+
 	"github.com/pkg/errors"
 )
 
-func Initialize(ctx context.Context, db *sql.DB) error {
+// Initialize recreates the tables and loads the seed data, whose item covers
+// are put in images.
+func Initialize(ctx context.Context, db *sql.DB, images imagestore.Store) error {
 	root, err := os.Getwd()
 	if err != nil {
 		return err
@@ -46,6 +50,14 @@ func Initialize(ctx context.Context, db *sql.DB) error {
 		}
 	}
 
+	if _, err := MigrateItemCovers(ctx, db, images); err != nil {
+		return errors.Wrap(err, "Failed to move item covers")
+	}
+
+	if err := rebuildSearchIndex(ctx, db, filepath.Join(root, "sql")); err != nil {
+		return errors.Wrap(err, "Failed to rebuild search index")
+	}
+
 	return nil
 }
 
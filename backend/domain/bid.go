@@ -0,0 +1,23 @@
+package domain
+
+type BidStatus int
+
+const (
+	// BidStatusActive bids hold their amount from the bidder's balance.
+	BidStatusActive BidStatus = iota
+	// BidStatusReplaced bids were raised by a later bid of the same bidder,
+	// which took over the hold.
+	BidStatusReplaced
+	BidStatusWon
+	// BidStatusLost bids had their hold released when the auction closed.
+	BidStatusLost
+)
+
+type Bid struct {
+	ID        int64
+	ItemID    int32
+	BidderID  int64
+	Amount    int64
+	Status    BidStatus
+	CreatedAt string
+}
@@ -0,0 +1,22 @@
+package domain
+
+type ChargeStatus int
+
+const (
+	ChargeStatusPending ChargeStatus = iota
+	ChargeStatusSucceeded
+	ChargeStatusFailed
+)
+
+// Charge is a balance top-up paid through the payment provider. The balance
+// is only credited once the provider confirms the charge.
+type Charge struct {
+	ID            int64
+	UserID        int64
+	Amount        int64
+	Status        ChargeStatus
+	Reference     string
+	FailureReason string
+	CreatedAt     string
+	UpdatedAt     string
+}
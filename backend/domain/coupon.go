@@ -0,0 +1,71 @@
+package domain
+
+type DiscountType int
+
+const (
+	// DiscountTypePercent coupons take Value percent off the purchase.
+	DiscountTypePercent DiscountType = iota
+	// DiscountTypeFixed coupons take Value off the purchase.
+	DiscountTypeFixed
+)
+
+// Coupon is a promotion code redeemable at checkout. Zero caps and an empty
+// validity window or category list mean no restriction.
+type Coupon struct {
+	ID           int64
+	Code         string
+	DiscountType DiscountType
+	Value        int64
+	MinSpend     int64
+	// MaxUses caps the redemptions across all users, MaxUsesPerUser those
+	// of a single user.
+	MaxUses        int64
+	MaxUsesPerUser int64
+	Uses           int64
+	StartsAt       string
+	EndsAt         string
+	CategoryIDs    []int64
+	Active         bool
+	CreatedAt      string
+	UpdatedAt      string
+}
+
+// Discount returns what the coupon takes off a purchase of amount. It never
+// exceeds the amount.
+func (c Coupon) Discount(amount int64) int64 {
+	var discount int64
+	switch c.DiscountType {
+	case DiscountTypePercent:
+		// Split so that amount * Value cannot overflow.
+		discount = amount/100*c.Value + amount%100*c.Value/100
+	case DiscountTypeFixed:
+		discount = c.Value
+	}
+	if discount > amount {
+		return amount
+	}
+	return discount
+}
+
+// AppliesTo reports whether the coupon can be used for items in the
+// category.
+func (c Coupon) AppliesTo(categoryID int64) bool {
+	if len(c.CategoryIDs) == 0 {
+		return true
+	}
+	for _, id := range c.CategoryIDs {
+		if id == categoryID {
+			return true
+		}
+	}
+	return false
+}
+
+type CouponRedemption struct {
+	ID        int64
+	CouponID  int64
+	UserID    int64
+	OrderID   int64
+	Discount  int64
+	CreatedAt string
+}
@@ -0,0 +1,50 @@
+package domain
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCouponDiscount(t *testing.T) {
+	tests := []struct {
+		name   string
+		coupon Coupon
+		amount int64
+		want   int64
+	}{
+		{"percent", Coupon{DiscountType: DiscountTypePercent, Value: 10}, 1000, 100},
+		{"percent rounded down", Coupon{DiscountType: DiscountTypePercent, Value: 10}, 999, 99},
+		{"percent of everything", Coupon{DiscountType: DiscountTypePercent, Value: 100}, 1000, 1000},
+		{"percent of a large amount", Coupon{DiscountType: DiscountTypePercent, Value: 50}, math.MaxInt64, math.MaxInt64 / 2},
+		{"fixed", Coupon{DiscountType: DiscountTypeFixed, Value: 300}, 1000, 300},
+		{"fixed capped at the amount", Coupon{DiscountType: DiscountTypeFixed, Value: 300}, 200, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.coupon.Discount(tt.amount); got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCouponAppliesTo(t *testing.T) {
+	tests := []struct {
+		name        string
+		categoryIDs []int64
+		categoryID  int64
+		want        bool
+	}{
+		{"any category", nil, 3, true},
+		{"listed category", []int64{1, 3}, 3, true},
+		{"other category", []int64{1, 2}, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Coupon{CategoryIDs: tt.categoryIDs}
+			if got := c.AppliesTo(tt.categoryID); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package domain
+
+// FeeRule is the platform's commission on a sale: a percentage of the price,
+// in basis points, plus a flat amount.
+type FeeRule struct {
+	BasisPoints int64
+	Flat        int64
+}
+
+// Fee returns the commission on a sale at price. It is rounded down and never
+// exceeds the price.
+func (r FeeRule) Fee(price int64) int64 {
+	fee := price*r.BasisPoints/10000 + r.Flat
+	if fee < 0 {
+		return 0
+	}
+	if fee > price {
+		return price
+	}
+	return fee
+}
+
+// Net returns what the seller receives for a sale at price.
+func (r FeeRule) Net(price int64) int64 {
+	return price - r.Fee(price)
+}
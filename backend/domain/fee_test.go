@@ -0,0 +1,30 @@
+package domain
+
+import "testing"
+
+func TestFeeRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    FeeRule
+		price   int64
+		wantFee int64
+	}{
+		{"percentage", FeeRule{BasisPoints: 1000}, 1000, 100},
+		{"rounded down", FeeRule{BasisPoints: 1000}, 999, 99},
+		{"flat", FeeRule{Flat: 50}, 1000, 50},
+		{"percentage and flat", FeeRule{BasisPoints: 500, Flat: 30}, 1000, 80},
+		{"capped at the price", FeeRule{BasisPoints: 1000, Flat: 500}, 300, 300},
+		{"never negative", FeeRule{Flat: -100}, 1000, 0},
+		{"free", FeeRule{}, 1000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if fee := tt.rule.Fee(tt.price); fee != tt.wantFee {
+				t.Errorf("expected fee %d, got %d", tt.wantFee, fee)
+			}
+			if net := tt.rule.Net(tt.price); net != tt.price-tt.wantFee {
+				t.Errorf("expected net %d, got %d", tt.price-tt.wantFee, net)
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package domain
+
+type IdempotencyRecord struct {
+	UserID      int64
+	Key         string
+	RequestHash string
+	// StatusCode is 0 until the first request with the key has finished.
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CreatedAt   string
+	ExpiresAt   string
+}
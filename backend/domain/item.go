@@ -6,19 +6,100 @@ const (
 	ItemStatusInitial ItemStatus = iota
 	ItemStatusOnSale
 	ItemStatusSoldOut
+	// ItemStatusPaused items were taken off sale by the seller and can be
+	// relisted.
+	ItemStatusPaused
+	// ItemStatusReserved items are held for the buyer of an accepted offer.
+	ItemStatusReserved
+	// ItemStatusDeleted items were deleted by the seller. They are kept for
+	// the orders that refer to them.
+	ItemStatusDeleted
+)
+
+type ListingType int
+
+const (
+	ListingTypeFixedPrice ListingType = iota
+	// ListingTypeAuction items are sold to the highest bidder when EndsAt
+	// passes. Price is the starting price.
+	ListingTypeAuction
 )
 
 type Item struct {
-	ID          int32
-	Name        string
-	Price       int64
-	Description string
-	CategoryID  int64
-	UserID      int64
-	Image       []byte
-	Status      ItemStatus
+	ID           int32
+	Name         string
+	Price        int64
+	Description  string
+	CategoryID   int64
+	UserID       int64
+	Status       ItemStatus
+	CreatedAt    string
+	UpdatedAt    string
+	ListingType  ListingType
+	MinIncrement int64
+	EndsAt       string
+	Stock        int64
+	// Version changes whenever the item does.
+	Version int64
+}
+
+// ItemPatch holds the fields of an item edit. Nil fields are left
+// unchanged. Non-nil Images replace all of the item's images, the first
+// becoming the cover.
+type ItemPatch struct {
+	Name        *string
+	Price       *int64
+	Description *string
+	CategoryID  *int64
+	Images      []Image
+}
+
+// Image is an image file with the MIME type detected from its content.
+type Image struct {
+	// ID and Key are set for images read back from the store. Key is the
+	// hex SHA-256 of Data.
+	ID          int64
+	Key         string
+	ContentType string
+	Data        []byte
+	// Variants holds the scaled-down renditions stored with an upload.
+	Variants map[ImageSize]Image
+	// DHash is the perceptual hash of an upload, used to find copies.
+	DHash *uint64
+}
+
+// ImageSize names a rendition of an item image.
+type ImageSize string
+
+const (
+	ImageSizeThumb    ImageSize = "thumb"
+	ImageSizeMedium   ImageSize = "medium"
+	ImageSizeOriginal ImageSize = "original"
+)
+
+// ItemImage describes one of an item's images. The image at position 0 is
+// the item's cover.
+type ItemImage struct {
+	ID          int64
+	ItemID      int32
+	Position    int
+	ContentType string
+	Size        int64
 	CreatedAt   string
-	UpdatedAt   string
+}
+
+// DuplicateImageFlag pairs an uploaded image with a near-identical image of
+// another seller's listing. Distance is how many bits their hashes differ.
+type DuplicateImageFlag struct {
+	ID            int64
+	ItemID        int32
+	ImageID       int64
+	SellerID      int64
+	OtherItemID   int32
+	OtherImageID  int64
+	OtherSellerID int64
+	Distance      int
+	CreatedAt     string
 }
 
 type Category struct {
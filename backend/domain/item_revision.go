@@ -0,0 +1,22 @@
+package domain
+
+// ItemRevision is a snapshot of an item taken after every edit and status
+// change, so that what a buyer saw when they bought it can be checked later.
+type ItemRevision struct {
+	ID     int64
+	ItemID int32
+	// Version is the item's version after the change.
+	Version int64
+	// ActorID is the user who made the change, or 0 for background jobs.
+	ActorID int64
+	// Change is "create", "edit" or the ItemEvent that changed the status.
+	Change      string
+	Name        string
+	Price       int64
+	Description string
+	CategoryID  int64
+	// ImageHash identifies the images and their order.
+	ImageHash string
+	Status    ItemStatus
+	CreatedAt string
+}
@@ -0,0 +1,114 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidItemTransition is returned when an event is not allowed in the
+// item's current status.
+var ErrInvalidItemTransition = errors.New("invalid item status transition")
+
+// ItemEvent is something that happens to an item and may change its status.
+type ItemEvent int
+
+const (
+	// ItemEventSell puts a new item on sale.
+	ItemEventSell ItemEvent = iota
+	// ItemEventUnlist takes an item off sale until it is relisted.
+	ItemEventUnlist
+	ItemEventRelist
+	ItemEventDelete
+	// ItemEventReserve holds the item for the buyer of an accepted offer.
+	ItemEventReserve
+	// ItemEventRelease ends a reservation, either because it ran out or
+	// because the buyer bought a unit and more are left.
+	ItemEventRelease
+	// ItemEventSellOut happens when the last unit is bought.
+	ItemEventSellOut
+	// ItemEventEndUnsold happens when an auction ends without bids.
+	ItemEventEndUnsold
+	// ItemEventRestock and ItemEventReturn happen when an order for a sold
+	// out item is cancelled. Restock puts it back on sale, Return back to
+	// the seller's drafts.
+	ItemEventRestock
+	ItemEventReturn
+)
+
+type itemTransition struct {
+	from []ItemStatus
+	to   ItemStatus
+}
+
+// itemTransitions declares every allowed status change.
+var itemTransitions = map[ItemEvent]itemTransition{
+	ItemEventSell:      {from: []ItemStatus{ItemStatusInitial}, to: ItemStatusOnSale},
+	ItemEventUnlist:    {from: []ItemStatus{ItemStatusOnSale}, to: ItemStatusPaused},
+	ItemEventRelist:    {from: []ItemStatus{ItemStatusPaused}, to: ItemStatusOnSale},
+	ItemEventDelete:    {from: []ItemStatus{ItemStatusInitial, ItemStatusOnSale, ItemStatusPaused, ItemStatusSoldOut}, to: ItemStatusDeleted},
+	ItemEventReserve:   {from: []ItemStatus{ItemStatusOnSale}, to: ItemStatusReserved},
+	ItemEventRelease:   {from: []ItemStatus{ItemStatusReserved}, to: ItemStatusOnSale},
+	ItemEventSellOut:   {from: []ItemStatus{ItemStatusOnSale, ItemStatusReserved}, to: ItemStatusSoldOut},
+	ItemEventEndUnsold: {from: []ItemStatus{ItemStatusOnSale}, to: ItemStatusInitial},
+	ItemEventRestock:   {from: []ItemStatus{ItemStatusSoldOut}, to: ItemStatusOnSale},
+	ItemEventReturn:    {from: []ItemStatus{ItemStatusSoldOut}, to: ItemStatusInitial},
+}
+
+// Next returns the status an item in status s moves to on event. It
+// returns an error wrapping ErrInvalidItemTransition when the event is not
+// allowed in s.
+func (s ItemStatus) Next(event ItemEvent) (ItemStatus, error) {
+	transition, ok := itemTransitions[event]
+	if ok {
+		for _, from := range transition.from {
+			if from == s {
+				return transition.to, nil
+			}
+		}
+	}
+	return s, fmt.Errorf("%w: cannot %s an item that is %s", ErrInvalidItemTransition, event, s)
+}
+
+func (s ItemStatus) String() string {
+	switch s {
+	case ItemStatusInitial:
+		return "initial"
+	case ItemStatusOnSale:
+		return "on sale"
+	case ItemStatusSoldOut:
+		return "sold out"
+	case ItemStatusPaused:
+		return "paused"
+	case ItemStatusReserved:
+		return "reserved"
+	case ItemStatusDeleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("ItemStatus(%d)", int(s))
+}
+
+func (e ItemEvent) String() string {
+	switch e {
+	case ItemEventSell:
+		return "sell"
+	case ItemEventUnlist:
+		return "unlist"
+	case ItemEventRelist:
+		return "relist"
+	case ItemEventDelete:
+		return "delete"
+	case ItemEventReserve:
+		return "reserve"
+	case ItemEventRelease:
+		return "release"
+	case ItemEventSellOut:
+		return "sell out"
+	case ItemEventEndUnsold:
+		return "end unsold"
+	case ItemEventRestock:
+		return "restock"
+	case ItemEventReturn:
+		return "return"
+	}
+	return fmt.Sprintf("ItemEvent(%d)", int(e))
+}
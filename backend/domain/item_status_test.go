@@ -0,0 +1,68 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestItemStatusNext(t *testing.T) {
+	statuses := []ItemStatus{ItemStatusInitial, ItemStatusOnSale, ItemStatusSoldOut, ItemStatusPaused, ItemStatusReserved, ItemStatusDeleted}
+
+	tests := []struct {
+		event ItemEvent
+		// allowed maps the statuses the event applies to onto the status it
+		// moves them to; every other status must be refused.
+		allowed map[ItemStatus]ItemStatus
+	}{
+		{ItemEventSell, map[ItemStatus]ItemStatus{ItemStatusInitial: ItemStatusOnSale}},
+		{ItemEventUnlist, map[ItemStatus]ItemStatus{ItemStatusOnSale: ItemStatusPaused}},
+		{ItemEventRelist, map[ItemStatus]ItemStatus{ItemStatusPaused: ItemStatusOnSale}},
+		{ItemEventDelete, map[ItemStatus]ItemStatus{
+			ItemStatusInitial: ItemStatusDeleted,
+			ItemStatusOnSale:  ItemStatusDeleted,
+			ItemStatusPaused:  ItemStatusDeleted,
+			ItemStatusSoldOut: ItemStatusDeleted,
+		}},
+		{ItemEventReserve, map[ItemStatus]ItemStatus{ItemStatusOnSale: ItemStatusReserved}},
+		{ItemEventRelease, map[ItemStatus]ItemStatus{ItemStatusReserved: ItemStatusOnSale}},
+		{ItemEventSellOut, map[ItemStatus]ItemStatus{
+			ItemStatusOnSale:   ItemStatusSoldOut,
+			ItemStatusReserved: ItemStatusSoldOut,
+		}},
+		{ItemEventEndUnsold, map[ItemStatus]ItemStatus{ItemStatusOnSale: ItemStatusInitial}},
+		{ItemEventRestock, map[ItemStatus]ItemStatus{ItemStatusSoldOut: ItemStatusOnSale}},
+		{ItemEventReturn, map[ItemStatus]ItemStatus{ItemStatusSoldOut: ItemStatusInitial}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.event.String(), func(t *testing.T) {
+			for _, status := range statuses {
+				next, err := status.Next(tt.event)
+				want, ok := tt.allowed[status]
+				if !ok {
+					if !errors.Is(err, ErrInvalidItemTransition) {
+						t.Errorf("%s: expected ErrInvalidItemTransition, got %v", status, err)
+					}
+					if next != status {
+						t.Errorf("%s: expected the status to stay, got %s", status, next)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("%s: unexpected error: %s", status, err)
+					continue
+				}
+				if next != want {
+					t.Errorf("%s: expected %s, got %s", status, want, next)
+				}
+			}
+		})
+	}
+}
+
+func TestItemStatusNextDeletedIsFinal(t *testing.T) {
+	for event := ItemEventSell; event <= ItemEventReturn; event++ {
+		if _, err := ItemStatusDeleted.Next(event); !errors.Is(err, ErrInvalidItemTransition) {
+			t.Errorf("%s: expected deleted items to refuse it, got %v", event, err)
+		}
+	}
+}
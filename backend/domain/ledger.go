@@ -0,0 +1,48 @@
+package domain
+
+type LedgerEntryKind int
+
+const (
+	LedgerEntryTopUp LedgerEntryKind = iota
+	LedgerEntryPurchase
+	LedgerEntrySale
+	LedgerEntryRefund
+	LedgerEntryWithdrawal
+	LedgerEntryWithdrawalFee
+	LedgerEntryWithdrawalReversal
+	LedgerEntryBidHold
+	LedgerEntryBidRelease
+	LedgerEntrySaleFee
+	LedgerEntryCouponDiscount
+	LedgerEntryPointsRedemption
+)
+
+// Ledger accounts are user IDs, except for the system accounts below which
+// have no row in the users table and whose balance only lives in the ledger.
+const (
+	// AccountExternal is the counterpart of money entering or leaving the
+	// platform, e.g. balance top-ups.
+	AccountExternal int64 = -1
+	// AccountEscrow holds what buyers paid for orders that are not completed
+	// yet.
+	AccountEscrow int64 = -2
+	// AccountPayoutClearing holds withdrawals that have been requested but
+	// not transferred to the bank yet.
+	AccountPayoutClearing int64 = -3
+	// AccountPlatform collects the platform's own revenue, e.g. fees.
+	AccountPlatform int64 = -4
+	// AccountBidHolds holds the amount of every active auction bid until the
+	// auction closes.
+	AccountBidHolds int64 = -5
+)
+
+type LedgerEntry struct {
+	ID           int64
+	JournalID    int64
+	AccountID    int64
+	Kind         LedgerEntryKind
+	Amount       int64
+	BalanceAfter int64
+	ItemID       int32
+	CreatedAt    string
+}
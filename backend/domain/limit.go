@@ -0,0 +1,82 @@
+package domain
+
+import "time"
+
+// Limits caps how much money a user can move. A zero field means no limit.
+type Limits struct {
+	MaxBalance   int64
+	DailyTopUp   int64
+	MonthlyTopUp int64
+	// MaxPurchase caps the total price of a single purchase.
+	MaxPurchase int64
+	// At most PurchaseBurst orders may be placed within PurchaseWindow, and
+	// at most TopUpBurst top-ups started within TopUpWindow.
+	PurchaseBurst  int64
+	PurchaseWindow time.Duration
+	TopUpBurst     int64
+	TopUpWindow    time.Duration
+}
+
+// LimitOverrides replace some of the default limits for one user. Nil
+// fields keep the default.
+type LimitOverrides struct {
+	MaxBalance    *int64
+	DailyTopUp    *int64
+	MonthlyTopUp  *int64
+	MaxPurchase   *int64
+	PurchaseBurst *int64
+	TopUpBurst    *int64
+}
+
+// Apply returns the limits with the overrides in place.
+func (o LimitOverrides) Apply(limits Limits) Limits {
+	if o.MaxBalance != nil {
+		limits.MaxBalance = *o.MaxBalance
+	}
+	if o.DailyTopUp != nil {
+		limits.DailyTopUp = *o.DailyTopUp
+	}
+	if o.MonthlyTopUp != nil {
+		limits.MonthlyTopUp = *o.MonthlyTopUp
+	}
+	if o.MaxPurchase != nil {
+		limits.MaxPurchase = *o.MaxPurchase
+	}
+	if o.PurchaseBurst != nil {
+		limits.PurchaseBurst = *o.PurchaseBurst
+	}
+	if o.TopUpBurst != nil {
+		limits.TopUpBurst = *o.TopUpBurst
+	}
+	return limits
+}
+
+// LimitRule names the limit a request broke. The values are the error codes
+// returned to clients.
+type LimitRule string
+
+const (
+	LimitRuleMaxBalance    LimitRule = "max_balance_exceeded"
+	LimitRuleDailyTopUp    LimitRule = "daily_top_up_exceeded"
+	LimitRuleMonthlyTopUp  LimitRule = "monthly_top_up_exceeded"
+	LimitRuleMaxPurchase   LimitRule = "max_purchase_exceeded"
+	LimitRulePurchaseBurst LimitRule = "purchase_velocity_exceeded"
+	LimitRuleTopUpBurst    LimitRule = "top_up_velocity_exceeded"
+)
+
+// Velocity reports whether the rule limits how often rather than how much,
+// so that retrying later may succeed.
+func (r LimitRule) Velocity() bool {
+	return r == LimitRulePurchaseBurst || r == LimitRuleTopUpBurst
+}
+
+// LimitViolation records a request that was refused for breaking a limit,
+// for later review.
+type LimitViolation struct {
+	ID        int64
+	UserID    int64
+	Rule      LimitRule
+	Limit     int64
+	Attempted int64
+	CreatedAt string
+}
@@ -0,0 +1,31 @@
+package domain
+
+type OfferStatus int
+
+const (
+	OfferStatusPending OfferStatus = iota
+	OfferStatusAccepted
+	OfferStatusRejected
+	OfferStatusCountered
+	OfferStatusExpired
+	OfferStatusPurchased
+)
+
+// Offer is a price proposed for an on-sale item, either by the buyer or, as a
+// counter offer, by the seller. The party that did not propose it answers it.
+// An accepted offer reserves the item for the buyer at Price until
+// ReservedUntil.
+type Offer struct {
+	ID            int64
+	ItemID        int32
+	BuyerID       int64
+	SellerID      int64
+	Price         int64
+	ProposedBy    int64
+	ParentID      int64
+	Status        OfferStatus
+	ExpiresAt     string
+	ReservedUntil string
+	CreatedAt     string
+	UpdatedAt     string
+}
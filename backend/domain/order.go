@@ -0,0 +1,61 @@
+package domain
+
+type OrderStatus int
+
+const (
+	OrderStatusPaid OrderStatus = iota
+	OrderStatusShipped
+	OrderStatusDelivered
+	OrderStatusCompleted
+	OrderStatusCancelled
+)
+
+// Order is the record of an item bought by a buyer. The price stays in
+// escrow until the order is completed; then the seller receives the price
+// minus the platform's fee. A coupon Discount and loyalty PointsUsed are paid
+// by the platform, so the buyer only pays Price - Discount - PointsUsed from
+// their balance.
+type Order struct {
+	ID          int64
+	ItemID      int32
+	BuyerID     int64
+	SellerID    int64
+	Price       int64
+	Fee         int64
+	Discount    int64
+	PointsUsed  int64
+	Status      OrderStatus
+	ShippedAt   string
+	DeliveredAt string
+	CompletedAt string
+	CancelledAt string
+	// CancelRequestedBy is the user waiting for the other party to agree to
+	// cancel a shipped order, or 0.
+	CancelRequestedBy int64
+	// ItemRevisionID is the item revision current at purchase, or 0.
+	ItemRevisionID int64
+	CreatedAt      string
+	UpdatedAt      string
+}
+
+type OrderEventKind int
+
+const (
+	OrderEventCreated OrderEventKind = iota
+	OrderEventShipped
+	OrderEventDelivered
+	OrderEventCompleted
+	OrderEventCancelRequested
+	OrderEventCancelled
+)
+
+type OrderEvent struct {
+	ID         int64
+	OrderID    int64
+	ActorID    int64
+	Kind       OrderEventKind
+	FromStatus OrderStatus
+	ToStatus   OrderStatus
+	Note       string
+	CreatedAt  string
+}
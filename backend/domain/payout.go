@@ -0,0 +1,35 @@
+package domain
+
+type BankAccount struct {
+	ID            int64
+	UserID        int64
+	BankName      string
+	BranchName    string
+	AccountNumber string
+	HolderName    string
+	CreatedAt     string
+}
+
+type PayoutStatus int
+
+const (
+	PayoutStatusPending PayoutStatus = iota
+	PayoutStatusProcessing
+	PayoutStatusPaid
+	PayoutStatusFailed
+)
+
+// Payout is a seller's request to withdraw Amount from their balance. Fee is
+// kept by the platform, so the bank account receives Amount - Fee.
+type Payout struct {
+	ID            int64
+	UserID        int64
+	BankAccountID int64
+	Amount        int64
+	Fee           int64
+	Status        PayoutStatus
+	Reference     string
+	FailureReason string
+	CreatedAt     string
+	UpdatedAt     string
+}
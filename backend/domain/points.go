@@ -0,0 +1,51 @@
+package domain
+
+import "time"
+
+type PointEntryKind int
+
+const (
+	PointEntryEarned PointEntryKind = iota
+	PointEntrySpent
+	// PointEntryRefunded points come back from a cancelled order they were
+	// spent on.
+	PointEntryRefunded
+	PointEntryExpired
+)
+
+// PointEntry is one change to a user's loyalty points. Points are worth one
+// yen each and are kept apart from the balance.
+type PointEntry struct {
+	ID        int64
+	UserID    int64
+	Kind      PointEntryKind
+	Amount    int64
+	OrderID   int64
+	CreatedAt string
+}
+
+// PointLot is a batch of points earned together. Points are spent from the
+// lot that expires first.
+type PointLot struct {
+	ID        int64
+	UserID    int64
+	Amount    int64
+	Remaining int64
+	ExpiresAt string
+	CreatedAt string
+}
+
+// PointsPolicy is how many points buyers earn, in basis points of what they
+// paid, and how long the points stay valid.
+type PointsPolicy struct {
+	EarnBasisPoints int64
+	TTL             time.Duration
+}
+
+// Earned returns the points earned for paying amount, rounded down.
+func (p PointsPolicy) Earned(amount int64) int64 {
+	if amount <= 0 {
+		return 0
+	}
+	return amount * p.EarnBasisPoints / 10000
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// adminUserIDs are the users allowed to call the /admin endpoints, given as a
+// comma-separated list in ADMIN_USER_IDS.
+var adminUserIDs = parseUserIDs(os.Getenv("ADMIN_USER_IDS"))
+
+func parseUserIDs(value string) map[int64]bool {
+	ids := make(map[int64]bool)
+	for _, field := range strings.Split(value, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids[id] = true
+	}
+	return ids
+}
+
+// RequireAdmin rejects logged-in users who are not admins. It must run after
+// the JWT middleware.
+func (h *Handler) RequireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID, err := getUserID(c)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, err)
+		}
+		if !adminUserIDs[userID] {
+			return echo.NewHTTPError(http.StatusForbidden, "admin only")
+		}
+		return next(c)
+	}
+}
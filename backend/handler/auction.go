@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+type placeBidRequest struct {
+	Amount int64 `json:"amount" validate:"required"`
+}
+
+type getBidResponse struct {
+	ID        int64            `json:"id"`
+	ItemID    int32            `json:"item_id"`
+	BidderID  int64            `json:"bidder_id"`
+	Amount    int64            `json:"amount"`
+	Status    domain.BidStatus `json:"status"`
+	CreatedAt string           `json:"created_at"`
+}
+
+func newGetBidResponse(bid domain.Bid) getBidResponse {
+	return getBidResponse{
+		ID:        bid.ID,
+		ItemID:    bid.ItemID,
+		BidderID:  bid.BidderID,
+		Amount:    bid.Amount,
+		Status:    bid.Status,
+		CreatedAt: bid.CreatedAt,
+	}
+}
+
+// PlaceBid bids on an auction. The amount is held from the bidder's balance
+// until the auction closes.
+func (h *Handler) PlaceBid(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	itemID, err := strconv.Atoi(c.Param("itemID"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid itemID type")
+	}
+
+	req := new(placeBidRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "amount is required")
+	}
+
+	bid, err := h.AuctionRepo.PlaceBid(ctx, int32(itemID), userID, req.Amount)
+	if err != nil {
+		var limitErr *db.LimitError
+		switch {
+		case errors.As(err, &limitErr):
+			return newLimitHTTPError(limitErr)
+		case errors.Is(err, db.ErrItemNotFound):
+			return echo.NewHTTPError(http.StatusNotFound, "Item not found.")
+		case errors.Is(err, db.ErrNotAuction):
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "This item is not sold by auction.")
+		case errors.Is(err, db.ErrOwnItem):
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "This item is listed by you!")
+		case errors.Is(err, db.ErrItemNotOnSale):
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "This item is not on sale.")
+		case errors.Is(err, db.ErrAuctionEnded):
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "This auction has already ended.")
+		case errors.Is(err, db.ErrBidTooLow):
+			return echo.NewHTTPError(http.StatusBadRequest, "The bid is below the minimum.")
+		case errors.Is(err, db.ErrUserNotFound):
+			return echo.NewHTTPError(http.StatusNotFound, "User not found.")
+		case errors.Is(err, db.ErrInsufficientBalance):
+			return echo.NewHTTPError(http.StatusBadRequest, "Insufficient balance")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	return c.JSON(http.StatusOK, newGetBidResponse(bid))
+}
+
+func (h *Handler) GetBids(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	itemID, err := strconv.Atoi(c.Param("itemID"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid itemID type")
+	}
+
+	bids, err := h.AuctionRepo.GetBids(ctx, int32(itemID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res := make([]getBidResponse, len(bids))
+	for i, bid := range bids {
+		res[i] = newGetBidResponse(bid)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// parseEndsAt converts the end time of an auction, an RFC 3339 time in the
+// future, to the database's local time format.
+func parseEndsAt(value string) (string, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", errors.New("ends_at must be an RFC 3339 time for auctions")
+	}
+	if !t.After(time.Now()) {
+		return "", errors.New("ends_at must be in the future")
+	}
+	return t.Local().Format(dbTimeLayout), nil
+}
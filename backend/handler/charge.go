@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/payment"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+type getChargeResponse struct {
+	ID            int64               `json:"id"`
+	Amount        int64               `json:"amount"`
+	Status        domain.ChargeStatus `json:"status"`
+	Reference     string              `json:"reference,omitempty"`
+	FailureReason string              `json:"failure_reason,omitempty"`
+	CreatedAt     string              `json:"created_at"`
+	UpdatedAt     string              `json:"updated_at"`
+}
+
+func newGetChargeResponse(charge domain.Charge) getChargeResponse {
+	return getChargeResponse{
+		ID:            charge.ID,
+		Amount:        charge.Amount,
+		Status:        charge.Status,
+		Reference:     charge.Reference,
+		FailureReason: charge.FailureReason,
+		CreatedAt:     charge.CreatedAt,
+		UpdatedAt:     charge.UpdatedAt,
+	}
+}
+
+func (h *Handler) GetCharges(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	charges, err := h.ChargeRepo.GetChargesByUserID(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res := make([]getChargeResponse, len(charges))
+	for i, charge := range charges {
+		res[i] = newGetChargeResponse(charge)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// GetCharge lets the user follow a top-up until it is settled.
+func (h *Handler) GetCharge(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	chargeID, err := strconv.ParseInt(c.Param("chargeID"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid chargeID type")
+	}
+
+	charge, err := h.ChargeRepo.GetCharge(ctx, chargeID)
+	if err != nil {
+		if errors.Is(err, db.ErrChargeNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Charge not found.")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	if charge.UserID != userID {
+		return echo.NewHTTPError(http.StatusNotFound, "Charge not found.")
+	}
+
+	return c.JSON(http.StatusOK, newGetChargeResponse(charge))
+}
+
+// PaymentCallback receives the payment provider's notice that a charge
+// succeeded or failed. The body must be signed with the webhook secret in
+// the X-Payment-Signature header.
+func (h *Handler) PaymentCallback(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if h.Payments == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Top-ups are not available.")
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	if !payment.VerifySignature(h.Config.PaymentWebhookSecret, body, c.Request().Header.Get("X-Payment-Signature")) {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid signature")
+	}
+
+	var cb payment.Callback
+	if err := json.Unmarshal(body, &cb); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	if err := h.Payments.HandleCallback(ctx, cb); err != nil {
+		if errors.Is(err, db.ErrChargeNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Charge not found.")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	return c.JSON(http.StatusOK, "successful")
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/payment"
+	"github.com/labstack/echo/v4"
+)
+
+func TestPaymentCallback(t *testing.T) {
+	const secret = "webhook secret"
+
+	tests := []struct {
+		name string
+		// secret is the one the server has; the callback is signed with
+		// signedWith.
+		secret      string
+		signedWith  string
+		unknown     bool
+		repeat      bool
+		wantStatus  int
+		wantCharge  domain.ChargeStatus
+		wantBalance int64
+	}{
+		{name: "valid", secret: secret, signedWith: secret, wantStatus: http.StatusOK, wantCharge: domain.ChargeStatusSucceeded, wantBalance: 1000},
+		{name: "repeated", secret: secret, signedWith: secret, repeat: true, wantStatus: http.StatusOK, wantCharge: domain.ChargeStatusSucceeded, wantBalance: 1000},
+		{name: "wrong signature", secret: secret, signedWith: "guess", wantStatus: http.StatusUnauthorized, wantCharge: domain.ChargeStatusPending},
+		{name: "no secret configured", signedWith: "", wantStatus: http.StatusUnauthorized, wantCharge: domain.ChargeStatusPending},
+		{name: "unknown charge", secret: secret, signedWith: secret, unknown: true, wantStatus: http.StatusNotFound, wantCharge: domain.ChargeStatusPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t)
+			h.Config.PaymentWebhookSecret = tt.secret
+			h.Payments = &payment.ChargeProcessor{Repo: h.ChargeRepo}
+			e := echo.New()
+			ctx := context.Background()
+			userID := addTestUser(t, h)
+			charge, err := h.ChargeRepo.AddCharge(ctx, userID, 1000)
+			if err != nil {
+				t.Fatalf("failed to add charge: %s", err)
+			}
+
+			chargeID := charge.ID
+			if tt.unknown {
+				chargeID = 999
+			}
+			body := fmt.Sprintf(`{"charge_id":%d,"reference":"ch_1","succeeded":true}`, chargeID)
+			send := func() int {
+				c, rec := newTestContext(e, 0, http.MethodPost, "/payments/callback", body)
+				c.Request().Header.Set("X-Payment-Signature", payment.Sign(tt.signedWith, []byte(body)))
+				if err := h.PaymentCallback(c); err != nil {
+					c.Error(err)
+				}
+				return rec.Code
+			}
+			if tt.repeat {
+				send()
+			}
+			if status := send(); status != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, status)
+			}
+
+			got, err := h.ChargeRepo.GetCharge(ctx, charge.ID)
+			if err != nil {
+				t.Fatalf("failed to get charge: %s", err)
+			}
+			if got.Status != tt.wantCharge {
+				t.Errorf("expected charge status %d, got %d", tt.wantCharge, got.Status)
+			}
+			var balance int64
+			if err := h.DB.QueryRow("SELECT balance FROM users WHERE id = ?", userID).Scan(&balance); err != nil {
+				t.Fatalf("failed to get balance: %s", err)
+			}
+			if balance != tt.wantBalance {
+				t.Errorf("expected balance %d, got %d", tt.wantBalance, balance)
+			}
+		})
+	}
+}
+
+func TestPaymentsWithoutProvider(t *testing.T) {
+	h := newTestHandler(t)
+	e := echo.New()
+	userID := addTestUser(t, h)
+
+	tests := []struct {
+		name    string
+		path    string
+		handler echo.HandlerFunc
+	}{
+		{"top-up", "/balance", h.AddBalance},
+		{"callback", "/payments/callback", h.PaymentCallback},
+		{"withdrawal", "/payouts", h.RequestPayout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, rec := newTestContext(e, userID, http.MethodPost, tt.path, `{"balance":1000,"payment_method":"fake_succeed"}`)
+			if err := tt.handler(c); err != nil {
+				c.Error(err)
+			}
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// couponRequest is the body of the admin coupon endpoints. starts_at and
+// ends_at are RFC 3339 times and may be left empty for an open window.
+type couponRequest struct {
+	Code           string              `json:"code"`
+	DiscountType   domain.DiscountType `json:"discount_type" validate:"min=0,max=1"`
+	Value          int64               `json:"value" validate:"required,min=1"`
+	MinSpend       int64               `json:"min_spend" validate:"min=0"`
+	MaxUses        int64               `json:"max_uses" validate:"min=0"`
+	MaxUsesPerUser int64               `json:"max_uses_per_user" validate:"min=0"`
+	StartsAt       string              `json:"starts_at"`
+	EndsAt         string              `json:"ends_at"`
+	CategoryIDs    []int64             `json:"category_ids"`
+	Active         *bool               `json:"active"`
+}
+
+type getCouponResponse struct {
+	ID             int64               `json:"id"`
+	Code           string              `json:"code"`
+	DiscountType   domain.DiscountType `json:"discount_type"`
+	Value          int64               `json:"value"`
+	MinSpend       int64               `json:"min_spend"`
+	MaxUses        int64               `json:"max_uses"`
+	MaxUsesPerUser int64               `json:"max_uses_per_user"`
+	Uses           int64               `json:"uses"`
+	StartsAt       string              `json:"starts_at,omitempty"`
+	EndsAt         string              `json:"ends_at,omitempty"`
+	CategoryIDs    []int64             `json:"category_ids"`
+	Active         bool                `json:"active"`
+	CreatedAt      string              `json:"created_at"`
+	UpdatedAt      string              `json:"updated_at"`
+}
+
+type couponRedemptionResponse struct {
+	UserID    int64  `json:"user_id"`
+	OrderID   int64  `json:"order_id"`
+	Discount  int64  `json:"discount"`
+	CreatedAt string `json:"created_at"`
+}
+
+type getCouponDetailResponse struct {
+	getCouponResponse
+	Redemptions []couponRedemptionResponse `json:"redemptions"`
+}
+
+func newGetCouponResponse(coupon domain.Coupon) getCouponResponse {
+	categoryIDs := coupon.CategoryIDs
+	if categoryIDs == nil {
+		categoryIDs = []int64{}
+	}
+	return getCouponResponse{
+		ID:             coupon.ID,
+		Code:           coupon.Code,
+		DiscountType:   coupon.DiscountType,
+		Value:          coupon.Value,
+		MinSpend:       coupon.MinSpend,
+		MaxUses:        coupon.MaxUses,
+		MaxUsesPerUser: coupon.MaxUsesPerUser,
+		Uses:           coupon.Uses,
+		StartsAt:       coupon.StartsAt,
+		EndsAt:         coupon.EndsAt,
+		CategoryIDs:    categoryIDs,
+		Active:         coupon.Active,
+		CreatedAt:      coupon.CreatedAt,
+		UpdatedAt:      coupon.UpdatedAt,
+	}
+}
+
+// bindCoupon reads and validates a couponRequest into a domain.Coupon.
+func bindCoupon(c echo.Context) (domain.Coupon, error) {
+	req := new(couponRequest)
+	if err := c.Bind(req); err != nil {
+		return domain.Coupon{}, echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return domain.Coupon{}, echo.NewHTTPError(http.StatusBadRequest, "value must be positive, caps and min_spend must not be negative and discount_type must be 0 or 1")
+	}
+	if req.DiscountType == domain.DiscountTypePercent && req.Value > 100 {
+		return domain.Coupon{}, echo.NewHTTPError(http.StatusBadRequest, "a percentage discount cannot exceed 100")
+	}
+
+	startsAt, err := parseOptionalTime(req.StartsAt)
+	if err != nil {
+		return domain.Coupon{}, echo.NewHTTPError(http.StatusBadRequest, "starts_at must be an RFC 3339 time")
+	}
+	endsAt, err := parseOptionalTime(req.EndsAt)
+	if err != nil {
+		return domain.Coupon{}, echo.NewHTTPError(http.StatusBadRequest, "ends_at must be an RFC 3339 time")
+	}
+	if startsAt != "" && endsAt != "" && endsAt <= startsAt {
+		return domain.Coupon{}, echo.NewHTTPError(http.StatusBadRequest, "ends_at must be after starts_at")
+	}
+
+	active := true
+	if req.Active != nil {
+		active = *req.Active
+	}
+
+	return domain.Coupon{
+		Code:           req.Code,
+		DiscountType:   req.DiscountType,
+		Value:          req.Value,
+		MinSpend:       req.MinSpend,
+		MaxUses:        req.MaxUses,
+		MaxUsesPerUser: req.MaxUsesPerUser,
+		StartsAt:       startsAt,
+		EndsAt:         endsAt,
+		CategoryIDs:    req.CategoryIDs,
+		Active:         active,
+	}, nil
+}
+
+func (h *Handler) AddCoupon(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	coupon, err := bindCoupon(c)
+	if err != nil {
+		return err
+	}
+	if coupon.Code == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "code is required")
+	}
+
+	coupon, err = h.CouponRepo.AddCoupon(ctx, coupon)
+	if err != nil {
+		if errors.Is(err, db.ErrCouponCodeTaken) {
+			return echo.NewHTTPError(http.StatusConflict, "This code is already used.")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	return c.JSON(http.StatusOK, newGetCouponResponse(coupon))
+}
+
+func (h *Handler) GetCoupons(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	coupons, err := h.CouponRepo.GetCoupons(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res := make([]getCouponResponse, len(coupons))
+	for i, coupon := range coupons {
+		res[i] = newGetCouponResponse(coupon)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) GetCoupon(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	couponID, err := strconv.ParseInt(c.Param("couponID"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid couponID type")
+	}
+
+	coupon, err := h.CouponRepo.GetCoupon(ctx, couponID)
+	if err != nil {
+		if errors.Is(err, db.ErrCouponNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Coupon not found.")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	redemptions, err := h.CouponRepo.GetRedemptions(ctx, couponID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res := getCouponDetailResponse{
+		getCouponResponse: newGetCouponResponse(coupon),
+		Redemptions:       make([]couponRedemptionResponse, len(redemptions)),
+	}
+	for i, redemption := range redemptions {
+		res.Redemptions[i] = couponRedemptionResponse{
+			UserID:    redemption.UserID,
+			OrderID:   redemption.OrderID,
+			Discount:  redemption.Discount,
+			CreatedAt: redemption.CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// UpdateCoupon replaces the terms of a coupon, e.g. to extend it or to
+// deactivate it with "active": false. The code cannot be changed.
+func (h *Handler) UpdateCoupon(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	couponID, err := strconv.ParseInt(c.Param("couponID"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid couponID type")
+	}
+
+	coupon, err := bindCoupon(c)
+	if err != nil {
+		return err
+	}
+	coupon.ID = couponID
+
+	coupon, err = h.CouponRepo.UpdateCoupon(ctx, coupon)
+	if err != nil {
+		if errors.Is(err, db.ErrCouponNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Coupon not found.")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	return c.JSON(http.StatusOK, newGetCouponResponse(coupon))
+}
+
+// parseOptionalTime converts an RFC 3339 time to the database's local time
+// format. Empty values stay empty.
+func parseOptionalTime(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", err
+	}
+	return t.Local().Format(dbTimeLayout), nil
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type duplicateImageFlagResponse struct {
+	ID            int64  `json:"id"`
+	ItemID        int32  `json:"item_id"`
+	ImageID       int64  `json:"image_id"`
+	SellerID      int64  `json:"seller_id"`
+	OtherItemID   int32  `json:"other_item_id"`
+	OtherImageID  int64  `json:"other_image_id"`
+	OtherSellerID int64  `json:"other_seller_id"`
+	Distance      int    `json:"distance"`
+	CreatedAt     string `json:"created_at"`
+}
+
+type getDuplicateImageFlagsResponse struct {
+	Flags   []duplicateImageFlagResponse `json:"flags"`
+	Page    int                          `json:"page"`
+	PerPage int                          `json:"per_page"`
+	Total   int64                        `json:"total"`
+}
+
+// GetDuplicateImageFlags lists uploaded images that look like images of
+// another seller's listing, the latest first.
+func (h *Handler) GetDuplicateImageFlags(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	page, perPage, err := getPagination(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	flags, err := h.ItemRepo.GetDuplicateImageFlags(ctx, perPage, (page-1)*perPage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	total, err := h.ItemRepo.CountDuplicateImageFlags(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res := getDuplicateImageFlagsResponse{
+		Flags:   make([]duplicateImageFlagResponse, len(flags)),
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+	}
+	for i, f := range flags {
+		res.Flags[i] = duplicateImageFlagResponse{
+			ID:            f.ID,
+			ItemID:        f.ItemID,
+			ImageID:       f.ImageID,
+			SellerID:      f.SellerID,
+			OtherItemID:   f.OtherItemID,
+			OtherImageID:  f.OtherImageID,
+			OtherSellerID: f.OtherSellerID,
+			Distance:      f.Distance,
+			CreatedAt:     f.CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
@@ -1,17 +1,18 @@
 package handler
 
 import (
-	"bytes"
 	"database/sql"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
 	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/payment"
 	"github.com/go-playground/validator/v10"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
@@ -23,6 +24,14 @@ var (
 	logFile = getEnv("LOGFILE", "access.log")
 )
 
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+
+	// dbTimeLayout is how SQLite's DATETIME() formats timestamps.
+	dbTimeLayout = "2006-01-02 15:04:05"
+)
+
 type JwtCustomClaims struct {
 	UserID int64 `json:"user_id"`
 	jwt.RegisteredClaims
@@ -64,14 +73,24 @@ type getItemsByNameResponse struct {
 }
 
 type getItemResponse struct {
-	ID           int32             `json:"id"`
-	Name         string            `json:"name"`
-	CategoryID   int64             `json:"category_id"`
-	CategoryName string            `json:"category_name"`
-	UserID       int64             `json:"user_id"`
-	Price        int64             `json:"price"`
-	Description  string            `json:"description"`
-	Status       domain.ItemStatus `json:"status"`
+	ID           int32              `json:"id"`
+	Name         string             `json:"name"`
+	CategoryID   int64              `json:"category_id"`
+	CategoryName string             `json:"category_name"`
+	UserID       int64              `json:"user_id"`
+	Price        int64              `json:"price"`
+	Description  string             `json:"description"`
+	Status       domain.ItemStatus  `json:"status"`
+	Stock        int64              `json:"stock"`
+	ListingType  domain.ListingType `json:"listing_type"`
+	MinIncrement int64              `json:"min_increment,omitempty"`
+	EndsAt       string             `json:"ends_at,omitempty"`
+	CurrentBid   int64              `json:"current_bid,omitempty"`
+	Version      int64              `json:"version"`
+	// Only shown to the seller: the commission and what they would receive
+	// per unit at the current price.
+	EstimatedFee         *int64 `json:"estimated_fee,omitempty"`
+	EstimatedNetProceeds *int64 `json:"estimated_net_proceeds,omitempty"`
 }
 
 type getCategoriesResponse struct {
@@ -81,13 +100,20 @@ type getCategoriesResponse struct {
 
 type sellRequest struct {
 	ItemID int32 `json:"item_id"`
+	// EndsAt gives an auction a new end time, e.g. after its order was
+	// cancelled.
+	EndsAt string `json:"ends_at"`
 }
 
 type addItemRequest struct {
-	Name        string `form:"name" validate:"required"`
-	CategoryID  int64  `form:"category_id" validate:"required"`
-	Price       int64  `form:"price" validate:"required"`
-	Description string `form:"description" validate:"required"`
+	Name         string             `form:"name" validate:"required"`
+	CategoryID   int64              `form:"category_id" validate:"required"`
+	Price        int64              `form:"price" validate:"required"`
+	Description  string             `form:"description" validate:"required"`
+	ListingType  domain.ListingType `form:"listing_type"`
+	MinIncrement int64              `form:"min_increment"`
+	EndsAt       string             `form:"ends_at"`
+	Stock        int64              `form:"stock"`
 }
 
 type addItemResponse struct {
@@ -105,14 +131,33 @@ type updateItemResponse struct {
 	ID int64 `json:"id"`
 }
 
+// addBalanceRequest is the body of POST /balance. PaymentMethod is the
+// payment provider's token for the card to charge.
 type addBalanceRequest struct {
-	Balance int64 `json:"balance"`
+	Balance       int64  `json:"balance"`
+	PaymentMethod string `json:"payment_method"`
 }
 
 type getBalanceResponse struct {
 	Balance int64 `json:"balance"`
 }
 
+type balanceHistoryEntry struct {
+	ID           int64                  `json:"id"`
+	Kind         domain.LedgerEntryKind `json:"kind"`
+	Amount       int64                  `json:"amount"`
+	BalanceAfter int64                  `json:"balance_after"`
+	ItemID       int32                  `json:"item_id,omitempty"`
+	CreatedAt    string                 `json:"created_at"`
+}
+
+type getBalanceHistoryResponse struct {
+	Entries []balanceHistoryEntry `json:"entries"`
+	Page    int                   `json:"page"`
+	PerPage int                   `json:"per_page"`
+	Total   int64                 `json:"total"`
+}
+
 type loginRequest struct {
 	UserID   int64  `json:"user_id" validate:"required"`
 	Password string `json:"password" validate:"required"`
@@ -124,10 +169,68 @@ type loginResponse struct {
 	Token string `json:"token"`
 }
 
+// Config holds the settings of the handlers. main reads them from the
+// environment on startup.
+type Config struct {
+	// MaxItemImages is how many images an item can have.
+	MaxItemImages int
+	// ImageMaxAge is how long clients may use an image before checking that
+	// it is still current.
+	ImageMaxAge time.Duration
+	// ImageSizes bounds the longest side of each variant stored with an
+	// image.
+	ImageSizes map[domain.ImageSize]int
+	// OfferTTL is how long an offer waits for an answer.
+	OfferTTL time.Duration
+	// OfferReservation is how long an accepted offer keeps the item for the
+	// buyer.
+	OfferReservation time.Duration
+	// PayoutMinAmount is the smallest withdrawal a seller can request.
+	PayoutMinAmount int64
+	// PayoutFee is deducted from every withdrawal and kept by the platform.
+	PayoutFee int64
+	// PaymentWebhookSecret signs the payment provider's callbacks. Without
+	// it the callback endpoint accepts nothing.
+	PaymentWebhookSecret string
+}
+
+// DefaultConfig returns the settings used when the environment sets none.
+func DefaultConfig() Config {
+	return Config{
+		MaxItemImages: 10,
+		ImageMaxAge:   time.Minute,
+		ImageSizes: map[domain.ImageSize]int{
+			domain.ImageSizeThumb:  240,
+			domain.ImageSizeMedium: 800,
+		},
+		OfferTTL:         48 * time.Hour,
+		OfferReservation: 24 * time.Hour,
+		PayoutMinAmount:  1000,
+		PayoutFee:        200,
+	}
+}
+
 type Handler struct {
-	DB       *sql.DB
-	UserRepo db.UserRepository
-	ItemRepo db.ItemRepository
+	Config          Config
+	DB              *sql.DB
+	UserRepo        db.UserRepository
+	ItemRepo        db.ItemRepository
+	Images          imagestore.Store
+	PurchaseRepo    db.PurchaseRepository
+	LedgerRepo      db.LedgerRepository
+	IdempotencyRepo db.IdempotencyRepository
+	OrderRepo       db.OrderRepository
+	PayoutRepo      db.PayoutRepository
+	OfferRepo       db.OfferRepository
+	AuctionRepo     db.AuctionRepository
+	CouponRepo      db.CouponRepository
+	PointsRepo      db.PointsRepository
+	ChargeRepo      db.ChargeRepository
+	LimitRepo       db.LimitRepository
+	// Payments and Payouts are nil when no payment provider is configured,
+	// and top-ups and withdrawals are refused.
+	Payments *payment.ChargeProcessor
+	Payouts  *payment.PayoutProcessor
 }
 
 type addItemToFavoriteRequest struct {
@@ -164,7 +267,7 @@ func (h *Handler) Initialize(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, errors.Wrap(err, "Failed to truncate access log"))
 	}
 
-	err = db.Initialize(c.Request().Context(), h.DB)
+	err = db.Initialize(c.Request().Context(), h.DB, h.Images)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, errors.Wrap(err, "Failed to initialize"))
 	}
@@ -260,27 +363,41 @@ func (h *Handler) AddItem(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "all columns are required")
 	}
 
+	if req.Stock == 0 {
+		req.Stock = 1
+	}
+	if req.Stock < 0 || req.Stock > db.MaxStock {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("stock must be between 1 and %d", db.MaxStock))
+	}
+
+	var endsAt string
+	switch req.ListingType {
+	case domain.ListingTypeFixedPrice:
+	case domain.ListingTypeAuction:
+		if req.Stock != 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "auctions sell a single unit")
+		}
+		if req.MinIncrement <= 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "min_increment must be positive for auctions")
+		}
+		var err error
+		if endsAt, err = parseEndsAt(req.EndsAt); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid listing_type")
+	}
+
 	userID, err := getUserID(c)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, err)
 	}
-	file, err := c.FormFile("image")
+	images, err := h.readImages(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
-	}
-
-	src, err := file.Open()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
+		return err
 	}
-	defer src.Close()
-
-	var dest []byte
-	blob := bytes.NewBuffer(dest)
-	// TODO: pass very big file
-	// http.StatusBadRequest(400)
-	if _, err := io.Copy(blob, src); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	if len(images) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "image is required")
 	}
 
 	_, err = h.ItemRepo.GetCategory(ctx, req.CategoryID)
@@ -292,14 +409,17 @@ func (h *Handler) AddItem(c echo.Context) error {
 	}
 
 	item, err := h.ItemRepo.AddItem(c.Request().Context(), domain.Item{
-		Name:        req.Name,
-		CategoryID:  req.CategoryID,
-		UserID:      userID,
-		Price:       req.Price,
-		Description: req.Description,
-		Image:       blob.Bytes(),
-		Status:      domain.ItemStatusInitial,
-	})
+		Name:         req.Name,
+		CategoryID:   req.CategoryID,
+		UserID:       userID,
+		Price:        req.Price,
+		Description:  req.Description,
+		Status:       domain.ItemStatusInitial,
+		ListingType:  req.ListingType,
+		MinIncrement: req.MinIncrement,
+		EndsAt:       endsAt,
+		Stock:        req.Stock,
+	}, images)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err)
 	}
@@ -332,6 +452,12 @@ func (h *Handler) UpdateItem(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, err)
 	}
 
+	// If-Match is optional here; PATCH requires it.
+	version, err := getIfMatchVersion(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
 	item, err := h.ItemRepo.GetItem(ctx, int32(itemID))
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -344,23 +470,12 @@ func (h *Handler) UpdateItem(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "you are not authorized to update this item")
 	}
 
-	file, err := c.FormFile("image")
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
-	}
-
-	src, err := file.Open()
+	images, err := h.readImages(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
+		return err
 	}
-	defer src.Close()
-
-	var dest []byte
-	blob := bytes.NewBuffer(dest)
-	// TODO: pass very big file
-	// http.StatusBadRequest(400)
-	if _, err := io.Copy(blob, src); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	if len(images) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "image is required")
 	}
 
 	_, err = h.ItemRepo.GetCategory(ctx, req.CategoryID)
@@ -371,20 +486,18 @@ func (h *Handler) UpdateItem(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, err)
 	}
 
-	updatedItem, err := h.ItemRepo.UpdateItem(c.Request().Context(), domain.Item{
-		ID:          int32(itemID),
-		Name:        req.Name,
-		CategoryID:  req.CategoryID,
-		UserID:      userID,
-		Price:       req.Price,
-		Description: req.Description,
-		Image:       blob.Bytes(),
-		Status:      domain.ItemStatusInitial,
+	updatedItem, err := h.ItemRepo.UpdateItem(ctx, int32(itemID), userID, version, domain.ItemPatch{
+		Name:        &req.Name,
+		Price:       &req.Price,
+		Description: &req.Description,
+		CategoryID:  &req.CategoryID,
+		Images:      images,
 	})
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
+		return h.newUpdateItemHTTPError(c, updatedItem, err)
 	}
 
+	c.Response().Header().Set(headerETag, itemETag(updatedItem))
 	return c.JSON(http.StatusOK, updateItemResponse{ID: int64(updatedItem.ID)})
 }
 
@@ -417,14 +530,20 @@ func (h *Handler) Sell(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusPreconditionFailed, "This item does not belong to you.")
 	}
 
-	// DONE: only update when status is initial
-	// http.StatusPreconditionFailed(412)
-	if item.Status != domain.ItemStatusInitial {
-		return echo.NewHTTPError(http.StatusPreconditionFailed, "Item status must be initial.")
+	var endsAt string
+	if req.EndsAt != "" {
+		if item.ListingType != domain.ListingTypeAuction {
+			return echo.NewHTTPError(http.StatusBadRequest, "ends_at is only for auctions")
+		}
+		if endsAt, err = parseEndsAt(req.EndsAt); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
 	}
 
-	if err := h.ItemRepo.UpdateItemStatus(ctx, item.ID, domain.ItemStatusOnSale); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	// Only drafts can be put on sale; the state machine answers 412 for
+	// the rest.
+	if _, err := h.ItemRepo.ChangeItemStatus(ctx, item.ID, userID, domain.ItemEventSell, endsAt); err != nil {
+		return newItemStatusHTTPError(err)
 	}
 
 	return c.JSON(http.StatusOK, "successful")
@@ -477,11 +596,25 @@ func (h *Handler) GetItem(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, err)
 	}
 
-	category, err := h.ItemRepo.GetCategory(ctx, item.CategoryID)
+	res, err := h.newGetItemResponse(c, item)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err)
 	}
-	return c.JSON(http.StatusOK, getItemResponse{
+	c.Response().Header().Set(headerETag, itemETag(item))
+	return c.JSON(http.StatusOK, res)
+}
+
+// newGetItemResponse describes the item, with the fee estimate when the
+// seller is asking.
+func (h *Handler) newGetItemResponse(c echo.Context, item domain.Item) (getItemResponse, error) {
+	ctx := c.Request().Context()
+
+	category, err := h.ItemRepo.GetCategory(ctx, item.CategoryID)
+	if err != nil {
+		return getItemResponse{}, err
+	}
+
+	res := getItemResponse{
 		ID:           item.ID,
 		Name:         item.Name,
 		CategoryID:   item.CategoryID,
@@ -490,7 +623,34 @@ func (h *Handler) GetItem(c echo.Context) error {
 		Price:        item.Price,
 		Description:  item.Description,
 		Status:       item.Status,
-	})
+		Stock:        item.Stock,
+		ListingType:  item.ListingType,
+		Version:      item.Version,
+	}
+	if item.ListingType == domain.ListingTypeAuction {
+		res.MinIncrement = item.MinIncrement
+		res.EndsAt = item.EndsAt
+		bid, err := h.AuctionRepo.GetHighestBid(ctx, item.ID)
+		if err != nil && !errors.Is(err, db.ErrBidNotFound) {
+			return res, err
+		}
+		res.CurrentBid = bid.Amount
+	}
+
+	if userID, ok := getOptionalUserID(c); ok && userID == item.UserID {
+		rule, err := h.ItemRepo.GetFeeRule(ctx, item.CategoryID)
+		if err != nil {
+			return res, err
+		}
+		price := item.Price
+		if res.CurrentBid > price {
+			price = res.CurrentBid
+		}
+		fee, net := rule.Fee(price), rule.Net(price)
+		res.EstimatedFee = &fee
+		res.EstimatedNetProceeds = &net
+	}
+	return res, nil
 }
 
 func (h *Handler) GetUserItems(c echo.Context) error {
@@ -549,8 +709,6 @@ func (h *Handler) GetCategories(c echo.Context) error {
 }
 
 func (h *Handler) GetImage(c echo.Context) error {
-	ctx := c.Request().Context()
-
 	// TODO: overflow
 	itemID, err := strconv.Atoi(c.Param("itemID"))
 	if err != nil {
@@ -558,12 +716,7 @@ func (h *Handler) GetImage(c echo.Context) error {
 	}
 
 	// オーバーフローしていると。ここのint32(itemID)がバグって正常に処理ができないはず
-	data, err := h.ItemRepo.GetItemImage(ctx, int32(itemID))
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
-	}
-
-	return c.Blob(http.StatusOK, "image/jpeg", data)
+	return h.serveItemImage(c, int32(itemID), 0)
 }
 
 func (h *Handler) SearchItems(c echo.Context) error {
@@ -593,16 +746,22 @@ func (h *Handler) SearchItems(c echo.Context) error {
 	return c.JSON(http.StatusOK, res)
 }
 
+// AddBalance starts a top-up. The response is the pending charge; the
+// balance is credited once the payment provider confirms it.
 func (h *Handler) AddBalance(c echo.Context) error {
 	ctx := c.Request().Context()
 
+	if h.Payments == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Top-ups are not available.")
+	}
+
 	req := new(addBalanceRequest)
 	if err := c.Bind(req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
 	}
 
-	if req.Balance < 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "Don't add minus balance")
+	if req.Balance <= 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "The top-up amount must be positive.")
 	}
 
 	userID, err := getUserID(c)
@@ -610,21 +769,23 @@ func (h *Handler) AddBalance(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, err)
 	}
 
-	user, err := h.UserRepo.GetUser(ctx, userID)
-	// TODO: not found handling
-	// http.StatusNotFound(404)
+	charge, err := h.Payments.TopUp(ctx, userID, req.Balance, req.PaymentMethod)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		var limitErr *db.LimitError
+		switch {
+		case errors.As(err, &limitErr):
+			return newLimitHTTPError(limitErr)
+		case errors.Is(err, db.ErrUserNotFound):
 			return echo.NewHTTPError(http.StatusNotFound, "User not found.")
+		case errors.Is(err, payment.ErrChargeDeclined):
+			return echo.NewHTTPError(http.StatusPaymentRequired, "The payment was declined.")
+		case errors.Is(err, payment.ErrInvalidPaymentMethod):
+			return echo.NewHTTPError(http.StatusBadRequest, "Unknown payment method.")
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, err)
 	}
 
-	if err := h.UserRepo.UpdateBalance(ctx, userID, user.Balance+req.Balance); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
-	}
-
-	return c.JSON(http.StatusOK, "successful")
+	return c.JSON(http.StatusOK, newGetChargeResponse(charge))
 }
 
 func (h *Handler) GetBalance(c echo.Context) error {
@@ -648,7 +809,7 @@ func (h *Handler) GetBalance(c echo.Context) error {
 	return c.JSON(http.StatusOK, getBalanceResponse{Balance: user.Balance})
 }
 
-func (h *Handler) Purchase(c echo.Context) error {
+func (h *Handler) GetBalanceHistory(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	userID, err := getUserID(c)
@@ -656,75 +817,115 @@ func (h *Handler) Purchase(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, err)
 	}
 
-	// TODO: overflow
-	itemID, err := strconv.Atoi(c.Param("itemID"))
+	page, perPage, err := getPagination(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	entries, err := h.LedgerRepo.GetEntries(ctx, userID, perPage, (page-1)*perPage)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err)
 	}
 
-	//下のUpdateItemStatusの前にsellerIDとBalanceの判定しないと、statusがsoldoutになってしまう
-	/*SellerIDの判定*/
-	item, err := h.ItemRepo.GetItem(ctx, int32(itemID))
-	// DONE: not found handling
-	// http.StatusNotFound(404)
+	total, err := h.LedgerRepo.CountEntries(ctx, userID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, "Item not found.")
-		}
 		return echo.NewHTTPError(http.StatusInternalServerError, err)
 	}
 
-	sellerID := item.UserID
-	if sellerID == userID {
-		return echo.NewHTTPError(http.StatusPreconditionFailed, "This item is listed by you!")
+	res := getBalanceHistoryResponse{
+		Entries: make([]balanceHistoryEntry, len(entries)),
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+	}
+	for i, entry := range entries {
+		res.Entries[i] = balanceHistoryEntry{
+			ID:           entry.ID,
+			Kind:         entry.Kind,
+			Amount:       entry.Amount,
+			BalanceAfter: entry.BalanceAfter,
+			ItemID:       entry.ItemID,
+			CreatedAt:    entry.CreatedAt,
+		}
 	}
 
-	// DONE: update only when item status is on sale
-	// http.StatusPreconditionFailed(412)
-	if item.Status != domain.ItemStatusOnSale {
-		return echo.NewHTTPError(http.StatusPreconditionFailed, "This item is not on sale.")
+	return c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) Purchase(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
 	}
 
-	/*Balanceの判定*/
-	user, err := h.UserRepo.GetUser(ctx, userID)
-	// TODO: not found handling
-	// http.StatusNotFound(404)
+	// TODO: overflow
+	itemID, err := strconv.Atoi(c.Param("itemID"))
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, "User not found.")
-		}
 		return echo.NewHTTPError(http.StatusInternalServerError, err)
 	}
 
-	if user.Balance-item.Price < 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "Insufficient balance")
+	req := new(purchaseRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
 	}
-
-	// オーバーフローしていると。ここのint32(itemID)がバグって正常に処理ができないはず
-	if err := h.ItemRepo.UpdateItemStatus(ctx, int32(itemID), domain.ItemStatusSoldOut); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	if req.Quantity == 0 {
+		req.Quantity = 1
 	}
-
-	// TODO: balance consistency
-	if err := h.UserRepo.UpdateBalance(ctx, userID, user.Balance-item.Price); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	if req.Quantity < 0 || req.Quantity > db.MaxStock {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("quantity must be between 1 and %d", db.MaxStock))
+	}
+	if req.Points < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "points must not be negative")
 	}
 
-	seller, err := h.UserRepo.GetUser(ctx, sellerID)
-	// TODO: not found handling
-	// http.StatusNotFound(404)
+	// The status check, the buyer's balance check and the order creation
+	// run in one transaction, so concurrent purchases cannot oversell.
+	orders, err := h.PurchaseRepo.Purchase(ctx, userID, int32(itemID), req.Quantity, req.CouponCode, req.Points)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusNotFound, "Seller not found.")
+		var limitErr *db.LimitError
+		switch {
+		case errors.As(err, &limitErr):
+			return newLimitHTTPError(limitErr)
+		case errors.Is(err, db.ErrItemNotFound):
+			return echo.NewHTTPError(http.StatusNotFound, "Item not found.")
+		case errors.Is(err, db.ErrOwnItem):
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "This item is listed by you!")
+		case errors.Is(err, db.ErrItemNotOnSale):
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "This item is not on sale.")
+		case errors.Is(err, db.ErrItemReserved):
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "This item is reserved for another buyer.")
+		case errors.Is(err, db.ErrAuctionItem):
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "This item is sold by auction. Place a bid instead.")
+		case errors.Is(err, db.ErrOutOfStock):
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "Not enough units in stock.")
+		case errors.Is(err, db.ErrAmountTooLarge):
+			return echo.NewHTTPError(http.StatusBadRequest, "The total price is too large.")
+		case errors.Is(err, db.ErrCouponNotFound):
+			return echo.NewHTTPError(http.StatusNotFound, "Coupon not found.")
+		case errors.Is(err, db.ErrCouponNotApplicable):
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "This coupon cannot be used for this purchase.")
+		case errors.Is(err, db.ErrCouponUsedUp):
+			return echo.NewHTTPError(http.StatusPreconditionFailed, "This coupon has been used up.")
+		case errors.Is(err, db.ErrUserNotFound):
+			return echo.NewHTTPError(http.StatusNotFound, "User not found.")
+		case errors.Is(err, db.ErrInsufficientBalance):
+			return echo.NewHTTPError(http.StatusBadRequest, "Insufficient balance")
+		case errors.Is(err, db.ErrInsufficientPoints):
+			return echo.NewHTTPError(http.StatusBadRequest, "Insufficient points")
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, err)
 	}
 
-	if err := h.UserRepo.UpdateBalance(ctx, sellerID, seller.Balance+item.Price); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	res := purchaseResponse{OrderID: orders[0].ID, OrderIDs: make([]int64, len(orders))}
+	for i, order := range orders {
+		res.OrderIDs[i] = order.ID
+		res.Discount += order.Discount
+		res.PointsUsed += order.PointsUsed
+		res.Paid += order.Price - order.Discount - order.PointsUsed
 	}
-
-	return c.JSON(http.StatusOK, "successful")
+	return c.JSON(http.StatusOK, res)
 }
 
 func getUserID(c echo.Context) (int64, error) {
@@ -740,6 +941,46 @@ func getUserID(c echo.Context) (int64, error) {
 	return claims.UserID, nil
 }
 
+// getOptionalUserID returns the user of a valid bearer token on routes that
+// do not require login. It reports false for anonymous requests and invalid
+// tokens alike.
+func getOptionalUserID(c echo.Context) (int64, bool) {
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return 0, false
+	}
+
+	claims := new(JwtCustomClaims)
+	_, err := jwt.ParseWithClaims(strings.TrimPrefix(auth, "Bearer "), claims, func(token *jwt.Token) (any, error) {
+		return []byte(GetSecret()), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return 0, false
+	}
+	return claims.UserID, true
+}
+
+// getPagination reads the page and per_page query parameters. Pages start at
+// 1 and hold defaultPerPage entries unless the client asks otherwise.
+func getPagination(c echo.Context) (int, int, error) {
+	page, perPage := 1, defaultPerPage
+	if v := c.QueryParam("page"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 {
+			return 0, 0, fmt.Errorf("invalid page")
+		}
+		page = p
+	}
+	if v := c.QueryParam("per_page"); v != "" {
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 || p > maxPerPage {
+			return 0, 0, fmt.Errorf("per_page must be between 1 and %d", maxPerPage)
+		}
+		perPage = p
+	}
+	return page, perPage, nil
+}
+
 func getEnv(key string, defaultValue string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -804,6 +1045,10 @@ func (h *Handler) GetFavoriteItems(c echo.Context) error {
 
 	for _, itemID := range itemIDs {
 		item, err := h.ItemRepo.GetItem(ctx, itemID.ItemID)
+		if err == sql.ErrNoRows {
+			// The seller deleted the item.
+			continue
+		}
 		if err != nil {
 			return c.JSON(http.StatusInternalServerError, err)
 		}
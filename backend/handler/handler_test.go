@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"database/sql"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+
+	sqlDB, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "test.sqlite3")+"?_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	schema, err := os.ReadFile(filepath.Join("..", "sql", "01_schema.sql"))
+	if err != nil {
+		t.Fatalf("failed to read schema: %s", err)
+	}
+	if _, err := sqlDB.Exec(string(schema)); err != nil {
+		t.Fatalf("failed to apply schema: %s", err)
+	}
+	if _, err := sqlDB.Exec("INSERT INTO category (id, name) VALUES (1, 'category')"); err != nil {
+		t.Fatalf("failed to add category: %s", err)
+	}
+
+	return &Handler{
+		Config:          DefaultConfig(),
+		DB:              sqlDB,
+		UserRepo:        db.NewUserRepository(sqlDB),
+		ItemRepo:        db.NewItemRepository(sqlDB, imagestore.NewMemoryStore()),
+		LedgerRepo:      db.NewLedgerRepository(sqlDB),
+		IdempotencyRepo: db.NewIdempotencyRepository(sqlDB),
+		ChargeRepo:      db.NewChargeRepository(sqlDB),
+	}
+}
+
+func addTestUser(t *testing.T, h *Handler) int64 {
+	t.Helper()
+
+	res, err := h.DB.Exec("INSERT INTO users (name, password) VALUES (?, ?)", "user", "password")
+	if err != nil {
+		t.Fatalf("failed to add user: %s", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get user id: %s", err)
+	}
+	return id
+}
+
+// newTestContext returns a context for the request as if the JWT middleware
+// had logged in userID.
+func newTestContext(e *echo.Echo, userID int64, method, path string, body string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.Set("user", jwt.NewWithClaims(jwt.SigningMethodHS256, &JwtCustomClaims{UserID: userID}))
+	return c, rec
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	idempotencyKeyHeader  = "Idempotency-Key"
+	defaultIdempotencyTTL = 24 * time.Hour
+)
+
+type IdempotencyConfig struct {
+	// TTL is how long the first response is replayed for a key. It defaults
+	// to 24 hours.
+	TTL time.Duration
+	// Required rejects requests that come without an Idempotency-Key header.
+	Required bool
+}
+
+// Idempotency records the first response for each (user, Idempotency-Key)
+// pair and replays it for retries of the same request. A key reused with a
+// different method, path or body is rejected with 422, and a retry that
+// arrives while the first request is still running gets 409. Server errors
+// are not recorded so that the client can retry them.
+//
+// It must run after the JWT middleware.
+func (h *Handler) Idempotency(config IdempotencyConfig) echo.MiddlewareFunc {
+	if config.TTL <= 0 {
+		config.TTL = defaultIdempotencyTTL
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			key := c.Request().Header.Get(idempotencyKeyHeader)
+			if key == "" {
+				if config.Required {
+					return echo.NewHTTPError(http.StatusBadRequest, "Idempotency-Key header is required")
+				}
+				return next(c)
+			}
+
+			userID, err := getUserID(c)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, err)
+			}
+
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err)
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+			hash := sha256.New()
+			hash.Write([]byte(c.Request().Method + " " + c.Request().URL.Path + "\n"))
+			hash.Write(body)
+			requestHash := hex.EncodeToString(hash.Sum(nil))
+
+			rec, reserved, err := h.IdempotencyRepo.Reserve(c.Request().Context(), userID, key, requestHash, config.TTL)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, err)
+			}
+			if !reserved {
+				if rec.RequestHash != requestHash {
+					return echo.NewHTTPError(http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+				}
+				if rec.StatusCode == 0 {
+					return echo.NewHTTPError(http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+				}
+				c.Response().Header().Set("Idempotent-Replayed", "true")
+				return c.Blob(rec.StatusCode, rec.ContentType, rec.Body)
+			}
+
+			recorder := &responseRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = recorder
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+
+			// The request context may already be cancelled if the client
+			// gave up, but the outcome still has to be stored.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			res := c.Response()
+			if res.Status >= http.StatusInternalServerError {
+				err = h.IdempotencyRepo.Release(ctx, userID, key)
+			} else {
+				err = h.IdempotencyRepo.Complete(ctx, userID, key, res.Status, res.Header().Get(echo.HeaderContentType), recorder.body.Bytes())
+			}
+			if err != nil {
+				c.Logger().Errorf("failed to store idempotent response: %s", err)
+			}
+			return nil
+		}
+	}
+}
+
+// responseRecorder keeps a copy of the response body while writing it.
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestIdempotency(t *testing.T) {
+	h := newTestHandler(t)
+	e := echo.New()
+	userID := addTestUser(t, h)
+
+	// The handler counts how often it really runs; fail makes it return a
+	// server error.
+	var calls int
+	var fail bool
+	next := func(c echo.Context) error {
+		calls++
+		if fail {
+			return echo.NewHTTPError(http.StatusInternalServerError, "broken")
+		}
+		return c.JSON(http.StatusCreated, calls)
+	}
+
+	tests := []struct {
+		name         string
+		key          string
+		body         string
+		required     bool
+		fail         bool
+		wantStatus   int
+		wantCalls    int
+		wantReplayed bool
+	}{
+		{name: "first request", key: "a", body: `{"n":1}`, wantStatus: http.StatusCreated, wantCalls: 1},
+		{name: "retry", key: "a", body: `{"n":1}`, wantStatus: http.StatusCreated, wantCalls: 1, wantReplayed: true},
+		{name: "key reused for another body", key: "a", body: `{"n":2}`, wantStatus: http.StatusUnprocessableEntity, wantCalls: 1},
+		{name: "server error", key: "b", body: `{}`, fail: true, wantStatus: http.StatusInternalServerError, wantCalls: 2},
+		{name: "retry after server error", key: "b", body: `{}`, wantStatus: http.StatusCreated, wantCalls: 3},
+		{name: "no key", body: `{}`, wantStatus: http.StatusCreated, wantCalls: 4},
+		{name: "no key when required", body: `{}`, required: true, wantStatus: http.StatusBadRequest, wantCalls: 4},
+	}
+	var firstBody string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fail = tt.fail
+			c, rec := newTestContext(e, userID, http.MethodPost, "/purchase/1", tt.body)
+			if tt.key != "" {
+				c.Request().Header.Set(idempotencyKeyHeader, tt.key)
+			}
+			if err := h.Idempotency(IdempotencyConfig{Required: tt.required})(next)(c); err != nil {
+				c.Error(err)
+			}
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("expected the handler to have run %d times, got %d", tt.wantCalls, calls)
+			}
+			replayed := rec.Header().Get("Idempotent-Replayed") == "true"
+			if replayed != tt.wantReplayed {
+				t.Errorf("expected replayed %t, got %t", tt.wantReplayed, replayed)
+			}
+			if firstBody == "" {
+				firstBody = rec.Body.String()
+			} else if tt.wantReplayed && rec.Body.String() != firstBody {
+				t.Errorf("expected the first response %q, got %q", firstBody, rec.Body)
+			}
+		})
+	}
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+	h := newTestHandler(t)
+	e := echo.New()
+	userID := addTestUser(t, h)
+
+	c, _ := newTestContext(e, userID, http.MethodPost, "/purchase/1", `{}`)
+	c.Request().Header.Set(idempotencyKeyHeader, "a")
+	ran := false
+	next := func(c echo.Context) error {
+		ran = true
+		// A retry arrives while the first request is still running.
+		retry, rec := newTestContext(e, userID, http.MethodPost, "/purchase/1", `{}`)
+		retry.Request().Header.Set(idempotencyKeyHeader, "a")
+		if err := h.Idempotency(IdempotencyConfig{})(func(echo.Context) error {
+			t.Error("expected the retry not to run")
+			return nil
+		})(retry); err != nil {
+			retry.Error(err)
+		}
+		if rec.Code != http.StatusConflict {
+			t.Errorf("expected status %d, got %d", http.StatusConflict, rec.Code)
+		}
+		return c.NoContent(http.StatusOK)
+	}
+	if err := h.Idempotency(IdempotencyConfig{})(next)(c); err != nil {
+		t.Fatalf("failed to run request: %s", err)
+	}
+	if !ran {
+		t.Error("expected the first request to run")
+	}
+
+	// Keys are per user.
+	otherID := addTestUser(t, h)
+	if _, reserved, err := h.IdempotencyRepo.Reserve(context.Background(), otherID, "a", "hash", time.Hour); err != nil || !reserved {
+		t.Errorf("expected another user to reserve the same key, got %t, %v", reserved, err)
+	}
+}
@@ -0,0 +1,321 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imaging"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+type itemImageResponse struct {
+	ID          int64  `json:"id"`
+	Position    int    `json:"position"`
+	Cover       bool   `json:"cover"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+type reorderItemImagesRequest struct {
+	// Order lists the current positions in their new order; the first one
+	// becomes the cover.
+	Order []int `json:"order" validate:"required"`
+}
+
+// GetItemImages lists the item's images in display order, the cover first.
+func (h *Handler) GetItemImages(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	itemID, err := strconv.Atoi(c.Param("itemID"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid itemID type")
+	}
+
+	images, err := h.ItemRepo.GetItemImages(ctx, int32(itemID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	if len(images) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Item not found.")
+	}
+
+	res := make([]itemImageResponse, len(images))
+	for i, image := range images {
+		res[i] = itemImageResponse{
+			ID:          image.ID,
+			Position:    image.Position,
+			Cover:       image.Position == 0,
+			ContentType: image.ContentType,
+			Size:        image.Size,
+			URL:         fmt.Sprintf("/items/%d/images/%d", itemID, image.Position),
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// GetItemImageAt returns the item's image at position n, 0 being the cover.
+func (h *Handler) GetItemImageAt(c echo.Context) error {
+	itemID, err := strconv.Atoi(c.Param("itemID"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid itemID type")
+	}
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid image position")
+	}
+
+	return h.serveItemImage(c, int32(itemID), n)
+}
+
+// serveItemImage writes the item's image at position in the size asked for
+// with ?size=thumb|medium|original, original being the default. Variants
+// missing for images stored before they existed are generated and kept.
+func (h *Handler) serveItemImage(c echo.Context, itemID int32, position int) error {
+	ctx := c.Request().Context()
+
+	size := domain.ImageSize(c.QueryParam("size"))
+	if size == "" {
+		size = domain.ImageSizeOriginal
+	}
+	maxSide, ok := h.Config.ImageSizes[size]
+	if !ok && size != domain.ImageSizeOriginal {
+		return echo.NewHTTPError(http.StatusBadRequest, "size must be thumb, medium or original")
+	}
+
+	if size != domain.ImageSizeOriginal {
+		variant, err := h.ItemRepo.GetItemImageVariant(ctx, itemID, position, size)
+		if err == nil {
+			return h.sendImage(c, variant)
+		}
+		if !errors.Is(err, db.ErrImageVariantNotFound) {
+			return echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+	}
+
+	image, err := h.ItemRepo.GetItemImageAt(ctx, itemID, position)
+	if err != nil {
+		if errors.Is(err, db.ErrItemImageNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Image not found.")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	if size == domain.ImageSizeOriginal {
+		return h.sendImage(c, image)
+	}
+
+	image, err = h.ItemRepo.LoadImage(ctx, image)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	variant, err := makeImageVariant(image, maxSide)
+	if err != nil {
+		// Images that cannot be scaled are served as they are.
+		c.Logger().Warnf("image %d: cannot make %s variant: %v", image.ID, size, err)
+		return h.sendImage(c, image)
+	}
+	variant, err = h.ItemRepo.AddItemImageVariant(ctx, image.ID, size, variant)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	return h.sendImage(c, variant)
+}
+
+// sendImage writes image with caching headers. Its ETag is the content
+// hash, so a matching If-None-Match is answered with 304 before the file is
+// read. Range requests are served by http.ServeContent.
+func (h *Handler) sendImage(c echo.Context, image domain.Image) error {
+	etag := `"` + image.Key + `"`
+	header := c.Response().Header()
+	header.Set(headerETag, etag)
+	header.Set(echo.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", int64(h.Config.ImageMaxAge.Seconds())))
+	if etagListed(c.Request().Header.Get(headerIfNoneMatch), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	if image.Data == nil {
+		var err error
+		image, err = h.ItemRepo.LoadImage(c.Request().Context(), image)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+	}
+	header.Set(echo.HeaderContentType, image.ContentType)
+	http.ServeContent(c.Response(), c.Request(), "", time.Time{}, bytes.NewReader(image.Data))
+	return nil
+}
+
+// etagListed reports whether an If-None-Match header lists etag. The
+// comparison is weak, as RFC 9110 requires for If-None-Match.
+func etagListed(header string, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ReorderItemImages rearranges the seller's item images. If-Match is
+// optional, as for PUT /items/:itemID.
+func (h *Handler) ReorderItemImages(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	itemID, err := strconv.Atoi(c.Param("itemID"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid itemID type")
+	}
+
+	version, err := getIfMatchVersion(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	req := new(reorderItemImagesRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	if len(req.Order) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "order is required")
+	}
+
+	return h.reorderItemImages(c, int32(itemID), userID, version, req.Order)
+}
+
+// SetItemCover makes the image at position n the cover. The other images
+// keep their order.
+func (h *Handler) SetItemCover(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	itemID, err := strconv.Atoi(c.Param("itemID"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid itemID type")
+	}
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid image position")
+	}
+
+	version, err := getIfMatchVersion(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	images, err := h.ItemRepo.GetItemImages(ctx, int32(itemID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	if n < 0 || n >= len(images) {
+		return echo.NewHTTPError(http.StatusNotFound, "Image not found.")
+	}
+	order := []int{n}
+	for i := range images {
+		if i != n {
+			order = append(order, i)
+		}
+	}
+
+	return h.reorderItemImages(c, int32(itemID), userID, version, order)
+}
+
+func (h *Handler) reorderItemImages(c echo.Context, itemID int32, userID int64, version int64, order []int) error {
+	item, err := h.ItemRepo.ReorderItemImages(c.Request().Context(), itemID, userID, version, order)
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidImageOrder) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return h.newUpdateItemHTTPError(c, item, err)
+	}
+
+	c.Response().Header().Set(headerETag, itemETag(item))
+	return h.GetItemImages(c)
+}
+
+// readImages reads and validates the files uploaded as "image", in order.
+// The field may be repeated to upload several images. It returns nil when
+// the request has none. Its errors are HTTP errors; any invalid file fails
+// the whole request before anything is stored.
+func (h *Handler) readImages(c echo.Context) ([]domain.Image, error) {
+	if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		return nil, nil
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	files := form.File["image"]
+	if len(files) > h.Config.MaxItemImages {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("an item can have at most %d images", h.Config.MaxItemImages))
+	}
+
+	limits := imaging.DefaultLimits
+	var images []domain.Image
+	for _, file := range files {
+		if limits.MaxBytes > 0 && file.Size > limits.MaxBytes {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s: images must be at most %d bytes", file.Filename, limits.MaxBytes))
+		}
+		src, err := file.Open()
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+		var blob bytes.Buffer
+		_, err = io.Copy(&blob, src)
+		src.Close()
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+
+		contentType, err := limits.Validate(blob.Bytes())
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s: %s", file.Filename, err))
+		}
+		// Photos often say where they were taken; that must not be served.
+		data, err := imaging.Sanitize(contentType, blob.Bytes())
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("%s: %s", file.Filename, err))
+		}
+
+		dhash, err := imaging.DHash(data)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+
+		image := domain.Image{ContentType: contentType, Data: data, Variants: map[domain.ImageSize]domain.Image{}, DHash: &dhash}
+		for size, maxSide := range h.Config.ImageSizes {
+			variant, err := makeImageVariant(image, maxSide)
+			if err != nil {
+				return nil, echo.NewHTTPError(http.StatusInternalServerError, err)
+			}
+			image.Variants[size] = variant
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// makeImageVariant scales image down to fit maxSide.
+func makeImageVariant(image domain.Image, maxSide int) (domain.Image, error) {
+	contentType, data, err := imaging.Fit(image.ContentType, image.Data, maxSide)
+	if err != nil {
+		return domain.Image{}, err
+	}
+	return domain.Image{ContentType: contentType, Data: data}, nil
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/labstack/echo/v4"
+)
+
+type itemRevisionResponse struct {
+	ID          int64             `json:"id"`
+	Version     int64             `json:"version"`
+	ActorID     int64             `json:"actor_id"`
+	Change      string            `json:"change"`
+	Name        string            `json:"name"`
+	Price       int64             `json:"price"`
+	Description string            `json:"description"`
+	CategoryID  int64             `json:"category_id"`
+	ImageHash   string            `json:"image_hash"`
+	Status      domain.ItemStatus `json:"status"`
+	CreatedAt   string            `json:"created_at"`
+}
+
+type getItemRevisionsResponse struct {
+	Revisions []itemRevisionResponse `json:"revisions"`
+	Page      int                    `json:"page"`
+	PerPage   int                    `json:"per_page"`
+	Total     int64                  `json:"total"`
+}
+
+// GetItemRevisions lists the snapshots taken on every change to the item,
+// the latest first. Only the seller and admins may see them. An actor_id of
+// 0 marks changes made by background jobs.
+func (h *Handler) GetItemRevisions(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	itemID, err := strconv.Atoi(c.Param("itemID"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid itemID type")
+	}
+
+	page, perPage, err := getPagination(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	item, err := h.ItemRepo.GetItem(ctx, int32(itemID))
+	switch {
+	case err == sql.ErrNoRows && adminUserIDs[userID]:
+		// Admins can audit deleted items too.
+	case err == sql.ErrNoRows:
+		return echo.NewHTTPError(http.StatusNotFound, "Item not found.")
+	case err != nil:
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	case item.UserID != userID && !adminUserIDs[userID]:
+		return echo.NewHTTPError(http.StatusForbidden, "This item does not belong to you.")
+	}
+
+	revisions, err := h.ItemRepo.GetItemRevisions(ctx, int32(itemID), perPage, (page-1)*perPage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	total, err := h.ItemRepo.CountItemRevisions(ctx, int32(itemID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res := getItemRevisionsResponse{
+		Revisions: make([]itemRevisionResponse, len(revisions)),
+		Page:      page,
+		PerPage:   perPage,
+		Total:     total,
+	}
+	for i, rev := range revisions {
+		res.Revisions[i] = itemRevisionResponse{
+			ID:          rev.ID,
+			Version:     rev.Version,
+			ActorID:     rev.ActorID,
+			Change:      rev.Change,
+			Name:        rev.Name,
+			Price:       rev.Price,
+			Description: rev.Description,
+			CategoryID:  rev.CategoryID,
+			ImageHash:   rev.ImageHash,
+			Status:      rev.Status,
+			CreatedAt:   rev.CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
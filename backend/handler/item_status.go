@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+type relistItemRequest struct {
+	// EndsAt gives an auction a new end time, needed once the old one has
+	// passed.
+	EndsAt string `json:"ends_at"`
+}
+
+type changeItemStatusResponse struct {
+	ID     int32             `json:"id"`
+	Status domain.ItemStatus `json:"status"`
+}
+
+// UnlistItem takes the seller's item off sale without deleting it.
+func (h *Handler) UnlistItem(c echo.Context) error {
+	return h.changeItemStatus(c, domain.ItemEventUnlist, "")
+}
+
+// RelistItem puts an unlisted item back on sale.
+func (h *Handler) RelistItem(c echo.Context) error {
+	req := new(relistItemRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+	var endsAt string
+	if req.EndsAt != "" {
+		var err error
+		if endsAt, err = parseEndsAt(req.EndsAt); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	return h.changeItemStatus(c, domain.ItemEventRelist, endsAt)
+}
+
+// DeleteItem removes the seller's item from every listing. Its orders keep
+// referring to it.
+func (h *Handler) DeleteItem(c echo.Context) error {
+	return h.changeItemStatus(c, domain.ItemEventDelete, "")
+}
+
+func (h *Handler) changeItemStatus(c echo.Context, event domain.ItemEvent, endsAt string) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	itemID, err := strconv.Atoi(c.Param("itemID"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid itemID type")
+	}
+
+	item, err := h.ItemRepo.ChangeItemStatus(ctx, int32(itemID), userID, event, endsAt)
+	if err != nil {
+		return newItemStatusHTTPError(err)
+	}
+
+	return c.JSON(http.StatusOK, changeItemStatusResponse{ID: item.ID, Status: item.Status})
+}
+
+// newItemStatusHTTPError maps errors of item status changes to HTTP errors.
+func newItemStatusHTTPError(err error) error {
+	switch {
+	case errors.Is(err, db.ErrItemNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Item not found.")
+	case errors.Is(err, db.ErrNotItemOwner):
+		return echo.NewHTTPError(http.StatusForbidden, "This item does not belong to you.")
+	case errors.Is(err, db.ErrAuctionEnded):
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "This auction has already ended. Give it a new ends_at.")
+	case errors.Is(err, db.ErrAuctionHasBids):
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "This auction already has bids.")
+	case errors.Is(err, domain.ErrInvalidItemTransition):
+		return echo.NewHTTPError(http.StatusPreconditionFailed, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, err)
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	headerETag        = "ETag"
+	headerIfMatch     = "If-Match"
+	headerIfNoneMatch = "If-None-Match"
+)
+
+// patchItemRequest holds the fields to change. Fields left out are kept, and
+// so are the images when none are uploaded.
+type patchItemRequest struct {
+	Name        *string `json:"name" form:"name" validate:"omitempty,min=1"`
+	CategoryID  *int64  `json:"category_id" form:"category_id" validate:"omitempty,min=1"`
+	Price       *int64  `json:"price" form:"price" validate:"omitempty,min=1"`
+	Description *string `json:"description" form:"description" validate:"omitempty,min=1"`
+}
+
+type itemConflictResponse struct {
+	Message string          `json:"message"`
+	Item    getItemResponse `json:"item"`
+}
+
+// PatchItem changes only the fields sent. The request must carry the item's
+// ETag in If-Match; if the item changed since, it fails with 412 and the
+// current item.
+func (h *Handler) PatchItem(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	itemID, err := strconv.Atoi(c.Param("itemID"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid itemID type")
+	}
+
+	if c.Request().Header.Get(headerIfMatch) == "" {
+		return echo.NewHTTPError(http.StatusPreconditionRequired, "If-Match with the item's ETag is required.")
+	}
+	version, err := getIfMatchVersion(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	req := new(patchItemRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "name, category_id, price and description cannot be empty")
+	}
+
+	if req.CategoryID != nil {
+		if _, err := h.ItemRepo.GetCategory(ctx, *req.CategoryID); err != nil {
+			if err == sql.ErrNoRows {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid categoryID")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+	}
+
+	images, err := h.readImages(c)
+	if err != nil {
+		return err
+	}
+
+	item, err := h.ItemRepo.UpdateItem(ctx, int32(itemID), userID, version, domain.ItemPatch{
+		Name:        req.Name,
+		Price:       req.Price,
+		Description: req.Description,
+		CategoryID:  req.CategoryID,
+		Images:      images,
+	})
+	if err != nil {
+		return h.newUpdateItemHTTPError(c, item, err)
+	}
+
+	res, err := h.newGetItemResponse(c, item)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	c.Response().Header().Set(headerETag, itemETag(item))
+	return c.JSON(http.StatusOK, res)
+}
+
+// newUpdateItemHTTPError maps errors of item updates to HTTP errors. A
+// conflicting edit gets the current item so the client can merge.
+func (h *Handler) newUpdateItemHTTPError(c echo.Context, current domain.Item, err error) error {
+	switch {
+	case errors.Is(err, db.ErrItemNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Item not found.")
+	case errors.Is(err, db.ErrNotItemOwner):
+		return echo.NewHTTPError(http.StatusForbidden, "you are not authorized to update this item")
+	case errors.Is(err, db.ErrItemModified):
+		res, err := h.newGetItemResponse(c, current)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+		c.Response().Header().Set(headerETag, itemETag(current))
+		return c.JSON(http.StatusPreconditionFailed, itemConflictResponse{
+			Message: "This item was changed by someone else.",
+			Item:    res,
+		})
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, err)
+}
+
+// itemETag identifies the item's current version.
+func itemETag(item domain.Item) string {
+	return fmt.Sprintf(`"%d"`, item.Version)
+}
+
+// weakETagVersion is the version getIfMatchVersion returns for weak ETags.
+// If-Match compares ETags strongly, so a weak one matches no version and
+// the request fails with 412 as if the item had changed.
+const weakETagVersion = -1
+
+// getIfMatchVersion returns the item version in the If-Match header, or 0
+// when there is none or it is "*".
+func getIfMatchVersion(c echo.Context) (int64, error) {
+	tag := strings.TrimSpace(c.Request().Header.Get(headerIfMatch))
+	if tag == "" || tag == "*" {
+		return 0, nil
+	}
+	if strings.HasPrefix(tag, "W/") {
+		return weakETagVersion, nil
+	}
+	version, err := strconv.ParseInt(strings.Trim(tag, `"`), 10, 64)
+	if err != nil || version <= 0 {
+		return 0, errors.New("If-Match must be an ETag returned for the item")
+	}
+	return version, nil
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/labstack/echo/v4"
+)
+
+func TestPatchItem(t *testing.T) {
+	tests := []struct {
+		name       string
+		ifMatch    string
+		otherUser  bool
+		itemID     string
+		wantStatus int
+		wantETag   string
+		wantName   string
+	}{
+		{name: "current version", ifMatch: `"2"`, wantStatus: http.StatusOK, wantETag: `"3"`, wantName: "renamed"},
+		{name: "weak ETag", ifMatch: `W/"2"`, wantStatus: http.StatusPreconditionFailed, wantETag: `"2"`, wantName: "item"},
+		{name: "any version", ifMatch: "*", wantStatus: http.StatusOK, wantETag: `"3"`, wantName: "renamed"},
+		{name: "stale version", ifMatch: `"1"`, wantStatus: http.StatusPreconditionFailed, wantETag: `"2"`, wantName: "item"},
+		{name: "no If-Match", wantStatus: http.StatusPreconditionRequired, wantName: "item"},
+		{name: "invalid If-Match", ifMatch: "abc", wantStatus: http.StatusBadRequest, wantName: "item"},
+		{name: "not the seller", ifMatch: `"2"`, otherUser: true, wantStatus: http.StatusForbidden, wantName: "item"},
+		{name: "unknown item", ifMatch: `"2"`, itemID: "999", wantStatus: http.StatusNotFound, wantName: "item"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHandler(t)
+			e := echo.New()
+			ctx := context.Background()
+			sellerID := addTestUser(t, h)
+			item, err := h.ItemRepo.AddItem(ctx, domain.Item{Name: "item", Price: 100, CategoryID: 1, UserID: sellerID, Status: domain.ItemStatusOnSale, Stock: 1}, nil)
+			if err != nil {
+				t.Fatalf("failed to add item: %s", err)
+			}
+			// Someone else changed the item since version 1.
+			if _, err := h.DB.Exec("UPDATE items SET description = 'changed' WHERE id = ?", item.ID); err != nil {
+				t.Fatalf("failed to change item: %s", err)
+			}
+
+			userID := sellerID
+			if tt.otherUser {
+				userID = addTestUser(t, h)
+			}
+			itemID := tt.itemID
+			if itemID == "" {
+				itemID = strconv.Itoa(int(item.ID))
+			}
+			c, rec := newTestContext(e, userID, http.MethodPatch, "/items/"+itemID, `{"name":"renamed"}`)
+			c.SetParamNames("itemID")
+			c.SetParamValues(itemID)
+			if tt.ifMatch != "" {
+				c.Request().Header.Set(headerIfMatch, tt.ifMatch)
+			}
+			if err := h.PatchItem(c); err != nil {
+				c.Error(err)
+			}
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body)
+			}
+			if etag := rec.Header().Get(headerETag); etag != tt.wantETag {
+				t.Errorf("expected ETag %q, got %q", tt.wantETag, etag)
+			}
+			switch rec.Code {
+			case http.StatusOK:
+				var res getItemResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+					t.Fatalf("failed to decode response: %s", err)
+				}
+				if res.Name != tt.wantName || res.Description != "changed" {
+					t.Errorf("expected only the name to change, got %+v", res)
+				}
+			case http.StatusPreconditionFailed:
+				// The conflict carries the current item to merge with.
+				var res itemConflictResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+					t.Fatalf("failed to decode response: %s", err)
+				}
+				if res.Item.Version != 2 || res.Item.Description != "changed" {
+					t.Errorf("expected the current item, got %+v", res.Item)
+				}
+			}
+
+			current, err := h.ItemRepo.GetItem(ctx, item.ID)
+			if err != nil {
+				t.Fatalf("failed to get item: %s", err)
+			}
+			if current.Name != tt.wantName {
+				t.Errorf("expected name %q, got %q", tt.wantName, current.Name)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+var limitMessages = map[domain.LimitRule]string{
+	domain.LimitRuleMaxBalance:    "This top-up would take your balance over its limit.",
+	domain.LimitRuleDailyTopUp:    "You have reached your daily top-up limit.",
+	domain.LimitRuleMonthlyTopUp:  "You have reached your monthly top-up limit.",
+	domain.LimitRuleMaxPurchase:   "This purchase is over your purchase limit.",
+	domain.LimitRulePurchaseBurst: "Too many purchases. Please try again later.",
+	domain.LimitRuleTopUpBurst:    "Too many top-ups. Please try again later.",
+}
+
+// limitErrorResponse is the body of requests refused by a limit. Code is
+// the broken domain.LimitRule.
+type limitErrorResponse struct {
+	Code    domain.LimitRule `json:"code"`
+	Message string           `json:"message"`
+	Limit   int64            `json:"limit"`
+}
+
+// newLimitHTTPError answers a LimitError with 429 for velocity rules, which
+// pass with time, and 403 for the others.
+func newLimitHTTPError(err *db.LimitError) error {
+	status := http.StatusForbidden
+	if err.Rule.Velocity() {
+		status = http.StatusTooManyRequests
+	}
+	return echo.NewHTTPError(status, limitErrorResponse{Code: err.Rule, Message: limitMessages[err.Rule], Limit: err.Limit})
+}
+
+// limitsRequest sets a user's overrides. Fields left null use the default.
+type limitsRequest struct {
+	MaxBalance    *int64 `json:"max_balance" validate:"omitempty,min=0"`
+	DailyTopUp    *int64 `json:"daily_top_up" validate:"omitempty,min=0"`
+	MonthlyTopUp  *int64 `json:"monthly_top_up" validate:"omitempty,min=0"`
+	MaxPurchase   *int64 `json:"max_purchase" validate:"omitempty,min=0"`
+	PurchaseBurst *int64 `json:"purchase_burst" validate:"omitempty,min=0"`
+	TopUpBurst    *int64 `json:"top_up_burst" validate:"omitempty,min=0"`
+}
+
+type limitsResponse struct {
+	MaxBalance     int64  `json:"max_balance"`
+	DailyTopUp     int64  `json:"daily_top_up"`
+	MonthlyTopUp   int64  `json:"monthly_top_up"`
+	MaxPurchase    int64  `json:"max_purchase"`
+	PurchaseBurst  int64  `json:"purchase_burst"`
+	PurchaseWindow string `json:"purchase_window"`
+	TopUpBurst     int64  `json:"top_up_burst"`
+	TopUpWindow    string `json:"top_up_window"`
+}
+
+// getLimitsResponse shows the limits in force for a user and which of them
+// are overridden.
+type getLimitsResponse struct {
+	Limits    limitsResponse `json:"limits"`
+	Overrides limitsRequest  `json:"overrides"`
+}
+
+type limitViolationResponse struct {
+	ID        int64            `json:"id"`
+	UserID    int64            `json:"user_id"`
+	Code      domain.LimitRule `json:"code"`
+	Limit     int64            `json:"limit"`
+	Attempted int64            `json:"attempted"`
+	CreatedAt string           `json:"created_at"`
+}
+
+type getLimitViolationsResponse struct {
+	Violations []limitViolationResponse `json:"violations"`
+	Page       int                      `json:"page"`
+	PerPage    int                      `json:"per_page"`
+	Total      int64                    `json:"total"`
+}
+
+func (h *Handler) GetUserLimits(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid userID type")
+	}
+
+	res, err := h.getLimitsResponse(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// SetUserLimits replaces a user's overrides of the default limits.
+func (h *Handler) SetUserLimits(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid userID type")
+	}
+
+	req := new(limitsRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "limits must not be negative")
+	}
+
+	err = h.LimitRepo.SetOverrides(ctx, userID, domain.LimitOverrides{
+		MaxBalance:    req.MaxBalance,
+		DailyTopUp:    req.DailyTopUp,
+		MonthlyTopUp:  req.MonthlyTopUp,
+		MaxPurchase:   req.MaxPurchase,
+		PurchaseBurst: req.PurchaseBurst,
+		TopUpBurst:    req.TopUpBurst,
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrUserNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "User not found.")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res, err := h.getLimitsResponse(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// GetLimitViolations lists refused requests for review, the latest first.
+// The user_id query parameter narrows them down to one user.
+func (h *Handler) GetLimitViolations(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var userID int64
+	if v := c.QueryParam("user_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid user_id type")
+		}
+		userID = id
+	}
+
+	page, perPage, err := getPagination(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	violations, err := h.LimitRepo.GetViolations(ctx, userID, perPage, (page-1)*perPage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	total, err := h.LimitRepo.CountViolations(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res := getLimitViolationsResponse{
+		Violations: make([]limitViolationResponse, len(violations)),
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+	}
+	for i, v := range violations {
+		res.Violations[i] = limitViolationResponse{
+			ID:        v.ID,
+			UserID:    v.UserID,
+			Code:      v.Rule,
+			Limit:     v.Limit,
+			Attempted: v.Attempted,
+			CreatedAt: v.CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) getLimitsResponse(ctx context.Context, userID int64) (getLimitsResponse, error) {
+	limits, err := h.LimitRepo.GetLimits(ctx, userID)
+	if err != nil {
+		return getLimitsResponse{}, err
+	}
+	overrides, err := h.LimitRepo.GetOverrides(ctx, userID)
+	if err != nil {
+		return getLimitsResponse{}, err
+	}
+
+	return getLimitsResponse{
+		Limits: limitsResponse{
+			MaxBalance:     limits.MaxBalance,
+			DailyTopUp:     limits.DailyTopUp,
+			MonthlyTopUp:   limits.MonthlyTopUp,
+			MaxPurchase:    limits.MaxPurchase,
+			PurchaseBurst:  limits.PurchaseBurst,
+			PurchaseWindow: limits.PurchaseWindow.String(),
+			TopUpBurst:     limits.TopUpBurst,
+			TopUpWindow:    limits.TopUpWindow.String(),
+		},
+		Overrides: limitsRequest{
+			MaxBalance:    overrides.MaxBalance,
+			DailyTopUp:    overrides.DailyTopUp,
+			MonthlyTopUp:  overrides.MonthlyTopUp,
+			MaxPurchase:   overrides.MaxPurchase,
+			PurchaseBurst: overrides.PurchaseBurst,
+			TopUpBurst:    overrides.TopUpBurst,
+		},
+	}, nil
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+type offerRequest struct {
+	Price int64 `json:"price" validate:"required"`
+}
+
+type getOfferResponse struct {
+	ID            int64              `json:"id"`
+	ItemID        int32              `json:"item_id"`
+	BuyerID       int64              `json:"buyer_id"`
+	SellerID      int64              `json:"seller_id"`
+	Price         int64              `json:"price"`
+	ProposedBy    int64              `json:"proposed_by"`
+	ParentID      int64              `json:"parent_id,omitempty"`
+	Status        domain.OfferStatus `json:"status"`
+	ExpiresAt     string             `json:"expires_at"`
+	ReservedUntil string             `json:"reserved_until,omitempty"`
+	CreatedAt     string             `json:"created_at"`
+}
+
+func newGetOfferResponse(offer domain.Offer) getOfferResponse {
+	return getOfferResponse{
+		ID:            offer.ID,
+		ItemID:        offer.ItemID,
+		BuyerID:       offer.BuyerID,
+		SellerID:      offer.SellerID,
+		Price:         offer.Price,
+		ProposedBy:    offer.ProposedBy,
+		ParentID:      offer.ParentID,
+		Status:        offer.Status,
+		ExpiresAt:     offer.ExpiresAt,
+		ReservedUntil: offer.ReservedUntil,
+		CreatedAt:     offer.CreatedAt,
+	}
+}
+
+func (h *Handler) MakeOffer(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	itemID, err := strconv.Atoi(c.Param("itemID"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid itemID type")
+	}
+
+	req := new(offerRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "price is required")
+	}
+
+	offer, err := h.OfferRepo.MakeOffer(ctx, int32(itemID), userID, req.Price, h.Config.OfferTTL)
+	if err != nil {
+		return offerError(err)
+	}
+
+	return c.JSON(http.StatusOK, newGetOfferResponse(offer))
+}
+
+// GetItemOffers lists the offers on an item. The seller sees all of them,
+// everybody else only the offers they are part of.
+func (h *Handler) GetItemOffers(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	itemID, err := strconv.Atoi(c.Param("itemID"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid itemID type")
+	}
+
+	offers, err := h.OfferRepo.GetOffersByItemID(ctx, int32(itemID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res := []getOfferResponse{}
+	for _, offer := range offers {
+		if offer.SellerID == userID || offer.BuyerID == userID {
+			res = append(res, newGetOfferResponse(offer))
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) AcceptOffer(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	offerID, err := strconv.ParseInt(c.Param("offerID"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid offerID type")
+	}
+
+	offer, err := h.OfferRepo.Accept(ctx, offerID, userID, h.Config.OfferReservation)
+	if err != nil {
+		return offerError(err)
+	}
+
+	return c.JSON(http.StatusOK, newGetOfferResponse(offer))
+}
+
+func (h *Handler) RejectOffer(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	offerID, err := strconv.ParseInt(c.Param("offerID"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid offerID type")
+	}
+
+	offer, err := h.OfferRepo.Reject(ctx, offerID, userID)
+	if err != nil {
+		return offerError(err)
+	}
+
+	return c.JSON(http.StatusOK, newGetOfferResponse(offer))
+}
+
+// CounterOffer answers an offer with a different price. The response is the
+// new offer, which the other party can accept, reject or counter in turn.
+func (h *Handler) CounterOffer(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	offerID, err := strconv.ParseInt(c.Param("offerID"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid offerID type")
+	}
+
+	req := new(offerRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "price is required")
+	}
+
+	offer, err := h.OfferRepo.Counter(ctx, offerID, userID, req.Price, h.Config.OfferTTL)
+	if err != nil {
+		return offerError(err)
+	}
+
+	return c.JSON(http.StatusOK, newGetOfferResponse(offer))
+}
+
+// offerError maps errors of offer operations to HTTP errors.
+func offerError(err error) error {
+	switch {
+	case errors.Is(err, db.ErrItemNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Item not found.")
+	case errors.Is(err, db.ErrOfferNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Offer not found.")
+	case errors.Is(err, db.ErrOwnItem):
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "This item is listed by you!")
+	case errors.Is(err, db.ErrItemNotOnSale):
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "This item is not on sale.")
+	case errors.Is(err, db.ErrAuctionItem):
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "This item is sold by auction. Place a bid instead.")
+	case errors.Is(err, db.ErrItemReserved):
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "This item is reserved for another buyer.")
+	case errors.Is(err, db.ErrInvalidOfferPrice):
+		return echo.NewHTTPError(http.StatusBadRequest, "The price must be positive and below the listed price.")
+	case errors.Is(err, db.ErrOfferPending):
+		return echo.NewHTTPError(http.StatusConflict, "You already have an offer waiting for an answer.")
+	case errors.Is(err, db.ErrNotOfferParty):
+		return echo.NewHTTPError(http.StatusForbidden, "You cannot answer your own offer.")
+	case errors.Is(err, db.ErrOfferNotOpen):
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "This offer is no longer open.")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, err)
+}
@@ -0,0 +1,268 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// purchaseRequest is the body of POST /purchase/:itemID. Quantity defaults
+// to one unit; CouponCode and Points are optional. Points beyond the amount
+// left to pay are not spent.
+type purchaseRequest struct {
+	Quantity   int64  `json:"quantity"`
+	CouponCode string `json:"coupon_code"`
+	Points     int64  `json:"points"`
+}
+
+// purchaseResponse lists the orders created by a purchase, one per unit.
+// OrderID is the first of them. Paid is what the buyer was charged from
+// their balance after the coupon discount and points.
+type purchaseResponse struct {
+	OrderID    int64   `json:"order_id"`
+	OrderIDs   []int64 `json:"order_ids"`
+	Discount   int64   `json:"discount,omitempty"`
+	PointsUsed int64   `json:"points_used,omitempty"`
+	Paid       int64   `json:"paid"`
+}
+
+type getOrderResponse struct {
+	ID                int64              `json:"id"`
+	ItemID            int32              `json:"item_id"`
+	BuyerID           int64              `json:"buyer_id"`
+	SellerID          int64              `json:"seller_id"`
+	Price             int64              `json:"price"`
+	Fee               int64              `json:"fee"`
+	Discount          int64              `json:"discount,omitempty"`
+	PointsUsed        int64              `json:"points_used,omitempty"`
+	Status            domain.OrderStatus `json:"status"`
+	ShippedAt         string             `json:"shipped_at,omitempty"`
+	DeliveredAt       string             `json:"delivered_at,omitempty"`
+	CompletedAt       string             `json:"completed_at,omitempty"`
+	CancelledAt       string             `json:"cancelled_at,omitempty"`
+	CancelRequestedBy int64              `json:"cancel_requested_by,omitempty"`
+	ItemRevisionID    int64              `json:"item_revision_id,omitempty"`
+	CreatedAt         string             `json:"created_at"`
+	UpdatedAt         string             `json:"updated_at"`
+}
+
+type cancelOrderRequest struct {
+	Reason string `json:"reason"`
+	// Relist puts the item back on sale instead of back to draft. Only the
+	// seller can ask for it.
+	Relist bool `json:"relist"`
+}
+
+type getOrderEventResponse struct {
+	ID         int64                 `json:"id"`
+	ActorID    int64                 `json:"actor_id"`
+	Kind       domain.OrderEventKind `json:"kind"`
+	FromStatus domain.OrderStatus    `json:"from_status"`
+	ToStatus   domain.OrderStatus    `json:"to_status"`
+	Note       string                `json:"note,omitempty"`
+	CreatedAt  string                `json:"created_at"`
+}
+
+func newGetOrderResponse(order domain.Order) getOrderResponse {
+	return getOrderResponse{
+		ID:                order.ID,
+		ItemID:            order.ItemID,
+		BuyerID:           order.BuyerID,
+		SellerID:          order.SellerID,
+		Price:             order.Price,
+		Fee:               order.Fee,
+		Discount:          order.Discount,
+		PointsUsed:        order.PointsUsed,
+		Status:            order.Status,
+		ShippedAt:         order.ShippedAt,
+		DeliveredAt:       order.DeliveredAt,
+		CompletedAt:       order.CompletedAt,
+		CancelledAt:       order.CancelledAt,
+		CancelRequestedBy: order.CancelRequestedBy,
+		ItemRevisionID:    order.ItemRevisionID,
+		CreatedAt:         order.CreatedAt,
+		UpdatedAt:         order.UpdatedAt,
+	}
+}
+
+func (h *Handler) GetOrders(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	orders, err := h.OrderRepo.GetOrdersByUserID(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res := make([]getOrderResponse, len(orders))
+	for i, order := range orders {
+		res[i] = newGetOrderResponse(order)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func (h *Handler) GetOrder(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	orderID, err := strconv.ParseInt(c.Param("orderID"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid orderID type")
+	}
+
+	order, err := h.OrderRepo.GetOrder(ctx, orderID)
+	if err != nil {
+		if errors.Is(err, db.ErrOrderNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Order not found.")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	// Orders are only visible to the people involved in them.
+	if order.BuyerID != userID && order.SellerID != userID {
+		return echo.NewHTTPError(http.StatusNotFound, "Order not found.")
+	}
+
+	return c.JSON(http.StatusOK, newGetOrderResponse(order))
+}
+
+func (h *Handler) ShipOrder(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	orderID, err := strconv.ParseInt(c.Param("orderID"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid orderID type")
+	}
+
+	if err := h.OrderRepo.Ship(ctx, orderID, userID); err != nil {
+		return orderError(err)
+	}
+
+	return c.JSON(http.StatusOK, "successful")
+}
+
+func (h *Handler) ConfirmOrder(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	orderID, err := strconv.ParseInt(c.Param("orderID"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid orderID type")
+	}
+
+	if err := h.OrderRepo.Confirm(ctx, orderID, userID); err != nil {
+		return orderError(err)
+	}
+
+	return c.JSON(http.StatusOK, "successful")
+}
+
+// CancelOrder cancels an order, or asks the other party to agree to cancel it
+// once it has been shipped. The response is the order after the call.
+func (h *Handler) CancelOrder(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	orderID, err := strconv.ParseInt(c.Param("orderID"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid orderID type")
+	}
+
+	req := new(cancelOrderRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	order, err := h.OrderRepo.Cancel(ctx, orderID, userID, req.Reason, req.Relist)
+	if err != nil {
+		return orderError(err)
+	}
+
+	return c.JSON(http.StatusOK, newGetOrderResponse(order))
+}
+
+func (h *Handler) GetOrderEvents(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	orderID, err := strconv.ParseInt(c.Param("orderID"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid orderID type")
+	}
+
+	order, err := h.OrderRepo.GetOrder(ctx, orderID)
+	if err != nil {
+		if errors.Is(err, db.ErrOrderNotFound) {
+			return echo.NewHTTPError(http.StatusNotFound, "Order not found.")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	if order.BuyerID != userID && order.SellerID != userID {
+		return echo.NewHTTPError(http.StatusNotFound, "Order not found.")
+	}
+
+	events, err := h.OrderRepo.GetOrderEvents(ctx, orderID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res := make([]getOrderEventResponse, len(events))
+	for i, event := range events {
+		res[i] = getOrderEventResponse{
+			ID:         event.ID,
+			ActorID:    event.ActorID,
+			Kind:       event.Kind,
+			FromStatus: event.FromStatus,
+			ToStatus:   event.ToStatus,
+			Note:       event.Note,
+			CreatedAt:  event.CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// orderError maps errors of order state changes to HTTP errors.
+func orderError(err error) error {
+	switch {
+	case errors.Is(err, db.ErrOrderNotFound):
+		return echo.NewHTTPError(http.StatusNotFound, "Order not found.")
+	case errors.Is(err, db.ErrNotOrderParty):
+		return echo.NewHTTPError(http.StatusForbidden, "You are not allowed to change this order.")
+	case errors.Is(err, db.ErrInvalidOrderStatus):
+		return echo.NewHTTPError(http.StatusPreconditionFailed, "The order status does not allow this operation.")
+	case errors.Is(err, db.ErrCancelRequested):
+		return echo.NewHTTPError(http.StatusConflict, "The cancellation is waiting for the other party.")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, err)
+}
@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+type addBankAccountRequest struct {
+	BankName      string `json:"bank_name" validate:"required"`
+	BranchName    string `json:"branch_name" validate:"required"`
+	AccountNumber string `json:"account_number" validate:"required,numeric"`
+	HolderName    string `json:"holder_name" validate:"required"`
+}
+
+type getBankAccountResponse struct {
+	ID            int64  `json:"id"`
+	BankName      string `json:"bank_name"`
+	BranchName    string `json:"branch_name"`
+	AccountNumber string `json:"account_number"`
+	HolderName    string `json:"holder_name"`
+}
+
+type requestPayoutRequest struct {
+	BankAccountID int64 `json:"bank_account_id" validate:"required"`
+	Amount        int64 `json:"amount" validate:"required"`
+}
+
+type getPayoutResponse struct {
+	ID            int64               `json:"id"`
+	BankAccountID int64               `json:"bank_account_id"`
+	Amount        int64               `json:"amount"`
+	Fee           int64               `json:"fee"`
+	Status        domain.PayoutStatus `json:"status"`
+	FailureReason string              `json:"failure_reason,omitempty"`
+	CreatedAt     string              `json:"created_at"`
+	UpdatedAt     string              `json:"updated_at"`
+}
+
+func newGetPayoutResponse(payout domain.Payout) getPayoutResponse {
+	return getPayoutResponse{
+		ID:            payout.ID,
+		BankAccountID: payout.BankAccountID,
+		Amount:        payout.Amount,
+		Fee:           payout.Fee,
+		Status:        payout.Status,
+		FailureReason: payout.FailureReason,
+		CreatedAt:     payout.CreatedAt,
+		UpdatedAt:     payout.UpdatedAt,
+	}
+}
+
+func (h *Handler) AddBankAccount(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	req := new(addBankAccountRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "bank_name, branch_name, account_number and holder_name are required")
+	}
+
+	account, err := h.PayoutRepo.AddBankAccount(ctx, domain.BankAccount{
+		UserID:        userID,
+		BankName:      req.BankName,
+		BranchName:    req.BranchName,
+		AccountNumber: req.AccountNumber,
+		HolderName:    req.HolderName,
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	return c.JSON(http.StatusOK, getBankAccountResponse{
+		ID:            account.ID,
+		BankName:      account.BankName,
+		BranchName:    account.BranchName,
+		AccountNumber: account.AccountNumber,
+		HolderName:    account.HolderName,
+	})
+}
+
+func (h *Handler) GetBankAccounts(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	accounts, err := h.PayoutRepo.GetBankAccountsByUserID(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res := make([]getBankAccountResponse, len(accounts))
+	for i, account := range accounts {
+		res[i] = getBankAccountResponse{
+			ID:            account.ID,
+			BankName:      account.BankName,
+			BranchName:    account.BranchName,
+			AccountNumber: account.AccountNumber,
+			HolderName:    account.HolderName,
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// RequestPayout withdraws part of the seller's balance to one of their bank
+// accounts. The transfer itself happens in the background.
+func (h *Handler) RequestPayout(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if h.Payouts == nil {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, "Withdrawals are not available.")
+	}
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	req := new(requestPayoutRequest)
+	if err := c.Bind(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "bank_account_id and amount are required")
+	}
+
+	if req.Amount < h.Config.PayoutMinAmount || req.Amount <= h.Config.PayoutFee {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("The minimum withdrawal is %d", h.Config.PayoutMinAmount))
+	}
+
+	payout, err := h.PayoutRepo.RequestPayout(ctx, domain.Payout{
+		UserID:        userID,
+		BankAccountID: req.BankAccountID,
+		Amount:        req.Amount,
+		Fee:           h.Config.PayoutFee,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrBankAccountNotFound):
+			return echo.NewHTTPError(http.StatusNotFound, "Bank account not found.")
+		case errors.Is(err, db.ErrInsufficientBalance):
+			return echo.NewHTTPError(http.StatusBadRequest, "Insufficient balance")
+		case errors.Is(err, db.ErrUserNotFound):
+			return echo.NewHTTPError(http.StatusNotFound, "User not found.")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	return c.JSON(http.StatusOK, newGetPayoutResponse(payout))
+}
+
+func (h *Handler) GetPayouts(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	payouts, err := h.PayoutRepo.GetPayoutsByUserID(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res := make([]getPayoutResponse, len(payouts))
+	for i, payout := range payouts {
+		res[i] = newGetPayoutResponse(payout)
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
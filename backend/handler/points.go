@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/labstack/echo/v4"
+)
+
+type pointEntryResponse struct {
+	ID        int64                 `json:"id"`
+	Kind      domain.PointEntryKind `json:"kind"`
+	Amount    int64                 `json:"amount"`
+	OrderID   int64                 `json:"order_id,omitempty"`
+	CreatedAt string                `json:"created_at"`
+}
+
+type pointExpirationResponse struct {
+	Amount    int64  `json:"amount"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+type getPointsResponse struct {
+	Balance     int64                     `json:"balance"`
+	Entries     []pointEntryResponse      `json:"entries"`
+	Page        int                       `json:"page"`
+	PerPage     int                       `json:"per_page"`
+	Total       int64                     `json:"total"`
+	Expirations []pointExpirationResponse `json:"expirations"`
+}
+
+// GetPoints returns the user's loyalty points: the spendable balance, a page
+// of their history and the points still to expire, the earliest first.
+func (h *Handler) GetPoints(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userID, err := getUserID(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, err)
+	}
+
+	page, perPage, err := getPagination(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	balance, err := h.PointsRepo.GetBalance(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	entries, err := h.PointsRepo.GetEntries(ctx, userID, perPage, (page-1)*perPage)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	total, err := h.PointsRepo.CountEntries(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	lots, err := h.PointsRepo.GetUpcomingExpirations(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+
+	res := getPointsResponse{
+		Balance:     balance,
+		Entries:     make([]pointEntryResponse, len(entries)),
+		Page:        page,
+		PerPage:     perPage,
+		Total:       total,
+		Expirations: make([]pointExpirationResponse, len(lots)),
+	}
+	for i, entry := range entries {
+		res.Entries[i] = pointEntryResponse{
+			ID:        entry.ID,
+			Kind:      entry.Kind,
+			Amount:    entry.Amount,
+			OrderID:   entry.OrderID,
+			CreatedAt: entry.CreatedAt,
+		}
+	}
+	for i, lot := range lots {
+		res.Expirations[i] = pointExpirationResponse{Amount: lot.Remaining, ExpiresAt: lot.ExpiresAt}
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
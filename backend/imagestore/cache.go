@@ -0,0 +1,94 @@
+package imagestore
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// Evicter is implemented by stores that cache images, so that callers can
+// drop images they no longer use.
+type Evicter interface {
+	Evict(key string)
+}
+
+// CachedStore keeps the most recently read images of another store in
+// memory, up to a budget of maxBytes. Images larger than the budget are
+// never cached.
+type CachedStore struct {
+	Store
+	maxBytes int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	data []byte
+}
+
+func NewCachedStore(store Store, maxBytes int64) *CachedStore {
+	return &CachedStore{
+		Store:    store,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (s *CachedStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	if e, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(e)
+		data := e.Value.(*cacheEntry).data
+		s.mu.Unlock()
+		return data, nil
+	}
+	s.mu.Unlock()
+
+	data, err := s.Store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	s.add(key, data)
+	return data, nil
+}
+
+func (s *CachedStore) add(key string, data []byte) {
+	if int64(len(data)) > s.maxBytes {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.entries[key]; ok {
+		return
+	}
+	s.entries[key] = s.lru.PushFront(&cacheEntry{key: key, data: data})
+	s.size += int64(len(data))
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *CachedStore) Delete(ctx context.Context, key string) error {
+	s.Evict(key)
+	return s.Store.Delete(ctx, key)
+}
+
+// Evict drops the image from the cache. The stored image is kept.
+func (s *CachedStore) Evict(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok {
+		s.remove(e)
+	}
+}
+
+func (s *CachedStore) remove(e *list.Element) {
+	entry := s.lru.Remove(e).(*cacheEntry)
+	delete(s.entries, entry.key)
+	s.size -= int64(len(entry.data))
+}
@@ -0,0 +1,77 @@
+package imagestore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// countingStore counts the reads that reach it.
+type countingStore struct {
+	Store
+	gets map[string]int
+}
+
+func (s *countingStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.gets[key]++
+	return s.Store.Get(ctx, key)
+}
+
+func TestCachedStore(t *testing.T) {
+	ctx := context.Background()
+	backing := &countingStore{Store: NewMemoryStore(), gets: map[string]int{}}
+	// Room for two of the 4-byte images.
+	cache := NewCachedStore(backing, 8)
+
+	keys := map[string]string{}
+	for _, data := range []string{"aaaa", "bbbb", "cccc", "too large"} {
+		key, err := cache.Put(ctx, []byte(data))
+		if err != nil {
+			t.Fatalf("failed to put: %s", err)
+		}
+		keys[data] = key
+	}
+
+	// Each step reads an image and expects the backing store to have been
+	// read that many times for it in total.
+	steps := []struct {
+		read      string
+		wantReads int
+	}{
+		{"aaaa", 1},
+		{"aaaa", 1},
+		{"bbbb", 1},
+		// Reading aaaa again makes bbbb the least recently used.
+		{"aaaa", 1},
+		{"cccc", 1},
+		{"bbbb", 2},
+		{"aaaa", 2},
+		{"too large", 1},
+		{"too large", 2},
+	}
+	for i, step := range steps {
+		data, err := cache.Get(ctx, keys[step.read])
+		if err != nil {
+			t.Fatalf("step %d: failed to get: %s", i, err)
+		}
+		if string(data) != step.read {
+			t.Errorf("step %d: expected %q, got %q", i, step.read, data)
+		}
+		if got := backing.gets[keys[step.read]]; got != step.wantReads {
+			t.Errorf("step %d: expected %d reads of %q, got %d", i, step.wantReads, step.read, got)
+		}
+	}
+
+	// Evicted images are read from the store again; deleted ones are gone.
+	cache.Evict(keys["aaaa"])
+	if _, err := cache.Get(ctx, keys["aaaa"]); err != nil || backing.gets[keys["aaaa"]] != 3 {
+		t.Errorf("expected an evicted image to be read again, got %d reads, %v", backing.gets[keys["aaaa"]], err)
+	}
+	if err := cache.Delete(ctx, keys["aaaa"]); err != nil {
+		t.Fatalf("failed to delete: %s", err)
+	}
+	if _, err := cache.Get(ctx, keys["aaaa"]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after deleting, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package imagestore
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryStore keeps images in memory. It suits tests and throwaway
+// servers; everything is lost on restart.
+type MemoryStore struct {
+	mu     sync.RWMutex
+	images map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{images: make(map[string][]byte)}
+}
+
+func (s *MemoryStore) Put(ctx context.Context, data []byte) (string, error) {
+	key := Key(data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[key]; !ok {
+		s.images[key] = append([]byte(nil), data...)
+	}
+	return key, nil
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.images[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.images, key)
+	return nil
+}
@@ -0,0 +1,68 @@
+// Package imagestore keeps image files outside the database. Files are
+// addressed by the SHA-256 of their content, so storing the same image
+// twice keeps a single copy.
+package imagestore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+var ErrNotFound = errors.New("image not found in store")
+
+// Store holds image files by key.
+type Store interface {
+	// Put stores data and returns its key. Storing data that is already
+	// there is a no-op.
+	Put(ctx context.Context, data []byte) (string, error)
+	// Get returns the data stored under key, or ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete removes the data stored under key, if any. Callers must make
+	// sure nothing refers to it anymore.
+	Delete(ctx context.Context, key string) error
+}
+
+// Key returns the key data is stored under: its hex SHA-256.
+func Key(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validKey reports whether key can have been returned by Key. Keys are
+// checked before they become file names.
+func validKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// New returns the store of the given kind: "fs" keeps files under dir and
+// "memory" keeps them until the process exits.
+func New(kind, dir string) (Store, error) {
+	switch kind {
+	case "fs":
+		return NewFSStore(dir)
+	case "memory":
+		return NewMemoryStore(), nil
+	}
+	return nil, errors.Errorf("unknown image store %q", kind)
+}
+
+// EnvConfig returns the kind and directory for New from IMAGE_STORE and
+// IMAGE_DIR, which default to the "fs" store under "images".
+func EnvConfig() (kind, dir string) {
+	kind, dir = os.Getenv("IMAGE_STORE"), os.Getenv("IMAGE_DIR")
+	if kind == "" {
+		kind = "fs"
+	}
+	if dir == "" {
+		dir = "images"
+	}
+	return kind, dir
+}
@@ -0,0 +1,105 @@
+package imagestore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"fs": func(t *testing.T) Store {
+			store, err := NewFSStore(filepath.Join(t.TempDir(), "images"))
+			if err != nil {
+				t.Fatalf("failed to create store: %s", err)
+			}
+			return store
+		},
+		"memory": func(t *testing.T) Store { return NewMemoryStore() },
+		"cached": func(t *testing.T) Store { return NewCachedStore(NewMemoryStore(), 1<<10) },
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+			data := []byte("image data")
+
+			key, err := store.Put(ctx, data)
+			if err != nil {
+				t.Fatalf("failed to put: %s", err)
+			}
+			if key != Key(data) {
+				t.Errorf("expected key %s, got %s", Key(data), key)
+			}
+			if again, err := store.Put(ctx, data); err != nil || again != key {
+				t.Errorf("expected the same key again, got %s, %v", again, err)
+			}
+			got, err := store.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("failed to get: %s", err)
+			}
+			if string(got) != string(data) {
+				t.Errorf("expected %q, got %q", data, got)
+			}
+
+			for _, bad := range []string{"", "../../etc/passwd", Key(data)[:10], Key([]byte("missing"))} {
+				if _, err := store.Get(ctx, bad); !errors.Is(err, ErrNotFound) {
+					t.Errorf("%q: expected ErrNotFound, got %v", bad, err)
+				}
+				if err := store.Delete(ctx, bad); err != nil {
+					t.Errorf("%q: expected deleting to be a no-op, got %v", bad, err)
+				}
+			}
+
+			if err := store.Delete(ctx, key); err != nil {
+				t.Fatalf("failed to delete: %s", err)
+			}
+			if _, err := store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+				t.Errorf("expected ErrNotFound after deleting, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFSStoreLayout(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFSStore(dir)
+	if err != nil {
+		t.Fatalf("failed to create store: %s", err)
+	}
+	key, err := store.Put(context.Background(), []byte("image data"))
+	if err != nil {
+		t.Fatalf("failed to put: %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, key[:2], key)); err != nil {
+		t.Errorf("expected the file under its key prefix: %s", err)
+	}
+	leftovers, err := filepath.Glob(filepath.Join(dir, key[:2], ".tmp-*"))
+	if err != nil {
+		t.Fatalf("failed to list files: %s", err)
+	}
+	if len(leftovers) != 0 {
+		t.Errorf("expected no temporary files, got %v", leftovers)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		kind    string
+		wantErr bool
+	}{
+		{"fs", false},
+		{"memory", false},
+		{"s3", true},
+	}
+	for _, tt := range tests {
+		_, err := New(tt.kind, t.TempDir())
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %t, got %v", tt.kind, tt.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+)
+
+// DHash returns the difference hash of an image: it is shrunk to 9×8 grey
+// pixels and each bit tells whether a pixel is brighter than its right
+// neighbour. Copies of a photo that were scaled, re-encoded or slightly
+// edited get hashes only a few bits apart.
+func DHash(data []byte) (uint64, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, ErrInvalid
+	}
+	small := resize(src, 9, 8)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if luma(small, x, y) > luma(small, x+1, y) {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// luma is the brightness of a pixel, weighted as in ITU-R BT.601.
+func luma(img *image.RGBA, x, y int) uint32 {
+	p := img.Pix[img.PixOffset(x, y):]
+	return 299*uint32(p[0]) + 587*uint32(p[1]) + 114*uint32(p[2])
+}
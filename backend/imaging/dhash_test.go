@@ -0,0 +1,54 @@
+package imaging
+
+import (
+	"math/bits"
+	"testing"
+)
+
+func TestDHash(t *testing.T) {
+	original := encodePNG(t, testImage(256, 192, 1))
+	hash, err := DHash(original)
+	if err != nil {
+		t.Fatalf("failed to hash the original: %s", err)
+	}
+
+	_, scaled, err := Fit(MIMEPNG, original, 100)
+	if err != nil {
+		t.Fatalf("failed to scale: %s", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		// The hash must be at most maxDistance bits from the original's, or
+		// more than minDistance bits for a different image.
+		maxDistance int
+		minDistance int
+	}{
+		{"same image", original, 0, -1},
+		{"re-encoded as jpeg", encodeJPEG(t, testImage(256, 192, 1)), 5, -1},
+		{"scaled down", scaled, 5, -1},
+		{"different image", encodePNG(t, testImage(256, 192, 2)), 64, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other, err := DHash(tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			distance := bits.OnesCount64(hash ^ other)
+			if distance > tt.maxDistance {
+				t.Errorf("expected at most %d bits apart, got %d", tt.maxDistance, distance)
+			}
+			if distance <= tt.minDistance {
+				t.Errorf("expected more than %d bits apart, got %d", tt.minDistance, distance)
+			}
+		})
+	}
+}
+
+func TestDHashInvalid(t *testing.T) {
+	if _, err := DHash([]byte("garbage")); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid, got %v", err)
+	}
+}
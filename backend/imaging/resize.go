@@ -0,0 +1,96 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+)
+
+// jpegQuality is used when encoding scaled JPEGs.
+const jpegQuality = 85
+
+// Fit scales the image down so that neither side exceeds maxSide, keeping
+// its aspect ratio, and returns the scaled image with its MIME type. Images
+// already small enough are returned unchanged. JPEGs stay JPEGs; PNGs and
+// GIFs become PNGs so that transparency survives.
+func Fit(contentType string, data []byte, maxSide int) (string, []byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, ErrInvalid
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= maxSide && h <= maxSide {
+		return contentType, data, nil
+	}
+	if w >= h {
+		w, h = maxSide, scaleSide(h, maxSide, w)
+	} else {
+		w, h = scaleSide(w, maxSide, h), maxSide
+	}
+
+	dst := resize(src, w, h)
+	var buf bytes.Buffer
+	if contentType == MIMEJPEG {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		contentType = MIMEPNG
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return contentType, buf.Bytes(), nil
+}
+
+// scaleSide returns side scaled by num/den, rounded and at least 1.
+func scaleSide(side, num, den int) int {
+	scaled := (side*num + den/2) / den
+	if scaled < 1 {
+		return 1
+	}
+	return scaled
+}
+
+// resize shrinks src to w×h. Each destination pixel is the average of the
+// source pixels it covers; averaging premultiplied colours keeps
+// transparent pixels from darkening their neighbours.
+func resize(src image.Image, w, h int) *image.RGBA {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	rgba := image.NewRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, (y+1)*sh/h
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, (x+1)*sw/w
+			if x1 == x0 {
+				x1++
+			}
+
+			var sum [4]uint64
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					sum[0] += uint64(p[0])
+					sum[1] += uint64(p[1])
+					sum[2] += uint64(p[2])
+					sum[3] += uint64(p[3])
+				}
+			}
+			n := uint64((y1 - y0) * (x1 - x0))
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[i+c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,52 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestFit(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentType   string
+		data          []byte
+		maxSide       int
+		wantType      string
+		wantW, wantH  int
+		wantUnchanged bool
+	}{
+		{"landscape jpeg", MIMEJPEG, encodeJPEG(t, testImage(400, 200, 1)), 100, MIMEJPEG, 100, 50, false},
+		{"portrait png", MIMEPNG, encodePNG(t, testImage(100, 400, 1)), 200, MIMEPNG, 50, 200, false},
+		{"gif becomes png", MIMEGIF, encodeGIF(t, testImage(300, 300, 1)), 150, MIMEPNG, 150, 150, false},
+		{"thin side kept at one pixel", MIMEPNG, encodePNG(t, testImage(1000, 2, 1)), 100, MIMEPNG, 100, 1, false},
+		{"small enough", MIMEJPEG, encodeJPEG(t, testImage(80, 60, 1)), 100, MIMEJPEG, 80, 60, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, data, err := Fit(tt.contentType, tt.data, tt.maxSide)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if contentType != tt.wantType {
+				t.Errorf("expected %s, got %s", tt.wantType, contentType)
+			}
+			if tt.wantUnchanged && !bytes.Equal(data, tt.data) {
+				t.Errorf("expected the image to be returned unchanged")
+			}
+			config, _, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("failed to decode the result: %s", err)
+			}
+			if config.Width != tt.wantW || config.Height != tt.wantH {
+				t.Errorf("expected %dx%d, got %dx%d", tt.wantW, tt.wantH, config.Width, config.Height)
+			}
+		})
+	}
+}
+
+func TestFitInvalid(t *testing.T) {
+	if _, _, err := Fit(MIMEJPEG, []byte("garbage"), 100); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid, got %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+)
+
+// rotatedJPEGQuality is used when a JPEG has to be re-encoded to apply its
+// orientation.
+const rotatedJPEGQuality = 90
+
+// Sanitize removes the metadata of an image, such as the GPS position and
+// camera model phones write into photos, and returns the cleaned image.
+// JPEGs whose EXIF orientation says they are rotated are turned upright
+// and re-encoded, since the orientation goes with the rest of the EXIF
+// data. Other images are cleaned without touching their pixels and are
+// returned as they are when there is nothing to remove.
+func Sanitize(contentType string, data []byte) ([]byte, error) {
+	switch contentType {
+	case MIMEJPEG:
+		return sanitizeJPEG(data)
+	case MIMEPNG:
+		return sanitizePNG(data)
+	case MIMEGIF:
+		return sanitizeGIF(data)
+	}
+	return nil, ErrUnsupportedType
+}
+
+// JPEG markers.
+const (
+	markerSOI  = 0xd8
+	markerEOI  = 0xd9
+	markerSOS  = 0xda
+	markerAPP0 = 0xe0
+	markerAPP1 = 0xe1
+	markerAPP2 = 0xe2
+	markerCOM  = 0xfe
+)
+
+// keptAPPn lists the application segments that carry no personal data but
+// affect how the image looks: JFIF (APP0) and Adobe colour transforms
+// (APP14). APP2 segments are kept only for ICC profiles; the others hold
+// MPF data, whose secondary images have their own EXIF.
+var keptAPPn = map[byte]bool{0xe0: true, 0xee: true}
+
+const iccProfileHeader = "ICC_PROFILE\x00"
+
+// keepSegment reports whether the marker segment with the given payload is
+// kept in sanitized JPEGs.
+func keepSegment(marker byte, payload []byte) bool {
+	if marker == markerCOM {
+		return false
+	}
+	if marker < markerAPP0 || marker > 0xef || keptAPPn[marker] {
+		return true
+	}
+	return marker == markerAPP2 && bytes.HasPrefix(payload, []byte(iccProfileHeader))
+}
+
+// sanitizeJPEG drops the comment and application segments keepSegment
+// rejects, and whatever follows the end of the image, such as the videos of
+// motion photos.
+func sanitizeJPEG(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != markerSOI {
+		return nil, ErrInvalid
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+	orientation := 1
+	changed := false
+
+	pos := 2
+	for {
+		if pos+2 > len(data) || data[pos] != 0xff {
+			return nil, ErrInvalid
+		}
+		marker := data[pos+1]
+		if marker == 0xff {
+			// Fill byte.
+			pos++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			out.Write(data[pos : pos+2])
+			pos += 2
+			continue
+		}
+		if marker == markerEOI {
+			out.Write(data[pos : pos+2])
+			changed = changed || pos+2 < len(data)
+			break
+		}
+		if pos+4 > len(data) {
+			return nil, ErrInvalid
+		}
+		// The length counts its own two bytes.
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, ErrInvalid
+		}
+		segment := data[pos:end]
+		pos = end
+
+		if marker == markerSOS {
+			pos = scanEnd(data, pos)
+			out.Write(segment)
+			out.Write(data[end:pos])
+			if pos == len(data) {
+				// Truncated before the end of the image.
+				break
+			}
+			continue
+		}
+		if !keepSegment(marker, segment[4:]) {
+			if marker == markerAPP1 {
+				if o, ok := exifOrientation(segment[4:]); ok {
+					orientation = o
+				}
+			}
+			changed = true
+			continue
+		}
+		out.Write(segment)
+	}
+
+	if orientation != 1 {
+		return rotateJPEG(out.Bytes(), orientation)
+	}
+	if !changed {
+		return data, nil
+	}
+	return out.Bytes(), nil
+}
+
+// scanEnd returns where the entropy-coded data starting at pos ends: at the
+// next marker, or at the end of data. 0xff bytes inside the data are
+// followed by 0x00 or a restart marker.
+func scanEnd(data []byte, pos int) int {
+	for ; pos+1 < len(data); pos++ {
+		if data[pos] != 0xff {
+			continue
+		}
+		if next := data[pos+1]; next != 0x00 && (next < 0xd0 || next > 0xd7) {
+			return pos
+		}
+	}
+	return len(data)
+}
+
+// exifOrientation reads the orientation tag from the IFD0 of the EXIF
+// payload of an APP1 segment.
+func exifOrientation(payload []byte) (int, bool) {
+	const header = "Exif\x00\x00"
+	if !bytes.HasPrefix(payload, []byte(header)) {
+		return 0, false
+	}
+	tiff := payload[len(header):]
+	if len(tiff) < 8 {
+		return 0, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0, false
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			o := int(order.Uint16(tiff[entry+8:]))
+			if o < 1 || o > 8 {
+				return 0, false
+			}
+			return o, true
+		}
+	}
+	return 0, false
+}
+
+// rotateJPEG turns the image upright according to its EXIF orientation and
+// encodes it again.
+func rotateJPEG(data []byte, orientation int) ([]byte, error) {
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, orient(src, orientation), &jpeg.Options{Quality: rotatedJPEGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// orient applies an EXIF orientation, 1 to 8, to src: 2 to 4 flip and turn
+// it half way, 5 to 8 turn it a quarter and swap its sides.
+func orient(src image.Image, orientation int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	if orientation == 1 {
+		return rgba
+	}
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], rgba.Pix[rgba.PixOffset(sx, sy):])
+		}
+	}
+	return dst
+}
+
+// strippedPNGChunks are the ancillary PNG chunks that hold text, EXIF data
+// and timestamps.
+var strippedPNGChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+
+// sanitizePNG drops strippedPNGChunks and whatever follows the end of the
+// image.
+func sanitizePNG(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, ErrInvalid
+	}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.WriteString(signature)
+	changed := false
+
+	pos := len(signature)
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, ErrInvalid
+		}
+		// Length, type, data and CRC.
+		end := pos + 12 + int(binary.BigEndian.Uint32(data[pos:]))
+		if end > len(data) || end < pos {
+			return nil, ErrInvalid
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		if strippedPNGChunks[chunkType] {
+			changed = true
+		} else {
+			out.Write(data[pos:end])
+		}
+		pos = end
+		if chunkType == "IEND" {
+			// Anything appended after the image goes too.
+			changed = changed || pos < len(data)
+			break
+		}
+	}
+
+	if !changed {
+		return data, nil
+	}
+	return out.Bytes(), nil
+}
+
+// sanitizeGIF encodes the GIF again, which keeps its frames and loop count
+// but drops comments and application data.
+func sanitizeGIF(data []byte) ([]byte, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
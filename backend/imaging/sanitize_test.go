@@ -0,0 +1,259 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+const secret = "GPS 35.6812N 139.7671E"
+
+// jpegSegment builds a marker segment with the given payload.
+func jpegSegment(marker byte, payload string) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// exifPayload builds an APP1 EXIF payload whose IFD0 holds only the given
+// orientation, followed by the secret.
+func exifPayload(orientation uint16) string {
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = append(tiff, 1, 0)
+	entry := make([]byte, 12)
+	binary.LittleEndian.PutUint16(entry[0:], 0x0112)
+	binary.LittleEndian.PutUint16(entry[2:], 3)
+	binary.LittleEndian.PutUint32(entry[4:], 1)
+	binary.LittleEndian.PutUint16(entry[8:], orientation)
+	tiff = append(tiff, entry...)
+	tiff = append(tiff, 0, 0, 0, 0)
+	return "Exif\x00\x00" + string(tiff) + secret
+}
+
+// withSegments inserts segments right after the SOI of a JPEG and appends
+// trailer after its EOI.
+func withSegments(data []byte, trailer string, segments ...[]byte) []byte {
+	out := append([]byte{}, data[:2]...)
+	for _, seg := range segments {
+		out = append(out, seg...)
+	}
+	out = append(out, data[2:]...)
+	return append(out, trailer...)
+}
+
+func TestSanitizeJPEG(t *testing.T) {
+	clean := encodeJPEG(t, testImage(64, 48, 1))
+	icc := jpegSegment(markerAPP2, iccProfileHeader+"\x01\x01profile")
+
+	tests := []struct {
+		name    string
+		data    []byte
+		keep    [][]byte
+		changed bool
+	}{
+		{"clean", clean, nil, false},
+		{"exif", withSegments(clean, "", jpegSegment(markerAPP1, exifPayload(1))), nil, true},
+		{"comment", withSegments(clean, "", jpegSegment(markerCOM, secret)), nil, true},
+		{"mpf", withSegments(clean, "", jpegSegment(markerAPP2, "MPF\x00"+secret)), nil, true},
+		{"trailer", withSegments(clean, "motion photo "+secret), nil, true},
+		{
+			"jfif and icc kept",
+			withSegments(clean, "", jpegSegment(markerAPP0, "JFIF\x00\x01\x01"), icc, jpegSegment(markerAPP1, exifPayload(1))),
+			[][]byte{[]byte("JFIF\x00"), icc},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Sanitize(MIMEJPEG, tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !tt.changed {
+				if !bytes.Equal(out, tt.data) {
+					t.Errorf("expected the image to be returned unchanged")
+				}
+				return
+			}
+			if bytes.Contains(out, []byte(secret)) {
+				t.Errorf("expected the metadata to be removed")
+			}
+			if !bytes.HasSuffix(out, []byte{0xff, markerEOI}) {
+				t.Errorf("expected the image to end at its EOI")
+			}
+			for _, keep := range tt.keep {
+				if !bytes.Contains(out, keep) {
+					t.Errorf("expected %q to be kept", keep)
+				}
+			}
+			if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+				t.Errorf("failed to decode the result: %s", err)
+			}
+		})
+	}
+}
+
+func TestSanitizeJPEGScans(t *testing.T) {
+	// A progressive JPEG has several scans with tables between them; the
+	// tables may contain ff d9, and the entropy-coded data may contain
+	// stuffed bytes and restart markers.
+	scan := []byte{0x01, 0x02, 0xff, 0x00, 0x03, 0xff, 0xd0, 0x04}
+	sos := jpegSegment(markerSOS, "\x01\x01\x00\x00\x3f\x00")
+	dht := jpegSegment(0xc4, "\x10\xff\xd9\x00")
+
+	var want []byte
+	want = append(want, 0xff, markerSOI)
+	want = append(want, sos...)
+	want = append(want, scan...)
+	want = append(want, dht...)
+	want = append(want, sos...)
+	want = append(want, scan...)
+	want = append(want, 0xff, markerEOI)
+
+	data := withSegments(want, "", jpegSegment(markerAPP1, exifPayload(1)))
+	data = append(data[:len(data)-2], jpegSegment(markerCOM, secret)...)
+	data = append(data, 0xff, markerEOI)
+	data = append(data, "trailer"...)
+
+	out, err := Sanitize(MIMEJPEG, data)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !bytes.Equal(out, want) {
+		t.Errorf("expected %x, got %x", want, out)
+	}
+}
+
+func TestSanitizeJPEGOrientation(t *testing.T) {
+	// Red top-left quarter on white.
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.RGBA{255, 255, 255, 255}
+			if x < 32 && y < 16 {
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	clean := encodeJPEG(t, img)
+
+	tests := []struct {
+		orientation uint16
+		w, h        int
+		red         image.Point
+	}{
+		{1, 64, 32, image.Pt(8, 8)},
+		{3, 64, 32, image.Pt(56, 24)},
+		{6, 32, 64, image.Pt(24, 8)},
+		{8, 32, 64, image.Pt(8, 56)},
+	}
+	for _, tt := range tests {
+		data := withSegments(clean, "", jpegSegment(markerAPP1, exifPayload(tt.orientation)))
+		out, err := Sanitize(MIMEJPEG, data)
+		if err != nil {
+			t.Fatalf("orientation %d: unexpected error: %s", tt.orientation, err)
+		}
+		got, err := jpeg.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("orientation %d: failed to decode the result: %s", tt.orientation, err)
+		}
+		if b := got.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %d: expected %dx%d, got %dx%d", tt.orientation, tt.w, tt.h, b.Dx(), b.Dy())
+			continue
+		}
+		if r, g, _, _ := got.At(tt.red.X, tt.red.Y).RGBA(); r>>8 < 200 || g>>8 > 60 {
+			t.Errorf("orientation %d: expected red at %v", tt.orientation, tt.red)
+		}
+	}
+}
+
+// pngChunk builds a PNG chunk with a valid CRC.
+func pngChunk(chunkType, data string) []byte {
+	chunk := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, chunkType+data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE([]byte(chunkType+data)))
+}
+
+func TestSanitizePNG(t *testing.T) {
+	clean := encodePNG(t, testImage(32, 32, 1))
+	// The IHDR chunk ends 33 bytes in.
+	withChunk := func(chunk []byte) []byte {
+		out := append([]byte{}, clean[:33]...)
+		out = append(out, chunk...)
+		return append(out, clean[33:]...)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		changed bool
+	}{
+		{"clean", clean, false},
+		{"text", withChunk(pngChunk("tEXt", "Comment\x00"+secret)), true},
+		{"exif", withChunk(pngChunk("eXIf", secret)), true},
+		{"trailer", append(append([]byte{}, clean...), secret...), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Sanitize(MIMEPNG, tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !tt.changed {
+				if !bytes.Equal(out, tt.data) {
+					t.Errorf("expected the image to be returned unchanged")
+				}
+				return
+			}
+			if !bytes.Equal(out, clean) {
+				t.Errorf("expected the image without the metadata")
+			}
+			if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+				t.Errorf("failed to decode the result: %s", err)
+			}
+		})
+	}
+}
+
+func TestSanitizeGIF(t *testing.T) {
+	out, err := Sanitize(MIMEGIF, encodeGIF(t, testImage(32, 32, 1)))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := gif.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("failed to decode the result: %s", err)
+	}
+}
+
+func TestSanitizeErrors(t *testing.T) {
+	jpegData := encodeJPEG(t, testImage(32, 32, 1))
+
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+		wantErr     error
+	}{
+		{"unsupported type", "image/webp", jpegData, ErrUnsupportedType},
+		{"jpeg without soi", MIMEJPEG, jpegData[2:], ErrInvalid},
+		{"jpeg bad segment length", MIMEJPEG, []byte{0xff, markerSOI, 0xff, markerCOM, 0xff, 0xff}, ErrInvalid},
+		{"png without signature", MIMEPNG, []byte("PNG"), ErrInvalid},
+		{"truncated png", MIMEPNG, encodePNG(t, testImage(32, 32, 1))[:20], ErrInvalid},
+		{"invalid gif", MIMEGIF, []byte("GIF89a"), ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Sanitize(tt.contentType, tt.data); err != tt.wantErr {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
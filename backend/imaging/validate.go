@@ -0,0 +1,77 @@
+// Package imaging checks and transforms the images uploaded for items.
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	// Register the decoders of the accepted formats.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// Accepted image types.
+const (
+	MIMEJPEG = "image/jpeg"
+	MIMEPNG  = "image/png"
+	MIMEGIF  = "image/gif"
+)
+
+var (
+	ErrTooLarge        = errors.New("image is too large")
+	ErrUnsupportedType = errors.New("image must be a JPEG, PNG or GIF")
+	ErrInvalid         = errors.New("image cannot be decoded")
+	ErrTooManyPixels   = errors.New("image dimensions are too large")
+)
+
+// Limits bound the images users can upload.
+type Limits struct {
+	// MaxBytes caps the size of the file.
+	MaxBytes  int64
+	MaxWidth  int
+	MaxHeight int
+}
+
+// DefaultLimits apply to every upload. They are configured on startup.
+var DefaultLimits = Limits{MaxBytes: 1 << 20, MaxWidth: 4096, MaxHeight: 4096}
+
+// formats maps the MIME types sniffed from the content to the names the
+// image package decodes them as.
+var formats = map[string]string{
+	MIMEJPEG: "jpeg",
+	MIMEPNG:  "png",
+	MIMEGIF:  "gif",
+}
+
+// Validate checks that data is a JPEG, PNG or GIF image within the limits
+// that decodes cleanly, and returns its MIME type. The type is taken from
+// the content, never from what the client claims.
+func (l Limits) Validate(data []byte) (string, error) {
+	if l.MaxBytes > 0 && int64(len(data)) > l.MaxBytes {
+		return "", fmt.Errorf("%w: %d bytes exceeds %d", ErrTooLarge, len(data), l.MaxBytes)
+	}
+
+	mimeType := http.DetectContentType(data)
+	format, ok := formats[mimeType]
+	if !ok {
+		return "", ErrUnsupportedType
+	}
+
+	// The header is checked before decoding so that a small file claiming
+	// huge dimensions is never decoded.
+	config, decoded, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || decoded != format {
+		return "", ErrInvalid
+	}
+	if (l.MaxWidth > 0 && config.Width > l.MaxWidth) || (l.MaxHeight > 0 && config.Height > l.MaxHeight) {
+		return "", fmt.Errorf("%w: %dx%d exceeds %dx%d", ErrTooManyPixels, config.Width, config.Height, l.MaxWidth, l.MaxHeight)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		return "", ErrInvalid
+	}
+	return mimeType, nil
+}
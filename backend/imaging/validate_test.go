@@ -0,0 +1,98 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"testing"
+)
+
+// testImage returns a w×h image of coloured blocks, the same for the same
+// seed.
+func testImage(w, h int, seed int64) *image.RGBA {
+	rnd := rand.New(rand.NewSource(seed))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	const block = 8
+	for by := 0; by < h; by += block {
+		for bx := 0; bx < w; bx += block {
+			c := color.RGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 255}
+			for y := by; y < by+block && y < h; y++ {
+				for x := bx; x < bx+block && x < w; x++ {
+					img.SetRGBA(x, y, c)
+				}
+			}
+		}
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatalf("failed to encode JPEG: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("failed to encode PNG: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func encodeGIF(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("failed to encode GIF: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestValidate(t *testing.T) {
+	limits := Limits{MaxBytes: 1 << 20, MaxWidth: 100, MaxHeight: 80}
+	jpegData := encodeJPEG(t, testImage(64, 48, 1))
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantType string
+		wantErr  error
+	}{
+		{"jpeg", jpegData, MIMEJPEG, nil},
+		{"png", encodePNG(t, testImage(64, 48, 1)), MIMEPNG, nil},
+		{"gif", encodeGIF(t, testImage(64, 48, 1)), MIMEGIF, nil},
+		{"text", []byte("not an image at all"), "", ErrUnsupportedType},
+		{"bmp", append([]byte("BM"), make([]byte, 64)...), "", ErrUnsupportedType},
+		{"truncated", jpegData[:len(jpegData)/2], "", ErrInvalid},
+		{"too wide", encodePNG(t, testImage(101, 10, 1)), "", ErrTooManyPixels},
+		{"too tall", encodePNG(t, testImage(10, 81, 1)), "", ErrTooManyPixels},
+		{"too large", append(jpegData, make([]byte, 1<<20)...), "", ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mimeType, err := limits.Validate(tt.data)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if mimeType != tt.wantType {
+				t.Errorf("expected %s, got %s", tt.wantType, mimeType)
+			}
+		})
+	}
+}
@@ -7,10 +7,15 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"time"
 
 	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
 	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/handler"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imagestore"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/imaging"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/payment"
 	"github.com/golang-jwt/jwt/v5"
 	echojwt "github.com/labstack/echo-jwt/v4"
 	"github.com/labstack/echo/v4"
@@ -48,10 +53,12 @@ func run(ctx context.Context) int {
 		frontURL = "http://localhost:3000"
 	}
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{frontURL},
-		AllowMethods: []string{"GET", "PUT", "DELETE", "OPTIONS", "POST"},
+		AllowOrigins:  []string{frontURL},
+		AllowMethods:  []string{"GET", "PUT", "PATCH", "DELETE", "OPTIONS", "POST"},
+		ExposeHeaders: []string{"ETag"},
 	}))
-	e.Use(middleware.BodyLimit("5M"))
+	// Room for several images of up to IMAGE_MAX_BYTES each.
+	e.Use(middleware.BodyLimit("12M"))
 
 	// jwt
 	config := echojwt.Config{
@@ -69,12 +76,185 @@ func run(ctx context.Context) int {
 	}
 	defer sqlDB.Close()
 
+	// Image files are kept out of the database, under IMAGE_DIR unless
+	// IMAGE_STORE says otherwise.
+	imageStoreKind, imageDir := imagestore.EnvConfig()
+	imageStore, err := imagestore.New(imageStoreKind, imageDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to prepare image store: %s\n", err)
+		return exitError
+	}
+	// The most requested images are kept in memory, up to IMAGE_CACHE_BYTES;
+	// 0 turns the cache off.
+	imageCacheBytes, err := envInt64("IMAGE_CACHE_BYTES", 64<<20)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid IMAGE_CACHE_BYTES: %s\n", err)
+		return exitError
+	}
+	if imageCacheBytes > 0 {
+		imageStore = imagestore.NewCachedStore(imageStore, imageCacheBytes)
+	}
+	// Databases from before items had several images keep the covers in
+	// items.image.
+	if _, err := db.MigrateItemCovers(ctx, sqlDB, imageStore); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to move item covers: %s\n", err)
+		return exitError
+	}
+
+	handlerConfig, err := envHandlerConfig(handler.DefaultConfig())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return exitError
+	}
+
 	h := handler.Handler{
-		DB:       sqlDB,
-		UserRepo: db.NewUserRepository(sqlDB),
-		ItemRepo: db.NewItemRepository(sqlDB),
+		Config:          handlerConfig,
+		DB:              sqlDB,
+		UserRepo:        db.NewUserRepository(sqlDB),
+		ItemRepo:        db.NewItemRepository(sqlDB, imageStore),
+		Images:          imageStore,
+		PurchaseRepo:    db.NewPurchaseRepository(sqlDB),
+		LedgerRepo:      db.NewLedgerRepository(sqlDB),
+		IdempotencyRepo: db.NewIdempotencyRepository(sqlDB),
+		OrderRepo:       db.NewOrderRepository(sqlDB),
+		PayoutRepo:      db.NewPayoutRepository(sqlDB),
+		OfferRepo:       db.NewOfferRepository(sqlDB),
+		AuctionRepo:     db.NewAuctionRepository(sqlDB),
+		CouponRepo:      db.NewCouponRepository(sqlDB),
+		PointsRepo:      db.NewPointsRepository(sqlDB),
+		ChargeRepo:      db.NewChargeRepository(sqlDB),
+		LimitRepo:       db.NewLimitRepository(sqlDB),
+	}
+
+	// Withdrawals and top-ups go through fake providers, which mark them done
+	// without moving any money. There is no real bank or payment integration
+	// yet, so they are only used with PAYMENT_PROVIDER=fake, for development
+	// and tests. Without it, top-ups and withdrawals are refused with 503 and
+	// the rest of the marketplace works as usual.
+	switch provider := os.Getenv("PAYMENT_PROVIDER"); provider {
+	case payment.ProviderFake:
+		h.Payouts = &payment.PayoutProcessor{
+			Repo:     h.PayoutRepo,
+			Provider: payment.NewFakePayoutProvider(),
+		}
+
+		// The fake payment provider confirms charges in-process,
+		// FAKE_PAYMENT_DELAY after they start for the payment method
+		// "fake_delay".
+		fakePaymentDelay, err := envDuration("FAKE_PAYMENT_DELAY", 30*time.Second)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid FAKE_PAYMENT_DELAY: %s\n", err)
+			return exitError
+		}
+		paymentProvider := payment.NewFakePaymentProvider(fakePaymentDelay)
+		h.Payments = &payment.ChargeProcessor{Repo: h.ChargeRepo, Provider: paymentProvider}
+		paymentProvider.Notify = h.Payments.HandleCallback
+	case "":
+		fmt.Fprintf(os.Stderr, "no payment provider configured, top-ups and withdrawals are disabled; set PAYMENT_PROVIDER=%s to use the fake one in development\n", payment.ProviderFake)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown PAYMENT_PROVIDER %q\n", provider)
+		return exitError
+	}
+
+	// The platform's commission on every sale, unless the item's category
+	// overrides it.
+	feeBasisPoints, err := envInt64("SALE_FEE_BPS", db.DefaultFeeRule.BasisPoints)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid SALE_FEE_BPS: %s\n", err)
+		return exitError
+	}
+	feeFlat, err := envInt64("SALE_FEE_FLAT", db.DefaultFeeRule.Flat)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid SALE_FEE_FLAT: %s\n", err)
+		return exitError
+	}
+	db.DefaultFeeRule = domain.FeeRule{BasisPoints: feeBasisPoints, Flat: feeFlat}
+
+	// Loyalty points buyers earn on completed orders and how long they last.
+	pointsBasisPoints, err := envInt64("POINTS_EARN_BPS", db.DefaultPointsPolicy.EarnBasisPoints)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid POINTS_EARN_BPS: %s\n", err)
+		return exitError
+	}
+	pointsTTL, err := envDuration("POINTS_TTL", db.DefaultPointsPolicy.TTL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid POINTS_TTL: %s\n", err)
+		return exitError
+	}
+	db.DefaultPointsPolicy = domain.PointsPolicy{EarnBasisPoints: pointsBasisPoints, TTL: pointsTTL}
+
+	// Uploaded images whose hashes are this many bits or fewer from an image
+	// of another seller's active listing are flagged for review.
+	duplicateImageDistance, err := envInt64("DUPLICATE_IMAGE_DISTANCE", int64(db.DuplicateImageDistance))
+	if err != nil || duplicateImageDistance < 0 || duplicateImageDistance > db.MaxDuplicateImageDistance {
+		fmt.Fprintf(os.Stderr, "DUPLICATE_IMAGE_DISTANCE must be between 0 and %d\n", db.MaxDuplicateImageDistance)
+		return exitError
+	}
+	db.DuplicateImageDistance = int(duplicateImageDistance)
+
+	// Per-user limits on top-ups and purchases. Admins can override them
+	// for single users.
+	if db.DefaultLimits, err = envLimits(db.DefaultLimits); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return exitError
+	}
+
+	// Uploaded images larger than these are rejected.
+	imageMaxBytes, err := envInt64("IMAGE_MAX_BYTES", imaging.DefaultLimits.MaxBytes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid IMAGE_MAX_BYTES: %s\n", err)
+		return exitError
+	}
+	imageMaxWidth, err := envInt64("IMAGE_MAX_WIDTH", int64(imaging.DefaultLimits.MaxWidth))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid IMAGE_MAX_WIDTH: %s\n", err)
+		return exitError
+	}
+	imageMaxHeight, err := envInt64("IMAGE_MAX_HEIGHT", int64(imaging.DefaultLimits.MaxHeight))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid IMAGE_MAX_HEIGHT: %s\n", err)
+		return exitError
+	}
+	imaging.DefaultLimits = imaging.Limits{MaxBytes: imageMaxBytes, MaxWidth: int(imageMaxWidth), MaxHeight: int(imageMaxHeight)}
+
+	// Shipped orders are completed automatically when the buyer does not
+	// confirm receipt in time.
+	autoCompleteAfter, err := envDuration("ORDER_AUTO_COMPLETE_AFTER", 7*24*time.Hour)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid ORDER_AUTO_COMPLETE_AFTER: %s\n", err)
+		return exitError
 	}
 
+	// Background jobs
+	bgCtx, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	go runEvery(bgCtx, e, time.Hour, "sweep expired idempotency keys", func(ctx context.Context) error {
+		_, err := h.IdempotencyRepo.DeleteExpired(ctx)
+		return err
+	})
+	go runEvery(bgCtx, e, time.Minute, "auto-complete orders", func(ctx context.Context) error {
+		_, err := h.OrderRepo.AutoComplete(ctx, autoCompleteAfter)
+		return err
+	})
+	if h.Payouts != nil {
+		go runEvery(bgCtx, e, 10*time.Second, "process payouts", h.Payouts.ProcessPending)
+	}
+	go runEvery(bgCtx, e, time.Minute, "expire offers", func(ctx context.Context) error {
+		_, err := h.OfferRepo.ExpireOffers(ctx)
+		return err
+	})
+	go runEvery(bgCtx, e, 10*time.Second, "close auctions", func(ctx context.Context) error {
+		_, err := h.AuctionRepo.CloseEndedAuctions(ctx)
+		return err
+	})
+	go runEvery(bgCtx, e, time.Hour, "expire points", func(ctx context.Context) error {
+		_, err := h.PointsRepo.ExpirePoints(ctx)
+		return err
+	})
+
+	// Money-moving requests can be retried safely with an Idempotency-Key.
+	idempotent := h.Idempotency(handler.IdempotencyConfig{TTL: 24 * time.Hour})
+
 	// Routes
 	e.POST("/initialize", h.Initialize)
 	e.GET("/log", h.AccessLog)
@@ -82,10 +262,14 @@ func run(ctx context.Context) int {
 	e.GET("/items", h.GetOnSaleItems)
 	e.GET("/items/:itemID", h.GetItem)
 	e.GET("/items/:itemID/image", h.GetImage)
+	e.GET("/items/:itemID/images", h.GetItemImages)
+	e.GET("/items/:itemID/images/:n", h.GetItemImageAt)
+	e.GET("/items/:itemID/bids", h.GetBids)
 	e.GET("/items/categories", h.GetCategories)
 	e.GET("/search", h.SearchItems)
 	e.POST("/register", h.Register)
 	e.POST("/login", h.Login)
+	e.POST("/payments/callback", h.PaymentCallback)
 
 	// Login required
 	l := e.Group("")
@@ -93,10 +277,37 @@ func run(ctx context.Context) int {
 	l.GET("/users/:userID/items", h.GetUserItems)
 	l.POST("/items", h.AddItem)
 	l.PUT("/items/:itemID", h.UpdateItem)
+	l.PATCH("/items/:itemID", h.PatchItem)
 	l.POST("/sell", h.Sell)
-	l.POST("/purchase/:itemID", h.Purchase)
+	l.POST("/items/:itemID/unlist", h.UnlistItem)
+	l.POST("/items/:itemID/relist", h.RelistItem)
+	l.DELETE("/items/:itemID", h.DeleteItem)
+	l.GET("/items/:itemID/revisions", h.GetItemRevisions)
+	l.PUT("/items/:itemID/images", h.ReorderItemImages)
+	l.POST("/items/:itemID/images/:n/cover", h.SetItemCover)
+	l.POST("/purchase/:itemID", h.Purchase, idempotent)
+	l.GET("/items/:itemID/offers", h.GetItemOffers)
+	l.POST("/items/:itemID/offers", h.MakeOffer)
+	l.POST("/items/:itemID/bids", h.PlaceBid, idempotent)
+	l.POST("/offers/:offerID/accept", h.AcceptOffer)
+	l.POST("/offers/:offerID/reject", h.RejectOffer)
+	l.POST("/offers/:offerID/counter", h.CounterOffer)
 	l.GET("/balance", h.GetBalance)
-	l.POST("/balance", h.AddBalance)
+	l.GET("/balance/history", h.GetBalanceHistory)
+	l.POST("/balance", h.AddBalance, idempotent)
+	l.GET("/balance/charges", h.GetCharges)
+	l.GET("/balance/charges/:chargeID", h.GetCharge)
+	l.GET("/points", h.GetPoints)
+	l.GET("/orders", h.GetOrders)
+	l.GET("/orders/:orderID", h.GetOrder)
+	l.POST("/orders/:orderID/ship", h.ShipOrder)
+	l.POST("/orders/:orderID/confirm", h.ConfirmOrder)
+	l.POST("/orders/:orderID/cancel", h.CancelOrder)
+	l.GET("/orders/:orderID/events", h.GetOrderEvents)
+	l.GET("/bank-accounts", h.GetBankAccounts)
+	l.POST("/bank-accounts", h.AddBankAccount)
+	l.GET("/payouts", h.GetPayouts)
+	l.POST("/payouts", h.RequestPayout, idempotent)
 	l.GET("/favorite", h.GetFavoriteFolders)
 	l.POST("/favorite", h.AddItemToFavoriteFolder)
 	l.GET("/favorite/:folderID", h.GetFavoriteItems)
@@ -104,6 +315,17 @@ func run(ctx context.Context) int {
 	l.GET("/favorite/check/:itemID", h.CheckFavoriteItem)
 	l.POST("/favorite/new", h.AddNewFavoriteFolder)
 
+	// Admin only (ADMIN_USER_IDS)
+	a := l.Group("/admin", h.RequireAdmin)
+	a.GET("/coupons", h.GetCoupons)
+	a.POST("/coupons", h.AddCoupon)
+	a.GET("/coupons/:couponID", h.GetCoupon)
+	a.PUT("/coupons/:couponID", h.UpdateCoupon)
+	a.GET("/users/:userID/limits", h.GetUserLimits)
+	a.PUT("/users/:userID/limits", h.SetUserLimits)
+	a.GET("/limit-violations", h.GetLimitViolations)
+	a.GET("/duplicate-images", h.GetDuplicateImageFlags)
+
 	// Start server
 	go func() {
 		if err := e.Start(":9000"); err != nil && err != http.ErrServerClosed {
@@ -114,6 +336,7 @@ func run(ctx context.Context) int {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	<-quit
+	stopBackground()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := e.Shutdown(ctx); err != nil {
@@ -123,6 +346,130 @@ func run(ctx context.Context) int {
 	return exitOK
 }
 
+// envDuration parses the environment variable key as a time.Duration, or
+// returns defaultValue when it is not set.
+func envDuration(key string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// envInt64 parses the environment variable key as an integer, or returns
+// defaultValue when it is not set.
+func envInt64(key string, defaultValue int64) (int64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// envLimits reads the LIMIT_* environment variables over limits. Amounts and
+// counts of 0 disable a limit.
+func envLimits(limits domain.Limits) (domain.Limits, error) {
+	for _, v := range []struct {
+		key   string
+		value *int64
+	}{
+		{"LIMIT_MAX_BALANCE", &limits.MaxBalance},
+		{"LIMIT_DAILY_TOP_UP", &limits.DailyTopUp},
+		{"LIMIT_MONTHLY_TOP_UP", &limits.MonthlyTopUp},
+		{"LIMIT_MAX_PURCHASE", &limits.MaxPurchase},
+		{"LIMIT_PURCHASE_BURST", &limits.PurchaseBurst},
+		{"LIMIT_TOP_UP_BURST", &limits.TopUpBurst},
+	} {
+		n, err := envInt64(v.key, *v.value)
+		if err != nil {
+			return limits, fmt.Errorf("invalid %s: %w", v.key, err)
+		}
+		*v.value = n
+	}
+	for _, v := range []struct {
+		key   string
+		value *time.Duration
+	}{
+		{"LIMIT_PURCHASE_WINDOW", &limits.PurchaseWindow},
+		{"LIMIT_TOP_UP_WINDOW", &limits.TopUpWindow},
+	} {
+		d, err := envDuration(v.key, *v.value)
+		if err != nil {
+			return limits, fmt.Errorf("invalid %s: %w", v.key, err)
+		}
+		*v.value = d
+	}
+	return limits, nil
+}
+
+// envHandlerConfig reads the settings of the handlers from the environment
+// over config.
+func envHandlerConfig(config handler.Config) (handler.Config, error) {
+	maxItemImages := int64(config.MaxItemImages)
+	thumbSize := int64(config.ImageSizes[domain.ImageSizeThumb])
+	mediumSize := int64(config.ImageSizes[domain.ImageSizeMedium])
+	for _, v := range []struct {
+		key   string
+		value *int64
+	}{
+		{"MAX_ITEM_IMAGES", &maxItemImages},
+		{"IMAGE_THUMB_SIZE", &thumbSize},
+		{"IMAGE_MEDIUM_SIZE", &mediumSize},
+		{"PAYOUT_MIN_AMOUNT", &config.PayoutMinAmount},
+		{"PAYOUT_FEE", &config.PayoutFee},
+	} {
+		n, err := envInt64(v.key, *v.value)
+		if err != nil {
+			return config, fmt.Errorf("invalid %s: %w", v.key, err)
+		}
+		*v.value = n
+	}
+	if maxItemImages < 1 || thumbSize < 1 || mediumSize < 1 {
+		return config, fmt.Errorf("MAX_ITEM_IMAGES, IMAGE_THUMB_SIZE and IMAGE_MEDIUM_SIZE must be positive")
+	}
+	config.MaxItemImages = int(maxItemImages)
+	config.ImageSizes = map[domain.ImageSize]int{
+		domain.ImageSizeThumb:  int(thumbSize),
+		domain.ImageSizeMedium: int(mediumSize),
+	}
+
+	for _, v := range []struct {
+		key   string
+		value *time.Duration
+	}{
+		{"IMAGE_MAX_AGE", &config.ImageMaxAge},
+		{"OFFER_TTL", &config.OfferTTL},
+		{"OFFER_RESERVATION", &config.OfferReservation},
+	} {
+		d, err := envDuration(v.key, *v.value)
+		if err != nil {
+			return config, fmt.Errorf("invalid %s: %w", v.key, err)
+		}
+		*v.value = d
+	}
+
+	config.PaymentWebhookSecret = os.Getenv("PAYMENT_WEBHOOK_SECRET")
+	return config, nil
+}
+
+// runEvery calls job every interval until ctx is cancelled. Failures are
+// logged and the job is retried on the next tick.
+func runEvery(ctx context.Context, e *echo.Echo, interval time.Duration, name string, job func(ctx context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := job(ctx); err != nil {
+				e.Logger.Errorf("failed to %s: %s", name, err)
+			}
+		}
+	}
+}
+
 func logFormat() string {
 	// Customize freely: https://echo.labstack.com/guide/customization/
 	var format string
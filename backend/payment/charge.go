@@ -0,0 +1,188 @@
+package payment
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrChargeDeclined is returned by a PaymentProvider when it refuses a
+	// charge outright, e.g. because the card is invalid.
+	ErrChargeDeclined = errors.New("charge declined by the payment provider")
+	// ErrInvalidPaymentMethod is returned by a PaymentProvider for payment
+	// methods it does not know.
+	ErrInvalidPaymentMethod = errors.New("unknown payment method")
+)
+
+// ProviderFake selects the fake providers, which confirm top-ups and
+// withdrawals without moving any real money.
+const ProviderFake = "fake"
+
+// Payment methods understood by FakePaymentProvider.
+const (
+	FakeMethodSucceed = "fake_succeed"
+	FakeMethodDecline = "fake_decline"
+	FakeMethodDelay   = "fake_delay"
+)
+
+type ChargeRequest struct {
+	ChargeID int64
+	UserID   int64
+	Amount   int64
+	// PaymentMethod is the provider's token for the card or wallet to
+	// charge.
+	PaymentMethod string
+}
+
+// Callback is the provider telling us how a charge ended.
+type Callback struct {
+	ChargeID  int64  `json:"charge_id"`
+	Reference string `json:"reference"`
+	Succeeded bool   `json:"succeeded"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// PaymentProvider collects money from users for balance top-ups. Charges are
+// asynchronous: Charge only starts one, and the outcome arrives later as a
+// Callback.
+type PaymentProvider interface {
+	// Charge starts the charge and returns the provider's reference for it.
+	Charge(ctx context.Context, req ChargeRequest) (string, error)
+}
+
+// Sign returns the signature a provider sends with a callback body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature reports whether signature is valid for body. Callbacks are
+// never accepted without a secret.
+func VerifySignature(secret string, body []byte, signature string) bool {
+	if secret == "" {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, body)), []byte(signature))
+}
+
+// FakePaymentProvider is an in-process PaymentProvider for local development
+// and tests. It confirms charges with the payment method FakeMethodSucceed
+// right away and those with FakeMethodDelay after Delay, declines those with
+// FakeMethodDecline and refuses any other method. Callbacks are delivered to
+// Notify.
+type FakePaymentProvider struct {
+	Delay  time.Duration
+	Notify func(ctx context.Context, cb Callback) error
+
+	mu      sync.Mutex
+	charges []ChargeRequest
+}
+
+func NewFakePaymentProvider(delay time.Duration) *FakePaymentProvider {
+	return &FakePaymentProvider{Delay: delay}
+}
+
+func (p *FakePaymentProvider) Charge(ctx context.Context, req ChargeRequest) (string, error) {
+	switch req.PaymentMethod {
+	case FakeMethodSucceed, FakeMethodDecline, FakeMethodDelay:
+	default:
+		return "", errors.Wrapf(ErrInvalidPaymentMethod, "%q", req.PaymentMethod)
+	}
+
+	p.mu.Lock()
+	p.charges = append(p.charges, req)
+	reference := fmt.Sprintf("fake-charge-%d", len(p.charges))
+	p.mu.Unlock()
+
+	cb := Callback{ChargeID: req.ChargeID, Reference: reference, Succeeded: true}
+	var delay time.Duration
+	switch req.PaymentMethod {
+	case FakeMethodDecline:
+		cb.Succeeded = false
+		cb.Reason = "card declined"
+	case FakeMethodDelay:
+		delay = p.Delay
+	}
+
+	if p.Notify != nil {
+		go func() {
+			time.Sleep(delay)
+			// The callback outlives the request that started the charge.
+			_ = p.Notify(context.Background(), cb)
+		}()
+	}
+	return reference, nil
+}
+
+// Charges returns the charges started so far.
+func (p *FakePaymentProvider) Charges() []ChargeRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]ChargeRequest(nil), p.charges...)
+}
+
+// ChargeProcessor runs balance top-ups through the PaymentProvider.
+type ChargeProcessor struct {
+	Repo     db.ChargeRepository
+	Provider PaymentProvider
+}
+
+// TopUp records a pending charge and asks the provider to collect it. The
+// balance is credited when the provider's callback confirms the charge.
+// Charges the provider declines outright, or whose payment method it does
+// not know, are marked failed and returned together with ErrChargeDeclined
+// or ErrInvalidPaymentMethod.
+func (p *ChargeProcessor) TopUp(ctx context.Context, userID int64, amount int64, method string) (domain.Charge, error) {
+	charge, err := p.Repo.AddCharge(ctx, userID, amount)
+	if err != nil {
+		return charge, err
+	}
+
+	reference, err := p.Provider.Charge(ctx, ChargeRequest{
+		ChargeID:      charge.ID,
+		UserID:        userID,
+		Amount:        amount,
+		PaymentMethod: method,
+	})
+	if err != nil {
+		if errors.Is(err, ErrChargeDeclined) || errors.Is(err, ErrInvalidPaymentMethod) {
+			failed, failErr := p.Repo.FailCharge(ctx, charge.ID, err.Error())
+			if failErr != nil && !errors.Is(failErr, db.ErrChargeSettled) {
+				return charge, failErr
+			}
+			return failed, err
+		}
+		return charge, errors.Wrapf(err, "failed to start charge %d", charge.ID)
+	}
+
+	if err := p.Repo.SetChargeReference(ctx, charge.ID, reference); err != nil {
+		return charge, err
+	}
+	return p.Repo.GetCharge(ctx, charge.ID)
+}
+
+// HandleCallback settles a charge from the provider's callback. Callbacks
+// for charges that are already settled are ignored, since providers retry
+// them.
+func (p *ChargeProcessor) HandleCallback(ctx context.Context, cb Callback) error {
+	var err error
+	if cb.Succeeded {
+		_, err = p.Repo.ConfirmCharge(ctx, cb.ChargeID, cb.Reference)
+	} else {
+		_, err = p.Repo.FailCharge(ctx, cb.ChargeID, cb.Reason)
+	}
+	if errors.Is(err, db.ErrChargeSettled) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package payment
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"charge_id":1,"succeeded":true}`)
+	tests := []struct {
+		name      string
+		secret    string
+		body      []byte
+		signature string
+		want      bool
+	}{
+		{name: "valid", secret: "secret", body: body, signature: Sign("secret", body), want: true},
+		{name: "wrong secret", secret: "secret", body: body, signature: Sign("other", body)},
+		{name: "tampered body", secret: "secret", body: []byte(`{"charge_id":2,"succeeded":true}`), signature: Sign("secret", body)},
+		{name: "no signature", secret: "secret", body: body},
+		{name: "no secret", body: body, signature: Sign("", body)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifySignature(tt.secret, tt.body, tt.signature); got != tt.want {
+				t.Errorf("expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTopUp(t *testing.T) {
+	tests := []struct {
+		method      string
+		wantErr     error
+		wantStatus  domain.ChargeStatus
+		wantBalance int64
+		// wantCallback is whether the provider calls back for the charge.
+		wantCallback bool
+	}{
+		{method: FakeMethodSucceed, wantStatus: domain.ChargeStatusSucceeded, wantBalance: 1000, wantCallback: true},
+		{method: FakeMethodDelay, wantStatus: domain.ChargeStatusSucceeded, wantBalance: 1000, wantCallback: true},
+		{method: FakeMethodDecline, wantStatus: domain.ChargeStatusFailed, wantCallback: true},
+		{method: "card_1234", wantErr: ErrInvalidPaymentMethod, wantStatus: domain.ChargeStatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			ctx := context.Background()
+			userID := addTestUser(t, sqlDB)
+			repo := db.NewChargeRepository(sqlDB)
+			provider := NewFakePaymentProvider(50 * time.Millisecond)
+			processor := &ChargeProcessor{Repo: repo, Provider: provider}
+			callbacks := make(chan Callback, 1)
+			provider.Notify = func(ctx context.Context, cb Callback) error {
+				err := processor.HandleCallback(ctx, cb)
+				callbacks <- cb
+				return err
+			}
+
+			charge, err := processor.TopUp(ctx, userID, 1000, tt.method)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+
+			if tt.wantCallback {
+				if tt.method == FakeMethodDelay && charge.Status != domain.ChargeStatusPending {
+					t.Errorf("expected the delayed charge to be pending, got %d", charge.Status)
+				}
+				var cb Callback
+				select {
+				case cb = <-callbacks:
+				case <-time.After(5 * time.Second):
+					t.Fatal("expected a callback")
+				}
+				if cb.Reference != charge.Reference {
+					t.Errorf("expected reference %q, got %q", charge.Reference, cb.Reference)
+				}
+				// Providers retry callbacks; the balance is credited once.
+				if err := processor.HandleCallback(ctx, cb); err != nil {
+					t.Errorf("expected a repeated callback to be ignored, got %v", err)
+				}
+			}
+
+			got, err := repo.GetCharge(ctx, charge.ID)
+			if err != nil {
+				t.Fatalf("failed to get charge: %s", err)
+			}
+			if got.Status != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, got.Status)
+			}
+			if balance := getTestBalance(t, sqlDB, userID); balance != tt.wantBalance {
+				t.Errorf("expected balance %d, got %d", tt.wantBalance, balance)
+			}
+		})
+	}
+}
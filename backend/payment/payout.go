@@ -0,0 +1,111 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+// ErrTransferRejected is returned by a PayoutProvider when the bank refused
+// the transfer, e.g. because the account does not exist.
+var ErrTransferRejected = errors.New("transfer rejected by the bank")
+
+type TransferRequest struct {
+	PayoutID int64
+	// Amount is what the bank account receives, i.e. after the fee.
+	Amount  int64
+	Account domain.BankAccount
+}
+
+// PayoutProvider sends money to sellers' bank accounts.
+type PayoutProvider interface {
+	// Transfer sends the money and returns the bank's reference for it.
+	Transfer(ctx context.Context, req TransferRequest) (string, error)
+}
+
+// FakePayoutProvider is an in-memory PayoutProvider for local development
+// and tests. Transfers to account numbers ending in RejectSuffix are
+// rejected, every other transfer succeeds.
+type FakePayoutProvider struct {
+	RejectSuffix string
+
+	mu        sync.Mutex
+	transfers []TransferRequest
+}
+
+func NewFakePayoutProvider() *FakePayoutProvider {
+	return &FakePayoutProvider{RejectSuffix: "9999"}
+}
+
+func (p *FakePayoutProvider) Transfer(ctx context.Context, req TransferRequest) (string, error) {
+	if p.RejectSuffix != "" && strings.HasSuffix(req.Account.AccountNumber, p.RejectSuffix) {
+		return "", errors.Wrap(ErrTransferRejected, "account is closed")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.transfers = append(p.transfers, req)
+	return fmt.Sprintf("fake-transfer-%d", len(p.transfers)), nil
+}
+
+// Transfers returns the transfers made so far.
+func (p *FakePayoutProvider) Transfers() []TransferRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]TransferRequest(nil), p.transfers...)
+}
+
+// PayoutProcessor sends pending payouts to the PayoutProvider.
+type PayoutProcessor struct {
+	Repo     db.PayoutRepository
+	Provider PayoutProvider
+}
+
+// ProcessPending claims pending payouts and transfers them. Payouts the bank
+// rejects are marked failed and refunded; other errors leave the payout in
+// processing for manual review, since the money may already have been sent.
+// A payout that fails does not hold up the others; their errors are returned
+// together.
+func (p *PayoutProcessor) ProcessPending(ctx context.Context) error {
+	payouts, err := p.Repo.ClaimPendingPayouts(ctx, 100)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for _, payout := range payouts {
+		if err := p.process(ctx, payout); err != nil {
+			failures = append(failures, fmt.Sprintf("payout %d: %s", payout.ID, err))
+		}
+	}
+	if len(failures) > 0 {
+		return errors.Errorf("failed to process %d of %d payouts: %s", len(failures), len(payouts), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (p *PayoutProcessor) process(ctx context.Context, payout domain.Payout) error {
+	account, err := p.Repo.GetBankAccount(ctx, payout.BankAccountID)
+	if err != nil {
+		return err
+	}
+
+	reference, err := p.Provider.Transfer(ctx, TransferRequest{
+		PayoutID: payout.ID,
+		Amount:   payout.Amount - payout.Fee,
+		Account:  account,
+	})
+	if err != nil {
+		if errors.Is(err, ErrTransferRejected) {
+			return p.Repo.MarkPayoutFailed(ctx, payout.ID, err.Error())
+		}
+		return errors.Wrap(err, "failed to transfer")
+	}
+
+	return p.Repo.MarkPayoutPaid(ctx, payout.ID, reference)
+}
@@ -0,0 +1,183 @@
+package payment
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/db"
+	"github.com/ChihiroShoda/mecari-build-hackathon-2023/backend/domain"
+	"github.com/pkg/errors"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	sqlDB, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "test.sqlite3")+"?_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	schema, err := os.ReadFile(filepath.Join("..", "sql", "01_schema.sql"))
+	if err != nil {
+		t.Fatalf("failed to read schema: %s", err)
+	}
+	if _, err := sqlDB.Exec(string(schema)); err != nil {
+		t.Fatalf("failed to apply schema: %s", err)
+	}
+	return sqlDB
+}
+
+func addTestUser(t *testing.T, sqlDB *sql.DB) int64 {
+	t.Helper()
+
+	res, err := sqlDB.Exec("INSERT INTO users (name, password) VALUES (?, ?)", "user", "password")
+	if err != nil {
+		t.Fatalf("failed to add user: %s", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		t.Fatalf("failed to get user id: %s", err)
+	}
+	return id
+}
+
+func getTestBalance(t *testing.T, sqlDB *sql.DB, userID int64) int64 {
+	t.Helper()
+
+	var balance int64
+	if err := sqlDB.QueryRow("SELECT balance FROM users WHERE id = ?", userID).Scan(&balance); err != nil {
+		t.Fatalf("failed to get balance: %s", err)
+	}
+	return balance
+}
+
+func TestProcessPending(t *testing.T) {
+	tests := []struct {
+		name          string
+		accountNumber string
+		wantStatus    domain.PayoutStatus
+		wantBalance   int64
+		// wantTransfer is what the bank account receives, if anything.
+		wantTransfer int64
+	}{
+		{name: "paid", accountNumber: "1234567", wantStatus: domain.PayoutStatusPaid, wantBalance: 500, wantTransfer: 800},
+		{name: "rejected", accountNumber: "1239999", wantStatus: domain.PayoutStatusFailed, wantBalance: 1500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sqlDB := newTestDB(t)
+			ctx := context.Background()
+			userID := addTestUser(t, sqlDB)
+			if err := db.NewLedgerRepository(sqlDB).TopUp(ctx, userID, 1500); err != nil {
+				t.Fatalf("failed to top up: %s", err)
+			}
+			repo := db.NewPayoutRepository(sqlDB)
+			account, err := repo.AddBankAccount(ctx, domain.BankAccount{UserID: userID, BankName: "bank", BranchName: "branch", AccountNumber: tt.accountNumber, HolderName: "holder"})
+			if err != nil {
+				t.Fatalf("failed to add bank account: %s", err)
+			}
+			if _, err := repo.RequestPayout(ctx, domain.Payout{UserID: userID, BankAccountID: account.ID, Amount: 1000, Fee: 200}); err != nil {
+				t.Fatalf("failed to request payout: %s", err)
+			}
+
+			provider := NewFakePayoutProvider()
+			processor := &PayoutProcessor{Repo: repo, Provider: provider}
+			if err := processor.ProcessPending(ctx); err != nil {
+				t.Fatalf("failed to process payouts: %s", err)
+			}
+			// Settled payouts are not sent again.
+			if err := processor.ProcessPending(ctx); err != nil {
+				t.Fatalf("failed to process payouts: %s", err)
+			}
+
+			payouts, err := repo.GetPayoutsByUserID(ctx, userID)
+			if err != nil {
+				t.Fatalf("failed to get payouts: %s", err)
+			}
+			if len(payouts) != 1 || payouts[0].Status != tt.wantStatus {
+				t.Errorf("expected one payout with status %d, got %+v", tt.wantStatus, payouts)
+			}
+			transfers := provider.Transfers()
+			if tt.wantTransfer == 0 {
+				if len(transfers) != 0 {
+					t.Errorf("expected no transfers, got %+v", transfers)
+				}
+			} else if len(transfers) != 1 || transfers[0].Amount != tt.wantTransfer {
+				t.Errorf("expected one transfer of %d, got %+v", tt.wantTransfer, transfers)
+			}
+			if balance := getTestBalance(t, sqlDB, userID); balance != tt.wantBalance {
+				t.Errorf("expected balance %d, got %d", tt.wantBalance, balance)
+			}
+		})
+	}
+}
+
+// unreachablePayoutProvider fails the transfers to failAccount as if the
+// bank could not be reached, and makes the others.
+type unreachablePayoutProvider struct {
+	*FakePayoutProvider
+	failAccount string
+}
+
+func (p unreachablePayoutProvider) Transfer(ctx context.Context, req TransferRequest) (string, error) {
+	if req.Account.AccountNumber == p.failAccount {
+		return "", errors.New("connection reset")
+	}
+	return p.FakePayoutProvider.Transfer(ctx, req)
+}
+
+func TestProcessPendingContinuesAfterError(t *testing.T) {
+	sqlDB := newTestDB(t)
+	ctx := context.Background()
+	userID := addTestUser(t, sqlDB)
+	if err := db.NewLedgerRepository(sqlDB).TopUp(ctx, userID, 3000); err != nil {
+		t.Fatalf("failed to top up: %s", err)
+	}
+	repo := db.NewPayoutRepository(sqlDB)
+	const failAccount = "2222222"
+	accountNumbers := make(map[int64]string)
+	for _, accountNumber := range []string{"1111111", failAccount, "3333333"} {
+		account, err := repo.AddBankAccount(ctx, domain.BankAccount{UserID: userID, BankName: "bank", BranchName: "branch", AccountNumber: accountNumber, HolderName: "holder"})
+		if err != nil {
+			t.Fatalf("failed to add bank account: %s", err)
+		}
+		accountNumbers[account.ID] = accountNumber
+		if _, err := repo.RequestPayout(ctx, domain.Payout{UserID: userID, BankAccountID: account.ID, Amount: 1000, Fee: 200}); err != nil {
+			t.Fatalf("failed to request payout: %s", err)
+		}
+	}
+
+	provider := unreachablePayoutProvider{FakePayoutProvider: NewFakePayoutProvider(), failAccount: failAccount}
+	processor := &PayoutProcessor{Repo: repo, Provider: provider}
+	if err := processor.ProcessPending(ctx); err == nil {
+		t.Fatalf("expected an error for the failed transfer")
+	}
+	// The failed payout waits for review instead of being sent again.
+	if err := processor.ProcessPending(ctx); err != nil {
+		t.Fatalf("failed to process payouts: %s", err)
+	}
+
+	payouts, err := repo.GetPayoutsByUserID(ctx, userID)
+	if err != nil {
+		t.Fatalf("failed to get payouts: %s", err)
+	}
+	if len(payouts) != 3 {
+		t.Fatalf("expected 3 payouts, got %d", len(payouts))
+	}
+	for _, payout := range payouts {
+		want := domain.PayoutStatusPaid
+		if accountNumbers[payout.BankAccountID] == failAccount {
+			want = domain.PayoutStatusProcessing
+		}
+		if payout.Status != want {
+			t.Errorf("payout %d: expected status %d, got %d", payout.ID, want, payout.Status)
+		}
+	}
+	if transfers := provider.Transfers(); len(transfers) != 2 {
+		t.Errorf("expected 2 transfers, got %+v", transfers)
+	}
+}
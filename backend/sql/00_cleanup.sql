@@ -1,4 +1,28 @@
 DROP TABLE items;
+DROP TABLE item_images;
+DROP TABLE item_image_variants;
+DROP TABLE item_image_hash_bands;
+DROP TABLE duplicate_image_flags;
+DROP TABLE item_revisions;
 DROP TABLE users;
 DROP TABLE category;
-DROP TABLE status;
\ No newline at end of file
+DROP TABLE status;
+DROP TABLE ledger_entries;
+DROP TABLE ledger_journals;
+DROP TABLE idempotency_keys;
+DROP TABLE orders;
+DROP TABLE order_events;
+DROP TABLE bank_accounts;
+DROP TABLE payouts;
+DROP TABLE offers;
+DROP TABLE bids;
+DROP TABLE coupons;
+DROP TABLE coupon_categories;
+DROP TABLE coupon_redemptions;
+DROP TABLE coupon_redemption_orders;
+DROP TABLE point_lots;
+DROP TABLE point_entries;
+DROP TABLE point_lot_spends;
+DROP TABLE charges;
+DROP TABLE user_limits;
+DROP TABLE limit_violations;
\ No newline at end of file
@@ -1,17 +1,108 @@
 CREATE TABLE IF NOT EXISTS items
+(
+    id            integer primary key autoincrement,
+    name          varchar(50),
+    price         integer,
+    description   text,
+    category_id   integer,
+    seller_id     integer,
+    status        integer,
+    created_at    text NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    updated_at    text NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    listing_type  integer NOT NULL DEFAULT 0,
+    -- auctions only: smallest raise over the highest bid and closing time
+    min_increment integer NOT NULL DEFAULT 0,
+    ends_at       text,
+    -- units left; the item is sold out when it reaches zero
+    stock         integer NOT NULL DEFAULT 1,
+    -- bumped on every change; clients send it back in If-Match
+    version       integer NOT NULL DEFAULT 1
+);
+
+CREATE INDEX IF NOT EXISTS items_auction ON items (listing_type, status, ends_at);
+
+CREATE TRIGGER IF NOT EXISTS items_version AFTER UPDATE ON items
+    WHEN NEW.version = OLD.version
+BEGIN
+    UPDATE items SET version = OLD.version + 1 WHERE id = NEW.id;
+END;
+
+-- Images of items in display order. The one at position 0 is the cover.
+CREATE TABLE IF NOT EXISTS item_images
+(
+    id           integer primary key autoincrement,
+    item_id      integer NOT NULL,
+    position     integer NOT NULL,
+    content_type text NOT NULL,
+    -- The key of the file in the image store, and its length in bytes.
+    image_key    text NOT NULL,
+    byte_size    integer NOT NULL,
+    -- Perceptual hash (dHash) of the image, NULL for images stored before
+    -- hashes were kept.
+    dhash        integer,
+    created_at   text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE INDEX IF NOT EXISTS item_images_item_id ON item_images (item_id, position);
+
+-- The dhash of item_images split into its 8 bytes. Hashes at most 7 bits
+-- apart share at least one byte, so near-duplicates are found by index.
+CREATE TABLE IF NOT EXISTS item_image_hash_bands
+(
+    image_id integer NOT NULL,
+    band     integer NOT NULL,
+    value    integer NOT NULL,
+    PRIMARY KEY (image_id, band)
+);
+
+CREATE INDEX IF NOT EXISTS item_image_hash_bands_value ON item_image_hash_bands (band, value);
+
+-- Uploaded images that look like an image of another seller's active
+-- listing, for admins to review.
+CREATE TABLE IF NOT EXISTS duplicate_image_flags
+(
+    id             integer primary key autoincrement,
+    item_id        integer NOT NULL,
+    image_id       integer NOT NULL,
+    other_item_id  integer NOT NULL,
+    other_image_id integer NOT NULL,
+    distance       integer NOT NULL,
+    created_at     text NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    UNIQUE (image_id, other_image_id)
+);
+
+-- Scaled-down renditions of item_images, keyed by size name ("thumb",
+-- "medium"). Missing rows are generated when first requested.
+CREATE TABLE IF NOT EXISTS item_image_variants
+(
+    image_id     integer NOT NULL,
+    size         text NOT NULL,
+    content_type text NOT NULL,
+    image_key    text NOT NULL,
+    created_at   text NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    PRIMARY KEY (image_id, size)
+);
+
+-- Snapshots of items after every edit and status change. actor_id is 0 for
+-- changes made by background jobs.
+CREATE TABLE IF NOT EXISTS item_revisions
 (
     id          integer primary key autoincrement,
+    item_id     integer NOT NULL,
+    version     integer NOT NULL,
+    actor_id    integer NOT NULL,
+    change      text NOT NULL,
     name        varchar(50),
     price       integer,
     description text,
     category_id integer,
-    seller_id   integer,
-    image       blob,
-    status      integer,
-    created_at  text NOT NULL DEFAULT (DATETIME('now', 'localtime')),
-    updated_at  text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+    image_hash  text NOT NULL,
+    status      integer NOT NULL,
+    created_at  text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
 );
 
+CREATE INDEX IF NOT EXISTS item_revisions_item_id ON item_revisions (item_id, id);
+
 CREATE TABLE IF NOT EXISTS users
 (
     id       integer primary key autoincrement,
@@ -20,14 +111,305 @@ CREATE TABLE IF NOT EXISTS users
     balance  integer default 0
 );
 
+-- fee_bps and fee_flat override the default sale commission for items in
+-- the category; NULL keeps the default.
 CREATE TABLE IF NOT EXISTS category
 (
-    id   integer primary key,
-    name varchar(50)
+    id       integer primary key,
+    name     varchar(50),
+    fee_bps  integer,
+    fee_flat integer
 );
 
 CREATE TABLE IF NOT EXISTS status
 (
     id   integer primary key,
     name varchar(50)
-);
\ No newline at end of file
+);
+
+-- Balance changes are recorded as immutable journals. The entries of one
+-- journal always sum to zero; users.balance caches the running total of a
+-- user's entries and is only written together with a new entry.
+CREATE TABLE IF NOT EXISTS ledger_journals
+(
+    id         integer primary key autoincrement,
+    created_at text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE TABLE IF NOT EXISTS ledger_entries
+(
+    id            integer primary key autoincrement,
+    journal_id    integer NOT NULL,
+    account_id    integer NOT NULL,
+    kind          integer NOT NULL,
+    amount        integer NOT NULL,
+    balance_after integer NOT NULL,
+    item_id       integer,
+    created_at    text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE INDEX IF NOT EXISTS ledger_entries_account_id ON ledger_entries (account_id, id);
+
+CREATE TRIGGER IF NOT EXISTS ledger_entries_no_update BEFORE UPDATE ON ledger_entries
+BEGIN
+    SELECT RAISE(ABORT, 'ledger entries are immutable');
+END;
+
+CREATE TRIGGER IF NOT EXISTS ledger_entries_no_delete BEFORE DELETE ON ledger_entries
+BEGIN
+    SELECT RAISE(ABORT, 'ledger entries are immutable');
+END;
+
+-- Responses of requests sent with an Idempotency-Key header. status_code is
+-- NULL while the first request with the key is still being processed.
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    user_id      integer NOT NULL,
+    key          text NOT NULL,
+    request_hash text NOT NULL,
+    status_code  integer,
+    content_type text,
+    body         blob,
+    created_at   text NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    expires_at   text NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+
+CREATE TABLE IF NOT EXISTS orders
+(
+    id                  integer primary key autoincrement,
+    item_id             integer NOT NULL,
+    buyer_id            integer NOT NULL,
+    seller_id           integer NOT NULL,
+    price               integer NOT NULL,
+    -- platform commission, fixed when the order is created
+    fee                 integer NOT NULL DEFAULT 0,
+    -- coupon discount, paid by the platform instead of the buyer
+    discount            integer NOT NULL DEFAULT 0,
+    -- loyalty points spent on the order, also paid by the platform
+    points_used         integer NOT NULL DEFAULT 0,
+    -- the item revision the buyer saw when buying
+    item_revision_id    integer,
+    status              integer NOT NULL,
+    shipped_at          text,
+    delivered_at        text,
+    completed_at        text,
+    cancelled_at        text,
+    -- set while one party waits for the other to agree to a cancellation
+    cancel_requested_by integer,
+    created_at          text NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    updated_at          text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE INDEX IF NOT EXISTS orders_buyer_id ON orders (buyer_id, created_at);
+CREATE INDEX IF NOT EXISTS orders_seller_id ON orders (seller_id);
+CREATE INDEX IF NOT EXISTS orders_status ON orders (status, shipped_at);
+
+-- Audit trail of everything that happened to an order. actor_id is 0 for
+-- changes made by the system, e.g. auto-completion.
+CREATE TABLE IF NOT EXISTS order_events
+(
+    id          integer primary key autoincrement,
+    order_id    integer NOT NULL,
+    actor_id    integer NOT NULL,
+    kind        integer NOT NULL,
+    from_status integer NOT NULL,
+    to_status   integer NOT NULL,
+    note        text NOT NULL DEFAULT '',
+    created_at  text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE INDEX IF NOT EXISTS order_events_order_id ON order_events (order_id, id);
+
+CREATE TABLE IF NOT EXISTS bank_accounts
+(
+    id             integer primary key autoincrement,
+    user_id        integer NOT NULL,
+    bank_name      text NOT NULL,
+    branch_name    text NOT NULL,
+    account_number text NOT NULL,
+    holder_name    text NOT NULL,
+    created_at     text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE INDEX IF NOT EXISTS bank_accounts_user_id ON bank_accounts (user_id);
+
+CREATE TABLE IF NOT EXISTS payouts
+(
+    id              integer primary key autoincrement,
+    user_id         integer NOT NULL,
+    bank_account_id integer NOT NULL,
+    amount          integer NOT NULL,
+    fee             integer NOT NULL,
+    status          integer NOT NULL,
+    reference       text NOT NULL DEFAULT '',
+    failure_reason  text NOT NULL DEFAULT '',
+    created_at      text NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    updated_at      text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE INDEX IF NOT EXISTS payouts_user_id ON payouts (user_id);
+CREATE INDEX IF NOT EXISTS payouts_status ON payouts (status);
+
+-- Balance top-ups paid through the payment provider. reference is the
+-- provider's ID for the charge.
+CREATE TABLE IF NOT EXISTS charges
+(
+    id             integer primary key autoincrement,
+    user_id        integer NOT NULL,
+    amount         integer NOT NULL,
+    status         integer NOT NULL,
+    reference      text NOT NULL DEFAULT '',
+    failure_reason text NOT NULL DEFAULT '',
+    created_at     text NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    updated_at     text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE INDEX IF NOT EXISTS charges_user_id ON charges (user_id, created_at);
+
+-- Per-user overrides of the default limits. NULL columns use the default.
+CREATE TABLE IF NOT EXISTS user_limits
+(
+    user_id        integer primary key,
+    max_balance    integer,
+    daily_top_up   integer,
+    monthly_top_up integer,
+    max_purchase   integer,
+    purchase_burst integer,
+    top_up_burst   integer,
+    updated_at     text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+-- Requests refused for breaking a limit, kept for review.
+CREATE TABLE IF NOT EXISTS limit_violations
+(
+    id          integer primary key autoincrement,
+    user_id     integer NOT NULL,
+    rule        text NOT NULL,
+    limit_value integer NOT NULL,
+    attempted   integer NOT NULL,
+    created_at  text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE INDEX IF NOT EXISTS limit_violations_user_id ON limit_violations (user_id, id);
+
+CREATE TABLE IF NOT EXISTS offers
+(
+    id             integer primary key autoincrement,
+    item_id        integer NOT NULL,
+    buyer_id       integer NOT NULL,
+    seller_id      integer NOT NULL,
+    price          integer NOT NULL,
+    proposed_by    integer NOT NULL,
+    -- the offer this one counters
+    parent_id      integer,
+    status         integer NOT NULL,
+    expires_at     text NOT NULL,
+    reserved_until text,
+    created_at     text NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    updated_at     text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE INDEX IF NOT EXISTS offers_item_id ON offers (item_id, status);
+CREATE INDEX IF NOT EXISTS offers_status ON offers (status);
+
+-- Auction bids. Each bidder's latest bid on an item is active and holds its
+-- amount from their balance until the auction closes.
+CREATE TABLE IF NOT EXISTS bids
+(
+    id         integer primary key autoincrement,
+    item_id    integer NOT NULL,
+    bidder_id  integer NOT NULL,
+    amount     integer NOT NULL,
+    status     integer NOT NULL,
+    created_at text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE INDEX IF NOT EXISTS bids_item_id ON bids (item_id, status, amount);
+
+CREATE TABLE IF NOT EXISTS coupons
+(
+    id                integer primary key autoincrement,
+    code              text NOT NULL UNIQUE,
+    discount_type     integer NOT NULL,
+    value             integer NOT NULL,
+    min_spend         integer NOT NULL DEFAULT 0,
+    -- 0 means unlimited
+    max_uses          integer NOT NULL DEFAULT 0,
+    max_uses_per_user integer NOT NULL DEFAULT 0,
+    uses              integer NOT NULL DEFAULT 0,
+    starts_at         text,
+    ends_at           text,
+    active            integer NOT NULL DEFAULT 1,
+    created_at        text NOT NULL DEFAULT (DATETIME('now', 'localtime')),
+    updated_at        text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+-- Categories a coupon is restricted to. Coupons without rows here apply to
+-- every category.
+CREATE TABLE IF NOT EXISTS coupon_categories
+(
+    coupon_id   integer NOT NULL,
+    category_id integer NOT NULL,
+    PRIMARY KEY (coupon_id, category_id)
+);
+
+CREATE TABLE IF NOT EXISTS coupon_redemptions
+(
+    id         integer primary key autoincrement,
+    coupon_id  integer NOT NULL,
+    user_id    integer NOT NULL,
+    -- the first order of the purchase the coupon was used for
+    order_id   integer NOT NULL,
+    discount   integer NOT NULL,
+    created_at text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE INDEX IF NOT EXISTS coupon_redemptions_coupon_id ON coupon_redemptions (coupon_id, user_id);
+
+-- The orders a redemption discounted. The coupon use is given back once all
+-- of them are cancelled.
+CREATE TABLE IF NOT EXISTS coupon_redemption_orders
+(
+    redemption_id integer NOT NULL,
+    order_id      integer NOT NULL,
+    PRIMARY KEY (redemption_id, order_id)
+);
+
+CREATE INDEX IF NOT EXISTS coupon_redemption_orders_order_id ON coupon_redemption_orders (order_id);
+
+-- Loyalty points are kept apart from the balance. Every earned batch is a
+-- lot with its own expiry; spending takes from the lot that expires first.
+CREATE TABLE IF NOT EXISTS point_lots
+(
+    id         integer primary key autoincrement,
+    user_id    integer NOT NULL,
+    amount     integer NOT NULL,
+    remaining  integer NOT NULL,
+    expires_at text NOT NULL,
+    created_at text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE INDEX IF NOT EXISTS point_lots_user_id ON point_lots (user_id, expires_at);
+
+CREATE TABLE IF NOT EXISTS point_entries
+(
+    id         integer primary key autoincrement,
+    user_id    integer NOT NULL,
+    kind       integer NOT NULL,
+    amount     integer NOT NULL,
+    order_id   integer,
+    created_at text NOT NULL DEFAULT (DATETIME('now', 'localtime'))
+);
+
+CREATE INDEX IF NOT EXISTS point_entries_user_id ON point_entries (user_id, id);
+
+-- The points spent on an order, by the lot they were taken from, so that a
+-- cancelled order puts them back into the same lots.
+CREATE TABLE IF NOT EXISTS point_lot_spends
+(
+    order_id integer NOT NULL,
+    lot_id   integer NOT NULL,
+    amount   integer NOT NULL,
+    PRIMARY KEY (order_id, lot_id)
+);
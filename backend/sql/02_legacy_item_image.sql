@@ -0,0 +1,4 @@
+-- The seed data in 10_data.sql still writes each item's cover into
+-- items.image. Initialize moves them into item_images and drops the column
+-- again once the data is loaded.
+ALTER TABLE items ADD COLUMN image blob;
@@ -0,0 +1,21 @@
+-- Full-text index over the name and description of items for /search. It is
+-- only loaded by servers built with -tags sqlite_fts5, so it is kept out of
+-- the files /initialize loads in order. The trigram tokenizer matches any
+-- part of a word, which Japanese text without spaces needs.
+CREATE VIRTUAL TABLE IF NOT EXISTS items_fts USING fts5(name, description, content='items', content_rowid='id', tokenize='trigram');
+
+CREATE TRIGGER IF NOT EXISTS items_fts_insert AFTER INSERT ON items
+BEGIN
+    INSERT INTO items_fts (rowid, name, description) VALUES (NEW.id, NEW.name, NEW.description);
+END;
+
+CREATE TRIGGER IF NOT EXISTS items_fts_delete AFTER DELETE ON items
+BEGIN
+    INSERT INTO items_fts (items_fts, rowid, name, description) VALUES ('delete', OLD.id, OLD.name, OLD.description);
+END;
+
+CREATE TRIGGER IF NOT EXISTS items_fts_update AFTER UPDATE OF name, description ON items
+BEGIN
+    INSERT INTO items_fts (items_fts, rowid, name, description) VALUES ('delete', OLD.id, OLD.name, OLD.description);
+    INSERT INTO items_fts (rowid, name, description) VALUES (NEW.id, NEW.name, NEW.description);
+END;